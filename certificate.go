@@ -0,0 +1,47 @@
+package libp2pquic
+
+import (
+	p2ptls "github.com/libp2p/go-libp2p-tls"
+)
+
+// Before the client's address is validated, a server may send at most 3 times the bytes it received.
+// Clients pad their first Initial to 1200 bytes.
+const (
+	amplificationFactor = 3
+	amplificationLimit  = amplificationFactor * 1200
+)
+
+// maxHandshakePacketSize is the size of the largest packets quic-go sends during the handshake.
+const maxHandshakePacketSize = 1252
+
+// handshakeFlightOverhead is an estimate of the size of the server's first flight, excluding the certificate chain:
+// the ServerHello, EncryptedExtensions (including the transport parameters), CertificateVerify and Finished messages,
+// as well as the packet headers and AEAD overhead.
+const handshakeFlightOverhead = 600
+
+// maxCertChainSize is the size of the certificate chain above which the server's first flight
+// likely exceeds the anti-amplification limit, costing clients an additional round trip.
+const maxCertChainSize = amplificationLimit - handshakeFlightOverhead
+
+// certChainSize returns the size of the certificate chain sent during the handshake.
+func certChainSize(identity *p2ptls.Identity) int {
+	conf, _ := identity.ConfigForAny()
+	var size int
+	for _, cert := range conf.Certificates {
+		for _, c := range cert.Certificate {
+			size += len(c)
+		}
+	}
+	return size
+}
+
+// checkCertChainSize warns if the certificate chain is so large that the handshake likely
+// stalls on the anti-amplification limit.
+func checkCertChainSize(size int) {
+	if size > maxCertChainSize {
+		log.Warnw("certificate chain likely exceeds the anti-amplification limit, handshakes will take an additional round trip",
+			"size", size,
+			"threshold", maxCertChainSize,
+		)
+	}
+}
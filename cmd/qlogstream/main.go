@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+// qlogstream prints the qlog events served on the socket configured using QLOGSOCKET.
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Printf("Usage: %s <socket> <connection ID | all>", os.Args[0])
+		return
+	}
+	if err := run(os.Args[1], os.Args[2]); err != nil {
+		log.Fatalf(err.Error())
+	}
+}
+
+func run(socket, connID string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", connID); err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, conn)
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// windowSize is the number of RTT samples the percentile is calculated over.
+const windowSize = 100
+
+// rttmonitor dials a peer, and prints the 95th percentile of the last RTT samples of the connection.
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Printf("Usage: %s <multiaddr> <peer id>", os.Args[0])
+		return
+	}
+	if err := run(os.Args[1], os.Args[2]); err != nil {
+		log.Fatalf(err.Error())
+	}
+}
+
+func run(raddr string, p string) error {
+	peerID, err := peer.Decode(p)
+	if err != nil {
+		return err
+	}
+	addr, err := ma.NewMultiaddr(raddr)
+	if err != nil {
+		return err
+	}
+	priv, _, err := ic.GenerateECDSAKeyPair(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	t, err := libp2pquic.NewTransport(priv, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Dialing %s\n", addr.String())
+	conn, err := t.Dial(context.Background(), addr, peerID)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The connection sends keep-alives, so RTT samples are taken even if the connection is not used otherwise.
+	rtts, unsubscribe := conn.(libp2pquic.RTTSubscriber).SubscribeRTT(windowSize)
+	defer unsubscribe()
+	window := make([]time.Duration, 0, windowSize)
+	for m := range rtts {
+		if len(window) == windowSize {
+			window = window[1:]
+		}
+		window = append(window, m.LatestRTT)
+		log.Printf("RTT: %s, p95 of the last %d samples: %s\n", m.LatestRTT, len(window), percentile(window, 0.95))
+	}
+	return nil
+}
+
+// percentile returns the p-th percentile of the samples.
+func percentile(samples []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))]
+}
@@ -2,9 +2,11 @@ package libp2pquic
 
 import (
 	"context"
+	"sync/atomic"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 
@@ -13,6 +15,10 @@ import (
 )
 
 type conn struct {
+	// accessed atomically, and need to be 64 bit aligned
+	streamsOpened   uint64
+	streamsAccepted uint64
+
 	sess      quic.Session
 	transport tpt.Transport
 
@@ -23,14 +29,35 @@ type conn struct {
 	remotePeerID    peer.ID
 	remotePubKey    ic.PubKey
 	remoteMultiaddr ma.Multiaddr
+	direction       network.Direction
+
+	// socket is the socket the connection was dialed or accepted on
+	socket transportConn
+
+	// stats is nil if the connection tracer of the session couldn't be found
+	stats *statsConnectionTracer
 }
 
 var _ tpt.CapableConn = &conn{}
+var _ ConnectionStatsReporter = &conn{}
+
+// An ErrorCodeCloser is a connection that can be closed with an application error code and a reason.
+// The peer can read both from the error returned when using the connection.
+type ErrorCodeCloser interface {
+	CloseWithError(code uint64, reason string) error
+}
+
+var _ ErrorCodeCloser = &conn{}
 
 func (c *conn) Close() error {
 	return c.sess.CloseWithError(0, "")
 }
 
+// CloseWithError closes the connection with an application error code and a reason.
+func (c *conn) CloseWithError(code uint64, reason string) error {
+	return c.sess.CloseWithError(quic.ErrorCode(code), reason)
+}
+
 // IsClosed returns whether a connection is fully closed.
 func (c *conn) IsClosed() bool {
 	return c.sess.Context().Err() != nil
@@ -39,12 +66,18 @@ func (c *conn) IsClosed() bool {
 // OpenStream creates a new stream.
 func (c *conn) OpenStream(ctx context.Context) (mux.MuxedStream, error) {
 	qstr, err := c.sess.OpenStreamSync(ctx)
+	if err == nil {
+		atomic.AddUint64(&c.streamsOpened, 1)
+	}
 	return &stream{Stream: qstr}, err
 }
 
 // AcceptStream accepts a stream opened by the other side.
 func (c *conn) AcceptStream() (mux.MuxedStream, error) {
 	qstr, err := c.sess.AcceptStream(context.Background())
+	if err == nil {
+		atomic.AddUint64(&c.streamsAccepted, 1)
+	}
 	return &stream{Stream: qstr}, err
 }
 
@@ -78,6 +111,15 @@ func (c *conn) RemoteMultiaddr() ma.Multiaddr {
 	return c.remoteMultiaddr
 }
 
+// Stats returns the current statistics of the connection.
+// It returns zero values if the statistics are not available.
+func (c *conn) Stats() ConnectionStats {
+	if c.stats == nil {
+		return ConnectionStats{}
+	}
+	return c.stats.Stats()
+}
+
 func (c *conn) Transport() tpt.Transport {
 	return c.transport
 }
@@ -4,15 +4,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	mrand "math/rand"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	gomock "github.com/golang/mock/gomock"
 	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 
@@ -23,6 +27,27 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// lossyPacketConn drops every 10th packet it reads.
+type lossyPacketConn struct {
+	net.PacketConn
+	count   int
+	dropped *int32
+}
+
+func (c *lossyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		c.count++
+		if c.count%10 != 0 {
+			return n, addr, err
+		}
+		atomic.AddInt32(c.dropped, 1)
+	}
+}
+
 //go:generate sh -c "mockgen -package libp2pquic -destination mock_connection_gater_test.go github.com/libp2p/go-libp2p-core/connmgr ConnectionGater && goimports -w mock_connection_gater_test.go"
 var _ = Describe("Connection", func() {
 	var (
@@ -115,6 +140,56 @@ var _ = Describe("Connection", func() {
 		Expect(serverConn.RemotePublicKey().Equals(clientKey.GetPublic())).To(BeTrue())
 	})
 
+	It("dials from the listening socket of the matching address family", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln4 := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln4.Close()
+		ln6 := runServer(serverTransport, "/ip6/::1/udp/0/quic")
+		defer ln6.Close()
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		cln4 := runServer(clientTransport, "/ip4/0.0.0.0/udp/0/quic")
+		defer cln4.Close()
+		cln6 := runServer(clientTransport, "/ip6/::/udp/0/quic")
+		defer cln6.Close()
+
+		for _, tc := range []struct{ ln, cln tpt.Listener }{{ln4, cln4}, {ln6, cln6}} {
+			conn, err := clientTransport.Dial(context.Background(), tc.ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := tc.ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			port, err := serverConn.RemoteMultiaddr().ValueForProtocol(ma.P_UDP)
+			Expect(err).ToNot(HaveOccurred())
+			listenPort, err := tc.cln.Multiaddr().ValueForProtocol(ma.P_UDP)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(port).To(Equal(listenPort))
+		}
+
+		// Closing the listeners doesn't close the sockets while they're still used by connections.
+		Expect(cln4.Close()).To(Succeed())
+		Expect(cln6.Close()).To(Succeed())
+		conn, err := clientTransport.Dial(context.Background(), ln4.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln4.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		str, err := conn.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+	})
+
 	It("opens and accepts streams", func() {
 		serverTransport, err := NewTransport(serverKey, nil, nil)
 		Expect(err).ToNot(HaveOccurred())
@@ -142,6 +217,105 @@ var _ = Describe("Connection", func() {
 		Expect(data).To(Equal([]byte("foobar")))
 	})
 
+	It("surfaces stream reset error codes", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		for _, code := range []uint64{0, 42} {
+			str, err := conn.OpenStream(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			sstr, err := serverConn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sstr.(ResettableStream).ResetWithCode(code)).To(Succeed())
+			_, err = sstr.Read([]byte{0})
+			Expect(errors.Is(err, mux.ErrReset)).To(BeTrue())
+			_, err = ioutil.ReadAll(str)
+			Expect(errors.Is(err, mux.ErrReset)).To(BeTrue())
+			if code == 0 {
+				Expect(err).To(Equal(mux.ErrReset))
+				continue
+			}
+			Expect(err).To(Equal(&StreamResetError{ErrorCode: code, Remote: true}))
+			_, err = sstr.Read([]byte{0})
+			Expect(err).To(Equal(&StreamResetError{ErrorCode: code, Remote: false}))
+		}
+	})
+
+	It("closes connections with an application error code", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(serverConn.(ErrorCodeCloser).CloseWithError(1337, "go away")).To(Succeed())
+		Expect(serverConn.IsClosed()).To(BeTrue())
+		_, err = conn.AcceptStream()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("go away"))
+	})
+
+	It("uses the packet conn wrapper", func() {
+		var numWrapped, numDropped int32
+		wrapper := func(c net.PacketConn) net.PacketConn {
+			atomic.AddInt32(&numWrapped, 1)
+			return &lossyPacketConn{PacketConn: c, dropped: &numDropped}
+		}
+		serverTransport, err := NewTransport(serverKey, nil, nil, WithPacketConnWrapper(wrapper))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+		Expect(atomic.LoadInt32(&numWrapped)).To(BeEquivalentTo(1))
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		// transfer some data, so that some packets are dropped
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+		str, err := conn.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			_, err := str.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(str.CloseWrite()).To(Succeed())
+		}()
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		received, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+		Expect(atomic.LoadInt32(&numDropped)).ToNot(BeZero())
+		Expect(atomic.LoadInt32(&numWrapped)).To(BeEquivalentTo(1))
+	})
+
 	It("fails if the peer ID doesn't match", func() {
 		thirdPartyID, _ := createPeer()
 
@@ -167,13 +341,18 @@ var _ = Describe("Connection", func() {
 		Eventually(done).Should(BeClosed())
 	})
 
-	It("gates accepted connections", func() {
+	It("gates accepted connections before the handshake", func() {
+		var allow uint32
 		cg := NewMockConnectionGater(mockCtrl)
-		cg.EXPECT().InterceptAccept(gomock.Any())
+		cg.EXPECT().InterceptAccept(gomock.Any()).DoAndReturn(func(addrs network.ConnMultiaddrs) bool {
+			Expect(addrs.RemoteMultiaddr().String()).To(HavePrefix("/ip4/127.0.0.1/udp/"))
+			return atomic.LoadUint32(&allow) > 0
+		}).AnyTimes()
 		serverTransport, err := NewTransport(serverKey, nil, cg)
 		Expect(err).ToNot(HaveOccurred())
 		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
 		defer ln.Close()
+		Expect(ln.Multiaddr().String()).To(HavePrefix("/ip4/127.0.0.1/udp/"))
 
 		accepted := make(chan struct{})
 		go func() {
@@ -186,20 +365,208 @@ var _ = Describe("Connection", func() {
 		clientTransport, err := NewTransport(clientKey, nil, nil)
 		Expect(err).ToNot(HaveOccurred())
 		// make sure that connection attempts fails
+		clientTransport.(*transport).clientConfig.HandshakeTimeout = 2 * time.Second
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).To(HaveOccurred())
+		Expect(serverTransport.(*transport).Stats().GatedAccepts).To(BeEquivalentTo(1))
+		Consistently(accepted).ShouldNot(BeClosed())
+
+		// now allow the address and make sure the connection goes through
+		atomic.StoreUint32(&allow, 1)
+		cg.EXPECT().InterceptSecured(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Eventually(accepted).Should(BeClosed())
+	})
+
+	It("gates accepted connections after the handshake", func() {
+		cg := NewMockConnectionGater(mockCtrl)
+		cg.EXPECT().InterceptAccept(gomock.Any()).Return(true).AnyTimes()
+		cg.EXPECT().InterceptSecured(gomock.Any(), clientID, gomock.Any())
+		serverTransport, err := NewTransport(serverKey, nil, cg)
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+
+		go func() {
+			defer GinkgoRecover()
+			ln.Accept()
+		}()
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
 		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
 		Expect(err).ToNot(HaveOccurred())
 		_, err = conn.AcceptStream()
 		Expect(err).To(HaveOccurred())
 		Expect(err.Error()).To(ContainSubstring("connection gated"))
+	})
 
-		// now allow the address and make sure the connection goes through
-		cg.EXPECT().InterceptAccept(gomock.Any()).Return(true)
-		cg.EXPECT().InterceptSecured(gomock.Any(), gomock.Any(), gomock.Any()).Return(true)
-		clientTransport.(*transport).clientConfig.HandshakeTimeout = 2 * time.Second
-		conn, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+	It("rejects connections when the accept queue is full", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil, WithAcceptQueueLength(1))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+		stats := serverTransport.(StatsReporter).Stats
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn1, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn1.Close()
+		Eventually(func() int { return stats().AcceptQueueLength }).Should(Equal(1))
+
+		conn2, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn2.Close()
+		_, err = conn2.AcceptStream()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("accept queue full"))
+		Expect(stats().AcceptQueueDrops).To(BeEquivalentTo(1))
+
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		Expect(serverConn.RemotePeer()).To(Equal(clientID))
+		Expect(stats().AcceptQueueLength).To(BeZero())
+	})
+
+	It("reports the statistics of every listener", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln1 := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln1.Close()
+		ln2 := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		stats := serverTransport.(StatsReporter).Stats
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln1.Multiaddr(), serverID)
 		Expect(err).ToNot(HaveOccurred())
 		defer conn.Close()
-		Eventually(accepted).Should(BeClosed())
+		Eventually(func() int { return stats().Listeners[ln1.Multiaddr().String()].AcceptQueueLength }).Should(Equal(1))
+		Expect(stats().Listeners).To(HaveLen(2))
+		Expect(stats().Listeners[ln1.Multiaddr().String()].Accepted).To(BeEquivalentTo(1))
+		Expect(stats().Listeners[ln2.Multiaddr().String()]).To(Equal(ListenerStats{}))
+
+		// closed listeners are not reported
+		Expect(ln2.Close()).To(Succeed())
+		Expect(stats().Listeners).To(HaveLen(1))
+	})
+
+	It("limits the number of connections per peer", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil, WithMaxConnsPerPeer(1))
+		Expect(err).ToNot(HaveOccurred())
+		ln := runServer(serverTransport, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln.Close()
+		stats := serverTransport.(StatsReporter).Stats
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn1, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		conn2, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn2.Close()
+		_, err = conn2.AcceptStream()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("too many connections"))
+		Expect(stats().RefusedConnsPerPeer).To(BeEquivalentTo(1))
+
+		// Once the first connection is closed, the peer can connect again.
+		Expect(conn1.Close()).To(Succeed())
+		Eventually(func() bool { return serverConn.IsClosed() }).Should(BeTrue())
+		Eventually(func() error {
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			return serverConn.Close()
+		}).Should(Succeed())
+	})
+
+	It("keeps one connection if both peers dial each other at the same time", func() {
+		tr1, err := NewTransport(serverKey, nil, nil, WithMaxConnsPerPeer(1))
+		Expect(err).ToNot(HaveOccurred())
+		ln1 := runServer(tr1, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln1.Close()
+		tr2, err := NewTransport(clientKey, nil, nil, WithMaxConnsPerPeer(1))
+		Expect(err).ToNot(HaveOccurred())
+		ln2 := runServer(tr2, "/ip4/127.0.0.1/udp/0/quic")
+		defer ln2.Close()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		dial := func(tr tpt.Transport, addr ma.Multiaddr, p peer.ID) {
+			defer wg.Done()
+			// The connection that loses the tie-break is closed, so the dial might fail.
+			tr.Dial(context.Background(), addr, p)
+		}
+		go dial(tr1, ln2.Multiaddr(), clientID)
+		go dial(tr2, ln1.Multiaddr(), serverID)
+		wg.Wait()
+
+		numConns := func(tr tpt.Transport) func() int {
+			return func() int { return len(tr.(ConnectionLister).Connections()) }
+		}
+		Eventually(numConns(tr1)).Should(Equal(1))
+		Eventually(numConns(tr2)).Should(Equal(1))
+		Consistently(numConns(tr1), 200*time.Millisecond).Should(Equal(1))
+		Consistently(numConns(tr2), 200*time.Millisecond).Should(Equal(1))
+		// the connection dialed by the peer with the smaller peer ID survives
+		dir1, dir2 := network.DirInbound, network.DirOutbound
+		if serverID < clientID {
+			dir1, dir2 = network.DirOutbound, network.DirInbound
+		}
+		Expect(tr1.(ConnectionLister).Connections()[0].Direction).To(Equal(dir1))
+		Expect(tr2.(ConnectionLister).Connections()[0].Direction).To(Equal(dir2))
+		for _, tr := range []tpt.Transport{tr1, tr2} {
+			Expect(tr.(Shutdowner).Shutdown(context.Background())).To(Succeed())
+		}
+	})
+
+	It("keeps the outbound connection on simultaneous open if the accept queue is full", func() {
+		// the inbound connection from peer B would replace peer A's outbound connection
+		idA, keyA, idB, keyB := serverID, serverKey, clientID, clientKey
+		if idA < idB {
+			idA, keyA, idB, keyB = idB, keyB, idA, keyA
+		}
+		trA, err := NewTransport(keyA, nil, nil, WithMaxConnsPerPeer(1), WithAcceptQueueLength(1))
+		Expect(err).ToNot(HaveOccurred())
+		lnA := runServer(trA, "/ip4/127.0.0.1/udp/0/quic")
+		defer lnA.Close()
+		// fill the accept queue
+		_, otherKey := createPeer()
+		otherTransport, err := NewTransport(otherKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		otherConn, err := otherTransport.Dial(context.Background(), lnA.Multiaddr(), idA)
+		Expect(err).ToNot(HaveOccurred())
+		defer otherConn.Close()
+		Eventually(func() int { return trA.(StatsReporter).Stats().AcceptQueueLength }).Should(Equal(1))
+
+		trB, err := NewTransport(keyB, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		lnB := runServer(trB, "/ip4/127.0.0.1/udp/0/quic")
+		defer lnB.Close()
+		outbound, err := trA.Dial(context.Background(), lnB.Multiaddr(), idB)
+		Expect(err).ToNot(HaveOccurred())
+		defer outbound.Close()
+		// The inbound connection can't be queued, so it is rejected and doesn't replace the outbound connection.
+		if inbound, err := trB.Dial(context.Background(), lnA.Multiaddr(), idA); err == nil {
+			defer inbound.Close()
+		}
+		Eventually(func() uint64 { return trA.(StatsReporter).Stats().AcceptQueueDrops }).Should(BeEquivalentTo(1))
+		Consistently(outbound.IsClosed, 200*time.Millisecond).Should(BeFalse())
 	})
 
 	It("gates secured connections", func() {
@@ -330,6 +697,10 @@ var _ = Describe("Connection", func() {
 		atomic.StoreUint32(&drop, 1)
 		Expect(ln.Close()).To(Succeed())
 		time.Sleep(100 * time.Millisecond) // give the kernel some time to free the UDP port
+		// Simulate a restart of the server by creating a new transport.
+		// It derives the same stateless reset key from the private key.
+		serverTransport, err = NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
 		ln = runServer(serverTransport, fmt.Sprintf("/ip4/127.0.0.1/udp/%d/quic", serverPort))
 		defer ln.Close()
 		// Now that the new server is up, re-enable packet forwarding.
@@ -0,0 +1,113 @@
+package libp2pquic
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// ConnectionInfo is a snapshot of an open connection.
+type ConnectionInfo struct {
+	RemotePeer      peer.ID
+	LocalMultiaddr  ma.Multiaddr
+	RemoteMultiaddr ma.Multiaddr
+	Direction       network.Direction
+	// StreamsOpened and StreamsAccepted are the number of streams opened by us and accepted from the peer.
+	StreamsOpened   uint64
+	StreamsAccepted uint64
+	// Stats are the statistics of the connection, including the bytes sent and received and the RTT estimates.
+	// The age of the connection is its Lifetime.
+	Stats ConnectionStats
+}
+
+// A ConnectionLister lists the open connections of a transport.
+// The transport returned by NewTransport implements this interface.
+type ConnectionLister interface {
+	Connections() []ConnectionInfo
+}
+
+var _ ConnectionLister = &transport{}
+
+// Connections returns a snapshot of the open connections, both inbound and outbound, in no particular order.
+// Connections are listed once the handshake completed and the connection was admitted,
+// until the connection is closed. Inbound connections are listed even if they were not accepted yet.
+// It is safe to call at any time, including after the transport was shut down.
+func (t *transport) Connections() []ConnectionInfo {
+	conns := t.conns.connections()
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.info())
+	}
+	return infos
+}
+
+func (c *conn) info() ConnectionInfo {
+	return ConnectionInfo{
+		RemotePeer:      c.remotePeerID,
+		LocalMultiaddr:  c.localMultiaddr,
+		RemoteMultiaddr: c.remoteMultiaddr,
+		Direction:       c.direction,
+		StreamsOpened:   atomic.LoadUint64(&c.streamsOpened),
+		StreamsAccepted: atomic.LoadUint64(&c.streamsAccepted),
+		Stats:           c.Stats(),
+	}
+}
+
+// connectionJSON is the JSON representation of a ConnectionInfo served by NewConnectionsHandler.
+type connectionJSON struct {
+	RemotePeer      string  `json:"remote_peer"`
+	LocalAddr       string  `json:"local_addr"`
+	RemoteAddr      string  `json:"remote_addr"`
+	Direction       string  `json:"direction"`
+	AgeMs           float64 `json:"age_ms"`
+	SmoothedRTTMs   float64 `json:"smoothed_rtt_ms"`
+	MinRTTMs        float64 `json:"min_rtt_ms"`
+	BytesSent       uint64  `json:"bytes_sent"`
+	BytesReceived   uint64  `json:"bytes_received"`
+	StreamsOpened   uint64  `json:"streams_opened"`
+	StreamsAccepted uint64  `json:"streams_accepted"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// NewConnectionsHandler returns an HTTP handler that renders the open connections as a JSON array.
+// It is meant for debugging, and is not registered anywhere: it's up to the caller to serve it,
+// e.g. by adding it to an http.ServeMux that is only reachable from localhost.
+func NewConnectionsHandler(l ConnectionLister) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns := l.Connections()
+		out := make([]connectionJSON, 0, len(conns))
+		for _, c := range conns {
+			j := connectionJSON{
+				RemotePeer:      c.RemotePeer.Pretty(),
+				Direction:       c.Direction.String(),
+				AgeMs:           milliseconds(c.Stats.Lifetime),
+				SmoothedRTTMs:   milliseconds(c.Stats.SmoothedRTT),
+				MinRTTMs:        milliseconds(c.Stats.MinRTT),
+				BytesSent:       c.Stats.BytesSent,
+				BytesReceived:   c.Stats.BytesReceived,
+				StreamsOpened:   c.StreamsOpened,
+				StreamsAccepted: c.StreamsAccepted,
+			}
+			if c.LocalMultiaddr != nil {
+				j.LocalAddr = c.LocalMultiaddr.String()
+			}
+			if c.RemoteMultiaddr != nil {
+				j.RemoteAddr = c.RemoteMultiaddr.String()
+			}
+			out = append(out, j)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			log.Debugf("writing the connection list failed: %s", err)
+		}
+	})
+}
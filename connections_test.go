@@ -0,0 +1,89 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+
+	quic "github.com/lucas-clemente/quic-go"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Listing Connections", func() {
+	It("lists the open connections", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1")
+		p.transfer(10 << 10)
+
+		conns := p.serverT.(ConnectionLister).Connections()
+		Expect(conns).To(HaveLen(1))
+		info := conns[0]
+		Expect(info.RemotePeer).To(Equal(p.clientID))
+		Expect(info.Direction).To(Equal(network.DirInbound))
+		Expect(info.LocalMultiaddr).To(Equal(p.ln.Multiaddr()))
+		Expect(info.RemoteMultiaddr).To(Equal(p.server.RemoteMultiaddr()))
+		Expect(info.StreamsOpened).To(BeEquivalentTo(1))
+		Expect(info.StreamsAccepted).To(BeZero())
+		Expect(info.Stats.Lifetime).To(BeNumerically(">", 0))
+		Expect(info.Stats.BytesSent).To(BeNumerically(">", 10<<10))
+		Expect(info.Stats.BytesReceived).ToNot(BeZero())
+		Expect(info.Stats.SmoothedRTT).To(BeNumerically(">", 0))
+		Expect(info.Stats.MinRTT).To(BeNumerically(">", 0))
+
+		conns = p.clientT.(ConnectionLister).Connections()
+		Expect(conns).To(HaveLen(1))
+		Expect(conns[0].RemotePeer).To(Equal(p.serverID))
+		Expect(conns[0].Direction).To(Equal(network.DirOutbound))
+		Expect(conns[0].StreamsAccepted).To(BeEquivalentTo(1))
+
+		p.close()
+		Eventually(func() []ConnectionInfo { return p.serverT.(ConnectionLister).Connections() }).Should(BeEmpty())
+		Eventually(func() []ConnectionInfo { return p.clientT.(ConnectionLister).Connections() }).Should(BeEmpty())
+	})
+
+	It("lists connections after the transport was shut down", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1")
+		defer p.close()
+		Expect(p.clientT.(Shutdowner).Shutdown(context.Background())).To(Succeed())
+		Eventually(func() []ConnectionInfo { return p.clientT.(ConnectionLister).Connections() }).Should(BeEmpty())
+	})
+
+	It("renders the connections as JSON", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1")
+		defer p.close()
+		str, err := p.client.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		defer str.Close()
+
+		rec := httptest.NewRecorder()
+		NewConnectionsHandler(p.clientT.(ConnectionLister)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+		var conns []map[string]interface{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &conns)).To(Succeed())
+		Expect(conns).To(HaveLen(1))
+		Expect(conns[0]).To(HaveKeyWithValue("remote_peer", p.serverID.Pretty()))
+		Expect(conns[0]).To(HaveKeyWithValue("remote_addr", p.ln.Multiaddr().String()))
+		Expect(conns[0]).To(HaveKeyWithValue("direction", "Outbound"))
+		Expect(conns[0]).To(HaveKeyWithValue("streams_opened", BeNumerically("==", 1)))
+		Expect(conns[0]).To(HaveKey("age_ms"))
+		Expect(conns[0]).To(HaveKey("smoothed_rtt_ms"))
+		Expect(conns[0]).To(HaveKey("bytes_sent"))
+	})
+
+	It("renders an empty list if there are no connections", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		rec := httptest.NewRecorder()
+		NewConnectionsHandler(tr.(ConnectionLister)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		Expect(rec.Body.String()).To(Equal("[]\n"))
+	})
+})
@@ -0,0 +1,129 @@
+package libp2pquic
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultConnIDLen is the length of the connection IDs quic-go uses if the quic.Config doesn't set one,
+// and the net.PacketConn is passed to quic-go (as opposed to quic-go creating the socket).
+const defaultConnIDLen = 4
+
+// retiredConnIDRoutingTime is the time quic-go keeps routing packets sent to a connection ID
+// after it was retired, or after the connection was closed (to drain the connection).
+const retiredConnIDRoutingTime = 5 * time.Second
+
+// maxRetiredConnIDs is the number of retired connection IDs that are remembered.
+// Once it is reached, the connection ID that was retired first is forgotten.
+const maxRetiredConnIDs = 1024
+
+// connIDTable tracks the connection IDs used by the connections of a transport, in order to classify
+// the short header packets that quic-go can't route to a connection. quic-go drops these packets
+// (or answers them with a stateless reset) without reporting them to the tracer.
+// The connection tracers add the connection IDs that we issued, and retire them when the peer retires them,
+// or when the connection is closed. All methods can be called on a nil connIDTable.
+type connIDTable struct {
+	// accessed atomically, and need to be 64 bit aligned
+	unknown  uint64
+	retired  uint64
+	noConnID uint64
+
+	connIDLen int
+	clock     clock
+
+	mutex  sync.RWMutex
+	active map[string]struct{}
+	// retiredAt is the time the connection IDs in retiredOrder were retired.
+	// retiredOrder is a ring buffer, next is the position of the next connection ID retired.
+	retiredAt    map[string]time.Time
+	retiredOrder []string
+	next         int
+}
+
+func newConnIDTable(connIDLen int, clock clock) *connIDTable {
+	if connIDLen == 0 {
+		connIDLen = defaultConnIDLen
+	}
+	return &connIDTable{
+		connIDLen:    connIDLen,
+		clock:        clock,
+		active:       make(map[string]struct{}),
+		retiredAt:    make(map[string]time.Time),
+		retiredOrder: make([]string, 0, maxRetiredConnIDs),
+	}
+}
+
+// Add adds a connection ID issued to the peer.
+func (t *connIDTable) Add(connID []byte) {
+	if t == nil || len(connID) == 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active[string(connID)] = struct{}{}
+	delete(t.retiredAt, string(connID))
+}
+
+// Retire retires a connection ID.
+func (t *connIDTable) Retire(connID []byte) {
+	if t == nil || len(connID) == 0 {
+		return
+	}
+	now := t.clock.Now()
+	key := string(connID)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.active[key]; !ok {
+		return
+	}
+	delete(t.active, key)
+	if len(t.retiredOrder) < maxRetiredConnIDs {
+		t.retiredOrder = append(t.retiredOrder, key)
+	} else {
+		delete(t.retiredAt, t.retiredOrder[t.next])
+		t.retiredOrder[t.next] = key
+	}
+	t.next = (t.next + 1) % maxRetiredConnIDs
+	t.retiredAt[key] = now
+}
+
+// Classify counts a received packet that quic-go won't route to a connection.
+// Long header packets are not classified, since their connection IDs are chosen by the client
+// when it starts a new connection.
+func (t *connIDTable) Classify(b []byte) {
+	if t == nil || len(b) == 0 || b[0]&0x80 != 0 {
+		return
+	}
+	if len(b) < 1+t.connIDLen {
+		atomic.AddUint64(&t.noConnID, 1)
+		return
+	}
+	connID := b[1 : 1+t.connIDLen]
+	t.mutex.RLock()
+	_, active := t.active[string(connID)]
+	retiredAt, retired := t.retiredAt[string(connID)]
+	t.mutex.RUnlock()
+	switch {
+	case active:
+	case retired:
+		// quic-go still routes the packet while the connection is draining
+		if t.clock.Now().Sub(retiredAt) >= retiredConnIDRoutingTime {
+			atomic.AddUint64(&t.retired, 1)
+		}
+	default:
+		atomic.AddUint64(&t.unknown, 1)
+	}
+}
+
+// Counts returns the number of packets that couldn't be routed.
+func (t *connIDTable) Counts() UnroutablePacketCounts {
+	if t == nil {
+		return UnroutablePacketCounts{}
+	}
+	return UnroutablePacketCounts{
+		UnknownConnectionID: atomic.LoadUint64(&t.unknown),
+		RetiredConnectionID: atomic.LoadUint64(&t.retired),
+		NoConnectionID:      atomic.LoadUint64(&t.noConnID),
+	}
+}
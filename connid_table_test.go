@@ -0,0 +1,101 @@
+package libp2pquic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection ID Table", func() {
+	var (
+		table *connIDTable
+		clk   *fakeClock
+	)
+
+	shortHeaderPacket := func(connID []byte) []byte {
+		return append(append([]byte{0x40}, connID...), 0xde, 0xad, 0xbe, 0xef)
+	}
+
+	BeforeEach(func() {
+		clk = &fakeClock{now: time.Unix(1612345678, 0)}
+		table = newConnIDTable(4, clk)
+	})
+
+	It("uses quic-go's default connection ID length", func() {
+		Expect(newConnIDTable(0, clk).connIDLen).To(Equal(defaultConnIDLen))
+	})
+
+	It("doesn't count packets for active connection IDs", func() {
+		table.Add([]byte{1, 2, 3, 4})
+		table.Classify(shortHeaderPacket([]byte{1, 2, 3, 4}))
+		Expect(table.Counts()).To(BeZero())
+	})
+
+	It("counts packets for unknown connection IDs", func() {
+		table.Add([]byte{1, 2, 3, 4})
+		table.Classify(shortHeaderPacket([]byte{4, 3, 2, 1}))
+		Expect(table.Counts()).To(Equal(UnroutablePacketCounts{UnknownConnectionID: 1}))
+	})
+
+	It("counts packets that are too short to contain a connection ID", func() {
+		table.Classify([]byte{0x40, 1, 2})
+		Expect(table.Counts()).To(Equal(UnroutablePacketCounts{NoConnectionID: 1}))
+	})
+
+	It("ignores long header packets", func() {
+		table.Classify([]byte{0xc0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8})
+		Expect(table.Counts()).To(BeZero())
+	})
+
+	It("counts packets for retired connection IDs, once quic-go stopped routing them", func() {
+		table.Add([]byte{1, 2, 3, 4})
+		table.Retire([]byte{1, 2, 3, 4})
+		table.Classify(shortHeaderPacket([]byte{1, 2, 3, 4}))
+		Expect(table.Counts()).To(BeZero())
+		clk.now = clk.now.Add(retiredConnIDRoutingTime)
+		table.Classify(shortHeaderPacket([]byte{1, 2, 3, 4}))
+		Expect(table.Counts()).To(Equal(UnroutablePacketCounts{RetiredConnectionID: 1}))
+	})
+
+	It("only remembers the most recently retired connection IDs", func() {
+		connID := func(i int) []byte {
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(i))
+			return b
+		}
+		for i := 0; i < maxRetiredConnIDs+10; i++ {
+			table.Add(connID(i))
+			table.Retire(connID(i))
+		}
+		Expect(table.retiredAt).To(HaveLen(maxRetiredConnIDs))
+		clk.now = clk.now.Add(retiredConnIDRoutingTime)
+		table.Classify(shortHeaderPacket(connID(9)))
+		table.Classify(shortHeaderPacket(connID(10)))
+		Expect(table.Counts()).To(Equal(UnroutablePacketCounts{UnknownConnectionID: 1, RetiredConnectionID: 1}))
+	})
+
+	It("counts packets received on the sockets of the transport", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		conn, err := net.DialUDP("udp", nil, ln.Addr().(*net.UDPAddr))
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write(shortHeaderPacket([]byte{1, 2, 3, 4}))
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(func() UnroutablePacketCounts {
+			return tr.(StatsReporter).Stats().UnroutablePackets
+		}).Should(Equal(UnroutablePacketCounts{UnknownConnectionID: 1}))
+	})
+})
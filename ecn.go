@@ -0,0 +1,20 @@
+package libp2pquic
+
+import (
+	"net"
+	"runtime"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// ecnCapable says if quic-go reads the ECN bits of the packets received on a packet conn.
+// quic-go (as of v0.19) does so on Linux and macOS, if the packet conn has the methods of a *net.UDPConn
+// that it needs (see quic.ECNCapablePacketConn). It reports the ECN counts in the ACK frames it sends.
+// It doesn't set the ECN bits of the packets it sends, and it doesn't use GSO.
+func ecnCapable(conn net.PacketConn) bool {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		return false
+	}
+	_, ok := conn.(quic.ECNCapablePacketConn)
+	return ok
+}
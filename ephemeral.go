@@ -0,0 +1,54 @@
+package libp2pquic
+
+import (
+	"context"
+	"net"
+)
+
+type ephemeralSocketKey struct{}
+
+// WithEphemeralSocket returns a context that makes the transport dial the connection from a new socket
+// bound to a random port, instead of reusing the socket of a listener or of another connection.
+// This is useful when the port must not be shared, e.g. when probing a NAT with several parallel dials.
+// The socket is closed when the connection is closed.
+// This also applies to transports using a packet conn passed to WithPacketConn.
+func WithEphemeralSocket(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ephemeralSocketKey{}, true)
+}
+
+func isEphemeralSocket(ctx context.Context) bool {
+	ephemeral, _ := ctx.Value(ephemeralSocketKey{}).(bool)
+	return ephemeral
+}
+
+// ephemeralConn is a socket used for a single connection. It is not added to the reuse.
+type ephemeralConn struct {
+	*reuseConn
+}
+
+var _ transportConn = &ephemeralConn{}
+
+// DialEphemeral creates a new socket on a random port.
+// Like the sockets of the reuse, it uses the filter, the rate limiter and the packet conn wrapper.
+func (r *reuse) DialEphemeral(network string) (*ephemeralConn, error) {
+	var addr *net.UDPAddr
+	switch network {
+	case "udp4":
+		addr = &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+	case "udp6":
+		addr = &net.UDPAddr{IP: net.IPv6zero, Port: 0}
+	}
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.configureConn != nil {
+		r.configureConn(conn)
+	}
+	return &ephemeralConn{reuseConn: r.newReuseConn(conn)}, nil
+}
+
+// DecreaseCount closes the socket. It is called when the connection is closed.
+func (c *ephemeralConn) DecreaseCount() { c.Close() }
+
+func (c *ephemeralConn) listeningSocket() bool { return false }
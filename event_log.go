@@ -0,0 +1,310 @@
+package libp2pquic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// The event log is a sequence of protobuf messages, each prefixed by its length (encoded as a varint).
+// This is the same format as used by protobuf's delimited readers and writers.
+// The messages are defined by:
+//
+//   message Event {
+//     enum Type {
+//       UNKNOWN = 0;
+//       PACKET_SENT = 1;
+//       PACKET_RECEIVED = 2;
+//       PACKET_LOST = 3;
+//       METRICS_UPDATED = 4;
+//       KEY_INSTALLED = 5;
+//       KEY_UPDATED = 6;
+//       CONNECTION_CLOSED = 7;
+//     }
+//     Type type = 1;
+//     int64 time = 2; // Unix time, in nanoseconds
+//     uint32 packet_type = 3;
+//     uint32 encryption_level = 4;
+//     uint64 packet_number = 5;
+//     uint64 size = 6;
+//     uint32 loss_reason = 7;
+//     int64 smoothed_rtt = 8; // in nanoseconds
+//     int64 latest_rtt = 9; // in nanoseconds
+//     int64 min_rtt = 10; // in nanoseconds
+//     uint64 congestion_window = 11;
+//     uint64 bytes_in_flight = 12;
+//     uint32 perspective = 13;
+//     uint64 key_generation = 14;
+//     bool remote = 15;
+//   }
+//
+// The numeric values of the enums defined by quic-go are used for the packet type, encryption level,
+// loss reason and perspective fields.
+// All fields are varint encoded. Following proto3 semantics, fields are omitted if they have their zero value.
+
+const (
+	eventTypePacketSent = 1 + iota
+	eventTypePacketReceived
+	eventTypePacketLost
+	eventTypeMetricsUpdated
+	eventTypeKeyInstalled
+	eventTypeKeyUpdated
+	eventTypeConnectionClosed
+)
+
+const (
+	eventFieldType = 1 + iota
+	eventFieldTime
+	eventFieldPacketType
+	eventFieldEncryptionLevel
+	eventFieldPacketNumber
+	eventFieldSize
+	eventFieldLossReason
+	eventFieldSmoothedRTT
+	eventFieldLatestRTT
+	eventFieldMinRTT
+	eventFieldCongestionWindow
+	eventFieldBytesInFlight
+	eventFieldPerspective
+	eventFieldKeyGeneration
+	eventFieldRemote
+)
+
+// maxEventSize is the maximum size of an encoded event.
+// It is larger than any event encoded by the eventLogWriter.
+const maxEventSize = 256
+
+// eventLogWriter writes events to an event log.
+type eventLogWriter struct {
+	mutex sync.Mutex
+	w     io.WriteCloser
+	bw    *bufio.Writer
+	buf   []byte
+	err   error // the first error that occurred when writing
+}
+
+var _ EventRecorder = &eventLogWriter{}
+
+// NewEventLogWriter returns an EventRecorder that writes the events to w.
+// Events are buffered, and written when the recorder is closed at the latest.
+// Once writing fails, all further events are discarded, and the error is returned by Close.
+// See ReadEventLog for reading the event log.
+func NewEventLogWriter(w io.WriteCloser) EventRecorder {
+	return &eventLogWriter{
+		w:   w,
+		bw:  bufio.NewWriter(w),
+		buf: make([]byte, 0, maxEventSize),
+	}
+}
+
+func (w *eventLogWriter) RecordEvent(e Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err != nil {
+		return
+	}
+	msg := appendEvent(w.buf[:0], e)
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(msg)))
+	if _, err := w.bw.Write(length[:n]); err != nil {
+		w.err = err
+		return
+	}
+	if _, err := w.bw.Write(msg); err != nil {
+		w.err = err
+	}
+}
+
+func (w *eventLogWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.err == nil {
+		w.err = w.bw.Flush()
+	}
+	if err := w.w.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(field)<<3) // wire type 0: varint
+	b = append(b, buf[:n]...)
+	n = binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendEvent(b []byte, e Event) []byte {
+	switch e := e.(type) {
+	case *PacketSentEvent:
+		b = appendVarintField(b, eventFieldType, eventTypePacketSent)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+		b = appendVarintField(b, eventFieldPacketType, uint64(e.PacketType))
+		b = appendVarintField(b, eventFieldPacketNumber, uint64(e.PacketNumber))
+		b = appendVarintField(b, eventFieldSize, uint64(e.Size))
+	case *PacketReceivedEvent:
+		b = appendVarintField(b, eventFieldType, eventTypePacketReceived)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+		b = appendVarintField(b, eventFieldPacketType, uint64(e.PacketType))
+		b = appendVarintField(b, eventFieldPacketNumber, uint64(e.PacketNumber))
+		b = appendVarintField(b, eventFieldSize, uint64(e.Size))
+	case *PacketLostEvent:
+		b = appendVarintField(b, eventFieldType, eventTypePacketLost)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+		b = appendVarintField(b, eventFieldEncryptionLevel, uint64(e.EncryptionLevel))
+		b = appendVarintField(b, eventFieldPacketNumber, uint64(e.PacketNumber))
+		b = appendVarintField(b, eventFieldLossReason, uint64(e.Reason))
+	case *MetricsUpdatedEvent:
+		b = appendVarintField(b, eventFieldType, eventTypeMetricsUpdated)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+		b = appendVarintField(b, eventFieldSmoothedRTT, uint64(e.SmoothedRTT))
+		b = appendVarintField(b, eventFieldLatestRTT, uint64(e.LatestRTT))
+		b = appendVarintField(b, eventFieldMinRTT, uint64(e.MinRTT))
+		b = appendVarintField(b, eventFieldCongestionWindow, uint64(e.CongestionWindow))
+		b = appendVarintField(b, eventFieldBytesInFlight, uint64(e.BytesInFlight))
+	case *KeyInstalledEvent:
+		b = appendVarintField(b, eventFieldType, eventTypeKeyInstalled)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+		b = appendVarintField(b, eventFieldEncryptionLevel, uint64(e.EncryptionLevel))
+		b = appendVarintField(b, eventFieldPerspective, uint64(e.Perspective))
+	case *KeyUpdatedEvent:
+		b = appendVarintField(b, eventFieldType, eventTypeKeyUpdated)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+		b = appendVarintField(b, eventFieldKeyGeneration, uint64(e.Generation))
+		if e.Remote {
+			b = appendVarintField(b, eventFieldRemote, 1)
+		}
+	case *ConnectionClosedEvent:
+		b = appendVarintField(b, eventFieldType, eventTypeConnectionClosed)
+		b = appendVarintField(b, eventFieldTime, uint64(e.Time.UnixNano()))
+	}
+	return b
+}
+
+// An EventLogReader reads the events written by an EventRecorder returned by NewEventLogWriter.
+type EventLogReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// ReadEventLog returns an EventLogReader reading from r.
+func ReadEventLog(r io.Reader) *EventLogReader {
+	return &EventLogReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event. It returns io.EOF at the end of the event log.
+// Events of an unknown type are skipped.
+func (r *EventLogReader) Next() (Event, error) {
+	for {
+		length, err := binary.ReadUvarint(r.r)
+		if err != nil {
+			return nil, err
+		}
+		if length > maxEventSize {
+			return nil, fmt.Errorf("event too large: %d bytes", length)
+		}
+		if cap(r.buf) < int(length) {
+			r.buf = make([]byte, length)
+		}
+		msg := r.buf[:length]
+		if _, err := io.ReadFull(r.r, msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		e, err := parseEvent(msg)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			return e, nil
+		}
+	}
+}
+
+// parseEvent parses an encoded event. It returns nil if the event type is unknown.
+func parseEvent(b []byte) (Event, error) {
+	var fields [eventFieldRemote + 1]uint64
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid field tag")
+		}
+		b = b[n:]
+		if wireType := tag & 0x7; wireType != 0 {
+			return nil, fmt.Errorf("unsupported wire type: %d", wireType)
+		}
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid varint")
+		}
+		b = b[n:]
+		// unknown fields are ignored
+		if field := tag >> 3; field < uint64(len(fields)) {
+			fields[field] = v
+		}
+	}
+
+	t := time.Unix(0, int64(fields[eventFieldTime]))
+	switch fields[eventFieldType] {
+	case eventTypePacketSent:
+		return &PacketSentEvent{
+			Time:         t,
+			PacketType:   logging.PacketType(fields[eventFieldPacketType]),
+			PacketNumber: logging.PacketNumber(fields[eventFieldPacketNumber]),
+			Size:         logging.ByteCount(fields[eventFieldSize]),
+		}, nil
+	case eventTypePacketReceived:
+		return &PacketReceivedEvent{
+			Time:         t,
+			PacketType:   logging.PacketType(fields[eventFieldPacketType]),
+			PacketNumber: logging.PacketNumber(fields[eventFieldPacketNumber]),
+			Size:         logging.ByteCount(fields[eventFieldSize]),
+		}, nil
+	case eventTypePacketLost:
+		return &PacketLostEvent{
+			Time:            t,
+			EncryptionLevel: logging.EncryptionLevel(fields[eventFieldEncryptionLevel]),
+			PacketNumber:    logging.PacketNumber(fields[eventFieldPacketNumber]),
+			Reason:          logging.PacketLossReason(fields[eventFieldLossReason]),
+		}, nil
+	case eventTypeMetricsUpdated:
+		return &MetricsUpdatedEvent{
+			Time:             t,
+			SmoothedRTT:      time.Duration(fields[eventFieldSmoothedRTT]),
+			LatestRTT:        time.Duration(fields[eventFieldLatestRTT]),
+			MinRTT:           time.Duration(fields[eventFieldMinRTT]),
+			CongestionWindow: logging.ByteCount(fields[eventFieldCongestionWindow]),
+			BytesInFlight:    logging.ByteCount(fields[eventFieldBytesInFlight]),
+		}, nil
+	case eventTypeKeyInstalled:
+		return &KeyInstalledEvent{
+			Time:            t,
+			EncryptionLevel: logging.EncryptionLevel(fields[eventFieldEncryptionLevel]),
+			Perspective:     logging.Perspective(fields[eventFieldPerspective]),
+		}, nil
+	case eventTypeKeyUpdated:
+		return &KeyUpdatedEvent{
+			Time:       t,
+			Generation: logging.KeyPhase(fields[eventFieldKeyGeneration]),
+			Remote:     fields[eventFieldRemote] != 0,
+		}, nil
+	case eventTypeConnectionClosed:
+		return &ConnectionClosedEvent{Time: t}, nil
+	default:
+		return nil, nil
+	}
+}
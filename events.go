@@ -0,0 +1,272 @@
+package libp2pquic
+
+import (
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// An EventRecorder records the events of a single connection, as observed by the connection tracer.
+// See NewEventLogWriter for an implementation that writes the events to a file.
+type EventRecorder interface {
+	// RecordEvent is called for every event.
+	RecordEvent(Event)
+	// Close is called once, when the connection is closed. No events are recorded afterwards.
+	Close() error
+}
+
+// An Event is an event observed by the connection tracer.
+// It is one of *PacketSentEvent, *PacketReceivedEvent, *PacketLostEvent, *MetricsUpdatedEvent,
+// *KeyInstalledEvent, *KeyUpdatedEvent and *ConnectionClosedEvent.
+type Event interface {
+	event()
+}
+
+// PacketSentEvent is recorded when a packet is sent.
+type PacketSentEvent struct {
+	Time         time.Time
+	PacketType   logging.PacketType
+	PacketNumber logging.PacketNumber
+	Size         logging.ByteCount
+}
+
+// PacketReceivedEvent is recorded when a packet is received.
+type PacketReceivedEvent struct {
+	Time         time.Time
+	PacketType   logging.PacketType
+	PacketNumber logging.PacketNumber
+	Size         logging.ByteCount
+}
+
+// PacketLostEvent is recorded when a packet is declared lost.
+type PacketLostEvent struct {
+	Time            time.Time
+	EncryptionLevel logging.EncryptionLevel
+	PacketNumber    logging.PacketNumber
+	Reason          logging.PacketLossReason
+}
+
+// MetricsUpdatedEvent is recorded when the RTT estimate or the congestion controller state is updated,
+// usually after processing an ACK.
+type MetricsUpdatedEvent struct {
+	Time             time.Time
+	SmoothedRTT      time.Duration
+	LatestRTT        time.Duration
+	MinRTT           time.Duration
+	CongestionWindow logging.ByteCount
+	BytesInFlight    logging.ByteCount
+}
+
+// KeyInstalledEvent is recorded when TLS installs the keys for an encryption level.
+type KeyInstalledEvent struct {
+	Time            time.Time
+	EncryptionLevel logging.EncryptionLevel
+	// Perspective says if these are the client's or the server's keys.
+	Perspective logging.Perspective
+}
+
+// KeyUpdatedEvent is recorded when the 1-RTT keys are updated.
+type KeyUpdatedEvent struct {
+	Time       time.Time
+	Generation logging.KeyPhase
+	// Remote says if the key update was initiated by the peer.
+	Remote bool
+}
+
+// ConnectionClosedEvent is recorded when the connection is closed.
+type ConnectionClosedEvent struct {
+	Time time.Time
+}
+
+func (*PacketSentEvent) event()       {}
+func (*PacketReceivedEvent) event()   {}
+func (*PacketLostEvent) event()       {}
+func (*MetricsUpdatedEvent) event()   {}
+func (*KeyInstalledEvent) event()     {}
+func (*KeyUpdatedEvent) event()       {}
+func (*ConnectionClosedEvent) event() {}
+
+// eventTracer passes the events of every connection to an EventRecorder.
+// It is only used if an EventRecorder is configured (see WithEventRecorder),
+// so connections don't pay for recording events otherwise.
+// Panics in the EventRecorder are recovered, so they don't take down the connection.
+type eventTracer struct {
+	newRecorder func(role logging.Perspective, connID []byte) EventRecorder
+	clock       clock
+	stats       *statsTracer // counts the panics, may be nil
+
+	// consecutivePanics counts the consecutive panics of newRecorder. Accessed atomically.
+	consecutivePanics int32
+}
+
+var _ logging.Tracer = &eventTracer{}
+
+// maxRecorderPanics is the number of consecutive panics after which event recording is disabled,
+// either for a single connection (if RecordEvent panics), or for the transport (if the constructor panics).
+const maxRecorderPanics = 3
+
+func (t *eventTracer) TracerForConnection(p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	if atomic.LoadInt32(&t.consecutivePanics) >= maxRecorderPanics {
+		return nil
+	}
+	r := t.createRecorder(p, odcid)
+	if r == nil {
+		return nil
+	}
+	return &eventConnectionTracer{recorder: r, clock: t.clock, stats: t.stats}
+}
+
+func (t *eventTracer) createRecorder(p logging.Perspective, odcid logging.ConnectionID) EventRecorder {
+	defer func() {
+		if r := recover(); r != nil {
+			logRecorderPanic(t.stats, r)
+			if atomic.AddInt32(&t.consecutivePanics, 1) == maxRecorderPanics {
+				log.Errorf("creating event recorders panicked %d times in a row, disabling event recording", maxRecorderPanics)
+			}
+		}
+	}()
+	r := t.newRecorder(p, odcid)
+	atomic.StoreInt32(&t.consecutivePanics, 0)
+	return r
+}
+
+func logRecorderPanic(stats *statsTracer, r interface{}) {
+	log.Errorf("event recorder panicked: %v\n%s", r, debug.Stack())
+	stats.countRecorderPanic()
+}
+
+func (t *eventTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+func (t *eventTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+type eventConnectionTracer struct {
+	recorder EventRecorder
+	clock    clock
+	stats    *statsTracer
+
+	panics   int // consecutive panics of the recorder
+	disabled bool
+
+	// quic-go may call the tracer after it was closed, and Close may be called more than once.
+	// The recorder is closed once, and events arriving afterwards are dropped.
+	closeOnce sync.Once
+	closed    int32 // accessed atomically
+}
+
+var _ logging.ConnectionTracer = &eventConnectionTracer{}
+
+func (t *eventConnectionTracer) record(ev Event) {
+	if atomic.LoadInt32(&t.closed) == 1 {
+		t.stats.countEventAfterClose()
+		return
+	}
+	if t.disabled {
+		return
+	}
+	defer t.recoverPanic()
+	t.recorder.RecordEvent(ev)
+	t.panics = 0
+}
+
+func (t *eventConnectionTracer) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logRecorderPanic(t.stats, r)
+	t.panics++
+	if t.panics >= maxRecorderPanics && !t.disabled {
+		log.Errorf("event recorder panicked %d times in a row, disabling it", t.panics)
+		t.disabled = true
+	}
+}
+
+func (t *eventConnectionTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, _ *logging.AckFrame, _ []logging.Frame) {
+	t.record(&PacketSentEvent{
+		Time:         t.clock.Now(),
+		PacketType:   logging.PacketTypeFromHeader(&hdr.Header),
+		PacketNumber: hdr.PacketNumber,
+		Size:         size,
+	})
+}
+
+func (t *eventConnectionTracer) ReceivedPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, _ []logging.Frame) {
+	t.record(&PacketReceivedEvent{
+		Time:         t.clock.Now(),
+		PacketType:   logging.PacketTypeFromHeader(&hdr.Header),
+		PacketNumber: hdr.PacketNumber,
+		Size:         size,
+	})
+}
+
+func (t *eventConnectionTracer) LostPacket(encLevel logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+	t.record(&PacketLostEvent{
+		Time:            t.clock.Now(),
+		EncryptionLevel: encLevel,
+		PacketNumber:    pn,
+		Reason:          reason,
+	})
+}
+
+func (t *eventConnectionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+	t.record(&MetricsUpdatedEvent{
+		Time:             t.clock.Now(),
+		SmoothedRTT:      rttStats.SmoothedRTT(),
+		LatestRTT:        rttStats.LatestRTT(),
+		MinRTT:           rttStats.MinRTT(),
+		CongestionWindow: cwnd,
+		BytesInFlight:    bytesInFlight,
+	})
+}
+
+func (t *eventConnectionTracer) UpdatedKeyFromTLS(encLevel logging.EncryptionLevel, p logging.Perspective) {
+	t.record(&KeyInstalledEvent{
+		Time:            t.clock.Now(),
+		EncryptionLevel: encLevel,
+		Perspective:     p,
+	})
+}
+
+func (t *eventConnectionTracer) UpdatedKey(generation logging.KeyPhase, remote bool) {
+	t.record(&KeyUpdatedEvent{
+		Time:       t.clock.Now(),
+		Generation: generation,
+		Remote:     remote,
+	})
+}
+
+func (t *eventConnectionTracer) ClosedConnection(logging.CloseReason) {
+	t.record(&ConnectionClosedEvent{Time: t.clock.Now()})
+}
+
+func (t *eventConnectionTracer) Close() {
+	t.closeOnce.Do(func() {
+		atomic.StoreInt32(&t.closed, 1)
+		defer t.recoverPanic()
+		if err := t.recorder.Close(); err != nil {
+			log.Debugf("closing the event recorder failed: %s", err)
+		}
+	})
+}
+
+func (t *eventConnectionTracer) StartedConnection(local, remote net.Addr, version logging.VersionNumber, srcConnID, destConnID logging.ConnectionID) {
+}
+func (t *eventConnectionTracer) SentTransportParameters(*logging.TransportParameters)     {}
+func (t *eventConnectionTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+func (t *eventConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (t *eventConnectionTracer) ReceivedRetry(*logging.Header)     {}
+func (t *eventConnectionTracer) BufferedPacket(logging.PacketType) {}
+func (t *eventConnectionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (t *eventConnectionTracer) UpdatedCongestionState(logging.CongestionState)                     {}
+func (t *eventConnectionTracer) UpdatedPTOCount(uint32)                                             {}
+func (t *eventConnectionTracer) DroppedEncryptionLevel(logging.EncryptionLevel)                     {}
+func (t *eventConnectionTracer) DroppedKey(logging.KeyPhase)                                        {}
+func (t *eventConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {}
+func (t *eventConnectionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel)        {}
+func (t *eventConnectionTracer) LossTimerCanceled()                                                 {}
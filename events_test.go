@@ -0,0 +1,345 @@
+package libp2pquic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/lucas-clemente/quic-go/logging"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type bufferWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferWriteCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+type failingWriteCloser struct{}
+
+func (failingWriteCloser) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+func (failingWriteCloser) Close() error              { return nil }
+
+type eventCollector struct {
+	mutex  sync.Mutex
+	events []Event
+	closed bool
+	closes int
+}
+
+func (c *eventCollector) RecordEvent(e Event) {
+	c.mutex.Lock()
+	c.events = append(c.events, e)
+	c.mutex.Unlock()
+}
+
+func (c *eventCollector) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.closes++
+	c.mutex.Unlock()
+	return nil
+}
+
+// panickingRecorder panics when recording an event.
+type panickingRecorder struct {
+	calls  int
+	closed bool
+}
+
+func (r *panickingRecorder) RecordEvent(Event) {
+	r.calls++
+	panic("recording failed")
+}
+
+func (r *panickingRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func (c *eventCollector) Events() []Event {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]Event{}, c.events...)
+}
+
+func (c *eventCollector) IsClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+var _ = Describe("Events", func() {
+	now := time.Unix(0, 1612345678123456789)
+
+	Context("event log", func() {
+		readAll := func(r io.Reader) []Event {
+			reader := ReadEventLog(r)
+			var events []Event
+			for {
+				e, err := reader.Next()
+				if err == io.EOF {
+					return events
+				}
+				ExpectWithOffset(1, err).ToNot(HaveOccurred())
+				events = append(events, e)
+			}
+		}
+
+		It("writes and reads events", func() {
+			events := []Event{
+				&KeyInstalledEvent{Time: now, EncryptionLevel: 2, Perspective: logging.PerspectiveServer},
+				&PacketSentEvent{Time: now, PacketType: logging.PacketTypeInitial, PacketNumber: 0, Size: 1252},
+				&PacketReceivedEvent{Time: now.Add(time.Millisecond), PacketType: logging.PacketType1RTT, PacketNumber: 1337, Size: 42},
+				&PacketLostEvent{Time: now.Add(2 * time.Millisecond), EncryptionLevel: 3, PacketNumber: 1234567, Reason: 1},
+				&MetricsUpdatedEvent{
+					Time:             now.Add(3 * time.Millisecond),
+					SmoothedRTT:      23 * time.Millisecond,
+					LatestRTT:        25 * time.Millisecond,
+					MinRTT:           20 * time.Millisecond,
+					CongestionWindow: 32 * 1252,
+					BytesInFlight:    10 * 1252,
+				},
+				&KeyUpdatedEvent{Time: now.Add(4 * time.Millisecond), Generation: 3, Remote: true},
+				&ConnectionClosedEvent{Time: now.Add(5 * time.Millisecond)},
+			}
+			buf := &bufferWriteCloser{}
+			w := NewEventLogWriter(buf)
+			for _, e := range events {
+				w.RecordEvent(e)
+			}
+			Expect(w.Close()).To(Succeed())
+			Expect(buf.closed).To(BeTrue())
+			Expect(readAll(buf)).To(Equal(events))
+		})
+
+		It("skips events of an unknown type", func() {
+			buf := &bufferWriteCloser{}
+			w := NewEventLogWriter(buf)
+			w.RecordEvent(&ConnectionClosedEvent{Time: now})
+			Expect(w.Close()).To(Succeed())
+			// an event of type 42
+			unknown := appendVarintField(nil, eventFieldType, 42)
+			unknown = appendVarintField(unknown, eventFieldTime, uint64(now.UnixNano()))
+			data := append([]byte{byte(len(unknown))}, unknown...)
+			data = append(data, buf.Bytes()...)
+			Expect(readAll(bytes.NewReader(data))).To(Equal([]Event{&ConnectionClosedEvent{Time: now}}))
+		})
+
+		It("errors on truncated event logs", func() {
+			buf := &bufferWriteCloser{}
+			w := NewEventLogWriter(buf)
+			w.RecordEvent(&ConnectionClosedEvent{Time: now})
+			Expect(w.Close()).To(Succeed())
+			data := buf.Bytes()
+			_, err := ReadEventLog(bytes.NewReader(data[:len(data)-1])).Next()
+			Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+		})
+
+		It("rejects events that are too large", func() {
+			_, err := ReadEventLog(bytes.NewReader([]byte{0xff, 0x7f})).Next()
+			Expect(err).To(MatchError("event too large: 16383 bytes"))
+		})
+
+		It("returns the write error when closing", func() {
+			w := NewEventLogWriter(failingWriteCloser{})
+			// fill the buffer of the bufio.Writer
+			for i := 0; i < 1000; i++ {
+				w.RecordEvent(&ConnectionClosedEvent{Time: now})
+			}
+			Expect(w.Close()).To(MatchError("write failed"))
+		})
+	})
+
+	Context("tracing", func() {
+		It("records events", func() {
+			collector := &eventCollector{}
+			var role logging.Perspective
+			var connID []byte
+			tracer := &eventTracer{
+				newRecorder: func(p logging.Perspective, c []byte) EventRecorder {
+					role = p
+					connID = c
+					return collector
+				},
+				clock: fakeClock{now: now},
+			}
+			t := tracer.TracerForConnection(logging.PerspectiveClient, logging.ConnectionID{0xde, 0xad, 0xbe, 0xef})
+			Expect(role).To(Equal(logging.PerspectiveClient))
+			Expect(connID).To(Equal([]byte{0xde, 0xad, 0xbe, 0xef}))
+			t.UpdatedKeyFromTLS(1, logging.PerspectiveServer)
+			t.LostPacket(1, 42, 0)
+			t.UpdatedKey(1, false)
+			t.ClosedConnection(logging.CloseReason{})
+			Expect(collector.IsClosed()).To(BeFalse())
+			t.Close()
+			Expect(collector.IsClosed()).To(BeTrue())
+			Expect(collector.Events()).To(Equal([]Event{
+				&KeyInstalledEvent{Time: now, EncryptionLevel: 1, Perspective: logging.PerspectiveServer},
+				&PacketLostEvent{Time: now, EncryptionLevel: 1, PacketNumber: 42},
+				&KeyUpdatedEvent{Time: now, Generation: 1},
+				&ConnectionClosedEvent{Time: now},
+			}))
+		})
+
+		It("closes the recorder once, and drops events that arrive afterwards", func() {
+			collector := &eventCollector{}
+			stats := &statsTracer{clock: realClock{}}
+			tracer := &eventTracer{
+				newRecorder: func(logging.Perspective, []byte) EventRecorder { return collector },
+				clock:       fakeClock{now: now},
+				stats:       stats,
+			}
+			t := tracer.TracerForConnection(logging.PerspectiveServer, logging.ConnectionID{1, 2, 3, 4})
+			t.ClosedConnection(logging.CloseReason{})
+			t.Close()
+			t.LostPacket(1, 42, 0)
+			t.UpdatedKey(1, true)
+			t.ClosedConnection(logging.CloseReason{})
+			t.Close()
+			Expect(collector.closes).To(Equal(1))
+			Expect(collector.Events()).To(Equal([]Event{&ConnectionClosedEvent{Time: now}}))
+			Expect(stats.EventsAfterClose()).To(BeEquivalentTo(3))
+		})
+
+		It("disables recorders that panic repeatedly", func() {
+			recorder := &panickingRecorder{}
+			stats := &statsTracer{clock: realClock{}}
+			tracer := &eventTracer{
+				newRecorder: func(logging.Perspective, []byte) EventRecorder { return recorder },
+				clock:       realClock{},
+				stats:       stats,
+			}
+			t := tracer.TracerForConnection(logging.PerspectiveClient, logging.ConnectionID{1, 2, 3, 4})
+			for i := 0; i < 10; i++ {
+				t.LostPacket(1, logging.PacketNumber(i), 0)
+			}
+			Expect(recorder.calls).To(Equal(maxRecorderPanics))
+			Expect(stats.RecorderPanics()).To(BeEquivalentTo(maxRecorderPanics))
+			// the recorder is closed nevertheless
+			t.Close()
+			Expect(recorder.closed).To(BeTrue())
+		})
+
+		It("disables event recording if creating recorders panics repeatedly", func() {
+			var calls int
+			stats := &statsTracer{clock: realClock{}}
+			tracer := &eventTracer{
+				newRecorder: func(logging.Perspective, []byte) EventRecorder {
+					calls++
+					panic("creating the recorder failed")
+				},
+				clock: realClock{},
+				stats: stats,
+			}
+			for i := 0; i < 10; i++ {
+				Expect(tracer.TracerForConnection(logging.PerspectiveClient, logging.ConnectionID{byte(i)})).To(BeNil())
+			}
+			Expect(calls).To(Equal(maxRecorderPanics))
+			Expect(stats.RecorderPanics()).To(BeEquivalentTo(maxRecorderPanics))
+		})
+
+		It("keeps the connection alive if the recorder panics", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithEventRecorder(func(logging.Perspective, []byte) EventRecorder {
+				return &panickingRecorder{}
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+
+			str, err := conn.OpenStream(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = str.Write([]byte("foobar"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(str.Close()).To(Succeed())
+			sstr, err := serverConn.AcceptStream()
+			Expect(err).ToNot(HaveOccurred())
+			data, err := ioutil.ReadAll(sstr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("foobar")))
+			Expect(serverTransport.(*transport).Stats().RecorderPanics).To(BeEquivalentTo(maxRecorderPanics))
+		})
+
+		It("doesn't trace connections without a recorder", func() {
+			tracer := &eventTracer{
+				newRecorder: func(logging.Perspective, []byte) EventRecorder { return nil },
+				clock:       realClock{},
+			}
+			Expect(tracer.TracerForConnection(logging.PerspectiveServer, logging.ConnectionID{1, 2, 3, 4})).To(BeNil())
+		})
+
+		It("records the events of a connection", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			collector := &eventCollector{}
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil, WithEventRecorder(func(role logging.Perspective, _ []byte) EventRecorder {
+				defer GinkgoRecover()
+				Expect(role).To(Equal(logging.PerspectiveClient))
+				return collector
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			Expect(conn.Close()).To(Succeed())
+			Eventually(collector.IsClosed).Should(BeTrue())
+
+			var sent, received, keys int
+			for _, e := range collector.Events() {
+				switch e.(type) {
+				case *PacketSentEvent:
+					sent++
+				case *PacketReceivedEvent:
+					received++
+				case *KeyInstalledEvent:
+					keys++
+				}
+			}
+			Expect(sent).ToNot(BeZero())
+			Expect(received).ToNot(BeZero())
+			Expect(keys).ToNot(BeZero())
+		})
+	})
+})
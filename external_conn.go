@@ -0,0 +1,99 @@
+package libp2pquic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// externalConn is a socket created by the application (see WithPacketConn).
+// It bypasses the reuse layer: all listeners and dials use it, and the transport never closes it.
+type externalConn struct {
+	localAddr *net.UDPAddr
+	// packetConn is the net.PacketConn passed to quic-go.
+	packetConn net.PacketConn
+
+	mutex     sync.Mutex
+	listening bool
+}
+
+var _ transportConn = &externalConn{}
+
+// newExternalConn applies the filter, the rate limiter and the packet conn wrapper of the reuse to conn.
+// A *net.UDPConn is wrapped in a reuseConn (that is never added to the reuse), so that quic-go can still use ECN.
+func newExternalConn(conn net.PacketConn, localAddr *net.UDPAddr, r *reuse) *externalConn {
+	c := &externalConn{localAddr: localAddr}
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		c.packetConn = r.newReuseConn(udpConn).packetConn
+		return c
+	}
+	c.packetConn = &filteredPacketConn{PacketConn: conn, filter: r.filter, limiter: r.limiter, connIDs: r.connIDs}
+	if r.wrapConn != nil {
+		c.packetConn = r.wrapConn(c.packetConn)
+	}
+	return c
+}
+
+func (c *externalConn) LocalAddr() net.Addr      { return c.localAddr }
+func (c *externalConn) quicConn() net.PacketConn { return c.packetConn }
+func (c *externalConn) DecreaseCount()           {}
+
+// closeSocket is a no-op, since the application owns the packet conn.
+func (c *externalConn) closeSocket() {}
+
+func (c *externalConn) listeningSocket() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.listening
+}
+
+// Listen starts listening on the socket.
+// laddr must be the address of the socket, but it may use the unspecified IP address and port 0.
+// There can only be one listener at a time.
+func (c *externalConn) Listen(laddr *net.UDPAddr) (transportConn, error) {
+	if (laddr.Port != 0 && laddr.Port != c.localAddr.Port) || (!laddr.IP.IsUnspecified() && !laddr.IP.Equal(c.localAddr.IP)) {
+		return nil, fmt.Errorf("can only listen on the address of the packet conn (%s)", c.localAddr)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.listening {
+		return nil, errors.New("already listening on the packet conn")
+	}
+	c.listening = true
+	return &externalListenConn{externalConn: c}, nil
+}
+
+// externalListenConn is the externalConn used by a listener.
+// When the listener is closed, a new listener can be created.
+type externalListenConn struct {
+	*externalConn
+}
+
+func (c *externalListenConn) DecreaseCount() {
+	c.mutex.Lock()
+	c.listening = false
+	c.mutex.Unlock()
+}
+
+// filteredPacketConn drops packets from denied prefixes and Initials exceeding the handshake rate limit,
+// and classifies the packets quic-go can't route, like the reuseConn does for the sockets created by the transport.
+type filteredPacketConn struct {
+	net.PacketConn
+	filter  *packetFilter
+	limiter *handshakeRateLimiter
+	connIDs *connIDTable
+}
+
+func (c *filteredPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if !(c.filter.Denied(addr) || c.limiter.Drop(b[:n], addr)) {
+			c.connIDs.Classify(b[:n])
+			return n, addr, err
+		}
+	}
+}
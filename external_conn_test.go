@@ -0,0 +1,188 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// demuxPacketConn passes QUIC packets to quic-go, and all other packets (e.g. STUN) to a channel.
+// All QUIC packets have the fixed bit (0x40) set, STUN packets start with two zero bits.
+type demuxPacketConn struct {
+	net.PacketConn
+	other chan []byte
+}
+
+func (c *demuxPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || n == 0 || b[0]&0x40 != 0 {
+			return n, addr, err
+		}
+		data := make([]byte, n)
+		copy(data, b)
+		c.other <- data
+	}
+}
+
+// addrChangingPacketConn reports a UDP address on the first call to LocalAddr, and a unix address afterwards.
+type addrChangingPacketConn struct {
+	net.PacketConn
+	calls int
+}
+
+func (c *addrChangingPacketConn) LocalAddr() net.Addr {
+	c.calls++
+	if c.calls == 1 {
+		return c.PacketConn.LocalAddr()
+	}
+	return &net.UnixAddr{Name: "/tmp/socket", Net: "unixgram"}
+}
+
+var _ = Describe("External packet conn", func() {
+	var (
+		udpConn            *net.UDPConn
+		demux              *demuxPacketConn
+		serverKey          ic.PrivKey
+		serverID, clientID peer.ID
+		clientKey          ic.PrivKey
+	)
+
+	BeforeEach(func() {
+		var err error
+		udpConn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		demux = &demuxPacketConn{PacketConn: udpConn, other: make(chan []byte, 10)}
+		serverKey, _, err = ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err = peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		clientKey, _, err = ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		clientID, err = peer.IDFromPrivateKey(clientKey)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		udpConn.Close()
+	})
+
+	// sendOther sends a non-QUIC packet to the shared socket.
+	sendOther := func(data []byte) {
+		conn, err := net.DialUDP("udp4", nil, udpConn.LocalAddr().(*net.UDPAddr))
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write(data)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	}
+
+	It("shares a socket with other protocols", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil, WithPacketConn(demux))
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		laddr, err := toQuicMultiaddr(udpConn.LocalAddr())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ln.Multiaddr()).To(Equal(laddr))
+
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		Expect(serverConn.RemotePeer()).To(Equal(clientID))
+
+		str, err := conn.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		sstr, err := serverConn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+
+		// a STUN binding request
+		stun := []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}
+		sendOther(stun)
+		Eventually(demux.other).Should(Receive(Equal(stun)))
+
+		// the socket is not closed with the listener
+		Expect(ln.Close()).To(Succeed())
+		sendOther(stun)
+		Eventually(demux.other).Should(Receive(Equal(stun)))
+		// and it's possible to listen again
+		ln, err = serverTransport.Listen(laddr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ln.Close()).To(Succeed())
+	})
+
+	It("dials from the socket", func() {
+		serverTransport, err := NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		clientTransport, err := NewTransport(clientKey, nil, nil, WithPacketConn(demux))
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		laddr, err := toQuicMultiaddr(udpConn.LocalAddr())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.LocalMultiaddr()).To(Equal(laddr))
+	})
+
+	It("only listens on the address of the socket", func() {
+		tr, err := NewTransport(serverKey, nil, nil, WithPacketConn(demux))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = tr.Listen(ma.StringCast("/ip4/127.0.0.2/udp/0/quic"))
+		Expect(err).To(MatchError(ContainSubstring("can only listen on the address of the packet conn")))
+		ln, err := tr.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		_, err = tr.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/quic"))
+		Expect(err).To(MatchError("already listening on the packet conn"))
+	})
+
+	It("keeps ECN if the socket is a *net.UDPConn", func() {
+		tr, err := NewTransport(serverKey, nil, nil, WithPacketConn(udpConn))
+		Expect(err).ToNot(HaveOccurred())
+		_, ok := tr.(*transport).connManager.external.quicConn().(oobCapablePacketConn)
+		Expect(ok).To(BeTrue())
+
+		tr, err = NewTransport(serverKey, nil, nil, WithPacketConn(demux))
+		Expect(err).ToNot(HaveOccurred())
+		_, ok = tr.(*transport).connManager.external.quicConn().(oobCapablePacketConn)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("rejects sockets that don't have a UDP address", func() {
+		conn, err := net.ListenPacket("unixgram", "")
+		if err != nil {
+			Skip("unixgram sockets not supported")
+		}
+		defer conn.Close()
+		_, err = NewTransport(serverKey, nil, nil, WithPacketConn(conn))
+		Expect(err).To(MatchError(ContainSubstring("packet conn must have a UDP address")))
+	})
+
+	It("rejects sockets whose address changes to a non-UDP address", func() {
+		_, err := NewTransport(serverKey, nil, nil, WithPacketConn(&addrChangingPacketConn{PacketConn: udpConn}))
+		Expect(err).To(MatchError(ContainSubstring("packet conn must have a UDP address")))
+	})
+})
@@ -0,0 +1,99 @@
+package libp2pquic
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// A PrefixFilter drops packets from denied IP prefixes, before they are passed to quic-go.
+type PrefixFilter interface {
+	// SetDeniedPrefixes replaces the list of denied prefixes.
+	// Packet counts are kept for prefixes that are denied before and after the update.
+	SetDeniedPrefixes(prefixes ...*net.IPNet)
+}
+
+var _ PrefixFilter = &transport{}
+
+// SetDeniedPrefixes sets the IP prefixes that packets are dropped from.
+func (t *transport) SetDeniedPrefixes(prefixes ...*net.IPNet) {
+	t.filter.SetDeniedPrefixes(prefixes...)
+}
+
+type deniedPrefixes struct {
+	nets []*net.IPNet
+	// counts[i] is the number of packets dropped because they matched nets[i].
+	// Accessed atomically.
+	counts []uint64
+}
+
+// packetFilter filters packets by the sender's IP address.
+// The list of denied prefixes is replaced atomically on updates, such that reading packets never blocks.
+type packetFilter struct {
+	mutex    sync.Mutex   // serializes updates
+	prefixes atomic.Value // *deniedPrefixes
+}
+
+func (f *packetFilter) SetDeniedPrefixes(nets ...*net.IPNet) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	old, _ := f.prefixes.Load().(*deniedPrefixes)
+	p := &deniedPrefixes{
+		nets:   make([]*net.IPNet, 0, len(nets)),
+		counts: make([]uint64, 0, len(nets)),
+	}
+	for _, n := range nets {
+		if n == nil {
+			continue
+		}
+		i := len(p.nets)
+		p.nets = append(p.nets, n)
+		p.counts = append(p.counts, 0)
+		if old == nil {
+			continue
+		}
+		for j, o := range old.nets {
+			if o.String() == n.String() {
+				p.counts[i] = atomic.LoadUint64(&old.counts[j])
+				break
+			}
+		}
+	}
+	f.prefixes.Store(p)
+}
+
+// Denied says if a packet received from addr should be dropped.
+func (f *packetFilter) Denied(addr net.Addr) bool {
+	if f == nil {
+		return false
+	}
+	p, _ := f.prefixes.Load().(*deniedPrefixes)
+	if p == nil || len(p.nets) == 0 {
+		return false
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for i, n := range p.nets {
+		if n.Contains(udpAddr.IP) {
+			atomic.AddUint64(&p.counts[i], 1)
+			return true
+		}
+	}
+	return false
+}
+
+// DroppedPackets returns the number of packets dropped, for every denied prefix.
+func (f *packetFilter) DroppedPackets() map[string]uint64 {
+	p, _ := f.prefixes.Load().(*deniedPrefixes)
+	if p == nil {
+		return nil
+	}
+	dropped := make(map[string]uint64, len(p.nets))
+	for i, n := range p.nets {
+		dropped[n.String()] = atomic.LoadUint64(&p.counts[i])
+	}
+	return dropped
+}
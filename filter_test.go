@@ -0,0 +1,115 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+var _ = Describe("Packet Filter", func() {
+	It("doesn't drop anything by default", func() {
+		var f packetFilter
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234})).To(BeFalse())
+		Expect(f.DroppedPackets()).To(BeEmpty())
+		var nilFilter *packetFilter
+		Expect(nilFilter.Denied(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234})).To(BeFalse())
+	})
+
+	It("drops packets from denied prefixes", func() {
+		var f packetFilter
+		f.SetDeniedPrefixes(mustParseCIDR("192.168.0.0/16"), mustParseCIDR("2001:db8::/32"))
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234})).To(BeTrue())
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1234})).To(BeTrue())
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234})).To(BeFalse())
+		Expect(f.Denied(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234})).To(BeTrue())
+		Expect(f.DroppedPackets()).To(Equal(map[string]uint64{
+			"192.168.0.0/16": 2,
+			"2001:db8::/32":  1,
+		}))
+	})
+
+	It("keeps the counts when updating the prefixes", func() {
+		var f packetFilter
+		f.SetDeniedPrefixes(mustParseCIDR("192.168.0.0/16"), mustParseCIDR("10.0.0.0/8"))
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234})).To(BeTrue())
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234})).To(BeTrue())
+		f.SetDeniedPrefixes(mustParseCIDR("192.168.0.0/16"), mustParseCIDR("172.16.0.0/12"))
+		Expect(f.Denied(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234})).To(BeFalse())
+		Expect(f.DroppedPackets()).To(Equal(map[string]uint64{
+			"192.168.0.0/16": 1,
+			"172.16.0.0/12":  0,
+		}))
+	})
+
+	It("drops packets before they reach quic-go", func() {
+		serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err := peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport, err := NewTransport(serverKey, nil, nil, WithDeniedPrefixes(mustParseCIDR("127.0.0.0/8")))
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err = clientTransport.Dial(ctx, ln.Multiaddr(), serverID)
+		Expect(err).To(HaveOccurred())
+		Expect(serverTransport.(StatsReporter).Stats().DeniedPackets["127.0.0.0/8"]).ToNot(BeZero())
+
+		serverTransport.(PrefixFilter).SetDeniedPrefixes()
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+	})
+})
+
+func BenchmarkPacketFilter(b *testing.B) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234}
+
+	b.Run("no prefixes", func(b *testing.B) {
+		var f packetFilter
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.Denied(addr)
+		}
+	})
+
+	b.Run("10 prefixes", func(b *testing.B) {
+		var f packetFilter
+		prefixes := make([]*net.IPNet, 10)
+		for i := range prefixes {
+			prefixes[i] = &net.IPNet{IP: net.IPv4(10, byte(i), 0, 0), Mask: net.CIDRMask(16, 32)}
+		}
+		f.SetDeniedPrefixes(prefixes...)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f.Denied(addr)
+		}
+	})
+}
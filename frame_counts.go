@@ -0,0 +1,136 @@
+package libp2pquic
+
+import (
+	"sync/atomic"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// frameType is the type of a frame, as counted by the connection tracer.
+type frameType uint8
+
+const (
+	frameTypePing frameType = iota
+	frameTypeAck
+	frameTypeResetStream
+	frameTypeStopSending
+	frameTypeCrypto
+	frameTypeNewToken
+	frameTypeStream
+	frameTypeMaxData
+	frameTypeMaxStreamData
+	frameTypeMaxStreams
+	frameTypeDataBlocked
+	frameTypeStreamDataBlocked
+	frameTypeStreamsBlocked
+	frameTypeNewConnectionID
+	frameTypeRetireConnectionID
+	frameTypePathChallenge
+	frameTypePathResponse
+	frameTypeConnectionClose
+	frameTypeHandshakeDone
+	frameTypeUnknown
+	numFrameTypes
+)
+
+// frameTypeNames are the names of the frame types, as used by qlog.
+var frameTypeNames = [numFrameTypes]string{
+	frameTypePing:               "ping",
+	frameTypeAck:                "ack",
+	frameTypeResetStream:        "reset_stream",
+	frameTypeStopSending:        "stop_sending",
+	frameTypeCrypto:             "crypto",
+	frameTypeNewToken:           "new_token",
+	frameTypeStream:             "stream",
+	frameTypeMaxData:            "max_data",
+	frameTypeMaxStreamData:      "max_stream_data",
+	frameTypeMaxStreams:         "max_streams",
+	frameTypeDataBlocked:        "data_blocked",
+	frameTypeStreamDataBlocked:  "stream_data_blocked",
+	frameTypeStreamsBlocked:     "streams_blocked",
+	frameTypeNewConnectionID:    "new_connection_id",
+	frameTypeRetireConnectionID: "retire_connection_id",
+	frameTypePathChallenge:      "path_challenge",
+	frameTypePathResponse:       "path_response",
+	frameTypeConnectionClose:    "connection_close",
+	frameTypeHandshakeDone:      "handshake_done",
+	frameTypeUnknown:            "unknown",
+}
+
+func (t frameType) String() string { return frameTypeNames[t] }
+
+// frameTypeOf returns the type of a frame.
+// quic-go passes all frames as pointers. This doesn't allocate.
+func frameTypeOf(f logging.Frame) frameType {
+	switch f.(type) {
+	case *logging.PingFrame:
+		return frameTypePing
+	case *logging.AckFrame:
+		return frameTypeAck
+	case *logging.ResetStreamFrame:
+		return frameTypeResetStream
+	case *logging.StopSendingFrame:
+		return frameTypeStopSending
+	case *logging.CryptoFrame:
+		return frameTypeCrypto
+	case *logging.NewTokenFrame:
+		return frameTypeNewToken
+	case *logging.StreamFrame:
+		return frameTypeStream
+	case *logging.MaxDataFrame:
+		return frameTypeMaxData
+	case *logging.MaxStreamDataFrame:
+		return frameTypeMaxStreamData
+	case *logging.MaxStreamsFrame:
+		return frameTypeMaxStreams
+	case *logging.DataBlockedFrame:
+		return frameTypeDataBlocked
+	case *logging.StreamDataBlockedFrame:
+		return frameTypeStreamDataBlocked
+	case *logging.StreamsBlockedFrame:
+		return frameTypeStreamsBlocked
+	case *logging.NewConnectionIDFrame:
+		return frameTypeNewConnectionID
+	case *logging.RetireConnectionIDFrame:
+		return frameTypeRetireConnectionID
+	case *logging.PathChallengeFrame:
+		return frameTypePathChallenge
+	case *logging.PathResponseFrame:
+		return frameTypePathResponse
+	case *logging.ConnectionCloseFrame:
+		return frameTypeConnectionClose
+	case *logging.HandshakeDoneFrame:
+		return frameTypeHandshakeDone
+	default:
+		return frameTypeUnknown
+	}
+}
+
+// frameCounts counts frames by their type.
+// The counters are accessed atomically.
+type frameCounts [numFrameTypes]uint64
+
+func (c *frameCounts) Add(frames []logging.Frame) {
+	for _, f := range frames {
+		atomic.AddUint64(&c[frameTypeOf(f)], 1)
+	}
+}
+
+func (c *frameCounts) AddType(t frameType) {
+	atomic.AddUint64(&c[t], 1)
+}
+
+// Counts returns the non-zero counts, keyed by the name of the frame type.
+// It returns nil if no frames were counted.
+func (c *frameCounts) Counts() map[string]uint64 {
+	var m map[string]uint64
+	for t := range c {
+		if n := atomic.LoadUint64(&c[t]); n > 0 {
+			if m == nil {
+				m = make(map[string]uint64)
+			}
+			m[frameType(t).String()] = n
+		}
+	}
+	return m
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package libp2pquic
+
+import "errors"
+
+func freeDiskSpace(string) (int64, error) {
+	return 0, errors.New("reading the free disk space is not supported on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package libp2pquic
+
+import "syscall"
+
+// freeDiskSpace returns the number of bytes available to unprivileged users on the file system of path.
+func freeDiskSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
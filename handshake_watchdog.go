@@ -0,0 +1,108 @@
+package libp2pquic
+
+import (
+	"sync"
+	"time"
+)
+
+// The watchdog samples the handshake counters handshakeWatchdogSamples times per window.
+const handshakeWatchdogSamples = 10
+
+// minHandshakesForAlert is the minimum number of handshakes that need to finish within the window
+// for the failure rate to be evaluated. This prevents alerts caused by a single failed handshake.
+const minHandshakesForAlert = 10
+
+// HandshakeFailureWindow describes the inbound handshakes that finished within the window of the
+// handshake failure watchdog (see WithHandshakeFailureAlert).
+type HandshakeFailureWindow struct {
+	// Window is the duration the counts were collected over.
+	// It is shorter than the configured window during the first window after the transport was created.
+	Window      time.Duration
+	Completed   int
+	Failed      int
+	FailureRate float64
+}
+
+// handshakeWatchdog alerts when the failure rate of inbound handshakes crosses a threshold.
+// It runs on a single go routine, which samples the counters of the handshake tracker.
+type handshakeWatchdog struct {
+	tracker   *handshakeTracker
+	threshold float64
+	window    time.Duration
+	alert     func(HandshakeFailureWindow)
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func newHandshakeWatchdog(tracker *handshakeTracker, threshold float64, window time.Duration, alert func(HandshakeFailureWindow)) *handshakeWatchdog {
+	w := &handshakeWatchdog{
+		tracker:   tracker,
+		threshold: threshold,
+		window:    window,
+		alert:     alert,
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	// Take the first sample before returning, so that handshakes finishing right after are counted.
+	go w.run(tracker.Totals())
+	return w
+}
+
+func (w *handshakeWatchdog) run(initial handshakeOutcomes) {
+	defer close(w.done)
+
+	interval := w.window / handshakeWatchdogSamples
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// samples of the counters, the oldest one is at the start of the window
+	samples := make([]handshakeOutcomes, 1, handshakeWatchdogSamples+1)
+	samples[0] = initial
+	var alerting bool
+	for {
+		select {
+		case <-w.closed:
+			return
+		case <-ticker.C:
+		}
+		if len(samples) == cap(samples) {
+			samples = append(samples[:0], samples[1:]...)
+		}
+		samples = append(samples, w.tracker.Totals())
+		oldest, latest := samples[0], samples[len(samples)-1]
+		alerting = w.check(HandshakeFailureWindow{
+			Window:    time.Duration(len(samples)-1) * interval,
+			Completed: latest.completed - oldest.completed,
+			Failed:    latest.failed - oldest.failed,
+		}, alerting)
+	}
+}
+
+// check evaluates the failure rate of a window, and calls the alert callback when it crosses the threshold.
+// Once the alert was raised, it is only raised again after the failure rate dropped below the threshold.
+// It returns if the alert is raised.
+func (w *handshakeWatchdog) check(s HandshakeFailureWindow, alerting bool) bool {
+	total := s.Completed + s.Failed
+	if total < minHandshakesForAlert {
+		return alerting
+	}
+	s.FailureRate = float64(s.Failed) / float64(total)
+	if s.FailureRate < w.threshold {
+		return false
+	}
+	if !alerting {
+		w.alert(s)
+	}
+	return true
+}
+
+// Close stops the watchdog, and waits until an alert callback that is running returns.
+func (w *handshakeWatchdog) Close() {
+	if w == nil {
+		return
+	}
+	w.closeOnce.Do(func() { close(w.closed) })
+	<-w.done
+}
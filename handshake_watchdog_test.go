@@ -0,0 +1,72 @@
+package libp2pquic
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handshake failure watchdog", func() {
+	It("alerts once, and again after recovering", func() {
+		var alerts []HandshakeFailureWindow
+		w := &handshakeWatchdog{
+			threshold: 0.5,
+			alert:     func(s HandshakeFailureWindow) { alerts = append(alerts, s) },
+		}
+		// not enough handshakes to evaluate the failure rate
+		Expect(w.check(HandshakeFailureWindow{Failed: 9}, false)).To(BeFalse())
+		Expect(alerts).To(BeEmpty())
+
+		alerting := w.check(HandshakeFailureWindow{Completed: 5, Failed: 5}, false)
+		Expect(alerting).To(BeTrue())
+		Expect(alerts).To(HaveLen(1))
+		Expect(alerts[0].FailureRate).To(Equal(0.5))
+		alerting = w.check(HandshakeFailureWindow{Completed: 2, Failed: 18}, alerting)
+		Expect(alerting).To(BeTrue())
+		Expect(alerts).To(HaveLen(1))
+		// too few handshakes don't end the alert
+		alerting = w.check(HandshakeFailureWindow{Completed: 1}, alerting)
+		Expect(alerting).To(BeTrue())
+
+		alerting = w.check(HandshakeFailureWindow{Completed: 9, Failed: 1}, alerting)
+		Expect(alerting).To(BeFalse())
+		alerting = w.check(HandshakeFailureWindow{Completed: 3, Failed: 7}, alerting)
+		Expect(alerting).To(BeTrue())
+		Expect(alerts).To(HaveLen(2))
+		Expect(alerts[1].FailureRate).To(Equal(0.7))
+	})
+
+	It("counts handshakes that time out", func() {
+		h := newHandshakeTracker(20 * time.Millisecond)
+		alerts := make(chan HandshakeFailureWindow, 1)
+		w := newHandshakeWatchdog(h, 0.8, 500*time.Millisecond, func(s HandshakeFailureWindow) { alerts <- s })
+		defer w.Close()
+
+		for i := 0; i < 10; i++ {
+			addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, byte(i)), Port: 1337}
+			h.Started(addr)
+			if i < 1 {
+				h.Completed(addr)
+			}
+		}
+		var s HandshakeFailureWindow
+		Eventually(alerts).Should(Receive(&s))
+		Expect(s.Completed).To(Equal(1))
+		Expect(s.Failed).To(Equal(9))
+		Expect(s.FailureRate).To(BeNumerically("~", 0.9))
+		Expect(s.Window).To(BeNumerically("<=", 500*time.Millisecond))
+		Consistently(alerts).ShouldNot(Receive())
+	})
+
+	It("stops when the transport is shut down", func() {
+		var w *handshakeWatchdog
+		w.Close() // a nil watchdog can be closed
+
+		w = newHandshakeWatchdog(newHandshakeTracker(time.Hour), 0.5, time.Second, func(HandshakeFailureWindow) {})
+		w.Close()
+		Eventually(w.done).Should(BeClosed())
+		w.Close()
+	})
+})
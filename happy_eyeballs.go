@@ -0,0 +1,123 @@
+package libp2pquic
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// The default delay between two connection attempts, as recommended by RFC 8305.
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// A MultiDialer dials a peer on multiple addresses.
+type MultiDialer interface {
+	// DialAddrs dials the peer on all addresses, using the Happy Eyeballs algorithm (RFC 8305).
+	// IPv6 addresses are tried first, and every subsequent connection attempt is started
+	// once the previous one failed or after a short delay, whichever happens first.
+	// The first connection that is established is returned. All other connection attempts are canceled,
+	// and connections that are established nevertheless are closed with ErrorCodeSuperseded.
+	DialAddrs(ctx context.Context, raddrs []ma.Multiaddr, p peer.ID) (tpt.CapableConn, error)
+}
+
+var _ MultiDialer = &transport{}
+
+// DialAddrs dials the peer on multiple addresses in parallel.
+func (t *transport) DialAddrs(ctx context.Context, raddrs []ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	if len(raddrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	addrs := sortHappyEyeballs(raddrs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	var started, done int
+	startNext := func() {
+		addr := addrs[started]
+		started++
+		go func() {
+			c, err := t.Dial(ctx, addr, p)
+			results <- dialResult{conn: c, err: err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(t.happyEyeballsDelay)
+	defer timer.Stop()
+	var lastErr error
+	for {
+		var timerChan <-chan time.Time
+		if started < len(addrs) {
+			timerChan = timer.C
+		}
+		select {
+		case <-timerChan:
+			startNext()
+			timer.Reset(t.happyEyeballsDelay)
+		case res := <-results:
+			done++
+			if res.err == nil {
+				cancel()
+				go closeSuperseded(results, started-done)
+				return res.conn, nil
+			}
+			lastErr = res.err
+			if started < len(addrs) {
+				// Start the next connection attempt right away.
+				if !timer.Stop() {
+					<-timer.C
+				}
+				startNext()
+				timer.Reset(t.happyEyeballsDelay)
+			} else if done == started {
+				return nil, lastErr
+			}
+		}
+	}
+}
+
+type dialResult struct {
+	conn tpt.CapableConn
+	err  error
+}
+
+// closeSuperseded closes the connections established by the remaining n connection attempts.
+func closeSuperseded(results <-chan dialResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.err == nil {
+			res.conn.(ErrorCodeCloser).CloseWithError(ErrorCodeSuperseded, "superseded")
+		}
+	}
+}
+
+// sortHappyEyeballs sorts the addresses such that IPv6 and IPv4 addresses alternate, starting with IPv6.
+// The relative order of the addresses of each address family is preserved.
+func sortHappyEyeballs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	var v6, other []ma.Multiaddr
+	for _, addr := range addrs {
+		if network, _, err := manet.DialArgs(addr); err == nil && network == "udp6" {
+			v6 = append(v6, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+	sorted := make([]ma.Multiaddr, 0, len(addrs))
+	for len(v6) > 0 || len(other) > 0 {
+		if len(v6) > 0 {
+			sorted = append(sorted, v6[0])
+			v6 = v6[1:]
+		}
+		if len(other) > 0 {
+			sorted = append(sorted, other[0])
+			other = other[1:]
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,118 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Happy Eyeballs", func() {
+	It("sorts addresses", func() {
+		addrs := []ma.Multiaddr{
+			ma.StringCast("/ip4/1.2.3.4/udp/1/quic"),
+			ma.StringCast("/ip4/1.2.3.4/udp/2/quic"),
+			ma.StringCast("/ip4/1.2.3.4/udp/3/quic"),
+			ma.StringCast("/ip6/::1/udp/4/quic"),
+			ma.StringCast("/ip6/::1/udp/5/quic"),
+		}
+		Expect(sortHappyEyeballs(addrs)).To(Equal([]ma.Multiaddr{
+			ma.StringCast("/ip6/::1/udp/4/quic"),
+			ma.StringCast("/ip4/1.2.3.4/udp/1/quic"),
+			ma.StringCast("/ip6/::1/udp/5/quic"),
+			ma.StringCast("/ip4/1.2.3.4/udp/2/quic"),
+			ma.StringCast("/ip4/1.2.3.4/udp/3/quic"),
+		}))
+	})
+
+	Context("dialing", func() {
+		var (
+			serverID        peer.ID
+			serverTransport tpt.Transport
+			clientTransport tpt.Transport
+		)
+
+		// blackHole returns the address of a UDP socket that never responds.
+		blackHole := func(network string) (ma.Multiaddr, func()) {
+			ip := "127.0.0.1"
+			if network == "udp6" {
+				ip = "::1"
+			}
+			conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(ip)})
+			Expect(err).ToNot(HaveOccurred())
+			addr, err := toQuicMultiaddr(conn.LocalAddr())
+			Expect(err).ToNot(HaveOccurred())
+			return addr, func() { conn.Close() }
+		}
+
+		BeforeEach(func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err = peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err = NewTransport(serverKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err = NewTransport(clientKey, nil, nil, WithHappyEyeballsDelay(50*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("falls back to IPv4 if IPv6 is black-holed", func() {
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+			v6Addr, closeFn := blackHole("udp6")
+			defer closeFn()
+
+			start := time.Now()
+			conn, err := clientTransport.(MultiDialer).DialAddrs(context.Background(), []ma.Multiaddr{ln.Multiaddr(), v6Addr}, serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(conn.RemoteMultiaddr()).To(Equal(ln.Multiaddr()))
+		})
+
+		It("prefers IPv6", func() {
+			ln4, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln4.Close()
+			ln6, err := serverTransport.Listen(ma.StringCast("/ip6/::1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln6.Close()
+
+			clientTransport, err := NewTransport(clientTransport.(*transport).privKey, nil, nil, WithHappyEyeballsDelay(time.Second))
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.(MultiDialer).DialAddrs(context.Background(), []ma.Multiaddr{ln4.Multiaddr(), ln6.Multiaddr()}, serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.RemoteMultiaddr()).To(Equal(ln6.Multiaddr()))
+		})
+
+		It("returns an error if all connection attempts fail", func() {
+			v4Addr, closeFn4 := blackHole("udp4")
+			defer closeFn4()
+			v6Addr, closeFn6 := blackHole("udp6")
+			defer closeFn6()
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, err := clientTransport.(MultiDialer).DialAddrs(ctx, []ma.Multiaddr{v4Addr, v6Addr}, serverID)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects invalid options", func() {
+			_, err := NewTransport(clientTransport.(*transport).privKey, nil, nil, WithHappyEyeballsDelay(0))
+			Expect(err).To(MatchError("happy eyeballs delay must be positive"))
+			_, err = clientTransport.(MultiDialer).DialAddrs(context.Background(), nil, serverID)
+			Expect(err).To(MatchError("no addresses to dial"))
+		})
+	})
+})
@@ -0,0 +1,72 @@
+package libp2pquic
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+type dialLabelKey struct{}
+
+// WithDialLabel returns a context that attaches a label to the connection dialed using this context.
+// The label is used to tell apart connections dialed by different subsystems: it is recorded in the
+// qlog index, and appended to the name of the qlog file.
+// Inbound connections don't have a label.
+func WithDialLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, dialLabelKey{}, label)
+}
+
+// DialLabel returns the label set by WithDialLabel, or an empty string if no label is set.
+func DialLabel(ctx context.Context) string {
+	label, _ := ctx.Value(dialLabelKey{}).(string)
+	return label
+}
+
+// connLabels holds the labels of connections while their connection tracers are created.
+// quic-go creates the tracer for a connection without passing in the context of the dial,
+// so the label is passed from the labelTracer to the tracers it wraps through this map.
+var connLabels = struct {
+	sync.Mutex
+	labels map[string]string
+}{labels: make(map[string]string)}
+
+// connLabel returns the label of a connection.
+// It may only be called from TracerForConnection.
+func connLabel(p logging.Perspective, connID []byte) string {
+	connLabels.Lock()
+	defer connLabels.Unlock()
+	return connLabels.labels[connKey(p, connID)]
+}
+
+// labelTracer makes a label available to the wrapped tracer, while it creates the connection tracer.
+type labelTracer struct {
+	logging.Tracer
+	label string
+}
+
+func (t *labelTracer) TracerForConnection(p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	key := connKey(p, odcid)
+	connLabels.Lock()
+	connLabels.labels[key] = t.label
+	connLabels.Unlock()
+	defer func() {
+		connLabels.Lock()
+		delete(connLabels.labels, key)
+		connLabels.Unlock()
+	}()
+	return t.Tracer.TracerForConnection(p, odcid)
+}
+
+// sanitizeLabel replaces all characters that are not safe to use in file names.
+func sanitizeLabel(label string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, label)
+}
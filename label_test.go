@@ -0,0 +1,59 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/lucas-clemente/quic-go/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type labelRecordingTracer struct {
+	logging.Tracer
+	label string
+}
+
+func (t *labelRecordingTracer) TracerForConnection(p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	t.label = connLabel(p, odcid)
+	return nil
+}
+
+var _ = Describe("Dial Labels", func() {
+	It("stores the label in the context", func() {
+		Expect(DialLabel(context.Background())).To(BeEmpty())
+		Expect(DialLabel(WithDialLabel(context.Background(), "dht"))).To(Equal("dht"))
+	})
+
+	It("passes the label to the tracer", func() {
+		recorder := &labelRecordingTracer{}
+		tracer := &labelTracer{Tracer: recorder, label: "dht"}
+		connID := logging.ConnectionID{0xde, 0xad, 0xbe, 0xef}
+		Expect(tracer.TracerForConnection(logging.PerspectiveClient, connID)).To(BeNil())
+		Expect(recorder.label).To(Equal("dht"))
+		// the label is only available while the connection tracer is created
+		Expect(connLabel(logging.PerspectiveClient, connID)).To(BeEmpty())
+		Expect(connLabels.labels).To(BeEmpty())
+	})
+
+	It("uses a labeling tracer when dialing with a label", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		t := tr.(*transport)
+		conf, err := t.clientConfigForContext(WithDialLabel(context.Background(), "dht"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conf.Tracer).To(BeAssignableToTypeOf(&labelTracer{}))
+		Expect(conf.Tracer.(*labelTracer).Tracer).To(Equal(t.clientConfig.Tracer))
+		Expect(t.clientConfig.Tracer).ToNot(BeAssignableToTypeOf(&labelTracer{}))
+	})
+
+	It("sanitizes labels for use in file names", func() {
+		Expect(sanitizeLabel("dht")).To(Equal("dht"))
+		Expect(sanitizeLabel("my-service.v1")).To(Equal("my-service.v1"))
+		Expect(sanitizeLabel("../foo/bar baz")).To(Equal(".._foo_bar_baz"))
+	})
+})
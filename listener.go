@@ -3,7 +3,10 @@ package libp2pquic
 import (
 	"context"
 	"crypto/tls"
+	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	n "github.com/libp2p/go-libp2p-core/network"
@@ -13,6 +16,7 @@ import (
 	p2ptls "github.com/libp2p/go-libp2p-tls"
 
 	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -20,17 +24,35 @@ var quicListen = quic.Listen // so we can mock it in tests
 
 // A listener listens for QUIC connections.
 type listener struct {
+	// stats needs to be the first field, to guarantee 64 bit alignment of its counters
+	stats listenerStats
+
 	quicListener   quic.Listener
-	conn           *reuseConn
+	conn           transportConn
 	transport      *transport
 	privKey        ic.PrivKey
 	localPeer      peer.ID
 	localMultiaddr ma.Multiaddr
+	// qlogSampling is the fraction of qlogs of accepted connections that are kept (see WithListenerQlogSampling).
+	qlogSampling float64
+
+	// queue holds connections that completed the handshake, but haven't been accepted yet.
+	queue chan *conn
+	// runDone is closed when the accept loop returns. acceptErr is set before.
+	runDone   chan struct{}
+	acceptErr error
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 var _ tpt.Listener = &listener{}
 
-func newListener(rconn *reuseConn, t *transport, localPeer peer.ID, key ic.PrivKey, identity *p2ptls.Identity) (tpt.Listener, error) {
+func newListener(rconn transportConn, t *transport, localPeer peer.ID, key ic.PrivKey, identity *p2ptls.Identity, qlogSampling float64) (tpt.Listener, error) {
+	localMultiaddr, err := toQuicMultiaddr(rconn.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
 	var tlsConf tls.Config
 	tlsConf.GetConfigForClient = func(_ *tls.ClientHelloInfo) (*tls.Config, error) {
 		// return a tls.Config that verifies the peer's certificate chain.
@@ -40,44 +62,161 @@ func newListener(rconn *reuseConn, t *transport, localPeer peer.ID, key ic.PrivK
 		conf, _ := identity.ConfigForAny()
 		return conf, nil
 	}
-	ln, err := quicListen(rconn, &tlsConf, t.serverConfig)
-	if err != nil {
-		return nil, err
+	quicConf := t.serverConfig
+	if t.gater != nil {
+		quicConf = t.serverConfig.Clone()
+		quicConf.AcceptToken = func(clientAddr net.Addr, token *quic.Token) bool {
+			if !t.interceptAccept(localMultiaddr, clientAddr, token) {
+				return false
+			}
+			return t.serverConfig.AcceptToken(clientAddr, token)
+		}
 	}
-	localMultiaddr, err := toQuicMultiaddr(ln.Addr())
+	ln, err := quicListen(rconn.quicConn(), &tlsConf, quicConf)
 	if err != nil {
 		return nil, err
 	}
-	return &listener{
+	l := &listener{
 		conn:           rconn,
 		quicListener:   ln,
 		transport:      t,
 		privKey:        key,
 		localPeer:      localPeer,
 		localMultiaddr: localMultiaddr,
-	}, nil
+		qlogSampling:   qlogSampling,
+		queue:          make(chan *conn, t.acceptQueueLength),
+		runDone:        make(chan struct{}),
+	}
+	if !t.conns.addListener(l) {
+		ln.Close()
+		return nil, errTransportClosed
+	}
+	go l.run()
+	return l, nil
 }
 
-// Accept accepts new connections.
-func (l *listener) Accept() (tpt.CapableConn, error) {
+// run accepts connections from quic-go and puts them into the accept queue.
+// If the queue is full, because the application is not calling Accept fast enough,
+// the connection is closed with ErrorCodeAcceptQueueFull.
+func (l *listener) run() {
+	defer close(l.runDone)
 	for {
 		sess, err := l.quicListener.Accept(context.Background())
 		if err != nil {
-			return nil, err
+			l.acceptErr = err
+			return
 		}
+		admissionDelay := l.transport.handshakes.Completed(sess.RemoteAddr())
 		conn, err := l.setupConn(sess)
 		if err != nil {
 			sess.CloseWithError(0, err.Error())
 			continue
 		}
-		if l.transport.gater != nil && !(l.transport.gater.InterceptAccept(conn) && l.transport.gater.InterceptSecured(n.DirInbound, conn.remotePeerID, conn)) {
-			sess.CloseWithError(errorCodeConnectionGating, "connection gated")
+		conn.stats.setAdmissionDelay(admissionDelay)
+		if l.transport.gater != nil && !l.transport.gater.InterceptSecured(n.DirInbound, conn.remotePeerID, conn) {
+			sess.CloseWithError(ErrorCodeConnectionGating, "connection gated")
+			continue
+		}
+		// The run loop is the only sender on the queue. If there's room now, the connection can be queued below.
+		// This is checked before adding the connection, so that it doesn't replace a connection it can't take over.
+		if len(l.queue) == cap(l.queue) {
+			atomic.AddUint64(&l.transport.stats.acceptQueueDrops, 1)
+			atomic.AddUint64(&l.stats.acceptQueueDrops, 1)
+			log.Debugf("accept queue full, rejecting connection from %s", conn.remoteMultiaddr)
+			sess.CloseWithError(ErrorCodeAcceptQueueFull, "accept queue full")
 			continue
 		}
+		replaced, err := l.transport.conns.addConn(conn, l.transport.maxConnsPerPeer)
+		if err != nil {
+			if err == errTooManyConns {
+				atomic.AddUint64(&l.transport.stats.refusedConnsPerPeer, 1)
+				atomic.AddUint64(&l.stats.refusedConnsPerPeer, 1)
+				log.Debugf("too many connections from %s, rejecting connection", conn.remotePeerID)
+				sess.CloseWithError(ErrorCodeTooManyConns, "too many connections")
+				continue
+			}
+			sess.CloseWithError(quic.ErrorCode(l.transport.shutdownErrorCode), "shutting down")
+			continue
+		}
+		if replaced != nil {
+			log.Debugf("simultaneous open with %s, closing our outbound connection", conn.remotePeerID)
+			replaced.CloseWithError(ErrorCodeTooManyConns, "too many connections")
+		}
+		conn.stats.setOwner(conn)
+		l.queue <- conn
+		atomic.AddInt64(&l.transport.stats.acceptQueueLength, 1)
+		atomic.AddUint64(&l.stats.accepted, 1)
+	}
+}
+
+// listenerStats holds the counters of a listener.
+// All fields are accessed atomically.
+type listenerStats struct {
+	accepted            uint64
+	acceptQueueDrops    uint64
+	refusedConnsPerPeer uint64
+}
+
+// Stats returns the statistics of the listener.
+func (l *listener) Stats() ListenerStats {
+	return ListenerStats{
+		Accepted:            atomic.LoadUint64(&l.stats.accepted),
+		AcceptQueueLength:   len(l.queue),
+		AcceptQueueDrops:    atomic.LoadUint64(&l.stats.acceptQueueDrops),
+		RefusedConnsPerPeer: atomic.LoadUint64(&l.stats.refusedConnsPerPeer),
+	}
+}
+
+// sampleQlog decides if the qlog of a connection with the given local address is kept.
+// The connection is resolved to the listener it arrived on. qlogs of connections that
+// don't belong to any listener are kept.
+func (t *transport) sampleQlog(local net.Addr) bool {
+	l := t.conns.listenerFor(local)
+	if l == nil || l.qlogSampling >= 1 {
+		return true
+	}
+	return rand.Float64() < l.qlogSampling
+}
+
+// Accept accepts new connections.
+func (l *listener) Accept() (tpt.CapableConn, error) {
+	select {
+	case conn := <-l.queue:
+		atomic.AddInt64(&l.transport.stats.acceptQueueLength, -1)
 		return conn, nil
+	case <-l.runDone:
+		return nil, l.acceptErr
 	}
 }
 
+// interceptAccept asks the connection gater if a connection attempt from clientAddr should be accepted.
+// It is called before the handshake is started.
+// If the attempt is rejected, quic-go sends a Retry. When the client retries, the connection attempt
+// is rejected again, and the server closes the connection with an INVALID_TOKEN error.
+func (t *transport) interceptAccept(localMultiaddr ma.Multiaddr, clientAddr net.Addr, token *quic.Token) bool {
+	remoteMultiaddr, err := toQuicMultiaddr(clientAddr)
+	if err != nil {
+		return false
+	}
+	if t.gater.InterceptAccept(&connMultiaddrs{local: localMultiaddr, remote: remoteMultiaddr}) {
+		return true
+	}
+	// Only count the first rejection of a connection attempt, not the one after the Retry.
+	if token == nil || !token.IsRetryToken {
+		atomic.AddUint64(&t.stats.gatedAccepts, 1)
+	}
+	return false
+}
+
+type connMultiaddrs struct {
+	local, remote ma.Multiaddr
+}
+
+var _ n.ConnMultiaddrs = &connMultiaddrs{}
+
+func (c *connMultiaddrs) LocalMultiaddr() ma.Multiaddr  { return c.local }
+func (c *connMultiaddrs) RemoteMultiaddr() ma.Multiaddr { return c.remote }
+
 func (l *listener) setupConn(sess quic.Session) (*conn, error) {
 	// The tls.Config used to establish this connection already verified the certificate chain.
 	// Since we don't have any way of knowing which tls.Config was used though,
@@ -97,6 +236,10 @@ func (l *listener) setupConn(sess quic.Session) (*conn, error) {
 		return nil, err
 	}
 
+	stats := l.transport.statsTracer.claim(logging.PerspectiveServer, sess.LocalAddr(), sess.RemoteAddr())
+	stats.setListeningSocket()
+	stats.setTLS(sess.ConnectionState().CipherSuite, remotePubKey)
+	stats.setECN(ecnCapable(l.conn.quicConn()))
 	return &conn{
 		sess:            sess,
 		transport:       l.transport,
@@ -106,13 +249,37 @@ func (l *listener) setupConn(sess quic.Session) (*conn, error) {
 		remoteMultiaddr: remoteMultiaddr,
 		remotePeerID:    remotePeerID,
 		remotePubKey:    remotePubKey,
+		direction:       n.DirInbound,
+		socket:          l.conn,
+		stats:           stats,
 	}, nil
 }
 
 // Close closes the listener.
+// Connections that were not accepted yet are closed.
 func (l *listener) Close() error {
-	defer l.conn.DecreaseCount()
-	return l.quicListener.Close()
+	return l.closeWithError(0, "")
+}
+
+// closeWithError closes the listener.
+// Connections that were not accepted yet are closed with the given error code.
+func (l *listener) closeWithError(code quic.ErrorCode, reason string) error {
+	l.closeOnce.Do(func() {
+		defer l.conn.DecreaseCount()
+		l.transport.conns.removeListener(l)
+		l.closeErr = l.quicListener.Close()
+		<-l.runDone
+		for {
+			select {
+			case conn := <-l.queue:
+				atomic.AddInt64(&l.transport.stats.acceptQueueLength, -1)
+				conn.sess.CloseWithError(code, reason)
+			default:
+				return
+			}
+		}
+	})
+	return l.closeErr
 }
 
 // Addr returns the address of this listener.
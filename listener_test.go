@@ -123,6 +123,20 @@ var _ = Describe("Listener", func() {
 			Eventually(done).Should(BeClosed())
 		})
 
+		It("rejects invalid accept queue lengths", func() {
+			key, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewTransport(key, nil, nil, WithAcceptQueueLength(0))
+			Expect(err).To(MatchError("accept queue length must be positive"))
+		})
+
+		It("rejects invalid per-peer connection limits", func() {
+			key, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewTransport(key, nil, nil, WithMaxConnsPerPeer(0))
+			Expect(err).To(MatchError("maximum number of connections per peer must be positive"))
+		})
+
 		It("doesn't accept Accept calls after it is closed", func() {
 			ln, err := t.Listen(localAddr)
 			Expect(err).ToNot(HaveOccurred())
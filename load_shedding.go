@@ -0,0 +1,70 @@
+package libp2pquic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An AcceptDecision is the decision of a load shedding callback (see WithLoadShedding)
+// about an inbound connection attempt.
+type AcceptDecision uint8
+
+const (
+	// AcceptDecisionAccept accepts the connection attempt.
+	// The configured Retry mode and handshake rate limit still apply.
+	AcceptDecisionAccept AcceptDecision = iota
+	// AcceptDecisionRetry sends a Retry, unless the client already validated its address.
+	AcceptDecisionRetry
+	// AcceptDecisionRefuse refuses the connection attempt.
+	// Since quic-go doesn't allow refusing connection attempts right away, clients that didn't validate their
+	// address are sent a Retry first. When the client retries, the load shedding callback is consulted again.
+	// If it refuses again, the connection is closed with an INVALID_TOKEN error.
+	AcceptDecisionRefuse
+)
+
+func (d AcceptDecision) String() string {
+	switch d {
+	case AcceptDecisionAccept:
+		return "accept"
+	case AcceptDecisionRetry:
+		return "retry"
+	case AcceptDecisionRefuse:
+		return "refuse"
+	default:
+		return fmt.Sprintf("unknown accept decision: %d", uint8(d))
+	}
+}
+
+const defaultLoadSheddingStatsMaxAge = 100 * time.Millisecond
+
+// statsCache caches the transport statistics, so that they don't need to be collected
+// for every connection attempt.
+type statsCache struct {
+	maxAge time.Duration
+
+	mutex   sync.Mutex
+	stats   TransportStats
+	updated time.Time
+}
+
+// cachedStats returns the statistics of the transport, which may be up to the configured max age old.
+func (t *transport) cachedStats() TransportStats {
+	c := t.statsCache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now := time.Now(); now.Sub(c.updated) >= c.maxAge {
+		c.stats = t.Stats()
+		c.updated = now
+	}
+	return c.stats
+}
+
+// decideAccept consults the load shedding callback about an inbound connection attempt.
+func (t *transport) decideAccept() AcceptDecision {
+	if t.shedLoad == nil {
+		return AcceptDecisionAccept
+	}
+	return t.shedLoad(t.cachedStats())
+}
@@ -0,0 +1,121 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	quic "github.com/lucas-clemente/quic-go"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load Shedding", func() {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1337}
+
+	newTransport := func(opts ...Option) *transport {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil, opts...)
+		Expect(err).ToNot(HaveOccurred())
+		return tr.(*transport)
+	}
+
+	decideAlways := func(d AcceptDecision) Option {
+		return WithLoadShedding(func(TransportStats) AcceptDecision { return d })
+	}
+
+	It("accepts connection attempts", func() {
+		t := newTransport(decideAlways(AcceptDecisionAccept))
+		Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+		Expect(t.Stats().RefusedHandshakes).To(BeZero())
+	})
+
+	It("refuses connection attempts", func() {
+		t := newTransport(decideAlways(AcceptDecisionRefuse))
+		Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+		retryToken := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+		Expect(t.serverConfig.AcceptToken(clientAddr, retryToken)).To(BeFalse())
+		stats := t.Stats()
+		Expect(stats.RefusedHandshakes).To(BeEquivalentTo(2))
+		Expect(stats.HandshakesInProgress).To(BeZero())
+	})
+
+	It("sends Retries", func() {
+		t := newTransport(decideAlways(AcceptDecisionRetry))
+		Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+		Expect(t.Stats().RetriesSent).To(BeEquivalentTo(1))
+		retryToken := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+		Expect(t.serverConfig.AcceptToken(clientAddr, retryToken)).To(BeTrue())
+		Expect(t.Stats().RetriesSent).To(BeEquivalentTo(1))
+	})
+
+	It("caches the stats", func() {
+		var inProgress []int
+		t := newTransport(
+			WithLoadShedding(func(s TransportStats) AcceptDecision {
+				inProgress = append(inProgress, s.HandshakesInProgress)
+				return AcceptDecisionAccept
+			}),
+			WithLoadSheddingStatsMaxAge(50*time.Millisecond),
+		)
+		for i := 0; i < 3; i++ {
+			addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i)), Port: 1337}
+			Expect(t.serverConfig.AcceptToken(addr, nil)).To(BeTrue())
+		}
+		Expect(inProgress).To(Equal([]int{0, 0, 0}))
+		time.Sleep(50 * time.Millisecond)
+		Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+		Expect(inProgress).To(Equal([]int{0, 0, 0, 3}))
+	})
+
+	It("rejects invalid stats max ages", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewTransport(key, nil, nil, WithLoadSheddingStatsMaxAge(0))
+		Expect(err).To(MatchError("load shedding stats max age must be positive"))
+	})
+
+	It("sheds load based on the number of open connections", func() {
+		serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err := peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		var calls int32
+		serverTransport, err := NewTransport(serverKey, nil, nil,
+			WithLoadShedding(func(s TransportStats) AcceptDecision {
+				atomic.AddInt32(&calls, 1)
+				if s.OpenConnections >= 1 {
+					return AcceptDecisionRefuse
+				}
+				return AcceptDecisionAccept
+			}),
+			WithLoadSheddingStatsMaxAge(time.Millisecond),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		clientTransport := newTransport()
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+		Expect(serverTransport.(StatsReporter).Stats().OpenConnections).To(Equal(1))
+
+		_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).To(HaveOccurred())
+		// The first attempt is answered with a Retry, the second one is refused.
+		Expect(atomic.LoadInt32(&calls)).To(BeNumerically(">=", 3))
+		Expect(serverTransport.(StatsReporter).Stats().RefusedHandshakes).To(BeNumerically(">=", 2))
+	})
+})
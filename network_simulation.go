@@ -0,0 +1,102 @@
+package libp2pquic
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetworkSimulation configures the simulation of a bad network.
+// It applies to the packets sent by the transport.
+type NetworkSimulation struct {
+	// Delay is the one-way delay added to every packet.
+	Delay time.Duration
+	// Jitter is the maximum random deviation from Delay, in both directions.
+	Jitter time.Duration
+	// Loss is the probability that a packet is dropped (between 0 and 1).
+	Loss float64
+	// Duplication is the probability that a packet is sent twice (between 0 and 1).
+	Duplication float64
+	// Reordering is the probability that a packet is held back (between 0 and 1),
+	// such that it is sent after packets sent later.
+	Reordering float64
+	// Seed seeds the random number generator, making the simulation deterministic.
+	Seed int64
+}
+
+func (s *NetworkSimulation) validate() error {
+	if s.Delay < 0 || s.Jitter < 0 {
+		return errors.New("network simulation delays must not be negative")
+	}
+	for _, p := range []float64{s.Loss, s.Duplication, s.Reordering} {
+		if p < 0 || p > 1 {
+			return errors.New("network simulation probabilities must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// minReorderDelay is the minimum time a reordered packet is held back.
+const minReorderDelay = time.Millisecond
+
+// simulatedPacketConn applies a NetworkSimulation to all packets written.
+type simulatedPacketConn struct {
+	net.PacketConn
+	sim NetworkSimulation
+
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+func newSimulatedPacketConn(c net.PacketConn, sim NetworkSimulation) *simulatedPacketConn {
+	return &simulatedPacketConn{
+		PacketConn: c,
+		sim:        sim,
+		rand:       rand.New(rand.NewSource(sim.Seed)),
+	}
+}
+
+func (c *simulatedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	// Always draw the same random numbers, so that the decisions only depend on the seed and the number of packets.
+	drop := c.rand.Float64() < c.sim.Loss
+	duplicate := c.rand.Float64() < c.sim.Duplication
+	reorder := c.rand.Float64() < c.sim.Reordering
+	delay := c.sim.Delay
+	if c.sim.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(2*int64(c.sim.Jitter)+1)) - c.sim.Jitter
+	}
+	c.mutex.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	if reorder {
+		extra := c.sim.Delay + c.sim.Jitter
+		if extra < minReorderDelay {
+			extra = minReorderDelay
+		}
+		delay += extra
+	}
+	num := 1
+	if duplicate {
+		num = 2
+	}
+	if delay <= 0 {
+		for i := 0; i < num; i++ {
+			if _, err := c.PacketConn.WriteTo(b, addr); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	// quic-go reuses the buffer once WriteTo returns
+	data := make([]byte, len(b))
+	copy(data, b)
+	for i := 0; i < num; i++ {
+		time.AfterFunc(delay, func() { c.PacketConn.WriteTo(data, addr) })
+	}
+	return len(b), nil
+}
@@ -0,0 +1,149 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Network Simulation", func() {
+	var sender, receiver *net.UDPConn
+
+	BeforeEach(func() {
+		var err error
+		sender, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+		receiver, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		sender.Close()
+		receiver.Close()
+	})
+
+	send := func(c net.PacketConn, i uint32) {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, i)
+		_, err := c.WriteTo(b, receiver.LocalAddr())
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	}
+
+	// receive receives packets until no packet arrives for the given duration
+	receive := func(timeout time.Duration) []uint32 {
+		var received []uint32
+		b := make([]byte, 100)
+		for {
+			receiver.SetReadDeadline(time.Now().Add(timeout))
+			n, _, err := receiver.ReadFrom(b)
+			if err != nil {
+				return received
+			}
+			ExpectWithOffset(1, n).To(Equal(4))
+			received = append(received, binary.BigEndian.Uint32(b))
+		}
+	}
+
+	It("rejects invalid configurations", func() {
+		Expect((&NetworkSimulation{Delay: -time.Second}).validate()).To(HaveOccurred())
+		Expect((&NetworkSimulation{Loss: 1.1}).validate()).To(HaveOccurred())
+		Expect((&NetworkSimulation{Reordering: -0.1}).validate()).To(HaveOccurred())
+		Expect((&NetworkSimulation{Delay: time.Second, Loss: 0.5}).validate()).To(Succeed())
+	})
+
+	It("delays packets", func() {
+		c := newSimulatedPacketConn(sender, NetworkSimulation{Delay: 100 * time.Millisecond})
+		start := time.Now()
+		send(c, 1)
+		Expect(receive(time.Second)).To(Equal([]uint32{1}))
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+	})
+
+	It("drops packets", func() {
+		c := newSimulatedPacketConn(sender, NetworkSimulation{Loss: 1})
+		send(c, 1)
+		Expect(receive(50 * time.Millisecond)).To(BeEmpty())
+	})
+
+	It("duplicates packets", func() {
+		c := newSimulatedPacketConn(sender, NetworkSimulation{Duplication: 1})
+		send(c, 1)
+		Expect(receive(50 * time.Millisecond)).To(Equal([]uint32{1, 1}))
+	})
+
+	It("reorders packets", func() {
+		c := newSimulatedPacketConn(sender, NetworkSimulation{Reordering: 1})
+		send(c, 1)
+		c.sim.Reordering = 0
+		send(c, 2)
+		Expect(receive(50 * time.Millisecond)).To(Equal([]uint32{2, 1}))
+	})
+
+	It("is deterministic", func() {
+		sim := NetworkSimulation{Loss: 0.5, Seed: 42}
+		var results [2][]uint32
+		for i := range results {
+			c := newSimulatedPacketConn(sender, sim)
+			for j := uint32(0); j < 50; j++ {
+				send(c, j)
+			}
+			results[i] = receive(50 * time.Millisecond)
+		}
+		Expect(results[0]).ToNot(BeEmpty())
+		Expect(len(results[0])).To(BeNumerically("<", 50))
+		Expect(results[1]).To(Equal(results[0]))
+	})
+
+	It("transfers data over a lossy network", func() {
+		serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err := peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport, err := NewTransport(serverKey, nil, nil, WithNetworkSimulation(NetworkSimulation{
+			Delay:  5 * time.Millisecond,
+			Jitter: 2 * time.Millisecond,
+			Loss:   0.05,
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		clientTransport, err := NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer serverConn.Close()
+
+		data := make([]byte, 200<<10)
+		rand.Read(data)
+		sstr, err := serverConn.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			_, err := sstr.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sstr.CloseWrite()).To(Succeed())
+		}()
+		str, err := conn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		received, err := ioutil.ReadAll(str)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+	})
+})
@@ -0,0 +1,691 @@
+package libp2pquic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// An Option configures the QUIC transport.
+type Option func(*config) error
+
+type config struct {
+	disableMetrics bool
+
+	newEventRecorder func(role logging.Perspective, connID []byte) EventRecorder
+
+	maxIdleTimeout time.Duration
+
+	maxIncomingStreams         int64
+	maxIncomingUniStreams      int64
+	maxStreamReceiveWindow     uint64
+	maxConnectionReceiveWindow uint64
+
+	versions []quic.VersionNumber
+
+	randomStatelessResetKey bool
+
+	retryMode               RetryMode
+	adaptiveRetryThreshold  int
+	maxConcurrentHandshakes int
+
+	handshakeRate  float64
+	handshakeBurst int
+	rateLimitMode  RateLimitMode
+
+	shedLoad                func(TransportStats) AcceptDecision
+	loadSheddingStatsMaxAge time.Duration
+
+	udpBufferSize int
+
+	reuseGarbageCollectInterval time.Duration
+	reuseMaxUnusedDuration      time.Duration
+
+	acceptQueueLength int
+
+	shutdownErrorCode *uint64
+
+	maxConnsPerPeer int
+
+	happyEyeballsDelay time.Duration
+
+	tokenStoreSize    int
+	disableTokenStore bool
+
+	modifyQUICConfig func(*quic.Config) *quic.Config
+
+	deniedPrefixes []*net.IPNet
+
+	packetConn        net.PacketConn
+	packetConnWrapper func(net.PacketConn) net.PacketConn
+	networkSimulation *NetworkSimulation
+
+	qlogDir       *string
+	qlogSocket    *string
+	qlogRetention map[string]struct{}
+	// listenerQlogSampling is the fraction of qlogs kept, keyed by listen address
+	listenerQlogSampling map[string]float64
+
+	statsTags map[string]string
+
+	stallTimeout time.Duration
+	onStall      func(tpt.CapableConn, ConnectionStats)
+
+	classifyRemoteAddr func(net.Addr) string
+
+	dialerHook DialerHook
+
+	handshakeFailureThreshold float64
+	handshakeFailureWindow    time.Duration
+	handshakeFailureAlert     func(HandshakeFailureWindow)
+}
+
+func (c *config) apply(opts ...Option) error {
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// populateQUICConfig sets the fields of the quic.Config that were configured using options.
+func (c *config) populateQUICConfig(conf *quic.Config) {
+	if c.maxIdleTimeout > 0 {
+		conf.MaxIdleTimeout = c.maxIdleTimeout
+	}
+	if c.maxIncomingStreams != 0 {
+		conf.MaxIncomingStreams = c.maxIncomingStreams
+	}
+	if c.maxIncomingUniStreams != 0 {
+		conf.MaxIncomingUniStreams = c.maxIncomingUniStreams
+	}
+	if c.maxStreamReceiveWindow != 0 {
+		conf.MaxReceiveStreamFlowControlWindow = c.maxStreamReceiveWindow
+	}
+	if c.maxConnectionReceiveWindow != 0 {
+		conf.MaxReceiveConnectionFlowControlWindow = c.maxConnectionReceiveWindow
+	}
+	if len(c.versions) > 0 {
+		conf.Versions = c.versions
+	}
+}
+
+// DisableMetrics disables the collection of connection metrics.
+// If neither qlog nor event recording is enabled, quic-go doesn't invoke any tracer callbacks.
+// Everything derived from the connection tracer is unavailable then: ConnectionStats and RTT updates
+// are zero, stall detection and the remote address classifier are disabled, and the TransportStats
+// that are counted by the tracer (SpuriousLosses, StatelessPackets, UnroutablePackets and the counts of the
+// EventRecorders) stay 0. Failed handshakes only free their slot (see WithMaxConcurrentHandshakes)
+// once the handshake timeout expires.
+func DisableMetrics() Option {
+	return func(c *config) error {
+		c.disableMetrics = true
+		return nil
+	}
+}
+
+// WithEventRecorder records the events observed by the connection tracer,
+// such as packets sent, received and lost, and RTT updates.
+// newRecorder is called for every connection, with the connection's original destination connection ID.
+// It may return nil to not record the events of a connection.
+// NewEventLogWriter returns an EventRecorder that writes the events to a file.
+func WithEventRecorder(newRecorder func(role logging.Perspective, connID []byte) EventRecorder) Option {
+	return func(c *config) error {
+		c.newEventRecorder = newRecorder
+		return nil
+	}
+}
+
+// WithMaxIdleTimeout sets the time after which an idle connection is closed.
+// Since the transport enables keep-alives, quic-go sends PING frames on otherwise idle connections,
+// well before the idle timeout expires. The keep-alive interval is derived from the idle timeout.
+func WithMaxIdleTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("idle timeout must be positive")
+		}
+		c.maxIdleTimeout = d
+		return nil
+	}
+}
+
+// maxStreamCount is the maximum value of a stream limit.
+// Larger values can't be encoded in the transport parameters (see section 4.6 of RFC 9000).
+const maxStreamCount = 1 << 60
+
+// WithMaxIncomingStreams sets the number of bidirectional streams the peer is allowed to open concurrently.
+// It defaults to 1000.
+func WithMaxIncomingStreams(n int64) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("maximum number of incoming streams must be positive")
+		}
+		if n > maxStreamCount {
+			return fmt.Errorf("maximum number of incoming streams too large: %d (maximum %d)", n, int64(maxStreamCount))
+		}
+		c.maxIncomingStreams = n
+		return nil
+	}
+}
+
+// WithMaxIncomingUniStreams sets the number of unidirectional streams the peer is allowed to open concurrently.
+// By default, unidirectional streams are disabled, since libp2p doesn't use them.
+// A negative value disables unidirectional streams.
+func WithMaxIncomingUniStreams(n int64) Option {
+	return func(c *config) error {
+		if n == 0 {
+			return errors.New("maximum number of incoming unidirectional streams must not be zero")
+		}
+		if n > maxStreamCount {
+			return fmt.Errorf("maximum number of incoming unidirectional streams too large: %d (maximum %d)", n, int64(maxStreamCount))
+		}
+		c.maxIncomingUniStreams = n
+		return nil
+	}
+}
+
+// WithMaxStreamReceiveWindow sets the maximum flow control window of a single stream.
+// It defaults to 10 MB.
+func WithMaxStreamReceiveWindow(n uint64) Option {
+	return func(c *config) error {
+		if n == 0 {
+			return errors.New("stream receive window must be positive")
+		}
+		c.maxStreamReceiveWindow = n
+		return nil
+	}
+}
+
+// WithMaxConnectionReceiveWindow sets the maximum flow control window of the connection,
+// i.e. for the data received on all streams combined.
+// It defaults to 15 MB.
+func WithMaxConnectionReceiveWindow(n uint64) Option {
+	return func(c *config) error {
+		if n == 0 {
+			return errors.New("connection receive window must be positive")
+		}
+		c.maxConnectionReceiveWindow = n
+		return nil
+	}
+}
+
+// WithQUICVersions sets the QUIC versions that are used for dialing and accepted when listening.
+// When dialing, the first version is offered first.
+// It defaults to draft-29 and draft-32.
+func WithQUICVersions(vs ...quic.VersionNumber) Option {
+	return func(c *config) error {
+		if len(vs) == 0 {
+			return errors.New("no QUIC versions configured")
+		}
+		c.versions = append([]quic.VersionNumber(nil), vs...)
+		return nil
+	}
+}
+
+// WithRandomStatelessResetKey makes the transport use a random stateless reset key,
+// instead of deriving it from the private key (see DeriveStatelessResetKey).
+// Stateless resets then only work for connections established since the transport was created.
+// This is useful for nodes that deliberately rotate keys.
+func WithRandomStatelessResetKey() Option {
+	return func(c *config) error {
+		c.randomStatelessResetKey = true
+		return nil
+	}
+}
+
+// WithRetryMode sets when the transport validates client addresses using a Retry.
+// Address validation costs a round trip, but protects against floods of Initial packets
+// from spoofed addresses. It defaults to RetryNever.
+func WithRetryMode(mode RetryMode) Option {
+	return func(c *config) error {
+		switch mode {
+		case RetryNever, RetryAlways, RetryAdaptive:
+		default:
+			return fmt.Errorf("invalid retry mode: %d", uint8(mode))
+		}
+		c.retryMode = mode
+		return nil
+	}
+}
+
+// WithAdaptiveRetryThreshold sets the number of handshakes in progress above which the
+// transport starts sending Retries, when using RetryAdaptive.
+// It stops sending Retries once the number drops below half the threshold.
+// It defaults to 100.
+func WithAdaptiveRetryThreshold(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("adaptive retry threshold must be positive")
+		}
+		c.adaptiveRetryThreshold = n
+		return nil
+	}
+}
+
+// WithMaxConcurrentHandshakes limits the number of inbound handshakes in progress.
+// Every handshake costs CPU for the cryptography, and memory for buffered packets.
+// Connection attempts exceeding the limit are sent a Retry, which costs neither, and delays the client by a round trip.
+// Clients that return with the Retry token while the limit is still reached are refused.
+// quic-go doesn't allow dropping connection attempts at this point, so this also applies with RetryNever.
+// How long a connection was delayed is reported in ConnectionStats.AdmissionDelay.
+//
+// The limit is checked after address validation (see WithRetryMode) and the handshake rate limit
+// (see WithHandshakeRateLimit), and applies to all clients, even if they validated their address.
+// When using RetryAdaptive, the limit should be well above the adaptive Retry threshold.
+// Otherwise, the threshold is never exceeded, and the limit is reached without clients being validated first.
+// By default, the number of handshakes in progress is not limited.
+func WithMaxConcurrentHandshakes(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("concurrent handshake limit must be positive")
+		}
+		c.maxConcurrentHandshakes = n
+		return nil
+	}
+}
+
+// WithHandshakeRateLimit limits the rate at which inbound handshakes are started, using a token bucket.
+// rate is the number of handshakes per second, burst the number of handshakes that can be started at once.
+// Connection attempts exceeding the limit are handled according to the RateLimitMode.
+// Clients that validated their address, either using a Retry or a token from a previous connection,
+// are not rate limited. By default, the handshake rate is not limited.
+func WithHandshakeRateLimit(rate float64, burst int) Option {
+	return func(c *config) error {
+		if rate <= 0 {
+			return errors.New("handshake rate must be positive")
+		}
+		if burst <= 0 {
+			return errors.New("handshake burst must be positive")
+		}
+		c.handshakeRate = rate
+		c.handshakeBurst = burst
+		return nil
+	}
+}
+
+// WithHandshakeRateLimitMode sets what happens to connection attempts exceeding the handshake rate limit.
+// It defaults to RateLimitRetry.
+func WithHandshakeRateLimitMode(mode RateLimitMode) Option {
+	return func(c *config) error {
+		switch mode {
+		case RateLimitRetry, RateLimitDrop:
+		default:
+			return fmt.Errorf("invalid rate limit mode: %d", uint8(mode))
+		}
+		c.rateLimitMode = mode
+		return nil
+	}
+}
+
+// WithLoadShedding registers a callback that is consulted for every inbound connection attempt,
+// before the handshake is started. Based on the transport statistics, it decides if the attempt is accepted,
+// challenged using a Retry, or refused.
+// The callback is called from quic-go's packet handling loop, and must return quickly.
+// To keep the cost low, the statistics are cached (see WithLoadSheddingStatsMaxAge).
+func WithLoadShedding(decide func(TransportStats) AcceptDecision) Option {
+	return func(c *config) error {
+		c.shedLoad = decide
+		return nil
+	}
+}
+
+// WithLoadSheddingStatsMaxAge sets how long the statistics passed to the load shedding callback are cached.
+// It defaults to 100ms.
+func WithLoadSheddingStatsMaxAge(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("load shedding stats max age must be positive")
+		}
+		c.loadSheddingStatsMaxAge = d
+		return nil
+	}
+}
+
+// WithUDPBufferSize sets the size of the receive and send buffers of the UDP sockets the transport creates.
+// The kernel might not allow setting the full size. The sizes achieved are reported in the TransportStats.
+// It defaults to 2 MB.
+func WithUDPBufferSize(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("UDP buffer size must be positive")
+		}
+		c.udpBufferSize = n
+		return nil
+	}
+}
+
+// WithReuseGarbageCollectInterval sets the interval at which UDP sockets that are not used any more are garbage collected.
+// It defaults to 30s.
+func WithReuseGarbageCollectInterval(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("garbage collection interval must be positive")
+		}
+		c.reuseGarbageCollectInterval = d
+		return nil
+	}
+}
+
+// WithReuseMaxUnusedDuration sets the time after which a UDP socket that is neither used by a listener
+// nor by any connection is closed. Until then, it is reused for new dials.
+// It defaults to 10s.
+func WithReuseMaxUnusedDuration(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("maximum unused duration must be positive")
+		}
+		c.reuseMaxUnusedDuration = d
+		return nil
+	}
+}
+
+// WithAcceptQueueLength sets the number of connections that have completed the handshake,
+// but haven't been accepted by the application yet, that a listener holds.
+// When the queue is full, new connections are closed with ErrorCodeAcceptQueueFull.
+// It defaults to 16.
+func WithAcceptQueueLength(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("accept queue length must be positive")
+		}
+		c.acceptQueueLength = n
+		return nil
+	}
+}
+
+// WithShutdownErrorCode sets the application error code that connections are closed with
+// when the transport is shut down.
+// It defaults to ErrorCodeShutdown.
+func WithShutdownErrorCode(code uint64) Option {
+	return func(c *config) error {
+		c.shutdownErrorCode = &code
+		return nil
+	}
+}
+
+// WithMaxConnsPerPeer limits the number of concurrent inbound connections from a single peer.
+// Connections exceeding the limit are closed after the handshake with ErrorCodeTooManyConns.
+// Outbound connections are not limited, but count towards the limit.
+// If both peers dial each other at the same time, the connection dialed by the peer with the
+// smaller peer ID is kept, and the other one is closed with ErrorCodeTooManyConns.
+// By default, the number of connections is not limited.
+func WithMaxConnsPerPeer(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("maximum number of connections per peer must be positive")
+		}
+		c.maxConnsPerPeer = n
+		return nil
+	}
+}
+
+// WithHappyEyeballsDelay sets the delay between two connection attempts when dialing multiple addresses
+// using DialAddrs. This gives IPv6 addresses a head start over IPv4 addresses.
+// It defaults to 250ms.
+func WithHappyEyeballsDelay(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("happy eyeballs delay must be positive")
+		}
+		c.happyEyeballsDelay = d
+		return nil
+	}
+}
+
+// WithTokenStoreSize sets the number of servers for which tokens received in NEW_TOKEN frames are stored.
+// When dialing a server again, the token is presented, allowing the server to skip address validation.
+// It defaults to 256.
+func WithTokenStoreSize(n int) Option {
+	return func(c *config) error {
+		if n <= 0 {
+			return errors.New("token store size must be positive")
+		}
+		c.tokenStoreSize = n
+		return nil
+	}
+}
+
+// DisableTokenStore disables storing tokens received from servers.
+func DisableTokenStore() Option {
+	return func(c *config) error {
+		c.disableTokenStore = true
+		return nil
+	}
+}
+
+// WithQUICConfig allows modifying the quic.Config used for dialing and listening.
+// The function is passed a copy of the configuration built from the other options, and returns the configuration to use.
+// The transport sets the Tracer and the AcceptToken callback afterwards, so these fields are ignored.
+// If the TokenStore is nil, the transport's default token store is used for dialing (unless disabled by DisableTokenStore).
+func WithQUICConfig(f func(base *quic.Config) *quic.Config) Option {
+	return func(c *config) error {
+		c.modifyQUICConfig = f
+		return nil
+	}
+}
+
+// WithDeniedPrefixes drops all packets received from the given IP prefixes, before they are passed to quic-go.
+// The list can be updated while the transport is running, using the PrefixFilter interface.
+// The number of dropped packets is reported per prefix in the TransportStats.
+func WithDeniedPrefixes(prefixes ...*net.IPNet) Option {
+	return func(c *config) error {
+		c.deniedPrefixes = prefixes
+		return nil
+	}
+}
+
+// WithPacketConn makes the transport listen and dial on conn, instead of creating its own UDP sockets.
+// This allows sharing a socket with other protocols, e.g. a STUN responder that demultiplexes the packets.
+// The local address of conn must be a *net.UDPAddr. Listen only accepts this address (the IP may be unspecified,
+// and the port may be 0), and there can only be one listener at a time.
+// The transport never closes conn. quic-go keeps reading from it until it is closed,
+// so the application should close it once the transport is not used any more.
+// The packet conn wrapper, the network simulation, the denied prefixes and the handshake rate limit apply to conn,
+// but the UDP buffer size (see WithUDPBufferSize) doesn't.
+// If conn is not a *net.UDPConn, quic-go can't use ECN, and can't increase the receive buffer of the socket.
+func WithPacketConn(conn net.PacketConn) Option {
+	return func(c *config) error {
+		if _, ok := conn.LocalAddr().(*net.UDPAddr); !ok {
+			return fmt.Errorf("packet conn must have a UDP address, got %T", conn.LocalAddr())
+		}
+		c.packetConn = conn
+		return nil
+	}
+}
+
+// WithPacketConnWrapper sets a function that wraps every UDP socket the transport creates, before it is used by quic-go.
+// It is called once per socket, and the returned net.PacketConn is used for all listeners and dials using that socket.
+// This allows adding custom framing, latency injection, or packet capture.
+// If the returned net.PacketConn doesn't implement ReadMsgUDP, WriteMsgUDP and SyscallConn of the *net.UDPConn,
+// quic-go can't use ECN.
+func WithPacketConnWrapper(f func(net.PacketConn) net.PacketConn) Option {
+	return func(c *config) error {
+		c.packetConnWrapper = f
+		return nil
+	}
+}
+
+// WithNetworkSimulation simulates a bad network, by delaying, dropping, duplicating and reordering
+// the packets sent by the transport. This is meant for testing applications.
+// Decisions are drawn from a random number generator seeded by the NetworkSimulation, per UDP socket.
+func WithNetworkSimulation(sim NetworkSimulation) Option {
+	return func(c *config) error {
+		if err := sim.validate(); err != nil {
+			return err
+		}
+		c.networkSimulation = &sim
+		return nil
+	}
+}
+
+// WithQlogDir writes the qlogs of the transport's connections to dir.
+// It overrides the QLOGDIR environment variable. An empty dir disables writing qlogs.
+// Every transport needs to use its own directory.
+func WithQlogDir(dir string) Option {
+	return func(c *config) error {
+		c.qlogDir = &dir
+		return nil
+	}
+}
+
+// WithQlogSocket streams the qlogs of the transport's connections on a unix domain socket at path.
+// It overrides the QLOGSOCKET environment variable. An empty path disables streaming qlogs.
+func WithQlogSocket(path string) Option {
+	return func(c *config) error {
+		c.qlogSocket = &path
+		return nil
+	}
+}
+
+// WithListenerQlogSampling keeps only a fraction of the qlogs of the connections accepted by the listener
+// listening on addr, e.g. to trace every connection on a VPN interface, but only 1% on a public interface.
+// addr must be the multiaddr passed to Listen. The qlogs of other listeners and of outgoing connections are all kept.
+// Sampling only applies to the qlogs written to disk (see WithQlogDir), streamed qlogs are not sampled.
+func WithListenerQlogSampling(addr ma.Multiaddr, fraction float64) Option {
+	return func(c *config) error {
+		if fraction < 0 || fraction > 1 {
+			return fmt.Errorf("invalid qlog sampling fraction: %f", fraction)
+		}
+		if c.listenerQlogSampling == nil {
+			c.listenerQlogSampling = make(map[string]float64)
+		}
+		c.listenerQlogSampling[addr.String()] = fraction
+		return nil
+	}
+}
+
+// WithQlogRetention only keeps the qlogs of connections that were closed for one of the given reasons,
+// e.g. "local_transport_error", "remote_transport_error" and "handshake_timeout", and deletes the others
+// once the connection is closed. The reasons are the ones reported in ConnectionStats.CloseReason.
+// By default, all qlogs are kept. qlogs that are finalized before the connection is closed,
+// because they reached the size limit, are always kept.
+func WithQlogRetention(closeReasons ...string) Option {
+	return func(c *config) error {
+		retain := make(map[string]struct{}, len(closeReasons))
+		for _, r := range closeReasons {
+			if _, ok := knownCloseReasons[r]; !ok {
+				return fmt.Errorf("unknown close reason: %q", r)
+			}
+			retain[r] = struct{}{}
+		}
+		c.qlogRetention = retain
+		return nil
+	}
+}
+
+// maxStatsTagsSize is the maximum total size of the keys and values of the stats tags.
+const maxStatsTagsSize = 1024
+
+// WithStatsTags tags the connection statistics written to disk, i.e. the entries of the qlog index,
+// for example with the arm of an experiment that the node takes part in.
+// Keys must start with a lowercase letter, and consist of lowercase letters, digits and underscores.
+// The total size of all keys and values is limited to 1 kB.
+func WithStatsTags(tags map[string]string) Option {
+	return func(c *config) error {
+		var size int
+		for k, v := range tags {
+			if !isValidStatsTagKey(k) {
+				return fmt.Errorf("invalid stats tag key: %q", k)
+			}
+			size += len(k) + len(v)
+		}
+		if size > maxStatsTagsSize {
+			return fmt.Errorf("stats tags too large: %d bytes (maximum %d bytes)", size, maxStatsTagsSize)
+		}
+		c.statsTags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			c.statsTags[k] = v
+		}
+		return nil
+	}
+}
+
+func isValidStatsTagKey(k string) bool {
+	if len(k) == 0 || k[0] < 'a' || k[0] > 'z' {
+		return false
+	}
+	for _, r := range k {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithStallDetection detects connections that stall, i.e. that don't make any forward progress for the timeout
+// while data is in flight. This happens when a connection is in persistent congestion, or when the path broke,
+// and it can take minutes until the idle timeout fires.
+// onStall is called with the connection and a snapshot of its statistics, at most once per stall.
+// It is called on its own go routine, and may close the connection and dial a new one.
+// Stalls are counted in ConnectionStats.
+func WithStallDetection(timeout time.Duration, onStall func(tpt.CapableConn, ConnectionStats)) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return errors.New("stall timeout must be positive")
+		}
+		c.stallTimeout = timeout
+		c.onStall = onStall
+		return nil
+	}
+}
+
+// WithRemoteAddrClassifier sets a function that classifies the remote address of inbound connections,
+// e.g. to tell apart connections to addresses only advertised via a relay from connections to directly
+// advertised addresses. The class is reported in ConnectionStats.RemoteAddrClass.
+// The classifier is called once per connection, when the handshake starts. It is called on its own go routine,
+// so it may block, e.g. on a peerstore lookup. The class is reported once it returned.
+func WithRemoteAddrClassifier(classify func(net.Addr) string) Option {
+	return func(c *config) error {
+		c.classifyRemoteAddr = classify
+		return nil
+	}
+}
+
+// WithHandshakeFailureAlert calls alert when the fraction of inbound handshakes that failed within the window
+// reaches the threshold, e.g. to page someone when a release breaks TLS interoperability.
+// Handshakes that don't complete within the handshake timeout count as failed.
+// The alert is raised once, and only raised again after the failure rate dropped below the threshold.
+// At least 10 handshakes need to finish within the window for the failure rate to be evaluated.
+// The failure rate is checked 10 times per window, on a go routine that runs until the transport is shut down
+// (see Shutdowner). alert is called on that go routine.
+func WithHandshakeFailureAlert(threshold float64, window time.Duration, alert func(HandshakeFailureWindow)) Option {
+	return func(c *config) error {
+		if threshold <= 0 || threshold > 1 {
+			return fmt.Errorf("invalid handshake failure threshold: %f", threshold)
+		}
+		if window < handshakeWatchdogSamples*time.Millisecond {
+			return errors.New("handshake failure window too short")
+		}
+		if alert == nil {
+			return errors.New("handshake failure alert callback must not be nil")
+		}
+		c.handshakeFailureThreshold = threshold
+		c.handshakeFailureWindow = window
+		c.handshakeFailureAlert = alert
+		return nil
+	}
+}
+
+// WithDialerHook makes Dial obtain the packet conn for every outbound connection from the hook,
+// e.g. to traverse a SOCKS5 proxy in networks that don't allow outbound UDP.
+// The packet conn is used for a single connection, and it is closed when the connection is closed.
+// Neither the sockets of the listeners nor the socket passed to WithPacketConn are used for dialing.
+// Connections dialed using the hook are reported as proxied in ConnectionStats.Proxied,
+// since their RTTs are not comparable to those of direct connections.
+func WithDialerHook(hook DialerHook) Option {
+	return func(c *config) error {
+		if hook == nil {
+			return errors.New("dialer hook must not be nil")
+		}
+		c.dialerHook = hook
+		return nil
+	}
+}
@@ -0,0 +1,29 @@
+package libp2pquic
+
+import (
+	"net"
+	"syscall"
+)
+
+// oobCapablePacketConn contains the methods quic-go uses to read and write ECN bits,
+// if the net.PacketConn passed to it implements them.
+type oobCapablePacketConn interface {
+	net.PacketConn
+	SyscallConn() (syscall.RawConn, error)
+	ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error)
+	WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error)
+}
+
+// wrapPacketConn applies the packet conn wrapper,
+// and logs a notice if the wrapped connection lost capabilities quic-go uses.
+func (t *transport) wrapPacketConn(wrap func(net.PacketConn) net.PacketConn) func(net.PacketConn) net.PacketConn {
+	return func(c net.PacketConn) net.PacketConn {
+		wrapped := wrap(c)
+		if _, ok := wrapped.(oobCapablePacketConn); !ok {
+			t.packetConnWrapperNoticeOnce.Do(func() {
+				log.Infof("Wrapped packet conn (%T) doesn't implement ReadMsgUDP, WriteMsgUDP and SyscallConn. ECN will be disabled.", wrapped)
+			})
+		}
+		return wrapped
+	}
+}
@@ -0,0 +1,46 @@
+package libp2pquic
+
+import (
+	"context"
+	"net"
+)
+
+// A DialerHook obtains the packet conn used to dial a connection to raddr, e.g. a packet conn that tunnels
+// the packets through a SOCKS5 proxy using UDP ASSOCIATE, or through a user-space tunnel.
+// It returns the packet conn and the address that quic-go sends the packets to, using the packet conn's WriteTo.
+// This is raddr if the packet conn addresses the packets to their final destination itself.
+// quic-go identifies packet conns by their local address, so every packet conn needs a distinct LocalAddr.
+type DialerHook func(ctx context.Context, raddr *net.UDPAddr) (net.PacketConn, *net.UDPAddr, error)
+
+// proxiedConn is a packet conn obtained from the DialerHook. It is used for a single connection,
+// and it bypasses the reuse, so the packet filter and rate limiter don't apply to it.
+type proxiedConn struct {
+	net.PacketConn
+}
+
+var _ transportConn = &proxiedConn{}
+
+// DecreaseCount closes the packet conn. It is called when the connection is closed.
+func (c *proxiedConn) DecreaseCount() { c.Close() }
+
+// quicConn hides the methods of the packet conn that are not part of net.PacketConn.
+// If the packet conn embeds a *net.UDPConn, quic-go would otherwise use ReadMsgUDP,
+// and read the packets from the underlying socket, bypassing the packet conn's ReadFrom.
+func (c *proxiedConn) quicConn() net.PacketConn { return c }
+
+func (c *proxiedConn) listeningSocket() bool { return false }
+
+func (c *proxiedConn) closeSocket() { c.Close() }
+
+// dialProxied obtains the packet conn for a connection to raddr from the DialerHook.
+// It returns the address that quic-go should dial.
+func (t *transport) dialProxied(ctx context.Context, raddr *net.UDPAddr) (transportConn, *net.UDPAddr, error) {
+	pconn, addr, err := t.dialerHook(ctx, raddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if addr == nil {
+		addr = raddr
+	}
+	return &proxiedConn{PacketConn: pconn}, addr, nil
+}
@@ -0,0 +1,189 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// socks5Header encodes the header of a SOCKS5 UDP request (RFC 1928, section 7) for an IPv4 address.
+func socks5Header(addr *net.UDPAddr) []byte {
+	hdr := []byte{0, 0, 0, 1} // RSV, FRAG, ATYP (IPv4)
+	hdr = append(hdr, addr.IP.To4()...)
+	return append(hdr, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// parseSocks5Header parses the header of a SOCKS5 UDP request for an IPv4 address, and returns the payload.
+func parseSocks5Header(b []byte) (*net.UDPAddr, []byte, error) {
+	if len(b) < 10 || b[2] != 0 || b[3] != 1 {
+		return nil, nil, errors.New("invalid SOCKS5 UDP header")
+	}
+	addr := &net.UDPAddr{IP: net.IP(append([]byte{}, b[4:8]...)), Port: int(binary.BigEndian.Uint16(b[8:10]))}
+	return addr, b[10:], nil
+}
+
+// socks5Relay is the UDP relay of a SOCKS5 proxy, after the client associated using UDP ASSOCIATE.
+// It relays the packets of a single client.
+type socks5Relay struct {
+	conn    *net.UDPConn
+	relayed uint64 // accessed atomically
+	client  *net.UDPAddr
+}
+
+func newSocks5Relay() *socks5Relay {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	r := &socks5Relay{conn: conn}
+	go r.run()
+	return r
+}
+
+func (r *socks5Relay) run() {
+	b := make([]byte, 2048)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// The first packet is sent by the client. Every other sender is a destination.
+		if r.client == nil {
+			r.client = addr
+		}
+		if addr.String() == r.client.String() {
+			dst, payload, err := parseSocks5Header(b[:n])
+			if err != nil {
+				continue
+			}
+			r.conn.WriteToUDP(payload, dst)
+		} else {
+			r.conn.WriteToUDP(append(socks5Header(addr), b[:n]...), r.client)
+		}
+		atomic.AddUint64(&r.relayed, 1)
+	}
+}
+
+func (r *socks5Relay) Addr() *net.UDPAddr { return r.conn.LocalAddr().(*net.UDPAddr) }
+func (r *socks5Relay) Relayed() uint64    { return atomic.LoadUint64(&r.relayed) }
+func (r *socks5Relay) Close() error       { return r.conn.Close() }
+
+// socks5PacketConn sends and receives packets through a SOCKS5 UDP relay.
+type socks5PacketConn struct {
+	*net.UDPConn
+	relay  *net.UDPAddr
+	closed int32 // accessed atomically
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if _, err := c.UDPConn.WriteTo(append(socks5Header(addr.(*net.UDPAddr)), b...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+10)
+	for {
+		n, _, err := c.UDPConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, payload, err := parseSocks5Header(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.UDPConn.Close()
+}
+
+func (c *socks5PacketConn) isClosed() bool { return atomic.LoadInt32(&c.closed) == 1 }
+
+var _ = Describe("Dialer Hook", func() {
+	It("dials through a SOCKS5 UDP relay", func() {
+		serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err := peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport, err := NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		relay := newSocks5Relay()
+		defer relay.Close()
+		pconns := make(chan *socks5PacketConn, 1)
+		clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		clientTransport, err := NewTransport(clientKey, nil, nil, WithDialerHook(func(_ context.Context, raddr *net.UDPAddr) (net.PacketConn, *net.UDPAddr, error) {
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return nil, nil, err
+			}
+			pconn := &socks5PacketConn{UDPConn: conn, relay: relay.Addr()}
+			pconns <- pconn
+			return pconn, raddr, nil
+		}))
+		Expect(err).ToNot(HaveOccurred())
+
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		var pconn *socks5PacketConn
+		Expect(pconns).To(Receive(&pconn))
+		sconn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		// the server sees the address of the relay
+		relayAddr, err := toQuicMultiaddr(relay.Addr())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sconn.RemoteMultiaddr()).To(Equal(relayAddr))
+		Expect(relay.Relayed()).ToNot(BeZero())
+
+		str, err := conn.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = str.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.Close()).To(Succeed())
+		sstr, err := sconn.AcceptStream()
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(sstr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(Equal([]byte("foobar")))
+
+		stats := conn.(ConnectionStatsReporter).Stats()
+		Expect(stats.Proxied).To(BeTrue())
+		Expect(stats.ListeningSocket).To(BeFalse())
+		// the packet conn passed to quic-go doesn't have the methods needed for reading the ECN bits
+		Expect(stats.ECN).To(BeFalse())
+		Expect(sconn.(ConnectionStatsReporter).Stats().Proxied).To(BeFalse())
+
+		// the packet conn is closed with the connection
+		Expect(conn.Close()).To(Succeed())
+		Eventually(pconn.isClosed).Should(BeTrue())
+	})
+
+	It("returns the error of the dialer hook", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil, WithDialerHook(func(context.Context, *net.UDPAddr) (net.PacketConn, *net.UDPAddr, error) {
+			return nil, nil, errors.New("proxy unreachable")
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = tr.Dial(context.Background(), ma.StringCast("/ip4/127.0.0.1/udp/1234/quic"), "peer")
+		Expect(err).To(MatchError("proxy unreachable"))
+	})
+})
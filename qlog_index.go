@@ -0,0 +1,323 @@
+package libp2pquic
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// qlogIndexFilename is the name of the file in the QLOGDIR that lists the qlogs written.
+const qlogIndexFilename = "index.jsonl"
+
+// A qlogIndexEntry describes a qlog file. It is written to the index once the qlog is complete.
+type qlogIndexEntry struct {
+	Filename    string    `json:"filename"`
+	ODCID       string    `json:"odcid"`
+	Perspective string    `json:"perspective"`
+	StartTime   time.Time `json:"start_time"`
+	EndTime     time.Time `json:"end_time"`
+	Label       string    `json:"label,omitempty"`
+	LocalAddr   string    `json:"local_addr,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	Close       string    `json:"close,omitempty"`
+	ErrorCode   uint64    `json:"error_code,omitempty"`
+	// TLSAlert is the description of the TLS alert, if the connection was closed with a CRYPTO_ERROR.
+	TLSAlert string `json:"tls_alert,omitempty"`
+	// DurationMs is the duration of the connection, in milliseconds. Unlike the difference between the start and
+	// the end time, it is measured using the monotonic clock, so it is not affected by wall clock jumps.
+	DurationMs int64 `json:"duration_ms"`
+	// ClosedByRemote is omitted if it's unknown who closed the connection.
+	ClosedByRemote *bool `json:"closed_by_remote,omitempty"`
+	// Tags are the tags configured using WithStatsTags.
+	Tags map[string]string `json:"tags,omitempty"`
+	Size int64             `json:"size"`
+}
+
+// qlogConnInfo is the information about a connection that is not contained in the name of its qlog file.
+type qlogConnInfo struct {
+	startTime  time.Time
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	close      connClose
+	// discarded is set if the qlog is not kept (see WithListenerQlogSampling).
+	// It is accessed atomically, since the qlog is written on a different go routine.
+	discarded int32
+}
+
+func (i *qlogConnInfo) isDiscarded() bool {
+	return atomic.LoadInt32(&i.discarded) == 1
+}
+
+// qlogIndex maintains the index of the qlogs in the QLOGDIR.
+// It is also a logging.Tracer, which collects the information about the connections
+// that end up in the index.
+// It must be used together with the qlog tracer, and it must come first in the multiplexed tracer,
+// so that the information about a connection is available when the qlog file for the connection is created.
+type qlogIndex struct {
+	dir   string
+	clock clock
+	tags  map[string]string // added to every entry
+	// sample decides if the qlog of an inbound connection with the given local address is kept.
+	// nil if all qlogs are kept.
+	sample func(local net.Addr) bool
+	// resources counts the index file while it is open. May be nil.
+	resources *resourceCounts
+
+	mutex   sync.Mutex
+	f       *os.File // opened when the first entry is written
+	closed  bool
+	pending map[string]*qlogConnInfo
+}
+
+var _ logging.Tracer = &qlogIndex{}
+
+func newQlogIndex(dir string, clock clock) *qlogIndex {
+	return &qlogIndex{
+		dir:     dir,
+		clock:   clock,
+		pending: make(map[string]*qlogConnInfo),
+	}
+}
+
+// connKey is the key used to find the state of a connection while its connection tracers are created.
+func connKey(p logging.Perspective, connID []byte) string {
+	return perspectiveString(p) + "_" + hex.EncodeToString(connID)
+}
+
+func (i *qlogIndex) TracerForConnection(p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
+	info := &qlogConnInfo{startTime: i.clock.Now()}
+	i.mutex.Lock()
+	i.pending[connKey(p, odcid)] = info
+	i.mutex.Unlock()
+	return &qlogIndexConnectionTracer{info: info, perspective: p, sample: i.sample}
+}
+
+func (i *qlogIndex) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+func (i *qlogIndex) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+// connInfo returns the information about a connection collected by TracerForConnection.
+// It must be called exactly once for every connection.
+func (i *qlogIndex) connInfo(p logging.Perspective, connID []byte) *qlogConnInfo {
+	key := connKey(p, connID)
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	info, ok := i.pending[key]
+	if !ok {
+		return &qlogConnInfo{startTime: i.clock.Now()}
+	}
+	delete(i.pending, key)
+	return info
+}
+
+// Add appends an entry to the index.
+// Every entry is written with a single write call, so a crash can at most leave the last line incomplete.
+func (i *qlogIndex) Add(e *qlogIndexEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if i.closed {
+		return errors.New("qlog index closed")
+	}
+	if i.f == nil {
+		f, err := openQlogIndex(filepath.Join(i.dir, qlogIndexFilename))
+		if err != nil {
+			return err
+		}
+		i.f = f
+		i.resources.OpenedFile()
+	}
+	_, err = i.f.Write(data)
+	return err
+}
+
+// Close closes the index. Entries can't be added afterwards.
+func (i *qlogIndex) Close() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.closed = true
+	if i.f == nil {
+		return nil
+	}
+	err := i.f.Close()
+	i.f = nil
+	i.resources.ClosedFile()
+	return err
+}
+
+// openQlogIndex opens the index for appending.
+// If the process crashed while writing to the index, the incomplete last line is removed.
+func openQlogIndex(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	size, err := validIndexSize(f)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// validIndexSize returns the size of the index up to (and including) the last newline.
+func validIndexSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	buf := make([]byte, 4096)
+	for size > 0 {
+		n := int64(len(buf))
+		if n > size {
+			n = size
+		}
+		if _, err := f.ReadAt(buf[:n], size-n); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return size - n + int64(i) + 1, nil
+		}
+		size -= n
+	}
+	return 0, nil
+}
+
+func perspectiveString(p logging.Perspective) string {
+	if p == logging.PerspectiveClient {
+		return "client"
+	}
+	return "server"
+}
+
+// connClose describes how a connection was closed.
+type connClose struct {
+	// reason is a short description of the reason the connection was closed.
+	reason    string
+	errorCode uint64
+	// byRemote says if the peer closed the connection. It is nil if that's unknown.
+	byRemote *bool
+	// tlsAlert is the description of the TLS alert, if the connection was closed with a CRYPTO_ERROR.
+	// Otherwise, it is empty.
+	tlsAlert     string
+	tlsAlertCode uint8
+}
+
+// knownCloseReasons are the reasons reported by classifyCloseReason.
+var knownCloseReasons = map[string]struct{}{
+	"local_application_error":  {},
+	"remote_application_error": {},
+	"local_transport_error":    {},
+	"remote_transport_error":   {},
+	"handshake_timeout":        {},
+	"idle_timeout":             {},
+	"stateless_reset":          {},
+	"unknown":                  {},
+}
+
+// classifyCloseReason classifies the reason a connection was closed.
+// Timeouts are detected by our own timers, so they count as closed by us.
+// Stateless resets are sent by the peer.
+// For transport errors in the CRYPTO_ERROR range, the TLS alert is decoded.
+func classifyCloseReason(r logging.CloseReason) connClose {
+	if code, remote, ok := r.ApplicationError(); ok {
+		if remote {
+			return connClose{reason: "remote_application_error", errorCode: uint64(code), byRemote: &remote}
+		}
+		return connClose{reason: "local_application_error", errorCode: uint64(code), byRemote: &remote}
+	}
+	if code, remote, ok := r.TransportError(); ok {
+		c := connClose{reason: "local_transport_error", errorCode: uint64(code), byRemote: &remote}
+		if remote {
+			c.reason = "remote_transport_error"
+		}
+		if alert, description, ok := tlsAlertFromErrorCode(uint64(code)); ok {
+			c.tlsAlert = description
+			c.tlsAlertCode = alert
+		}
+		return c
+	}
+	if reason, ok := r.Timeout(); ok {
+		remote := false
+		if reason == logging.TimeoutReasonHandshake {
+			return connClose{reason: "handshake_timeout", byRemote: &remote}
+		}
+		return connClose{reason: "idle_timeout", byRemote: &remote}
+	}
+	if _, ok := r.StatelessReset(); ok {
+		remote := true
+		return connClose{reason: "stateless_reset", byRemote: &remote}
+	}
+	return connClose{reason: "unknown"}
+}
+
+type qlogIndexConnectionTracer struct {
+	info        *qlogConnInfo
+	perspective logging.Perspective
+	sample      func(local net.Addr) bool
+}
+
+var _ logging.ConnectionTracer = &qlogIndexConnectionTracer{}
+
+func (t *qlogIndexConnectionTracer) StartedConnection(local, remote net.Addr, _ logging.VersionNumber, _, _ logging.ConnectionID) {
+	t.info.localAddr = local
+	t.info.remoteAddr = remote
+	if t.perspective == logging.PerspectiveServer && t.sample != nil && !t.sample(local) {
+		atomic.StoreInt32(&t.info.discarded, 1)
+	}
+}
+
+func (t *qlogIndexConnectionTracer) ClosedConnection(r logging.CloseReason) {
+	t.info.close = classifyCloseReason(r)
+}
+
+func (t *qlogIndexConnectionTracer) SentTransportParameters(*logging.TransportParameters)     {}
+func (t *qlogIndexConnectionTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+func (t *qlogIndexConnectionTracer) SentPacket(*logging.ExtendedHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+}
+func (t *qlogIndexConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (t *qlogIndexConnectionTracer) ReceivedRetry(*logging.Header) {}
+func (t *qlogIndexConnectionTracer) ReceivedPacket(*logging.ExtendedHeader, logging.ByteCount, []logging.Frame) {
+}
+func (t *qlogIndexConnectionTracer) BufferedPacket(logging.PacketType) {}
+func (t *qlogIndexConnectionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (t *qlogIndexConnectionTracer) UpdatedMetrics(*logging.RTTStats, logging.ByteCount, logging.ByteCount, int) {
+}
+func (t *qlogIndexConnectionTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+}
+func (t *qlogIndexConnectionTracer) UpdatedCongestionState(logging.CongestionState)                 {}
+func (t *qlogIndexConnectionTracer) UpdatedPTOCount(uint32)                                         {}
+func (t *qlogIndexConnectionTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective) {}
+func (t *qlogIndexConnectionTracer) UpdatedKey(logging.KeyPhase, bool)                              {}
+func (t *qlogIndexConnectionTracer) DroppedEncryptionLevel(logging.EncryptionLevel)                 {}
+func (t *qlogIndexConnectionTracer) DroppedKey(logging.KeyPhase)                                    {}
+func (t *qlogIndexConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {
+}
+func (t *qlogIndexConnectionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {}
+func (t *qlogIndexConnectionTracer) LossTimerCanceled()                                          {}
+func (t *qlogIndexConnectionTracer) Close()                                                      {}
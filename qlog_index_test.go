@@ -0,0 +1,253 @@
+package libp2pquic
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("qlog index", func() {
+	var qlogDir string
+
+	BeforeEach(func() {
+		var err error
+		qlogDir, err = ioutil.TempDir("", "libp2p-quic-transport-test")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(qlogDir)).To(Succeed())
+	})
+
+	readIndex := func() []qlogIndexEntry {
+		f, err := os.Open(filepath.Join(qlogDir, qlogIndexFilename))
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		defer f.Close()
+		var entries []qlogIndexEntry
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e qlogIndexEntry
+			ExpectWithOffset(1, json.Unmarshal(scanner.Bytes(), &e)).To(Succeed())
+			entries = append(entries, e)
+		}
+		ExpectWithOffset(1, scanner.Err()).ToNot(HaveOccurred())
+		return entries
+	}
+
+	It("adds qlogs to the index when they are closed", func() {
+		start := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+		index := newQlogIndex(qlogDir, fakeClock{now: start})
+		connID := logging.ConnectionID{0xde, 0xad, 0xbe, 0xef}
+		t := index.TracerForConnection(logging.PerspectiveServer, connID)
+		t.StartedConnection(
+			&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+			&net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 4321},
+			0, nil, nil,
+		)
+		t.ClosedConnection(logging.CloseReason{})
+
+		end := start.Add(time.Minute)
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, connID, "", fakeClock{now: end})
+		logger.index = index
+		logger.info = index.connInfo(logging.PerspectiveServer, connID)
+		Expect(index.pending).To(BeEmpty())
+		logger.Write([]byte("foobar"))
+		Expect(logger.Close()).To(Succeed())
+
+		fi, err := os.Stat(logger.filename)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readIndex()).To(Equal([]qlogIndexEntry{{
+			Filename:    filepath.Base(logger.filename),
+			ODCID:       "deadbeef",
+			Perspective: "server",
+			StartTime:   start,
+			EndTime:     end,
+			DurationMs:  60000,
+			LocalAddr:   "127.0.0.1:1234",
+			RemoteAddr:  "192.168.0.1:4321",
+			Close:       "unknown",
+			Size:        fi.Size(),
+		}}))
+	})
+
+	It("doesn't report negative durations when the wall clock jumps", func() {
+		start := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+		index := newQlogIndex(qlogDir, fakeClock{now: start})
+		connID := logging.ConnectionID{0xde, 0xad, 0xbe, 0xef}
+		index.TracerForConnection(logging.PerspectiveServer, connID)
+		// The fake clock doesn't have a monotonic reading, so this looks like the wall clock being stepped back.
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, connID, "", fakeClock{now: start.Add(-time.Hour)})
+		logger.index = index
+		logger.info = index.connInfo(logging.PerspectiveServer, connID)
+		Expect(logger.Close()).To(Succeed())
+		entries := readIndex()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].DurationMs).To(BeZero())
+	})
+
+	It("classifies close reasons", func() {
+		yes, no := true, false
+		for _, tc := range []struct {
+			reason logging.CloseReason
+			close  connClose
+		}{
+			{logging.NewApplicationCloseReason(42, false), connClose{reason: "local_application_error", errorCode: 42, byRemote: &no}},
+			{logging.NewApplicationCloseReason(42, true), connClose{reason: "remote_application_error", errorCode: 42, byRemote: &yes}},
+			{logging.NewTransportCloseReason(0xa, false), connClose{reason: "local_transport_error", errorCode: 0xa, byRemote: &no}},
+			{logging.NewTransportCloseReason(0xa, true), connClose{reason: "remote_transport_error", errorCode: 0xa, byRemote: &yes}},
+			{logging.NewTransportCloseReason(0x100+46, false), connClose{reason: "local_transport_error", errorCode: 0x12e, byRemote: &no, tlsAlert: "certificate_unknown", tlsAlertCode: 46}},
+			{logging.NewTransportCloseReason(0x100+40, true), connClose{reason: "remote_transport_error", errorCode: 0x128, byRemote: &yes, tlsAlert: "handshake_failure", tlsAlertCode: 40}},
+			{logging.NewTimeoutCloseReason(logging.TimeoutReasonHandshake), connClose{reason: "handshake_timeout", byRemote: &no}},
+			{logging.NewTimeoutCloseReason(logging.TimeoutReasonIdle), connClose{reason: "idle_timeout", byRemote: &no}},
+			{logging.NewStatelessResetCloseReason(logging.StatelessResetToken{}), connClose{reason: "stateless_reset", byRemote: &yes}},
+			{logging.CloseReason{}, connClose{reason: "unknown"}},
+		} {
+			Expect(classifyCloseReason(tc.reason)).To(Equal(tc.close))
+		}
+	})
+
+	It("decodes TLS alerts", func() {
+		for code, description := range map[uint64]string{
+			0x100 + 40:  "handshake_failure",
+			0x100 + 42:  "bad_certificate",
+			0x100 + 46:  "certificate_unknown",
+			0x100 + 48:  "unknown_ca",
+			0x100 + 70:  "protocol_version",
+			0x100 + 80:  "internal_error",
+			0x100 + 120: "no_application_protocol",
+			0x100 + 255: "unknown",
+		} {
+			alert, d, ok := tlsAlertFromErrorCode(code)
+			Expect(ok).To(BeTrue())
+			Expect(alert).To(BeEquivalentTo(code - 0x100))
+			Expect(d).To(Equal(description))
+		}
+		_, _, ok := tlsAlertFromErrorCode(0xa)
+		Expect(ok).To(BeFalse())
+		_, _, ok = tlsAlertFromErrorCode(0x200)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("discards the qlogs of inbound connections that are not sampled", func() {
+		index := newQlogIndex(qlogDir, realClock{})
+		var sampled []net.Addr
+		index.sample = func(local net.Addr) bool {
+			sampled = append(sampled, local)
+			return false
+		}
+		local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+		remote := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 4321}
+		var stats qlogStats
+		var loggers []*qlogger
+		for _, p := range []logging.Perspective{logging.PerspectiveServer, logging.PerspectiveClient} {
+			connID := logging.ConnectionID{0xde, 0xad, 0xbe, 0xef}
+			index.TracerForConnection(p, connID).StartedConnection(local, remote, 0, nil, nil)
+			logger := newQlogger(&qlogConfig{dir: qlogDir}, p, connID, "", realClock{})
+			logger.index = index
+			logger.info = index.connInfo(p, connID)
+			logger.stats = &stats
+			logger.Write([]byte("foobar"))
+			Expect(logger.Close()).To(Succeed())
+			loggers = append(loggers, logger)
+		}
+		// only inbound connections are sampled
+		Expect(sampled).To(Equal([]net.Addr{local}))
+		Expect(stats.discarded).To(BeEquivalentTo(1))
+		Expect(stats.written).To(BeEquivalentTo(1))
+		files, err := ioutil.ReadDir(qlogDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(2)) // the client's qlog and the index
+		entries := readIndex()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Filename).To(Equal(filepath.Base(loggers[1].filename)))
+		Expect(entries[0].Perspective).To(Equal("client"))
+	})
+
+	It("only retains the qlogs of connections closed for the configured reasons", func() {
+		index := newQlogIndex(qlogDir, realClock{})
+		cfg := &qlogConfig{dir: qlogDir, retain: map[string]struct{}{"local_transport_error": {}}}
+		var stats qlogStats
+		var loggers []*qlogger
+		for i, reason := range []logging.CloseReason{
+			logging.NewTransportCloseReason(0xa, false),
+			logging.NewApplicationCloseReason(0, false),
+		} {
+			connID := logging.ConnectionID{byte(i)}
+			index.TracerForConnection(logging.PerspectiveClient, connID).ClosedConnection(reason)
+			logger := newQlogger(cfg, logging.PerspectiveClient, connID, "", realClock{})
+			logger.index = index
+			logger.info = index.connInfo(logging.PerspectiveClient, connID)
+			logger.stats = &stats
+			logger.Write([]byte("foobar"))
+			Expect(logger.Close()).To(Succeed())
+			loggers = append(loggers, logger)
+		}
+		Expect(stats.written).To(BeEquivalentTo(1))
+		Expect(stats.discarded).To(BeEquivalentTo(1))
+		_, err := os.Stat(loggers[0].filename)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = os.Stat(loggers[1].filename)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		entries := readIndex()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Close).To(Equal("local_transport_error"))
+	})
+
+	It("tags the entries", func() {
+		index := newQlogIndex(qlogDir, realClock{})
+		index.tags = map[string]string{"experiment": "cubic"}
+		connID := logging.ConnectionID{0xde, 0xad, 0xbe, 0xef}
+		index.TracerForConnection(logging.PerspectiveClient, connID)
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveClient, connID, "", realClock{})
+		logger.index = index
+		logger.info = index.connInfo(logging.PerspectiveClient, connID)
+		Expect(logger.Close()).To(Succeed())
+		entries := readIndex()
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Tags).To(Equal(map[string]string{"experiment": "cubic"}))
+	})
+
+	It("serializes concurrent writes", func() {
+		index := newQlogIndex(qlogDir, realClock{})
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(index.Add(&qlogIndexEntry{Filename: "foobar", Size: 42})).To(Succeed())
+			}()
+		}
+		wg.Wait()
+		Expect(readIndex()).To(HaveLen(50))
+	})
+
+	It("removes a torn last line", func() {
+		filename := filepath.Join(qlogDir, qlogIndexFilename)
+		Expect(ioutil.WriteFile(filename, []byte("{\"filename\":\"foo\",\"size\":1}\n{\"filename\":\"ba"), 0666)).To(Succeed())
+		index := newQlogIndex(qlogDir, realClock{})
+		Expect(index.Add(&qlogIndexEntry{Filename: "bar", Size: 2})).To(Succeed())
+		entries := readIndex()
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Filename).To(Equal("foo"))
+		Expect(entries[1].Filename).To(Equal("bar"))
+	})
+
+	It("removes a torn line when there's no complete line", func() {
+		filename := filepath.Join(qlogDir, qlogIndexFilename)
+		Expect(ioutil.WriteFile(filename, []byte("{\"filena"), 0666)).To(Succeed())
+		index := newQlogIndex(qlogDir, realClock{})
+		Expect(index.Add(&qlogIndexEntry{Filename: "bar", Size: 2})).To(Succeed())
+		Expect(readIndex()).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,86 @@
+package libp2pquic
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// QlogStatus is the status of the qlog subsystem of a transport.
+type QlogStatus struct {
+	// Enabled says if qlogs are written to disk or streamed (see WithQlogDir and WithQlogSocket).
+	Enabled bool
+	// Dir is the directory that qlogs are written to. It is empty if qlogs are not written to disk.
+	Dir string
+	// FreeBytes is the space available on the file system of Dir.
+	// It is -1 if unknown, e.g. on platforms other than Linux and macOS.
+	FreeBytes int64
+	// StreamClients is the number of clients connected to the qlog stream.
+	StreamClients int
+
+	// Written is the number of qlogs written to disk.
+	Written uint64
+	// Failed is the number of qlogs that couldn't be created or finalized.
+	Failed uint64
+	// Truncated is the number of qlogs that were truncated, because they reached the size limit.
+	// LastTruncation is the time the last qlog was truncated. It is zero if no qlog was truncated.
+	Truncated      uint64
+	LastTruncation time.Time
+	// Discarded is the number of qlogs that were discarded, because they were not sampled (see WithListenerQlogSampling),
+	// or because the connection was closed for a reason that qlogs are not kept for (see WithQlogRetention).
+	Discarded uint64
+
+	// Goroutines is the number of go routines run by the qlog subsystem, e.g. to serve the clients of the qlog stream.
+	// OpenFiles is the number of files it holds open: one per qlog being written, and the index.
+	// Both drop to 0 once the transport is shut down and all connections are closed.
+	// If they don't, go routines or file descriptors are leaked.
+	Goroutines int
+	OpenFiles  int
+}
+
+// A QlogStatusReporter reports the status of the qlog subsystem.
+// The transport returned by NewTransport implements this interface.
+type QlogStatusReporter interface {
+	QlogStatus() QlogStatus
+}
+
+var _ QlogStatusReporter = &transport{}
+
+// QlogStatus returns the status of the qlog subsystem.
+// Except for the free space of the qlog directory, which requires a system call,
+// all values are read without taking any locks.
+func (t *transport) QlogStatus() QlogStatus {
+	return t.qlog.Status()
+}
+
+// Status returns the status of the qlog tracer.
+func (t *qlogTracer) Status() QlogStatus {
+	if t == nil {
+		return QlogStatus{FreeBytes: -1}
+	}
+	s := QlogStatus{
+		Enabled:    true,
+		Dir:        t.dir,
+		FreeBytes:  -1,
+		Written:    atomic.LoadUint64(&t.stats.written),
+		Failed:     atomic.LoadUint64(&t.stats.failed),
+		Truncated:  atomic.LoadUint64(&t.stats.truncated),
+		Discarded:  atomic.LoadUint64(&t.stats.discarded),
+		Goroutines: t.resources.Goroutines(),
+		OpenFiles:  t.resources.OpenFiles(),
+	}
+	if last := atomic.LoadInt64(&t.stats.lastTruncation); last != 0 {
+		s.LastTruncation = time.Unix(0, last)
+	}
+	if t.streamer != nil {
+		s.StreamClients = t.streamer.numSubscribers()
+	}
+	if len(t.dir) > 0 {
+		free, err := freeDiskSpace(t.dir)
+		if err != nil {
+			log.Debugf("reading the free space of %s failed: %s", t.dir, err)
+		} else {
+			s.FreeBytes = free
+		}
+	}
+	return s
+}
@@ -0,0 +1,263 @@
+package libp2pquic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// qlogStreamBacklog is the number of qlog events buffered for a client of the qlog stream.
+// Clients that fall further behind are disconnected.
+const qlogStreamBacklog = 1024
+
+// qlogStreamSubscribeTimeout is the time a client has to send its subscription after connecting.
+const qlogStreamSubscribeTimeout = 5 * time.Second
+
+// qlogStreamer serves the qlog events of all connections over a unix domain socket.
+// A client connects, and sends a line containing either the (hex encoded) original destination connection ID
+// of the connection it is interested in, or "all" for all connections.
+// It then receives the qlog events as they are produced, one per line.
+type qlogStreamer struct {
+	ln        net.Listener
+	resources *resourceCounts
+
+	numClients int32 // accessed atomically
+
+	mutex   sync.Mutex
+	closed  bool
+	clients map[*qlogStreamClient]struct{}
+	// pending are the connections of clients that haven't sent their subscription yet
+	pending map[net.Conn]struct{}
+}
+
+type qlogStreamClient struct {
+	conn   net.Conn
+	connID string // empty when subscribed to all connections
+	events chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *qlogStreamClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// newQlogStreamer serves qlogs on the unix domain socket at path.
+// The go routines of the streamer are counted in resources, which may be nil.
+func newQlogStreamer(path string, resources *resourceCounts) (*qlogStreamer, error) {
+	// remove the socket left behind by a previous process
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &qlogStreamer{
+		ln:        ln,
+		resources: resources,
+		clients:   make(map[*qlogStreamClient]struct{}),
+		pending:   make(map[net.Conn]struct{}),
+	}
+	resources.Go(s.run)
+	return s, nil
+}
+
+func (s *qlogStreamer) run() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.pending[conn] = struct{}{}
+		s.mutex.Unlock()
+		s.resources.Go(func() { s.handleClient(conn) })
+	}
+}
+
+func (s *qlogStreamer) handleClient(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(qlogStreamSubscribeTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	s.mutex.Lock()
+	delete(s.pending, conn)
+	closed := s.closed
+	s.mutex.Unlock()
+	if err != nil || closed {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	connID := strings.ToLower(strings.TrimSpace(line))
+	if connID == "all" {
+		connID = ""
+	} else if _, err := hex.DecodeString(connID); err != nil || len(connID) == 0 {
+		conn.Write([]byte("invalid connection ID\n"))
+		conn.Close()
+		return
+	}
+
+	c := &qlogStreamClient{
+		conn:   conn,
+		connID: connID,
+		events: make(chan []byte, qlogStreamBacklog),
+		closed: make(chan struct{}),
+	}
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients[c] = struct{}{}
+	atomic.AddInt32(&s.numClients, 1)
+	s.mutex.Unlock()
+	defer s.removeClient(c)
+
+	// The client isn't expected to send anything else. Reading returns once it disconnects.
+	s.resources.Go(func() {
+		io.Copy(ioutil.Discard, r)
+		c.close()
+	})
+	for {
+		select {
+		case ev := <-c.events:
+			if _, err := conn.Write(ev); err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (s *qlogStreamer) removeClient(c *qlogStreamClient) {
+	c.close()
+	s.mutex.Lock()
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		atomic.AddInt32(&s.numClients, -1)
+	}
+	s.mutex.Unlock()
+}
+
+// hasClients says if any clients are connected.
+func (s *qlogStreamer) hasClients() bool {
+	return atomic.LoadInt32(&s.numClients) > 0
+}
+
+// numSubscribers returns the number of clients connected.
+func (s *qlogStreamer) numSubscribers() int {
+	return int(atomic.LoadInt32(&s.numClients))
+}
+
+// publish sends a qlog event to all clients subscribed to the connection.
+// Clients that can't keep up are disconnected.
+func (s *qlogStreamer) publish(connID string, event []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for c := range s.clients {
+		if c.connID != "" && c.connID != connID {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			log.Debugf("disconnecting slow qlog stream client")
+			delete(s.clients, c)
+			atomic.AddInt32(&s.numClients, -1)
+			c.close()
+		}
+	}
+}
+
+// Close stops serving qlog streams, and disconnects all clients,
+// including the ones that haven't sent their subscription yet.
+func (s *qlogStreamer) Close() error {
+	err := s.ln.Close()
+	s.mutex.Lock()
+	s.closed = true
+	for c := range s.clients {
+		c.close()
+	}
+	for conn := range s.pending {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	return err
+}
+
+// NewWriter returns a writer for the qlog of a connection.
+func (s *qlogStreamer) NewWriter(connID []byte) io.WriteCloser {
+	return &qlogStreamWriter{streamer: s, connID: hex.EncodeToString(connID)}
+}
+
+// qlogStreamWriter splits the qlog of a connection into events, and publishes them.
+type qlogStreamWriter struct {
+	streamer *qlogStreamer
+	connID   string
+	buf      []byte // the beginning of an incomplete event
+}
+
+func (w *qlogStreamWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	i := bytes.LastIndexByte(w.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	if w.streamer.hasClients() {
+		for _, line := range bytes.SplitAfter(w.buf[:i+1], []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			// w.buf is reused, so the event needs to be copied
+			w.streamer.publish(w.connID, append([]byte(nil), line...))
+		}
+	}
+	w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	return len(b), nil
+}
+
+func (w *qlogStreamWriter) Close() error {
+	if len(w.buf) > 0 && w.streamer.hasClients() {
+		w.streamer.publish(w.connID, append(w.buf, '\n'))
+	}
+	w.buf = nil
+	return nil
+}
+
+// teeWriteCloser writes to a WriteCloser, and to a second writer that never fails.
+type teeWriteCloser struct {
+	io.WriteCloser
+	tee io.WriteCloser
+}
+
+func (t *teeWriteCloser) Write(b []byte) (int, error) {
+	t.tee.Write(b)
+	return t.WriteCloser.Write(b)
+}
+
+func (t *teeWriteCloser) Close() error {
+	t.tee.Close()
+	return t.WriteCloser.Close()
+}
@@ -0,0 +1,138 @@
+package libp2pquic
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("qlog streaming", func() {
+	var (
+		dir      string
+		socket   string
+		streamer *qlogStreamer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "libp2p-quic-transport-test")
+		Expect(err).ToNot(HaveOccurred())
+		socket = filepath.Join(dir, "qlog.sock")
+		streamer, err = newQlogStreamer(socket, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(streamer.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	subscribe := func(connID string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("unix", socket)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		_, err = fmt.Fprintf(conn, "%s\n", connID)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return conn, bufio.NewReader(conn)
+	}
+
+	readLine := func(r *bufio.Reader) string {
+		line, err := r.ReadString('\n')
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return line
+	}
+
+	It("streams the events of a connection", func() {
+		conn, r := subscribe("deadbeef")
+		defer conn.Close()
+		Eventually(streamer.hasClients).Should(BeTrue())
+
+		w := streamer.NewWriter([]byte{0xde, 0xad, 0xbe, 0xef})
+		other := streamer.NewWriter([]byte{0xc0, 0xff, 0xee})
+		// events are only published once they are complete
+		_, err := w.Write([]byte(`{"name":"packet_sent"`))
+		Expect(err).ToNot(HaveOccurred())
+		other.Write([]byte("{\"name\":\"other\"}\n"))
+		w.Write([]byte("}\n{\"name\":\"packet_received\"}\n{\"name\":"))
+		Expect(w.Close()).To(Succeed())
+		Expect(readLine(r)).To(Equal("{\"name\":\"packet_sent\"}\n"))
+		Expect(readLine(r)).To(Equal("{\"name\":\"packet_received\"}\n"))
+		Expect(readLine(r)).To(Equal("{\"name\":\n"))
+	})
+
+	It("streams the events of all connections", func() {
+		conn, r := subscribe("all")
+		defer conn.Close()
+		Eventually(streamer.hasClients).Should(BeTrue())
+
+		streamer.NewWriter([]byte{1, 2, 3, 4}).Write([]byte("foo\n"))
+		streamer.NewWriter([]byte{5, 6, 7, 8}).Write([]byte("bar\n"))
+		Expect(readLine(r)).To(Equal("foo\n"))
+		Expect(readLine(r)).To(Equal("bar\n"))
+	})
+
+	It("rejects invalid connection IDs", func() {
+		conn, r := subscribe("foobar")
+		defer conn.Close()
+		Expect(readLine(r)).To(Equal("invalid connection ID\n"))
+		_, err := r.ReadByte()
+		Expect(err).To(HaveOccurred())
+		Expect(streamer.hasClients()).To(BeFalse())
+	})
+
+	It("removes clients that disconnect", func() {
+		conn, _ := subscribe("all")
+		Eventually(streamer.hasClients).Should(BeTrue())
+		Expect(conn.Close()).To(Succeed())
+		Eventually(streamer.hasClients).Should(BeFalse())
+	})
+
+	It("disconnects clients that don't keep up", func() {
+		slow, _ := subscribe("all")
+		defer slow.Close()
+		fast, r := subscribe("all")
+		defer fast.Close()
+		Eventually(func() int {
+			streamer.mutex.Lock()
+			defer streamer.mutex.Unlock()
+			return len(streamer.clients)
+		}).Should(Equal(2))
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			for i := 0; i < 100*qlogStreamBacklog; i++ {
+				Expect(readLine(r)).To(Equal(fmt.Sprintf("event %d\n", i)))
+			}
+		}()
+		w := streamer.NewWriter([]byte{1, 2, 3, 4})
+		// The slow client never reads. Once the socket buffer and the backlog are full, it is disconnected.
+		for i := 0; i < 100*qlogStreamBacklog; i++ {
+			fmt.Fprintf(w, "event %d\n", i)
+			// give the fast client a chance to keep up
+			if i%(qlogStreamBacklog/2) == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		Eventually(done).Should(BeClosed())
+		streamer.mutex.Lock()
+		Expect(streamer.clients).To(HaveLen(1))
+		streamer.mutex.Unlock()
+		slow.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := ioutil.ReadAll(slow)
+		Expect(err).ToNot(HaveOccurred()) // the connection was closed
+	})
+
+	It("doesn't publish events when no clients are connected", func() {
+		w := streamer.NewWriter([]byte{1, 2, 3, 4}).(*qlogStreamWriter)
+		w.Write([]byte("foo\nbar"))
+		Expect(w.buf).To(Equal([]byte("bar")))
+	})
+})
@@ -0,0 +1,109 @@
+package libp2pquic
+
+import (
+	"math"
+	"sort"
+)
+
+// p2Quantile estimates a quantile of a stream of observations in constant memory,
+// using the P² algorithm by Jain and Chlamtac.
+// See https://www.cse.wustl.edu/~jain/papers/ftp/psqr.pdf.
+type p2Quantile struct {
+	p float64
+	n int
+
+	heights   [5]float64 // marker heights
+	positions [5]float64 // actual marker positions
+	desired   [5]float64 // desired marker positions
+	increment [5]float64 // increments of the desired marker positions
+}
+
+func newP2Quantile(p float64) *p2Quantile {
+	return &p2Quantile{
+		p:         p,
+		increment: [5]float64{0, p / 2, p, (1 + p) / 2, 1},
+	}
+}
+
+// Add adds an observation.
+func (q *p2Quantile) Add(x float64) {
+	if q.n < 5 {
+		q.heights[q.n] = x
+		q.n++
+		if q.n == 5 {
+			sort.Float64s(q.heights[:])
+			q.positions = [5]float64{1, 2, 3, 4, 5}
+			q.desired = [5]float64{1, 1 + 2*q.p, 1 + 4*q.p, 3 + 2*q.p, 5}
+		}
+		return
+	}
+	q.n++
+
+	// find the cell k with heights[k] <= x < heights[k+1], adjusting the extreme markers if necessary
+	var k int
+	switch {
+	case x < q.heights[0]:
+		q.heights[0] = x
+		k = 0
+	case x >= q.heights[4]:
+		q.heights[4] = x
+		k = 3
+	default:
+		for k = 0; k < 3; k++ {
+			if x < q.heights[k+1] {
+				break
+			}
+		}
+	}
+	for i := k + 1; i < 5; i++ {
+		q.positions[i]++
+	}
+	for i := range q.desired {
+		q.desired[i] += q.increment[i]
+	}
+
+	// adjust the heights of the middle markers, if they're off their desired positions
+	for i := 1; i < 4; i++ {
+		d := q.desired[i] - q.positions[i]
+		if (d >= 1 && q.positions[i+1]-q.positions[i] > 1) || (d <= -1 && q.positions[i-1]-q.positions[i] < -1) {
+			s := math.Copysign(1, d)
+			h := q.parabolic(i, s)
+			if q.heights[i-1] < h && h < q.heights[i+1] {
+				q.heights[i] = h
+			} else {
+				q.heights[i] = q.linear(i, s)
+			}
+			q.positions[i] += s
+		}
+	}
+}
+
+func (q *p2Quantile) parabolic(i int, d float64) float64 {
+	return q.heights[i] + d/(q.positions[i+1]-q.positions[i-1])*
+		((q.positions[i]-q.positions[i-1]+d)*(q.heights[i+1]-q.heights[i])/(q.positions[i+1]-q.positions[i])+
+			(q.positions[i+1]-q.positions[i]-d)*(q.heights[i]-q.heights[i-1])/(q.positions[i]-q.positions[i-1]))
+}
+
+func (q *p2Quantile) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return q.heights[i] + d*(q.heights[j]-q.heights[i])/(q.positions[j]-q.positions[i])
+}
+
+// Quantile returns the estimate of the quantile.
+// For fewer than 5 observations, the exact value is returned.
+func (q *p2Quantile) Quantile() float64 {
+	if q.n == 0 {
+		return 0
+	}
+	if q.n < 5 {
+		heights := make([]float64, q.n)
+		copy(heights, q.heights[:q.n])
+		sort.Float64s(heights)
+		i := int(math.Ceil(q.p*float64(q.n))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return heights[i]
+	}
+	return q.heights[2]
+}
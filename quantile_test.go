@@ -0,0 +1,47 @@
+package libp2pquic
+
+import (
+	"math/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quantile Estimation", func() {
+	It("returns 0 without any observations", func() {
+		Expect(newP2Quantile(0.99).Quantile()).To(BeZero())
+	})
+
+	It("returns exact values for few observations", func() {
+		q := newP2Quantile(0.5)
+		for _, x := range []float64{7, 1, 5} {
+			q.Add(x)
+		}
+		Expect(q.Quantile()).To(Equal(5.0))
+		q.Add(3)
+		Expect(q.Quantile()).To(Equal(3.0))
+	})
+
+	It("estimates quantiles", func() {
+		for _, p := range []float64{0.5, 0.9, 0.99} {
+			q := newP2Quantile(p)
+			for _, i := range rand.Perm(10000) {
+				q.Add(float64(i))
+			}
+			Expect(q.Quantile()).To(BeNumerically("~", p*10000, 100))
+		}
+	})
+
+	It("estimates quantiles of skewed distributions", func() {
+		q := newP2Quantile(0.99)
+		// 99.5% of the observations are 0
+		for i := 0; i < 100000; i++ {
+			if i%200 == 0 {
+				q.Add(10)
+			} else {
+				q.Add(0)
+			}
+		}
+		Expect(q.Quantile()).To(BeNumerically("<", 1))
+	})
+})
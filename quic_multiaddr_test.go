@@ -27,4 +27,26 @@ var _ = Describe("QUIC Multiaddr", func() {
 		Expect(udpAddr.IP).To(Equal(net.IPv4(192, 168, 0, 42)))
 		Expect(udpAddr.Port).To(Equal(1337))
 	})
+
+	It("round-trips addresses", func() {
+		for _, tc := range []struct {
+			addr  *net.UDPAddr
+			maddr string
+		}{
+			{addr: &net.UDPAddr{IP: net.IPv4(192, 168, 0, 42), Port: 1337}, maddr: "/ip4/192.168.0.42/udp/1337/quic"},
+			{addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1337}, maddr: "/ip6/2001:db8::1/udp/1337/quic"},
+			{addr: &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1337, Zone: "eth0"}, maddr: "/ip6zone/eth0/ip6/fe80::1/udp/1337/quic"},
+		} {
+			maddr, err := toQuicMultiaddr(tc.addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(maddr.String()).To(Equal(tc.maddr))
+			addr, err := fromQuicMultiaddr(maddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addr).To(BeAssignableToTypeOf(&net.UDPAddr{}))
+			udpAddr := addr.(*net.UDPAddr)
+			Expect(udpAddr.IP.Equal(tc.addr.IP)).To(BeTrue())
+			Expect(udpAddr.Port).To(Equal(tc.addr.Port))
+			Expect(udpAddr.Zone).To(Equal(tc.addr.Zone))
+		}
+	})
 })
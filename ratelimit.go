@@ -0,0 +1,153 @@
+package libp2pquic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// RateLimitMode determines what happens to connection attempts that exceed the handshake rate limit
+// (see WithHandshakeRateLimit).
+type RateLimitMode uint8
+
+const (
+	// RateLimitRetry sends a Retry to clients that exceed the rate limit. This is the default.
+	// Clients that return with a valid token are not rate limited again.
+	RateLimitRetry RateLimitMode = iota
+	// RateLimitDrop silently drops the Initial packets of clients that exceed the rate limit,
+	// before they are passed to quic-go.
+	RateLimitDrop
+)
+
+func (m RateLimitMode) String() string {
+	switch m {
+	case RateLimitRetry:
+		return "retry"
+	case RateLimitDrop:
+		return "drop"
+	default:
+		return fmt.Sprintf("unknown rate limit mode: %d", uint8(m))
+	}
+}
+
+// minClientConnIDLen is the minimum length of the connection ID a client chooses for its first Initial.
+// quic-go uses shorter connection IDs by default, so packets sent to connection IDs of at least this length
+// are Initials that start a new connection (or retransmissions thereof).
+const minClientConnIDLen = 8
+
+// isNewConnectionInitial says if a packet is an Initial packet that starts a new connection.
+func isNewConnectionInitial(b []byte) bool {
+	// first byte, 4 bytes version, 1 byte connection ID length
+	if len(b) < 6 || b[0]&0x80 == 0 {
+		return false
+	}
+	// Version Negotiation packets have the version 0.
+	if binary.BigEndian.Uint32(b[1:5]) == 0 {
+		return false
+	}
+	// The long header packet type of Initials is 0.
+	if b[0]&0x30 != 0 {
+		return false
+	}
+	return int(b[5]) >= minClientConnIDLen
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a new token bucket. It starts full.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Allow takes a token from the bucket, if one is available.
+func (b *tokenBucket) Allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// handshakeRateLimiter limits the rate at which new handshakes are started.
+// All methods can be called on a nil handshakeRateLimiter, in which case nothing is rate limited.
+type handshakeRateLimiter struct {
+	// limited is the number of rate limited connection attempts.
+	// It needs to be the first field, to guarantee 64 bit alignment. Accessed atomically.
+	limited uint64
+
+	mode   RateLimitMode
+	bucket *tokenBucket
+	tracer logging.Tracer // may be nil
+}
+
+func newHandshakeRateLimiter(rate float64, burst int, mode RateLimitMode, tracer logging.Tracer) *handshakeRateLimiter {
+	return &handshakeRateLimiter{
+		mode:   mode,
+		bucket: newTokenBucket(rate, burst),
+		tracer: tracer,
+	}
+}
+
+// Drop says if a packet received from addr should be dropped, because it starts a new connection
+// while the rate limit is exceeded. Packets are only dropped in RateLimitDrop mode.
+func (l *handshakeRateLimiter) Drop(b []byte, addr net.Addr) bool {
+	if l == nil || l.mode != RateLimitDrop || !isNewConnectionInitial(b) {
+		return false
+	}
+	if l.bucket.Allow(time.Now()) {
+		return false
+	}
+	atomic.AddUint64(&l.limited, 1)
+	if l.tracer != nil {
+		l.tracer.DroppedPacket(addr, logging.PacketTypeInitial, logging.ByteCount(len(b)), logging.PacketDropDOSPrevention)
+	}
+	return true
+}
+
+// RetryRequired says if a client that didn't validate its address needs to be sent a Retry,
+// because the rate limit is exceeded. Retries are only required in RateLimitRetry mode.
+func (l *handshakeRateLimiter) RetryRequired() bool {
+	if l == nil || l.mode != RateLimitRetry {
+		return false
+	}
+	if l.bucket.Allow(time.Now()) {
+		return false
+	}
+	atomic.AddUint64(&l.limited, 1)
+	return true
+}
+
+// Limited returns the number of rate limited connection attempts.
+func (l *handshakeRateLimiter) Limited() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.limited)
+}
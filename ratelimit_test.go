@@ -0,0 +1,236 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// newInitial creates a packet that looks like the first Initial packet of a new connection.
+func newInitial(connIDLen int) []byte {
+	b := make([]byte, 1200)
+	b[0] = 0xc0                               // long header, Initial
+	b[1], b[2], b[3], b[4] = 0xff, 0, 0, 0x1d // draft-29
+	b[5] = byte(connIDLen)
+	rand.Read(b[6 : 6+connIDLen])
+	return b
+}
+
+type droppedPacketTracer struct {
+	logging.Tracer
+	dropped uint32
+}
+
+func (t *droppedPacketTracer) DroppedPacket(_ net.Addr, typ logging.PacketType, _ logging.ByteCount, reason logging.PacketDropReason) {
+	if typ == logging.PacketTypeInitial && reason == logging.PacketDropDOSPrevention {
+		atomic.AddUint32(&t.dropped, 1)
+	}
+}
+
+var _ = Describe("Handshake Rate Limiting", func() {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1337}
+
+	newTransport := func(opts ...Option) *transport {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil, opts...)
+		Expect(err).ToNot(HaveOccurred())
+		return tr.(*transport)
+	}
+
+	It("refills the token bucket", func() {
+		b := newTokenBucket(10, 2)
+		now := time.Now()
+		Expect(b.Allow(now)).To(BeTrue())
+		Expect(b.Allow(now)).To(BeTrue())
+		Expect(b.Allow(now)).To(BeFalse())
+		Expect(b.Allow(now.Add(50 * time.Millisecond))).To(BeFalse())
+		Expect(b.Allow(now.Add(100 * time.Millisecond))).To(BeTrue())
+		Expect(b.Allow(now.Add(100 * time.Millisecond))).To(BeFalse())
+		// the bucket never holds more than burst tokens
+		later := now.Add(time.Hour)
+		Expect(b.Allow(later)).To(BeTrue())
+		Expect(b.Allow(later)).To(BeTrue())
+		Expect(b.Allow(later)).To(BeFalse())
+	})
+
+	It("recognizes Initials that start new connections", func() {
+		Expect(isNewConnectionInitial(newInitial(8))).To(BeTrue())
+		Expect(isNewConnectionInitial(newInitial(20))).To(BeTrue())
+		// Initials sent to a connection ID chosen by quic-go
+		Expect(isNewConnectionInitial(newInitial(4))).To(BeFalse())
+		handshake := newInitial(8)
+		handshake[0] = 0xe0
+		Expect(isNewConnectionInitial(handshake)).To(BeFalse())
+		vn := newInitial(8)
+		vn[1], vn[2], vn[3], vn[4] = 0, 0, 0, 0
+		Expect(isNewConnectionInitial(vn)).To(BeFalse())
+		shortHeader := newInitial(8)
+		shortHeader[0] = 0x40
+		Expect(isNewConnectionInitial(shortHeader)).To(BeFalse())
+		Expect(isNewConnectionInitial([]byte{0xc0, 0xff})).To(BeFalse())
+	})
+
+	It("rejects invalid options", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = NewTransport(key, nil, nil, WithHandshakeRateLimit(0, 1))
+		Expect(err).To(MatchError("handshake rate must be positive"))
+		_, err = NewTransport(key, nil, nil, WithHandshakeRateLimit(1, 0))
+		Expect(err).To(MatchError("handshake burst must be positive"))
+		_, err = NewTransport(key, nil, nil, WithHandshakeRateLimitMode(42))
+		Expect(err).To(MatchError("invalid rate limit mode: 42"))
+		_, err = NewTransport(key, nil, nil,
+			WithHandshakeRateLimit(1, 1),
+			WithHandshakeRateLimitMode(RateLimitDrop),
+			WithQUICConfig(func(c *quic.Config) *quic.Config {
+				c.ConnectionIDLength = 8
+				return c
+			}),
+		)
+		Expect(err).To(MatchError("dropping rate limited Initials requires connection IDs shorter than 8 bytes"))
+	})
+
+	It("doesn't rate limit by default", func() {
+		t := newTransport()
+		Expect(t.limiter).To(BeNil())
+		for i := 0; i < 100; i++ {
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+		}
+		Expect(t.Stats().RateLimitedHandshakes).To(BeZero())
+	})
+
+	Context("sending Retries", func() {
+		It("sends Retries when the rate limit is exceeded", func() {
+			t := newTransport(WithHandshakeRateLimit(0.001, 2))
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+			stats := t.Stats()
+			Expect(stats.RateLimitedHandshakes).To(BeEquivalentTo(1))
+			Expect(stats.RetriesSent).To(BeEquivalentTo(1))
+		})
+
+		It("doesn't rate limit clients that validated their address", func() {
+			t := newTransport(WithHandshakeRateLimit(0.001, 1))
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+			retryToken := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+			Expect(t.serverConfig.AcceptToken(clientAddr, retryToken)).To(BeTrue())
+			token := &quic.Token{RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+			Expect(t.serverConfig.AcceptToken(clientAddr, token)).To(BeTrue())
+			Expect(t.Stats().RateLimitedHandshakes).To(BeZero())
+		})
+
+		It("doesn't close connections that presented an invalid Retry token", func() {
+			t := newTransport(WithHandshakeRateLimit(0.001, 1))
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+			// a Retry token issued for a different address
+			retryToken := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.2", SentTime: time.Now()}
+			Expect(t.serverConfig.AcceptToken(clientAddr, retryToken)).To(BeTrue())
+			Expect(t.Stats().RateLimitedHandshakes).To(BeZero())
+		})
+
+		It("doesn't use up the rate limit when validating addresses anyway", func() {
+			t := newTransport(WithHandshakeRateLimit(0.001, 1), WithRetryMode(RetryAdaptive), WithAdaptiveRetryThreshold(2))
+			for i := 0; i < 3; i++ {
+				addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, byte(i)), Port: 1337}
+				t.handshakes.Started(addr)
+			}
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+			stats := t.Stats()
+			Expect(stats.RetriesSent).To(BeEquivalentTo(2))
+			Expect(stats.RateLimitedHandshakes).To(BeZero())
+		})
+
+		It("establishes connections when the rate limit is exceeded", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithHandshakeRateLimit(0.001, 1))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			for i := 0; i < 2; i++ {
+				clientTransport := newTransport()
+				conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+				Expect(err).ToNot(HaveOccurred())
+				defer conn.Close()
+				serverConn, err := ln.Accept()
+				Expect(err).ToNot(HaveOccurred())
+				defer serverConn.Close()
+			}
+			stats := serverTransport.(StatsReporter).Stats()
+			Expect(stats.RateLimitedHandshakes).To(BeEquivalentTo(1))
+			Expect(stats.RetriesSent).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("dropping packets", func() {
+		It("drops Initials when the rate limit is exceeded", func() {
+			tracer := &droppedPacketTracer{}
+			l := newHandshakeRateLimiter(0.001, 1, RateLimitDrop, tracer)
+			Expect(l.Drop(newInitial(8), clientAddr)).To(BeFalse())
+			Expect(l.Drop(newInitial(8), clientAddr)).To(BeTrue())
+			// packets belonging to existing connections are never dropped
+			Expect(l.Drop(newInitial(4), clientAddr)).To(BeFalse())
+			Expect(l.Limited()).To(BeEquivalentTo(1))
+			Expect(tracer.dropped).To(BeEquivalentTo(1))
+			// in Retry mode, the rate limiter doesn't drop packets
+			Expect(l.RetryRequired()).To(BeFalse())
+		})
+
+		It("bounds the number of handshakes under an Initial flood", func() {
+			const burst = 10
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil,
+				WithHandshakeRateLimit(0.001, burst),
+				WithHandshakeRateLimitMode(RateLimitDrop),
+			)
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+			stats := serverTransport.(StatsReporter).Stats
+
+			const numInitials = 200
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			for i := 0; i < numInitials; i++ {
+				_, err := conn.WriteTo(newInitial(8), ln.Addr())
+				Expect(err).ToNot(HaveOccurred())
+			}
+			// Only burst Initials make it to quic-go. All others are dropped
+			// before any cryptographic operations are performed.
+			Eventually(func() uint64 { return stats().RateLimitedHandshakes }).Should(BeEquivalentTo(numInitials - burst))
+			Consistently(func() uint64 { return stats().RateLimitedHandshakes }).Should(BeEquivalentTo(numInitials - burst))
+		})
+	})
+})
+
+func BenchmarkHandshakeRateLimiter(b *testing.B) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1234}
+	l := newHandshakeRateLimiter(100, 100, RateLimitDrop, nil)
+	initial := newInitial(8)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Drop(initial, addr)
+	}
+}
@@ -0,0 +1,162 @@
+package libp2pquic
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	errTransportClosed = errors.New("transport closed")
+	errTooManyConns    = errors.New("too many connections to peer")
+)
+
+// simultaneousOpenWindow is the time after an outbound connection was established during which
+// an inbound connection from the same peer is considered to be the result of a simultaneous open.
+const simultaneousOpenWindow = 5 * time.Second
+
+// connRegistry keeps track of the listeners and the open connections of a transport.
+type connRegistry struct {
+	mutex     sync.Mutex
+	closed    bool
+	conns     map[*conn]time.Time // the time the connection was added
+	perPeer   map[peer.ID]int
+	listeners map[*listener]struct{}
+}
+
+// addConn adds a connection to the registry, until the underlying session is closed.
+// If maxPerPeer is positive, connections are refused once there are maxPerPeer connections to the peer.
+// When both peers dial each other at the same time, each of them sees an outbound and an inbound connection.
+// To make sure that both peers keep the same connection, the connection dialed by the peer with the
+// smaller peer ID wins: an inbound connection from such a peer replaces one of our outbound connections
+// that was established within the simultaneousOpenWindow. It is returned and needs to be closed by the caller.
+func (r *connRegistry) addConn(c *conn, maxPerPeer int) (replaced *conn, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errTransportClosed
+	}
+	if maxPerPeer > 0 && r.perPeer[c.remotePeerID] >= maxPerPeer {
+		if c.direction != network.DirInbound || c.remotePeerID >= c.localPeer {
+			return nil, errTooManyConns
+		}
+		replaced = r.simultaneousOutboundConnLocked(c.remotePeerID, time.Now())
+		if replaced == nil {
+			return nil, errTooManyConns
+		}
+		r.removeConnLocked(replaced)
+	}
+	if r.conns == nil {
+		r.conns = make(map[*conn]time.Time)
+		r.perPeer = make(map[peer.ID]int)
+	}
+	r.conns[c] = time.Now()
+	r.perPeer[c.remotePeerID]++
+	go func() {
+		<-c.sess.Context().Done()
+		r.mutex.Lock()
+		r.removeConnLocked(c)
+		r.mutex.Unlock()
+	}()
+	return replaced, nil
+}
+
+// simultaneousOutboundConnLocked returns an outbound connection to the peer that was established
+// within the simultaneousOpenWindow, or nil if there is none.
+// Older connections are in use already, and are never replaced.
+func (r *connRegistry) simultaneousOutboundConnLocked(p peer.ID, now time.Time) *conn {
+	for c, added := range r.conns {
+		if c.remotePeerID == p && c.direction == network.DirOutbound && now.Sub(added) < simultaneousOpenWindow {
+			return c
+		}
+	}
+	return nil
+}
+
+// removeConnLocked removes a connection from the registry. It is a no-op if the connection was already removed.
+func (r *connRegistry) removeConnLocked(c *conn) {
+	if _, ok := r.conns[c]; !ok {
+		return
+	}
+	delete(r.conns, c)
+	if r.perPeer[c.remotePeerID] <= 1 {
+		delete(r.perPeer, c.remotePeerID)
+	} else {
+		r.perPeer[c.remotePeerID]--
+	}
+}
+
+// addListener adds a listener to the registry.
+// It returns false if the transport was already shut down.
+func (r *connRegistry) addListener(l *listener) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return false
+	}
+	if r.listeners == nil {
+		r.listeners = make(map[*listener]struct{})
+	}
+	r.listeners[l] = struct{}{}
+	return true
+}
+
+func (r *connRegistry) removeListener(l *listener) {
+	r.mutex.Lock()
+	delete(r.listeners, l)
+	r.mutex.Unlock()
+}
+
+// listenerFor returns the listener listening on the local address, or nil if there is none.
+func (r *connRegistry) listenerFor(local net.Addr) *listener {
+	addr := local.String()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for l := range r.listeners {
+		if l.Addr().String() == addr {
+			return l
+		}
+	}
+	return nil
+}
+
+// listenerStats returns the statistics of all listeners, keyed by their multiaddr.
+func (r *connRegistry) listenerStats() map[string]ListenerStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stats := make(map[string]ListenerStats, len(r.listeners))
+	for l := range r.listeners {
+		stats[l.localMultiaddr.String()] = l.Stats()
+	}
+	return stats
+}
+
+// numConns returns the number of open connections.
+func (r *connRegistry) numConns() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.conns)
+}
+
+// connections returns the open connections.
+func (r *connRegistry) connections() []*conn {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	conns := make([]*conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (r *connRegistry) isClosed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.closed
+}
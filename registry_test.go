@@ -0,0 +1,48 @@
+package libp2pquic
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection registry", func() {
+	It("only replaces outbound connections established during the simultaneous open window", func() {
+		// the remote peer has the smaller peer ID, so its connection wins a simultaneous open
+		localPeer, remotePeer := peer.ID("peer B"), peer.ID("peer A")
+		var sessions []*stuckSession
+		defer func() {
+			for _, sess := range sessions {
+				sess.cancel()
+			}
+		}()
+		newConn := func(dir network.Direction) *conn {
+			sess := newStuckSession()
+			sessions = append(sessions, sess)
+			return &conn{sess: sess, localPeer: localPeer, remotePeerID: remotePeer, direction: dir}
+		}
+		r := &connRegistry{}
+		outbound := newConn(network.DirOutbound)
+		_, err := r.addConn(outbound, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		r.mutex.Lock()
+		r.conns[outbound] = time.Now().Add(-simultaneousOpenWindow)
+		r.mutex.Unlock()
+		_, err = r.addConn(newConn(network.DirInbound), 1)
+		Expect(err).To(MatchError(errTooManyConns))
+
+		r.mutex.Lock()
+		r.conns[outbound] = time.Now()
+		r.mutex.Unlock()
+		inbound := newConn(network.DirInbound)
+		replaced, err := r.addConn(inbound, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replaced).To(Equal(outbound))
+		Expect(r.connections()).To(Equal([]*conn{inbound}))
+	})
+})
@@ -0,0 +1,40 @@
+package libp2pquic
+
+import "sync/atomic"
+
+// resourceCounts counts the go routines and the open files of the qlog subsystem.
+// Every go routine started and every file opened by the qlog tracer, the qlog index and the qlog stream
+// is counted here, so that leaks show up in the QlogStatus.
+// All fields are accessed atomically. A nil *resourceCounts doesn't count anything.
+type resourceCounts struct {
+	goroutines int64
+	files      int64
+}
+
+// Go runs f on a new go routine, and counts the go routine until f returns.
+func (r *resourceCounts) Go(f func()) {
+	if r == nil {
+		go f()
+		return
+	}
+	atomic.AddInt64(&r.goroutines, 1)
+	go func() {
+		defer atomic.AddInt64(&r.goroutines, -1)
+		f()
+	}()
+}
+
+func (r *resourceCounts) OpenedFile() {
+	if r != nil {
+		atomic.AddInt64(&r.files, 1)
+	}
+}
+
+func (r *resourceCounts) ClosedFile() {
+	if r != nil {
+		atomic.AddInt64(&r.files, -1)
+	}
+}
+
+func (r *resourceCounts) Goroutines() int { return int(atomic.LoadInt64(&r.goroutines)) }
+func (r *resourceCounts) OpenFiles() int  { return int(atomic.LoadInt64(&r.files)) }
@@ -0,0 +1,364 @@
+package libp2pquic
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// RetryMode determines when the transport validates the address of a client
+// by sending a Retry, before it starts the handshake.
+type RetryMode uint8
+
+const (
+	// RetryNever never sends a Retry. This is the default.
+	RetryNever RetryMode = iota
+	// RetryAlways sends a Retry to every client that doesn't present a valid token.
+	RetryAlways
+	// RetryAdaptive only sends Retries while the number of handshakes in progress
+	// exceeds a threshold (see WithAdaptiveRetryThreshold).
+	RetryAdaptive
+)
+
+func (m RetryMode) String() string {
+	switch m {
+	case RetryNever:
+		return "never"
+	case RetryAlways:
+		return "always"
+	case RetryAdaptive:
+		return "adaptive"
+	default:
+		return fmt.Sprintf("unknown retry mode: %d", uint8(m))
+	}
+}
+
+const defaultAdaptiveRetryThreshold = 100
+
+// The validity periods quic-go uses for the tokens it issues.
+const (
+	retryTokenValidity = 10 * time.Second
+	tokenValidity      = 24 * time.Hour
+)
+
+// The token store holds the tokens received in NEW_TOKEN frames for up to defaultTokenStoreSize servers,
+// and up to tokensPerOrigin tokens per server. Tokens can only be used once.
+const (
+	defaultTokenStoreSize = 256
+	tokensPerOrigin       = 4
+)
+
+// maxTrackedHandshakes limits the memory used for tracking handshakes in progress.
+const maxTrackedHandshakes = 10000
+
+// The handshake failure rate is calculated over the handshakes that finished
+// in the current and the previous window.
+const handshakeFailureRateWindow = time.Minute
+
+// acceptToken is used as the AcceptToken callback of the quic.Config used for listening.
+// It is called for every new connection attempt, before the handshake is started.
+func (t *transport) acceptToken(clientAddr net.Addr, token *quic.Token) bool {
+	decision := t.decideAccept()
+	if decision == AcceptDecisionRefuse {
+		atomic.AddUint64(&t.stats.refusedHandshakes, 1)
+		return false
+	}
+	if !isValidToken(clientAddr, token) {
+		if decision == AcceptDecisionRetry || t.requireAddressValidation() {
+			// If a Retry token was presented, quic-go closes the connection instead of sending a Retry.
+			if token == nil || !token.IsRetryToken {
+				atomic.AddUint64(&t.stats.retriesSent, 1)
+			}
+			return false
+		}
+		// Only consult the rate limiter if no Retry was sent to this client yet.
+		// Otherwise, a client returning with a Retry token would have its connection closed.
+		// The rate limiter is not consulted if a Retry is sent anyway (see above),
+		// so that address validation doesn't use up the rate limit.
+		if (token == nil || !token.IsRetryToken) && t.limiter.RetryRequired() {
+			atomic.AddUint64(&t.stats.retriesSent, 1)
+			return false
+		}
+	}
+	// The concurrent handshake limit applies to all clients, even if they validated their address.
+	if !t.handshakes.TryStart(clientAddr, t.maxConcurrentHandshakes) {
+		atomic.AddUint64(&t.stats.concurrencyLimitedHandshakes, 1)
+		// If a Retry token was presented, quic-go refuses the connection instead of sending a Retry.
+		if token == nil || !token.IsRetryToken {
+			atomic.AddUint64(&t.stats.retriesSent, 1)
+		}
+		return false
+	}
+	return true
+}
+
+func (t *transport) requireAddressValidation() bool {
+	switch t.retryMode {
+	case RetryAlways:
+		return true
+	case RetryAdaptive:
+		return t.handshakes.UnderLoad(t.adaptiveRetryThreshold)
+	default:
+		return false
+	}
+}
+
+// isValidToken checks if a token was issued for the client's address, and if it is still valid.
+func isValidToken(clientAddr net.Addr, token *quic.Token) bool {
+	if token == nil {
+		return false
+	}
+	validity := tokenValidity
+	if token.IsRetryToken {
+		validity = retryTokenValidity
+	}
+	if time.Now().After(token.SentTime.Add(validity)) {
+		return false
+	}
+	sourceAddr := clientAddr.String()
+	if udpAddr, ok := clientAddr.(*net.UDPAddr); ok {
+		sourceAddr = udpAddr.IP.String()
+	}
+	return sourceAddr == token.RemoteAddr
+}
+
+// handshakeTracker keeps track of the handshakes that are currently in progress.
+// quic-go only hands us connections that completed the handshake.
+// Handshakes are considered failed when the stats tracer sees the connection being closed before the
+// handshake completed (see Failed). Without the stats tracer (see DisableMetrics), and for connections
+// that are never closed, handshakes that didn't complete within the handshake timeout are considered failed.
+type handshakeTracker struct {
+	timeout time.Duration
+
+	mutex sync.Mutex
+	// started holds the handshakes in progress, keyed by the client's address, oldest first.
+	// Several clients behind the same NAT might use the same address, one after another.
+	started    map[string][]trackedHandshake
+	numStarted int
+	// deferred holds the time that clients were first sent a Retry because the concurrent handshake limit
+	// was reached, keyed by the client's address. Entries are removed once the handshake is started,
+	// or once the Retry token expired.
+	deferred   map[string]time.Time
+	lastPruned time.Time
+	underLoad  bool
+
+	windowStart       time.Time
+	current, previous handshakeOutcomes
+	// totals counts all handshakes that finished
+	totals handshakeOutcomes
+}
+
+type trackedHandshake struct {
+	start time.Time
+	// admissionDelay is the time the handshake was delayed by the concurrent handshake limit
+	admissionDelay time.Duration
+}
+
+// handshakeOutcomes counts the handshakes that finished.
+type handshakeOutcomes struct {
+	completed, failed int
+}
+
+func newHandshakeTracker(timeout time.Duration) *handshakeTracker {
+	return &handshakeTracker{
+		timeout:  timeout,
+		started:  make(map[string][]trackedHandshake),
+		deferred: make(map[string]time.Time),
+	}
+}
+
+// Started records that a handshake with a client was started.
+func (h *handshakeTracker) Started(addr net.Addr) {
+	h.TryStart(addr, 0)
+}
+
+// TryStart records that a handshake with a client was started, unless limit handshakes are already in progress.
+// A limit of 0 means that the number of handshakes is not limited.
+// If the handshake is not started, the client is expected to be sent a Retry, and the time it is delayed by
+// is reported once the handshake completes.
+func (h *handshakeTracker) TryStart(addr net.Addr, limit int) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	h.maybePruneLocked(now)
+	key := addr.String()
+	if limit > 0 && h.numStarted >= limit {
+		if _, ok := h.deferred[key]; !ok && len(h.deferred) < maxTrackedHandshakes {
+			h.deferred[key] = now
+		}
+		return false
+	}
+	if h.numStarted >= maxTrackedHandshakes {
+		return true
+	}
+	hs := trackedHandshake{start: now}
+	if deferred, ok := h.deferred[key]; ok {
+		hs.admissionDelay = now.Sub(deferred)
+		delete(h.deferred, key)
+	}
+	h.started[key] = append(h.started[key], hs)
+	h.numStarted++
+	return true
+}
+
+// Completed records that the handshake with a client completed.
+// It returns the time the handshake was delayed by the concurrent handshake limit.
+func (h *handshakeTracker) Completed(addr net.Addr) time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	hs, ok := h.removeLocked(addr.String())
+	if !ok {
+		return 0
+	}
+	h.rotateLocked(time.Now())
+	h.current.completed++
+	h.totals.completed++
+	return hs.admissionDelay
+}
+
+// Failed records that the handshake with a client failed, and frees its slot.
+// It is a no-op if no handshake with the client is in progress.
+func (h *handshakeTracker) Failed(addr net.Addr) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.removeLocked(addr.String()); !ok {
+		return
+	}
+	h.rotateLocked(time.Now())
+	h.current.failed++
+	h.totals.failed++
+}
+
+// removeLocked removes the oldest handshake in progress with a client.
+// Since all handshakes with the same address look the same to us, the oldest one is assumed to have finished.
+func (h *handshakeTracker) removeLocked(key string) (trackedHandshake, bool) {
+	started := h.started[key]
+	if len(started) == 0 {
+		return trackedHandshake{}, false
+	}
+	hs := started[0]
+	if len(started) == 1 {
+		delete(h.started, key)
+	} else {
+		h.started[key] = started[1:]
+	}
+	h.numStarted--
+	return hs, true
+}
+
+// InProgress returns the number of handshakes that are currently in progress.
+func (h *handshakeTracker) InProgress() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.maybePruneLocked(time.Now())
+	return h.numStarted
+}
+
+// UnderLoad says if the number of handshakes in progress exceeds the threshold.
+// To avoid flapping, the load is only considered to have decreased once the number
+// of handshakes in progress drops below half the threshold.
+func (h *handshakeTracker) UnderLoad(threshold int) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.maybePruneLocked(time.Now())
+	if h.underLoad {
+		h.underLoad = h.numStarted >= threshold/2
+	} else {
+		h.underLoad = h.numStarted > threshold
+	}
+	return h.underLoad
+}
+
+// FailureRate returns the fraction of the recently finished handshakes that failed.
+// It returns 0 if no handshakes finished recently.
+func (h *handshakeTracker) FailureRate() float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	h.maybePruneLocked(now)
+	h.rotateLocked(now)
+	failed := h.current.failed + h.previous.failed
+	total := failed + h.current.completed + h.previous.completed
+	if total == 0 {
+		return 0
+	}
+	return float64(failed) / float64(total)
+}
+
+// rotateLocked starts a new failure rate window, if the current window has ended.
+func (h *handshakeTracker) rotateLocked(now time.Time) {
+	switch elapsed := now.Sub(h.windowStart); {
+	case elapsed >= 2*handshakeFailureRateWindow:
+		h.previous = handshakeOutcomes{}
+		h.current = handshakeOutcomes{}
+		h.windowStart = now
+	case elapsed >= handshakeFailureRateWindow:
+		h.previous = h.current
+		h.current = handshakeOutcomes{}
+		h.windowStart = now
+	}
+}
+
+// IsUnderLoad returns the result of the last call to UnderLoad.
+func (h *handshakeTracker) IsUnderLoad() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.underLoad
+}
+
+// maybePruneLocked removes handshakes that timed out, and counts them as failed.
+// Deferred clients are forgotten once the Retry token they were sent expired.
+// To keep the cost of tracking handshakes low, it prunes at most 10 times per handshake timeout.
+func (h *handshakeTracker) maybePruneLocked(now time.Time) {
+	if now.Sub(h.lastPruned) < h.timeout/10 {
+		return
+	}
+	h.lastPruned = now
+	var failed int
+	for addr, started := range h.started {
+		// handshakes are sorted by start time
+		var n int
+		for n < len(started) && now.Sub(started[n].start) > h.timeout {
+			n++
+		}
+		switch n {
+		case 0:
+			continue
+		case len(started):
+			delete(h.started, addr)
+		default:
+			h.started[addr] = started[n:]
+		}
+		h.numStarted -= n
+		failed += n
+	}
+	for addr, deferred := range h.deferred {
+		if now.Sub(deferred) > retryTokenValidity {
+			delete(h.deferred, addr)
+		}
+	}
+	if failed > 0 {
+		h.rotateLocked(now)
+		h.current.failed += failed
+		h.totals.failed += failed
+	}
+}
+
+// Totals returns the number of all handshakes that completed and failed.
+func (h *handshakeTracker) Totals() handshakeOutcomes {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.maybePruneLocked(time.Now())
+	return h.totals
+}
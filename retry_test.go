@@ -0,0 +1,340 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	quic "github.com/lucas-clemente/quic-go"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type countingTokenStore struct {
+	quic.TokenStore
+	puts int32
+}
+
+func (s *countingTokenStore) Put(key string, token *quic.ClientToken) {
+	atomic.AddInt32(&s.puts, 1)
+	s.TokenStore.Put(key, token)
+}
+
+var _ = Describe("Retry", func() {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1337}
+
+	newTransport := func(opts ...Option) *transport {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil, opts...)
+		Expect(err).ToNot(HaveOccurred())
+		return tr.(*transport)
+	}
+
+	Context("validating tokens", func() {
+		It("rejects missing tokens", func() {
+			Expect(isValidToken(clientAddr, nil)).To(BeFalse())
+		})
+
+		It("accepts tokens issued for the client's IP address", func() {
+			token := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+			Expect(isValidToken(clientAddr, token)).To(BeTrue())
+		})
+
+		It("rejects tokens issued for a different IP address", func() {
+			token := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.2", SentTime: time.Now()}
+			Expect(isValidToken(clientAddr, token)).To(BeFalse())
+		})
+
+		It("rejects expired Retry tokens", func() {
+			token := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now().Add(-time.Minute)}
+			Expect(isValidToken(clientAddr, token)).To(BeFalse())
+			// tokens sent in NEW_TOKEN frames are valid for much longer
+			token.IsRetryToken = false
+			Expect(isValidToken(clientAddr, token)).To(BeTrue())
+		})
+	})
+
+	Context("retry modes", func() {
+		It("never sends Retries by default", func() {
+			t := newTransport()
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeTrue())
+			stats := t.Stats()
+			Expect(stats.RetryMode).To(Equal(RetryNever))
+			Expect(stats.ValidatingAddresses).To(BeFalse())
+			Expect(stats.RetriesSent).To(BeZero())
+			Expect(stats.HandshakesInProgress).To(Equal(1))
+		})
+
+		It("always sends Retries", func() {
+			t := newTransport(WithRetryMode(RetryAlways))
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+			token := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+			Expect(t.serverConfig.AcceptToken(clientAddr, token)).To(BeTrue())
+			stats := t.Stats()
+			Expect(stats.RetryMode).To(Equal(RetryAlways))
+			Expect(stats.ValidatingAddresses).To(BeTrue())
+			Expect(stats.RetriesSent).To(BeEquivalentTo(1))
+			Expect(stats.HandshakesInProgress).To(Equal(1))
+		})
+
+		It("sends Retries when under load", func() {
+			t := newTransport(WithRetryMode(RetryAdaptive), WithAdaptiveRetryThreshold(4))
+			for i := 0; i < 5; i++ {
+				addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, byte(i)), Port: 1337}
+				Expect(t.serverConfig.AcceptToken(addr, nil)).To(BeTrue())
+			}
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+			Expect(t.Stats().ValidatingAddresses).To(BeTrue())
+			Expect(t.Stats().RetriesSent).To(BeEquivalentTo(1))
+		})
+
+		It("rejects invalid retry modes", func() {
+			key, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewTransport(key, nil, nil, WithRetryMode(42))
+			Expect(err).To(MatchError("invalid retry mode: 42"))
+			_, err = NewTransport(key, nil, nil, WithAdaptiveRetryThreshold(0))
+			Expect(err).To(MatchError("adaptive retry threshold must be positive"))
+		})
+
+		It("establishes connections when sending Retries", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithRetryMode(RetryAlways))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			clientTransport := newTransport()
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			stats := serverTransport.(*transport).Stats()
+			Expect(stats.RetriesSent).To(BeEquivalentTo(1))
+			Expect(stats.HandshakesInProgress).To(BeZero())
+		})
+	})
+
+	Context("limiting concurrent handshakes", func() {
+		It("sends Retries when the limit is reached", func() {
+			t := newTransport(WithMaxConcurrentHandshakes(2))
+			for i := 0; i < 2; i++ {
+				addr := &net.UDPAddr{IP: net.IPv4(192, 168, 0, byte(10+i)), Port: 1337}
+				Expect(t.serverConfig.AcceptToken(addr, nil)).To(BeTrue())
+			}
+			Expect(t.serverConfig.AcceptToken(clientAddr, nil)).To(BeFalse())
+			// the limit also applies to clients that validated their address
+			token := &quic.Token{IsRetryToken: true, RemoteAddr: "192.168.0.1", SentTime: time.Now()}
+			Expect(t.serverConfig.AcceptToken(clientAddr, token)).To(BeFalse())
+			stats := t.Stats()
+			Expect(stats.HandshakesInProgress).To(Equal(2))
+			Expect(stats.ConcurrencyLimitedHandshakes).To(BeEquivalentTo(2))
+			Expect(stats.RetriesSent).To(BeEquivalentTo(1))
+		})
+
+		It("reports how long a handshake was delayed", func() {
+			h := newHandshakeTracker(time.Hour)
+			other := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 1337}
+			Expect(h.TryStart(other, 1)).To(BeTrue())
+			Expect(h.TryStart(clientAddr, 1)).To(BeFalse())
+			time.Sleep(10 * time.Millisecond)
+			Expect(h.TryStart(clientAddr, 1)).To(BeFalse())
+			Expect(h.Completed(other)).To(BeZero())
+			Expect(h.TryStart(clientAddr, 1)).To(BeTrue())
+			// the delay is measured from the first attempt
+			Expect(h.Completed(clientAddr)).To(BeNumerically(">=", 10*time.Millisecond))
+		})
+
+		It("admits clients once a handshake completed", func() {
+			serverTransport := newTransport(WithMaxConcurrentHandshakes(1))
+			serverID := serverTransport.localPeer
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			// a handshake that never completes
+			serverTransport.handshakes.Started(clientAddr)
+			clientTransport := newTransport()
+			_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).To(HaveOccurred())
+			Expect(serverTransport.Stats().ConcurrencyLimitedHandshakes).To(BeEquivalentTo(2))
+
+			serverTransport.handshakes.Completed(clientAddr)
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			Expect(serverConn.(ConnectionStatsReporter).Stats().AdmissionDelay).To(BeNumerically(">", 0))
+		})
+
+		It("frees the slot of a failed handshake right away", func() {
+			serverTransport := newTransport(WithMaxConcurrentHandshakes(1))
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			// The client aborts the handshake, since the server's peer ID doesn't match.
+			clientTransport := newTransport()
+			_, err = clientTransport.Dial(context.Background(), ln.Multiaddr(), newTransport().localPeer)
+			Expect(err).To(HaveOccurred())
+			// The handshake timeout is 10s, so the slot is freed by the closed connection.
+			Eventually(serverTransport.handshakes.InProgress).Should(BeZero())
+			Expect(serverTransport.handshakes.Totals().failed).To(Equal(1))
+
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverTransport.localPeer)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+		})
+
+		It("rejects invalid limits", func() {
+			key, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewTransport(key, nil, nil, WithMaxConcurrentHandshakes(0))
+			Expect(err).To(MatchError("concurrent handshake limit must be positive"))
+		})
+	})
+
+	Context("storing tokens", func() {
+		It("uses a token store by default", func() {
+			t := newTransport()
+			Expect(t.clientConfig.TokenStore).ToNot(BeNil())
+			Expect(t.serverConfig.TokenStore).To(BeNil())
+		})
+
+		It("disables the token store", func() {
+			Expect(newTransport(DisableTokenStore()).clientConfig.TokenStore).To(BeNil())
+		})
+
+		It("rejects invalid token store sizes", func() {
+			key, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = NewTransport(key, nil, nil, WithTokenStoreSize(0))
+			Expect(err).To(MatchError("token store size must be positive"))
+		})
+
+		It("skips the Retry when dialing again", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithRetryMode(RetryAlways))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			clientTransport := newTransport()
+			tokenStore := &countingTokenStore{TokenStore: clientTransport.clientConfig.TokenStore}
+			clientTransport.clientConfig.TokenStore = tokenStore
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			stats := serverTransport.(*transport).Stats()
+			Expect(stats.RetriesSent).To(BeEquivalentTo(1))
+			Expect(stats.RetriesSentTotal).To(BeEquivalentTo(1))
+			Expect(stats.StatelessPackets).To(Equal(map[string]StatelessPacketCounts{"127.0.0.0/24": {Retry: 1}}))
+			// wait for the NEW_TOKEN frame
+			Eventually(func() int32 { return atomic.LoadInt32(&tokenStore.puts) }).ShouldNot(BeZero())
+
+			conn2, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn2.Close()
+			serverConn2, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn2.Close()
+			Expect(serverTransport.(*transport).Stats().RetriesSent).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("tracking handshakes", func() {
+		It("tracks handshakes", func() {
+			h := newHandshakeTracker(time.Hour)
+			addr1 := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1337}
+			addr2 := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 1337}
+			h.Started(addr1)
+			h.Started(addr2)
+			Expect(h.InProgress()).To(Equal(2))
+			h.Completed(addr1)
+			Expect(h.InProgress()).To(Equal(1))
+		})
+
+		It("tracks multiple handshakes from the same address", func() {
+			h := newHandshakeTracker(time.Hour)
+			h.Started(clientAddr)
+			h.Started(clientAddr)
+			Expect(h.InProgress()).To(Equal(2))
+			Expect(h.TryStart(clientAddr, 2)).To(BeFalse())
+			h.Completed(clientAddr)
+			Expect(h.InProgress()).To(Equal(1))
+			h.Failed(clientAddr)
+			Expect(h.InProgress()).To(BeZero())
+			Expect(h.Totals()).To(Equal(handshakeOutcomes{completed: 1, failed: 1}))
+		})
+
+		It("considers handshakes failed after the handshake timeout", func() {
+			h := newHandshakeTracker(50 * time.Millisecond)
+			h.Started(clientAddr)
+			Expect(h.InProgress()).To(Equal(1))
+			Eventually(h.InProgress).Should(BeZero())
+		})
+
+		It("frees the slot of failed handshakes", func() {
+			h := newHandshakeTracker(time.Hour)
+			h.Started(clientAddr)
+			h.Failed(clientAddr)
+			Expect(h.InProgress()).To(BeZero())
+			Expect(h.FailureRate()).To(Equal(1.0))
+			// handshakes that weren't tracked don't count
+			h.Failed(clientAddr)
+			Expect(h.Totals().failed).To(Equal(1))
+		})
+
+		It("calculates the failure rate", func() {
+			h := newHandshakeTracker(50 * time.Millisecond)
+			Expect(h.FailureRate()).To(BeZero())
+			addr1 := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 1337}
+			addr2 := &net.UDPAddr{IP: net.IPv4(192, 168, 0, 2), Port: 1337}
+			h.Started(addr1)
+			h.Started(addr2)
+			h.Completed(addr1)
+			// handshakes that weren't tracked don't count
+			h.Completed(clientAddr)
+			Expect(h.FailureRate()).To(BeZero())
+			Eventually(h.FailureRate).Should(Equal(0.5))
+		})
+
+		It("uses hysteresis when determining the load", func() {
+			h := newHandshakeTracker(time.Hour)
+			for i := 0; i < 11; i++ {
+				Expect(h.UnderLoad(10)).To(BeFalse())
+				h.Started(&net.UDPAddr{IP: net.IPv4(192, 168, 0, byte(i)), Port: 1337})
+			}
+			Expect(h.UnderLoad(10)).To(BeTrue())
+			// drop to 5 handshakes in progress
+			for i := 0; i < 6; i++ {
+				h.Completed(&net.UDPAddr{IP: net.IPv4(192, 168, 0, byte(i)), Port: 1337})
+				Expect(h.UnderLoad(10)).To(BeTrue())
+			}
+			h.Completed(&net.UDPAddr{IP: net.IPv4(192, 168, 0, 6), Port: 1337})
+			Expect(h.UnderLoad(10)).To(BeFalse())
+		})
+	})
+})
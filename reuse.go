@@ -10,7 +10,7 @@ import (
 	"github.com/libp2p/go-netroute"
 )
 
-// Constant. Defined as variables to simplify testing.
+// Default values. Defined as variables to simplify testing.
 var (
 	garbageCollectInterval = 30 * time.Second
 	maxUnusedDuration      = 10 * time.Second
@@ -19,6 +19,19 @@ var (
 type reuseConn struct {
 	*net.UDPConn
 
+	// listening is set if this connection was created by Listen.
+	// It is set before the connection is added to the reuse, and never changed afterwards.
+	listening bool
+	// filter drops packets from denied prefixes. It may be nil.
+	filter *packetFilter
+	// limiter drops Initial packets exceeding the handshake rate limit. It may be nil.
+	limiter *handshakeRateLimiter
+	// connIDs classifies the packets that quic-go can't route to a connection. It may be nil.
+	connIDs *connIDTable
+	// packetConn is the net.PacketConn passed to quic-go.
+	// It is either the reuseConn itself, or the reuseConn wrapped by the packet conn wrapper.
+	packetConn net.PacketConn
+
 	mutex       sync.Mutex
 	refCount    int
 	unusedSince time.Time
@@ -28,6 +41,40 @@ func newReuseConn(conn *net.UDPConn, gater connmgr.ConnectionGater) *reuseConn {
 	return &reuseConn{UDPConn: conn}
 }
 
+func (c *reuseConn) quicConn() net.PacketConn { return c.packetConn }
+func (c *reuseConn) listeningSocket() bool    { return c.listening }
+func (c *reuseConn) closeSocket()             { c.packetConn.Close() }
+
+// ReadFrom reads the next packet that is not dropped by the filter or the rate limiter.
+func (c *reuseConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFrom(b)
+		if err != nil || !c.drop(b[:n], addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// ReadMsgUDP reads the next packet that is not dropped by the filter or the rate limiter.
+// quic-go uses this method instead of ReadFrom if it's available.
+func (c *reuseConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	for {
+		n, oobn, flags, addr, err = c.UDPConn.ReadMsgUDP(b, oob)
+		if err != nil || !c.drop(b[:n], addr) {
+			return
+		}
+	}
+}
+
+// drop says if a packet should be dropped before it is passed to quic-go.
+func (c *reuseConn) drop(b []byte, addr net.Addr) bool {
+	if c.filter.Denied(addr) || c.limiter.Drop(b, addr) {
+		return true
+	}
+	c.connIDs.Classify(b)
+	return false
+}
+
 func (c *reuseConn) IncreaseCount() {
 	c.mutex.Lock()
 	c.refCount++
@@ -44,16 +91,31 @@ func (c *reuseConn) DecreaseCount() {
 	c.mutex.Unlock()
 }
 
-func (c *reuseConn) ShouldGarbageCollect(now time.Time) bool {
+func (c *reuseConn) ShouldGarbageCollect(now time.Time, maxUnused time.Duration) bool {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	return !c.unusedSince.IsZero() && c.unusedSince.Add(maxUnusedDuration).Before(now)
+	return !c.unusedSince.IsZero() && c.unusedSince.Add(maxUnused).Before(now)
 }
 
 type reuse struct {
 	mutex sync.Mutex
 
 	gater connmgr.ConnectionGater
+	// configureConn is called for every UDP socket that is created. It may be nil.
+	configureConn func(*net.UDPConn)
+	// filter is used for all connections. It may be nil.
+	filter *packetFilter
+	// limiter is used for all connections. It may be nil.
+	limiter *handshakeRateLimiter
+	// connIDs is used for all connections. It may be nil.
+	connIDs *connIDTable
+	// wrapConn is applied once to every connection, before it is passed to quic-go. It may be nil.
+	wrapConn func(net.PacketConn) net.PacketConn
+
+	// Connections that haven't been used for maxUnusedDuration are closed.
+	// The garbage collector checks for such connections every garbageCollectInterval.
+	garbageCollectInterval time.Duration
+	maxUnusedDuration      time.Duration
 
 	garbageCollectorRunning bool
 
@@ -64,29 +126,43 @@ type reuse struct {
 
 func newReuse(gater connmgr.ConnectionGater) *reuse {
 	return &reuse{
-		gater:   gater,
-		unicast: make(map[string]map[int]*reuseConn),
-		global:  make(map[int]*reuseConn),
+		gater:                  gater,
+		garbageCollectInterval: garbageCollectInterval,
+		maxUnusedDuration:      maxUnusedDuration,
+		unicast:                make(map[string]map[int]*reuseConn),
+		global:                 make(map[int]*reuseConn),
 	}
 }
 
+func (r *reuse) newReuseConn(conn *net.UDPConn) *reuseConn {
+	rconn := newReuseConn(conn, r.gater)
+	rconn.filter = r.filter
+	rconn.limiter = r.limiter
+	rconn.connIDs = r.connIDs
+	rconn.packetConn = rconn
+	if r.wrapConn != nil {
+		rconn.packetConn = r.wrapConn(rconn)
+	}
+	return rconn
+}
+
 func (r *reuse) runGarbageCollector() {
-	ticker := time.NewTicker(garbageCollectInterval)
+	ticker := time.NewTicker(r.garbageCollectInterval)
 	defer ticker.Stop()
 
 	for now := range ticker.C {
 		var shouldExit bool
 		r.mutex.Lock()
 		for key, conn := range r.global {
-			if conn.ShouldGarbageCollect(now) {
-				conn.Close()
+			if conn.ShouldGarbageCollect(now, r.maxUnusedDuration) {
+				conn.closeSocket()
 				delete(r.global, key)
 			}
 		}
 		for ukey, conns := range r.unicast {
 			for key, conn := range conns {
-				if conn.ShouldGarbageCollect(now) {
-					conn.Close()
+				if conn.ShouldGarbageCollect(now, r.maxUnusedDuration) {
+					conn.closeSocket()
 					delete(conns, key)
 				}
 			}
@@ -115,6 +191,27 @@ func (r *reuse) maybeStartGarbageCollector() {
 		go r.runGarbageCollector()
 	}
 }
+
+// Sockets returns the number of sockets that are available for reuse, keyed by local IP address.
+// Sockets listening on 0.0.0.0 or :: are reported under the unspecified address.
+func (r *reuse) Sockets() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	sockets := make(map[string]int, len(r.unicast)+1)
+	for _, conn := range r.global {
+		sockets[conn.LocalAddr().(*net.UDPAddr).IP.String()]++
+	}
+	for ip, conns := range r.unicast {
+		sockets[ip] += len(conns)
+	}
+	return sockets
+}
+
+// Dial returns a connection that can be used to dial raddr.
+// The connection's reference count is increased before the mutex is released,
+// so it can't be garbage collected while the dial is in progress.
+// The caller must call DecreaseCount when it's done using the connection.
 func (r *reuse) Dial(network string, raddr *net.UDPAddr) (*reuseConn, error) {
 	var ip *net.IP
 	if router, err := netroute.New(); err == nil {
@@ -149,8 +246,16 @@ func (r *reuse) dialLocked(network string, raddr *net.UDPAddr, source *net.IP) (
 
 	// Use a connection listening on 0.0.0.0 (or ::).
 	// Again, we don't care about the port number.
+	// Prefer connections we're listening on, so that the port we dial from matches the port we advertise.
+	var dialConn *reuseConn
 	for _, conn := range r.global {
-		return conn, nil
+		if conn.listening {
+			return conn, nil
+		}
+		dialConn = conn
+	}
+	if dialConn != nil {
+		return dialConn, nil
 	}
 
 	// We don't have a connection that we can use for dialing.
@@ -166,7 +271,10 @@ func (r *reuse) dialLocked(network string, raddr *net.UDPAddr, source *net.IP) (
 	if err != nil {
 		return nil, err
 	}
-	rconn := newReuseConn(conn, r.gater)
+	if r.configureConn != nil {
+		r.configureConn(conn)
+	}
+	rconn := r.newReuseConn(conn)
 	r.global[conn.LocalAddr().(*net.UDPAddr).Port] = rconn
 	return rconn, nil
 }
@@ -176,9 +284,13 @@ func (r *reuse) Listen(network string, laddr *net.UDPAddr) (*reuseConn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if r.configureConn != nil {
+		r.configureConn(conn)
+	}
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
 
-	rconn := newReuseConn(conn, r.gater)
+	rconn := r.newReuseConn(conn)
+	rconn.listening = true
 	rconn.IncreaseCount()
 
 	r.mutex.Lock()
@@ -67,6 +67,23 @@ var _ = Describe("Reuse", func() {
 			Expect(conn.GetCount()).To(Equal(1))
 		})
 
+		It("doesn't reuse ephemeral sockets", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lconn.listeningSocket()).To(BeTrue())
+			conn, err := reuse.DialEphemeral("udp4")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.listeningSocket()).To(BeFalse())
+			Expect(conn.LocalAddr().(*net.UDPAddr).Port).ToNot(Equal(lconn.LocalAddr().(*net.UDPAddr).Port))
+			Expect(reuse.global).To(HaveLen(1))
+			// the socket is closed when the connection is closed
+			conn.DecreaseCount()
+			_, err = conn.WriteTo([]byte("foobar"), lconn.LocalAddr())
+			Expect(err).To(HaveOccurred())
+		})
+
 		It("creates a new global connection when dialing", func() {
 			addr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
 			Expect(err).ToNot(HaveOccurred())
@@ -93,6 +110,58 @@ var _ = Describe("Reuse", func() {
 			Expect(conn.GetCount()).To(Equal(2))
 		})
 
+		It("prefers a connection it created for listening over one it created for dialing", func() {
+			raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			dconn, err := reuse.Dial("udp4", raddr)
+			Expect(err).ToNot(HaveOccurred())
+			// listen
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 10; i++ {
+				conn, err := reuse.Dial("udp4", raddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(conn).To(BeIdenticalTo(lconn))
+			}
+			Expect(dconn.GetCount()).To(Equal(1))
+			Expect(lconn.GetCount()).To(Equal(11))
+		})
+
+		It("keeps a listening connection open while it's used for dialing", func() {
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.Dial("udp4", raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn).To(BeIdenticalTo(lconn))
+			// close the listener
+			lconn.DecreaseCount()
+			Expect(conn.GetCount()).To(Equal(1))
+			Consistently(func() bool { return conn.ShouldGarbageCollect(time.Now(), reuse.maxUnusedDuration) }).Should(BeFalse())
+			_, err = conn.WriteTo([]byte("foobar"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("reports the number of sockets", func() {
+			Expect(reuse.Sockets()).To(BeEmpty())
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			addr, err = net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reuse.Sockets()).To(Equal(map[string]int{"0.0.0.0": 1, "127.0.0.1": 2}))
+		})
+
 		OnPlatformsWithRoutingTablesIt("reuses a connection it created for listening on a specific interface", func() {
 			router, err := netroute.New()
 			Expect(err).ToNot(HaveOccurred())
@@ -122,7 +191,7 @@ var _ = Describe("Reuse", func() {
 		}
 
 		BeforeEach(func() {
-			maxUnusedDuration = 100 * time.Millisecond
+			reuse.maxUnusedDuration = 100 * time.Millisecond
 		})
 
 		It("garbage collects connections once they're not used any more for a certain time", func() {
@@ -137,7 +206,7 @@ var _ = Describe("Reuse", func() {
 
 			for {
 				num := numGlobals()
-				if closeTime.Add(maxUnusedDuration).Before(time.Now()) {
+				if closeTime.Add(reuse.maxUnusedDuration).Before(time.Now()) {
 					break
 				}
 				Expect(num).To(Equal(1))
@@ -146,6 +215,20 @@ var _ = Describe("Reuse", func() {
 			Eventually(numGlobals).Should(BeZero())
 		})
 
+		It("closes garbage collected connections through the packet conn wrapper", func() {
+			closed := make(chan struct{})
+			reuse.wrapConn = func(c net.PacketConn) net.PacketConn {
+				return &closeNotifyingPacketConn{PacketConn: c, closed: closed}
+			}
+			addr, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
+			Expect(err).ToNot(HaveOccurred())
+			lconn, err := reuse.Listen("udp4", addr)
+			Expect(err).ToNot(HaveOccurred())
+			lconn.DecreaseCount()
+			Eventually(closed).Should(BeClosed())
+			Eventually(numGlobals).Should(BeZero())
+		})
+
 		It("only stops the garbage collector when there are no more connections", func() {
 			addr1, err := net.ResolveUDPAddr("udp4", "0.0.0.0:0")
 			Expect(err).ToNot(HaveOccurred())
@@ -159,9 +242,36 @@ var _ = Describe("Reuse", func() {
 
 			Eventually(isGarbageCollectorRunning).Should(BeTrue())
 			conn1.DecreaseCount()
-			Consistently(isGarbageCollectorRunning, 2*maxUnusedDuration).Should(BeTrue())
+			Consistently(isGarbageCollectorRunning, 2*reuse.maxUnusedDuration).Should(BeTrue())
 			conn2.DecreaseCount()
-			Eventually(isGarbageCollectorRunning, 2*maxUnusedDuration).Should(BeFalse())
+			Eventually(isGarbageCollectorRunning, 2*reuse.maxUnusedDuration).Should(BeFalse())
+		})
+
+		It("doesn't garbage collect connections that are used for dialing", func() {
+			raddr, err := net.ResolveUDPAddr("udp4", "1.1.1.1:1234")
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := reuse.Dial("udp4", raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Consistently(numGlobals, 3*reuse.maxUnusedDuration).Should(Equal(1))
+			// a second dial picks the same connection
+			conn2, err := reuse.Dial("udp4", raddr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn2).To(BeIdenticalTo(conn))
+			conn.DecreaseCount()
+			Consistently(numGlobals, 3*reuse.maxUnusedDuration).Should(Equal(1))
+			conn2.DecreaseCount()
+			Eventually(numGlobals).Should(BeZero())
 		})
 	})
 })
+
+// closeNotifyingPacketConn closes the closed channel when it is closed.
+type closeNotifyingPacketConn struct {
+	net.PacketConn
+	closed chan struct{}
+}
+
+func (c *closeNotifyingPacketConn) Close() error {
+	close(c.closed)
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,131 @@
+package libp2pquic
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// An RTTMeasurement is an update of the RTT estimate of a connection.
+type RTTMeasurement struct {
+	// Time is the time the RTT estimate was updated.
+	Time time.Time
+	// LatestRTT is the RTT sample that caused the update.
+	LatestRTT   time.Duration
+	SmoothedRTT time.Duration
+	MinRTT      time.Duration
+}
+
+// An RTTSubscriber delivers the RTT updates of a connection.
+// The connections of the transport returned by NewTransport implement this interface.
+type RTTSubscriber interface {
+	// SubscribeRTT subscribes to the RTT updates of the connection.
+	// The channel holds up to buffer updates. If the subscriber doesn't keep up, the oldest updates are dropped.
+	// The channel is closed when the connection is closed, or when the returned function is called.
+	SubscribeRTT(buffer int) (<-chan RTTMeasurement, func())
+}
+
+var _ RTTSubscriber = &conn{}
+
+// SubscribeRTT subscribes to the RTT updates of the connection.
+func (c *conn) SubscribeRTT(buffer int) (<-chan RTTMeasurement, func()) {
+	if c.stats == nil {
+		ch := make(chan RTTMeasurement)
+		close(ch)
+		return ch, func() {}
+	}
+	return c.stats.rttSubscriptions.Subscribe(buffer)
+}
+
+// rttSubscriptions are the subscriptions to the RTT updates of a connection.
+type rttSubscriptions struct {
+	num int32 // accessed atomically, so that publishing is cheap if there are no subscribers
+
+	mutex  sync.Mutex
+	subs   map[chan RTTMeasurement]struct{}
+	closed bool
+
+	// the last RTTs published, only accessed from the connection's run loop
+	latest, smoothed time.Duration
+}
+
+func (s *rttSubscriptions) Subscribe(buffer int) (<-chan RTTMeasurement, func()) {
+	if buffer < 1 {
+		buffer = 1
+	}
+	ch := make(chan RTTMeasurement, buffer)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.subs == nil {
+		s.subs = make(map[chan RTTMeasurement]struct{})
+	}
+	s.subs[ch] = struct{}{}
+	atomic.AddInt32(&s.num, 1)
+	return ch, func() { s.unsubscribe(ch) }
+}
+
+func (s *rttSubscriptions) unsubscribe(ch chan RTTMeasurement) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.subs[ch]; !ok {
+		return
+	}
+	delete(s.subs, ch)
+	atomic.AddInt32(&s.num, -1)
+	close(ch)
+}
+
+// Publish sends an RTT update to all subscribers.
+// quic-go reports the RTT estimate with every metrics update. Only changes of the estimate are published.
+func (s *rttSubscriptions) Publish(clock clock, rttStats *logging.RTTStats) {
+	if atomic.LoadInt32(&s.num) == 0 {
+		return
+	}
+	latest, smoothed := rttStats.LatestRTT(), rttStats.SmoothedRTT()
+	if latest == s.latest && smoothed == s.smoothed {
+		return
+	}
+	s.latest, s.smoothed = latest, smoothed
+	m := RTTMeasurement{
+		Time:        clock.Now(),
+		LatestRTT:   latest,
+		SmoothedRTT: smoothed,
+		MinRTT:      rttStats.MinRTT(),
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for ch := range s.subs {
+		for {
+			select {
+			case ch <- m:
+			default:
+				// drop the oldest update, and try again
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Close closes all subscriptions. Later subscriptions are closed immediately.
+func (s *rttSubscriptions) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for ch := range s.subs {
+		close(ch)
+	}
+	s.subs = nil
+	atomic.StoreInt32(&s.num, 0)
+}
@@ -0,0 +1,87 @@
+package libp2pquic
+
+import (
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RTT Subscriptions", func() {
+	var (
+		subs     *rttSubscriptions
+		rttStats *logging.RTTStats
+		clk      *fakeClock
+	)
+
+	BeforeEach(func() {
+		subs = &rttSubscriptions{}
+		rttStats = &logging.RTTStats{}
+		clk = &fakeClock{now: time.Unix(1612345678, 0)}
+	})
+
+	update := func(rtt time.Duration) {
+		rttStats.UpdateRTT(rtt, 0, clk.now)
+		subs.Publish(clk, rttStats)
+	}
+
+	It("delivers RTT updates", func() {
+		ch, unsubscribe := subs.Subscribe(10)
+		defer unsubscribe()
+		update(10 * time.Millisecond)
+		clk.now = clk.now.Add(time.Second)
+		update(20 * time.Millisecond)
+		var m RTTMeasurement
+		Expect(ch).To(Receive(&m))
+		Expect(m.LatestRTT).To(Equal(10 * time.Millisecond))
+		Expect(m.MinRTT).To(Equal(10 * time.Millisecond))
+		Expect(ch).To(Receive(&m))
+		Expect(m.Time).To(Equal(clk.now))
+		Expect(m.LatestRTT).To(Equal(20 * time.Millisecond))
+		Expect(m.MinRTT).To(Equal(10 * time.Millisecond))
+		Expect(m.SmoothedRTT).To(And(BeNumerically(">", 10*time.Millisecond), BeNumerically("<", 20*time.Millisecond)))
+	})
+
+	It("only publishes changes of the RTT estimate", func() {
+		ch, unsubscribe := subs.Subscribe(10)
+		defer unsubscribe()
+		update(10 * time.Millisecond)
+		subs.Publish(clk, rttStats)
+		Expect(ch).To(HaveLen(1))
+	})
+
+	It("drops the oldest updates if the subscriber is slow", func() {
+		ch, unsubscribe := subs.Subscribe(2)
+		defer unsubscribe()
+		for i := 1; i <= 5; i++ {
+			update(time.Duration(i) * time.Millisecond)
+		}
+		var m RTTMeasurement
+		Expect(ch).To(Receive(&m))
+		Expect(m.LatestRTT).To(Equal(4 * time.Millisecond))
+		Expect(ch).To(Receive(&m))
+		Expect(m.LatestRTT).To(Equal(5 * time.Millisecond))
+	})
+
+	It("closes the channel when unsubscribing", func() {
+		ch, unsubscribe := subs.Subscribe(10)
+		unsubscribe()
+		Expect(ch).To(BeClosed())
+		// unsubscribing twice is fine
+		unsubscribe()
+		update(10 * time.Millisecond)
+	})
+
+	It("closes the channels when the connection is closed", func() {
+		ch1, unsubscribe := subs.Subscribe(10)
+		ch2, _ := subs.Subscribe(10)
+		subs.Close()
+		Expect(ch1).To(BeClosed())
+		Expect(ch2).To(BeClosed())
+		unsubscribe()
+		ch3, _ := subs.Subscribe(10)
+		Expect(ch3).To(BeClosed())
+	})
+})
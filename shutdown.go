@@ -0,0 +1,78 @@
+package libp2pquic
+
+import (
+	"context"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// A Shutdowner can be shut down gracefully.
+type Shutdowner interface {
+	// Shutdown closes all listeners and closes all connections with the shutdown error code.
+	// It waits until the connections are closed or the context is done, whichever happens first.
+	// If the context is done first, the sockets of the remaining connections are closed, which destroys
+	// the connections without notifying the peers, and the context's error is returned.
+	// A packet conn passed to WithPacketConn is never closed.
+	// Afterwards, dialing and listening fail, and qlogs are not streamed or added to the qlog index any more.
+	// The handshake failure watchdog is stopped (see WithHandshakeFailureAlert).
+	Shutdown(context.Context) error
+}
+
+var _ Shutdowner = &transport{}
+
+// Shutdown gracefully shuts down the transport.
+func (t *transport) Shutdown(ctx context.Context) error {
+	t.conns.mutex.Lock()
+	t.conns.closed = true
+	listeners := make([]*listener, 0, len(t.conns.listeners))
+	for l := range t.conns.listeners {
+		listeners = append(listeners, l)
+	}
+	conns := make([]*conn, 0, len(t.conns.conns))
+	for c := range t.conns.conns {
+		conns = append(conns, c)
+	}
+	t.conns.mutex.Unlock()
+	t.watchdog.Close()
+	// The qlogs of the connections are finalized when the connections are closed,
+	// so the qlog tracer is closed last.
+	defer t.qlog.Close()
+
+	code := quic.ErrorCode(t.shutdownErrorCode)
+	// Closing a quic-go listener closes all its sessions without an error code.
+	// The connections (including the ones that haven't been accepted yet) are therefore closed first,
+	// and the listeners are only closed once the connections are.
+	for _, c := range conns {
+		go c.sess.CloseWithError(code, "shutting down")
+	}
+	for _, c := range conns {
+		select {
+		case <-c.sess.Context().Done():
+		case <-ctx.Done():
+			forceClose(conns)
+			for _, l := range listeners {
+				go l.closeWithError(code, "shutting down")
+			}
+			return ctx.Err()
+		}
+	}
+	for _, l := range listeners {
+		l.closeWithError(code, "shutting down")
+	}
+	return nil
+}
+
+// forceClose closes the sockets of the connections that are not closed yet.
+func forceClose(conns []*conn) {
+	closed := make(map[transportConn]struct{})
+	for _, c := range conns {
+		if c.socket == nil || c.IsClosed() {
+			continue
+		}
+		if _, ok := closed[c.socket]; ok {
+			continue
+		}
+		closed[c.socket] = struct{}{}
+		c.socket.closeSocket()
+	}
+}
@@ -0,0 +1,141 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	quic "github.com/lucas-clemente/quic-go"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// A session that doesn't finish closing until unblock is closed.
+type stuckSession struct {
+	quic.Session
+	ctx     context.Context
+	cancel  context.CancelFunc
+	unblock chan struct{}
+}
+
+func newStuckSession() *stuckSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stuckSession{ctx: ctx, cancel: cancel, unblock: make(chan struct{})}
+}
+
+func (s *stuckSession) Context() context.Context { return s.ctx }
+
+func (s *stuckSession) CloseWithError(quic.ErrorCode, string) error {
+	<-s.unblock
+	s.cancel()
+	return nil
+}
+
+// A socket that records if it was closed.
+type fakeSocket struct {
+	transportConn
+	closed bool
+}
+
+func (s *fakeSocket) closeSocket() { s.closed = true }
+
+var _ = Describe("Shutdown", func() {
+	var (
+		serverTransport, clientTransport tpt.Transport
+		serverID                         peer.ID
+	)
+
+	BeforeEach(func() {
+		serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		serverID, err = peer.IDFromPrivateKey(serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		serverTransport, err = NewTransport(serverKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		clientTransport, err = NewTransport(clientKey, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("closes listeners and connections", func() {
+		ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		// accepted connection
+		conn1, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn1.Close()
+		serverConn, err := ln.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		// connection that was not accepted yet
+		conn2, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn2.Close()
+		Eventually(func() int { return serverTransport.(StatsReporter).Stats().AcceptQueueLength }).Should(Equal(1))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(serverTransport.(Shutdowner).Shutdown(ctx)).To(Succeed())
+		Expect(serverConn.IsClosed()).To(BeTrue())
+		for _, c := range []tpt.CapableConn{conn1, conn2} {
+			_, err := c.AcceptStream()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("shutting down"))
+		}
+		_, err = ln.Accept()
+		Expect(err).To(HaveOccurred())
+
+		_, err = serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).To(MatchError(errTransportClosed))
+		_, err = serverTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+		Expect(err).To(MatchError(errTransportClosed))
+	})
+
+	It("closes the sockets of the remaining connections when the context is done", func() {
+		sess := newStuckSession()
+		defer close(sess.unblock)
+		socket := &fakeSocket{}
+		_, err := serverTransport.(*transport).conns.addConn(&conn{sess: sess, socket: socket}, 0)
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		Expect(serverTransport.(Shutdowner).Shutdown(ctx)).To(MatchError(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(socket.closed).To(BeTrue())
+	})
+
+	It("uses the configured error code", func() {
+		key, _, err := ic.GenerateEd25519Key(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		id, err := peer.IDFromPrivateKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		tr, err := NewTransport(key, nil, nil, WithShutdownErrorCode(42))
+		Expect(err).ToNot(HaveOccurred())
+		ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+
+		conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), id)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Eventually(func() int { return tr.(StatsReporter).Stats().AcceptQueueLength }).Should(Equal(1))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(tr.(Shutdowner).Shutdown(ctx)).To(Succeed())
+		_, err = conn.AcceptStream()
+		Expect(err).To(HaveOccurred())
+		// the close reason is recorded by the connection tracer, which might run after AcceptStream returned
+		Eventually(func() string { return conn.(ConnectionStatsReporter).Stats().CloseReason }).Should(Equal("remote_application_error"))
+		Expect(conn.(ConnectionStatsReporter).Stats().CloseErrorCode).To(BeEquivalentTo(42))
+		Expect(serverTransport.(*transport).shutdownErrorCode).To(BeEquivalentTo(ErrorCodeShutdown))
+	})
+})
@@ -0,0 +1,153 @@
+package libp2pquic
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stallDetector detects connections that don't make forward progress while data is in flight,
+// e.g. because they are in persistent congestion, or because the path broke.
+// A connection makes progress when an ACK acknowledges a packet that wasn't acknowledged before.
+//
+// The detector uses a single timer, which is not reset on every ACK. When it fires,
+// it checks the time of the last progress, and either reports a stall or re-arms itself.
+type stallDetector struct {
+	// accessed atomically
+	lastProgress  int64 // in nanoseconds since start
+	bytesInFlight int64
+	stalled       int32
+
+	timeout time.Duration
+	clock   clock
+	// start carries a monotonic clock reading, so the times measured from it are not affected by wall clock jumps.
+	start time.Time
+	// onStall is called when a stall is detected, at most once per quiet period.
+	// It is called from the timer's go routine.
+	onStall func()
+
+	mutex       sync.Mutex
+	timer       *time.Timer
+	armed       bool
+	closed      bool
+	stallStart  int64 // the last progress before the current stall
+	stalls      uint64
+	stalledTime time.Duration // of the stalls that ended
+}
+
+func newStallDetector(timeout time.Duration, clock clock, onStall func()) *stallDetector {
+	return &stallDetector{
+		timeout: timeout,
+		clock:   clock,
+		start:   clock.Now(),
+		onStall: onStall,
+	}
+}
+
+// now returns the time since the detector was created, in nanoseconds.
+func (d *stallDetector) now() int64 {
+	return int64(d.clock.Now().Sub(d.start))
+}
+
+// Progress is called when an ACK acknowledges new packets.
+func (d *stallDetector) Progress() {
+	now := d.now()
+	atomic.StoreInt64(&d.lastProgress, now)
+	if atomic.LoadInt32(&d.stalled) == 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.endStall(now)
+}
+
+// UpdatedBytesInFlight is called with every metrics update.
+// The timer is armed once data is in flight.
+func (d *stallDetector) UpdatedBytesInFlight(bytesInFlight int64) {
+	atomic.StoreInt64(&d.bytesInFlight, bytesInFlight)
+	if bytesInFlight == 0 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.armed || d.closed || atomic.LoadInt32(&d.stalled) == 1 {
+		return
+	}
+	// The quiet period starts when data is sent, not at the last progress before the connection went idle.
+	now := d.now()
+	atomic.StoreInt64(&d.lastProgress, now)
+	d.arm(d.timeout)
+}
+
+// arm arms the timer. It must be called with the mutex held.
+func (d *stallDetector) arm(after time.Duration) {
+	d.armed = true
+	if d.timer == nil {
+		d.timer = time.AfterFunc(after, d.fire)
+	} else {
+		d.timer.Reset(after)
+	}
+}
+
+func (d *stallDetector) fire() {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return
+	}
+	d.armed = false
+	if atomic.LoadInt64(&d.bytesInFlight) == 0 {
+		// nothing in flight, the timer is armed again when data is sent
+		d.mutex.Unlock()
+		return
+	}
+	last := atomic.LoadInt64(&d.lastProgress)
+	if remaining := time.Duration(last + int64(d.timeout) - d.now()); remaining > 0 {
+		d.arm(remaining)
+		d.mutex.Unlock()
+		return
+	}
+	d.stalls++
+	d.stallStart = last
+	atomic.StoreInt32(&d.stalled, 1)
+	d.mutex.Unlock()
+
+	if d.onStall != nil {
+		d.onStall()
+	}
+}
+
+// endStall accounts for the time of the current stall. It must be called with the mutex held.
+func (d *stallDetector) endStall(now int64) {
+	if atomic.LoadInt32(&d.stalled) == 0 {
+		return
+	}
+	atomic.StoreInt32(&d.stalled, 0)
+	d.stalledTime += time.Duration(now - d.stallStart)
+}
+
+// Close stops the detector. A stall that is ongoing ends.
+func (d *stallDetector) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.endStall(d.now())
+}
+
+// Stats returns the number of stalls, and the total time the connection was stalled,
+// including the current stall.
+func (d *stallDetector) Stats() (uint64, time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stalledTime := d.stalledTime
+	if atomic.LoadInt32(&d.stalled) == 1 {
+		stalledTime += time.Duration(d.now() - d.stallStart)
+	}
+	return d.stalls, stalledTime
+}
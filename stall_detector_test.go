@@ -0,0 +1,103 @@
+package libp2pquic
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stall Detector", func() {
+	const timeout = 10 * time.Second
+
+	var (
+		d      *stallDetector
+		clk    *fakeClock
+		stalls int
+	)
+
+	BeforeEach(func() {
+		stalls = 0
+		clk = &fakeClock{now: time.Unix(1612345678, 0)}
+		d = newStallDetector(timeout, clk, func() { stalls++ })
+	})
+
+	AfterEach(func() {
+		d.Close()
+	})
+
+	It("doesn't arm the timer while no data is in flight", func() {
+		d.UpdatedBytesInFlight(0)
+		Expect(d.armed).To(BeFalse())
+		d.UpdatedBytesInFlight(1000)
+		Expect(d.armed).To(BeTrue())
+	})
+
+	It("reports a stall once per quiet period", func() {
+		d.UpdatedBytesInFlight(1000)
+		clk.now = clk.now.Add(timeout)
+		d.fire()
+		Expect(stalls).To(Equal(1))
+		// the timer is not armed again until the connection makes progress
+		d.UpdatedBytesInFlight(2000)
+		Expect(d.armed).To(BeFalse())
+		clk.now = clk.now.Add(5 * time.Second)
+		n, stalledTime := d.Stats()
+		Expect(n).To(BeEquivalentTo(1))
+		Expect(stalledTime).To(Equal(15 * time.Second))
+
+		d.Progress()
+		d.UpdatedBytesInFlight(1000)
+		Expect(d.armed).To(BeTrue())
+		clk.now = clk.now.Add(time.Hour)
+		n, stalledTime = d.Stats()
+		Expect(n).To(BeEquivalentTo(1))
+		Expect(stalledTime).To(Equal(15 * time.Second))
+		d.fire()
+		Expect(stalls).To(Equal(2))
+	})
+
+	It("re-arms the timer if the connection made progress", func() {
+		d.UpdatedBytesInFlight(1000)
+		clk.now = clk.now.Add(timeout / 2)
+		d.Progress()
+		clk.now = clk.now.Add(timeout / 2)
+		d.fire()
+		Expect(stalls).To(BeZero())
+		Expect(d.armed).To(BeTrue())
+		clk.now = clk.now.Add(timeout / 2)
+		d.fire()
+		Expect(stalls).To(Equal(1))
+	})
+
+	It("doesn't report a stall if nothing is in flight", func() {
+		d.UpdatedBytesInFlight(1000)
+		d.UpdatedBytesInFlight(0)
+		clk.now = clk.now.Add(timeout)
+		d.fire()
+		Expect(stalls).To(BeZero())
+		Expect(d.armed).To(BeFalse())
+	})
+
+	It("starts the quiet period when data is sent after an idle period", func() {
+		clk.now = clk.now.Add(time.Hour)
+		d.UpdatedBytesInFlight(1000)
+		clk.now = clk.now.Add(timeout / 2)
+		d.fire()
+		Expect(stalls).To(BeZero())
+	})
+
+	It("ends the stall when closed", func() {
+		d.UpdatedBytesInFlight(1000)
+		clk.now = clk.now.Add(timeout)
+		d.fire()
+		clk.now = clk.now.Add(time.Second)
+		d.Close()
+		clk.now = clk.now.Add(time.Hour)
+		n, stalledTime := d.Stats()
+		Expect(n).To(BeEquivalentTo(1))
+		Expect(stalledTime).To(Equal(timeout + time.Second))
+		d.fire()
+		Expect(stalls).To(Equal(1))
+	})
+})
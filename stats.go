@@ -0,0 +1,444 @@
+package libp2pquic
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// TransportStats contains statistics about a transport.
+type TransportStats struct {
+	// GatedAccepts is the number of inbound connection attempts that were rejected
+	// by the connection gater before the handshake started.
+	GatedAccepts uint64
+
+	// RetryMode is the configured address validation mode.
+	RetryMode RetryMode
+	// ValidatingAddresses says if Retries are currently being sent.
+	// This is always true for RetryAlways, and depends on the load for RetryAdaptive.
+	ValidatingAddresses bool
+	// RetriesSent is the number of Retries sent to validate client addresses.
+	RetriesSent uint64
+	// RateLimitedHandshakes is the number of connection attempts that exceeded the handshake rate limit
+	// (see WithHandshakeRateLimit). Depending on the RateLimitMode, they were sent a Retry
+	// (and are counted in RetriesSent as well) or their Initial packet was dropped.
+	// Dropped packets are also reported to the tracer, using the DoS prevention drop reason.
+	RateLimitedHandshakes uint64
+	// HandshakesInProgress is the number of inbound handshakes that are currently in progress.
+	HandshakesInProgress int
+	// ConcurrencyLimitedHandshakes is the number of connection attempts that exceeded the concurrent handshake limit
+	// (see WithMaxConcurrentHandshakes). They were sent a Retry (and are counted in RetriesSent as well),
+	// or refused if they already presented a Retry token.
+	ConcurrencyLimitedHandshakes uint64
+	// HandshakeFailureRate is the fraction of the inbound handshakes that finished within the last one to two minutes,
+	// and that failed to complete within the handshake timeout.
+	HandshakeFailureRate float64
+	// RefusedHandshakes is the number of inbound connection attempts refused by the load shedding callback
+	// (see WithLoadShedding).
+	RefusedHandshakes uint64
+
+	// OpenConnections is the number of open connections, both inbound and outbound.
+	OpenConnections int
+
+	// CertificateChainSize is the size of the certificate chain sent during the handshake.
+	// If the chain is too large, the server's first flight exceeds the anti-amplification limit,
+	// and handshakes take an additional round trip. A warning is logged when creating the transport in that case.
+	CertificateChainSize int
+
+	// UDPBufferSize is the configured size of the UDP receive and send buffers.
+	UDPBufferSize int
+	// UDPReceiveBufferSize and UDPSendBufferSize are the smallest buffer sizes reported by the kernel
+	// for any of the UDP sockets created by the transport. They are 0 if unknown.
+	// On Linux, they are twice the size usable for packets.
+	UDPReceiveBufferSize int
+	UDPSendBufferSize    int
+
+	// ReusableSockets is the number of UDP sockets that are available for reuse when dialing,
+	// keyed by local IP address. Sockets bound to 0.0.0.0 or :: are reported under that address.
+	ReusableSockets map[string]int
+
+	// AcceptQueueLength is the number of connections waiting to be accepted, summed over all listeners.
+	AcceptQueueLength int
+	// AcceptQueueDrops is the number of connections that were closed because the accept queue was full.
+	AcceptQueueDrops uint64
+	// RefusedConnsPerPeer is the number of inbound connections that were closed,
+	// because the limit of connections per peer was reached.
+	RefusedConnsPerPeer uint64
+
+	// Listeners are the statistics of the open listeners, keyed by their multiaddr.
+	// Unlike the counters above, they are reset when a listener is closed.
+	Listeners map[string]ListenerStats
+
+	// SpuriousLosses is the number of packets that were declared lost, but were acknowledged later,
+	// summed over all connections. A high number indicates that loss detection is too aggressive for the paths used.
+	// Only the most recently lost packets of every connection are tracked, so this is a lower bound.
+	SpuriousLosses uint64
+
+	// VersionNegotiationsSent and RetriesSentTotal are the number of Version Negotiation packets and Retries sent.
+	// Unlike RetriesSent, RetriesSentTotal includes the Retries that quic-go sends on its own, e.g. when a token expired.
+	VersionNegotiationsSent uint64
+	RetriesSentTotal        uint64
+	// StatelessPackets is the number of Version Negotiation packets and Retries sent,
+	// keyed by the /24 (IPv4) or /48 (IPv6) prefix of the remote address.
+	// At most 1024 prefixes are tracked. Packets sent to other prefixes are counted under "other".
+	// A spike of Version Negotiation packets means that clients use an incompatible QUIC version,
+	// a spike of Retries means that the server is under load.
+	StatelessPackets map[string]StatelessPacketCounts
+
+	// RecorderPanics is the number of panics of the EventRecorders (see WithEventRecorder), including their constructor.
+	// The panics are recovered, and an EventRecorder that panics repeatedly is disabled.
+	RecorderPanics uint64
+	// RecorderEventsAfterClose is the number of events that quic-go reported after the connection's EventRecorder
+	// was closed. They are not passed to the EventRecorder.
+	RecorderEventsAfterClose uint64
+
+	// DeniedPackets is the number of packets dropped, for every denied prefix (see WithDeniedPrefixes).
+	DeniedPackets map[string]uint64
+
+	// UnroutablePackets counts the short header packets that quic-go couldn't route to a connection,
+	// since their connection ID doesn't belong to any connection. quic-go drops them silently, or
+	// answers them with a stateless reset.
+	UnroutablePackets UnroutablePacketCounts
+}
+
+// UnroutablePacketCounts are the numbers of short header packets that couldn't be routed to a connection.
+// Connections sharing a socket are told apart by their connection IDs, so a packet with a connection ID
+// that quic-go doesn't know is lost, e.g. if it arrives after the peer migrated or retired the connection ID,
+// or after the connection was closed.
+type UnroutablePacketCounts struct {
+	// UnknownConnectionID is the number of packets with a connection ID that was never issued,
+	// or that was retired too long ago to be remembered (the last 1024 connection IDs retired are remembered).
+	// This includes stateless resets sent by peers, since they look like packets with a random connection ID.
+	UnknownConnectionID uint64
+	// RetiredConnectionID is the number of packets with a connection ID that was retired recently,
+	// or that belonged to a connection that was closed recently. quic-go keeps routing these packets
+	// for 5 seconds, to drain the connection. Only the packets arriving later are counted.
+	// A spike means that the draining period is too short for the peers' retransmissions.
+	RetiredConnectionID uint64
+	// NoConnectionID is the number of packets that are too short to contain a connection ID of the length
+	// used by the transport.
+	NoConnectionID uint64
+}
+
+// ListenerStats contains statistics about a listener.
+type ListenerStats struct {
+	// Accepted is the number of connections put into the accept queue.
+	Accepted uint64
+	// AcceptQueueLength is the number of connections waiting to be accepted.
+	AcceptQueueLength int
+	// AcceptQueueDrops is the number of connections that were closed because the accept queue was full.
+	AcceptQueueDrops uint64
+	// RefusedConnsPerPeer is the number of connections that were closed,
+	// because the limit of connections per peer was reached.
+	RefusedConnsPerPeer uint64
+}
+
+// StatelessPacketCounts are the numbers of packets sent outside of a connection.
+type StatelessPacketCounts struct {
+	VersionNegotiation uint64
+	Retry              uint64
+}
+
+// A StatsReporter reports statistics about a transport.
+// The transport returned by NewTransport implements this interface.
+type StatsReporter interface {
+	Stats() TransportStats
+}
+
+// ConnectionStats contains statistics about a connection.
+type ConnectionStats struct {
+	// CongestionWindow is the current congestion window, in bytes.
+	CongestionWindow int64
+	// MaxCongestionWindow is the largest congestion window observed during the lifetime of the connection.
+	MaxCongestionWindow int64
+	// BytesInFlight is the number of bytes sent, but not yet acknowledged or declared lost.
+	BytesInFlight int64
+	// MaxBytesInFlight is the largest number of bytes in flight observed during the lifetime of the connection.
+	MaxBytesInFlight int64
+	// SpuriousLosses is the number of packets that were declared lost, but were acknowledged later.
+	// Only the most recently lost packets are tracked, so this is a lower bound (see TransportStats.SpuriousLosses).
+	SpuriousLosses uint64
+	// BytesSent and BytesReceived are the number of bytes sent and received, including the QUIC packet overhead
+	// and retransmissions, but not the UDP and IP headers.
+	BytesSent     uint64
+	BytesReceived uint64
+	// SendThroughput and ReceiveThroughput are the current throughput estimates, in bytes per second.
+	// They are exponentially weighted moving averages over 1 second intervals. The current interval is not
+	// taken into account, so they lag behind by up to a second.
+	// PeakSendThroughput and PeakReceiveThroughput are the highest estimates during the lifetime of the connection.
+	// MeanSendThroughput and MeanReceiveThroughput are the bytes sent and received, divided by the lifetime.
+	SendThroughput        float64
+	ReceiveThroughput     float64
+	PeakSendThroughput    float64
+	PeakReceiveThroughput float64
+	MeanSendThroughput    float64
+	MeanReceiveThroughput float64
+	// SmoothedRTT and MinRTT are the current RTT estimates. They are 0 until the first RTT sample was taken.
+	SmoothedRTT time.Duration
+	MinRTT      time.Duration
+
+	// LossTimerExpirations and PTOExpirations are the number of times the loss timer and the probe timeout expired,
+	// per encryption level. Encryption levels without any expirations are omitted.
+	// A connection that makes progress by receiving ACKs rarely relies on timers.
+	LossTimerExpirations map[logging.EncryptionLevel]uint64
+	PTOExpirations       map[logging.EncryptionLevel]uint64
+	// PacketsSent is the number of packets sent.
+	PacketsSent uint64
+	// PacketsSentOnTimer is the number of packets sent in response to a timer expiration.
+	// This is an approximation: only the first packet sent after a timer expired is counted.
+	PacketsSentOnTimer uint64
+
+	// MaxReordering and P99Reordering are the maximum and the (estimated) 99th percentile of the reordering displacement
+	// of late packets, i.e. how many packet numbers behind the highest packet number received they arrived.
+	// Packets that arrive in order are not taken into account.
+	// For comparison, loss detection declares a packet lost once a packet sent 3 packet numbers later is acknowledged.
+	MaxReordering int64
+	P99Reordering float64
+	// DuplicatePackets is the number of packets received more than once.
+	// Many duplicates indicate that the peer's loss detection fires spuriously, or that a device on the path
+	// duplicates packets.
+	DuplicatePackets uint64
+
+	// MeanAckDelay and MaxAckDelay are the mean and the maximum ACK delay reported by the peer in its ACKs for 1-RTT packets.
+	// A large ACK delay inflates the RTT samples, and the ACK delay is only subtracted up to the max_ack_delay.
+	MeanAckDelay time.Duration
+	MaxAckDelay  time.Duration
+	// PacketsPerAckSent and PacketsPerAckReceived are the average number of packets newly acknowledged
+	// by the ACK frames sent and received, i.e. the ACK frequency in both directions.
+	PacketsPerAckSent     float64
+	PacketsPerAckReceived float64
+
+	// LocalPort is the local UDP port of the connection.
+	// ListeningSocket says if the connection uses the socket of a listener. This is always the case for inbound
+	// connections. Outbound connections reuse the socket of a listener if possible, so that the peer (and any NAT
+	// on the path) sees the port we listen on. They don't if no listener is suitable, or if they were dialed using
+	// WithEphemeralSocket.
+	LocalPort       int
+	ListeningSocket bool
+	// Proxied says if the connection was dialed using the packet conn returned by the DialerHook
+	// (see WithDialerHook). The RTTs of proxied connections include the detour via the proxy.
+	Proxied bool
+
+	// RemoteAddrClass is the class of the remote address of an inbound connection,
+	// as returned by the classifier passed to WithRemoteAddrClassifier.
+	// It is empty for outbound connections, if no classifier is configured, and until the classifier returned.
+	RemoteAddrClass string
+
+	// AdmissionDelay is the time an inbound connection was delayed by the concurrent handshake limit
+	// (see WithMaxConcurrentHandshakes), from the first connection attempt that was sent a Retry
+	// to the attempt that started the handshake. It is 0 if the connection was admitted right away.
+	AdmissionDelay time.Duration
+
+	// ECN says if the ECN bits of the packets received are read. This depends on the platform (Linux and macOS),
+	// and on the packet conn: proxied connections and packet conns returned by the packet conn wrapper
+	// don't support ECN, unless they have the methods of a *net.UDPConn that quic-go needs.
+	// CEMarksReceived is the number of packets received with the Congestion Experienced mark.
+	// The packets sent are not marked, and GSO is not used (as of quic-go v0.19).
+	ECN             bool
+	CEMarksReceived uint64
+
+	// Resources estimates the resources the connection holds.
+	Resources ResourceStats
+
+	// HandshakeFlightSize is the number of bytes of Handshake packets sent before the first 1-RTT packet,
+	// including retransmissions. On the server, most of it is the certificate chain.
+	// AmplificationStalled says if the server was blocked by the anti-amplification limit before the client's
+	// address was validated, i.e. if it couldn't send another full-sized packet. The handshake then takes
+	// an additional round trip. It is always false for outbound connections.
+	HandshakeFlightSize  uint64
+	AmplificationStalled bool
+
+	// FramesSent and FramesReceived are the number of frames sent and received, keyed by the frame type
+	// as named by qlog, e.g. "stream", "ping" or "new_connection_id". Frame types that were never sent
+	// or received are omitted.
+	FramesSent     map[string]uint64
+	FramesReceived map[string]uint64
+
+	// ConnectionIDs counts the connection IDs issued and retired.
+	ConnectionIDs ConnectionIDStats
+
+	// Stalls is the number of times the connection stalled, i.e. no packet was newly acknowledged
+	// for the stall timeout while data was in flight (see WithStallDetection).
+	// StalledTime is the total time the connection was stalled, measured from the last progress.
+	// Both are 0 if stall detection is disabled.
+	Stalls      uint64
+	StalledTime time.Duration
+
+	// Lifetime is the time since the connection was started, or the duration of the connection once it is closed.
+	Lifetime time.Duration
+	// IdleTime is the sum of all gaps between packets (sent or received) longer than 5 seconds.
+	// The IdleTime divided by the Lifetime is the fraction of time the connection was idle.
+	IdleTime time.Duration
+
+	// Handshake contains the times of the handshake milestones.
+	Handshake HandshakeTimings
+	// TLS contains the details of the TLS handshake.
+	// It is nil until the handshake completed, and for connections whose handshake failed.
+	TLS *TLSDetails
+
+	// CloseReason is a short description of the reason the connection was closed,
+	// e.g. "local_application_error", "remote_transport_error", "idle_timeout" or "stateless_reset".
+	// It is empty while the connection is open.
+	// CloseErrorCode is the error code of application and transport errors.
+	CloseReason    string
+	CloseErrorCode uint64
+	// CloseTLSAlert is the description of the TLS alert, e.g. "certificate_unknown" or "protocol_version",
+	// if the connection was closed with a transport error in the CRYPTO_ERROR range, locally or by the peer.
+	// CloseTLSAlertCode is the alert number. Both are unset for all other errors.
+	CloseTLSAlert     string
+	CloseTLSAlertCode uint8
+	// ClosedByRemote says if the peer closed the connection. Timeouts count as closed by us.
+	// It is nil while the connection is open, or if it's unknown who closed the connection.
+	ClosedByRemote *bool
+}
+
+// ConnectionIDStats counts the connection IDs issued and retired on a connection.
+// Many connection IDs issued and retired indicate that the peer prepares to migrate,
+// or that it cycles connection IDs for no reason.
+// The counts are the number of NEW_CONNECTION_ID and RETIRE_CONNECTION_ID frames sent and received,
+// so frames that were retransmitted are counted multiple times.
+type ConnectionIDStats struct {
+	// Issued is the number of connection IDs we issued to the peer (not counting the one used during the handshake),
+	// Retired is the number of them that the peer retired.
+	Issued  uint64
+	Retired uint64
+	// PeerIssued is the number of connection IDs the peer issued to us, PeerRetired is the number of them we retired.
+	PeerIssued  uint64
+	PeerRetired uint64
+	// ActiveLimit and PeerActiveLimit are the active_connection_id_limit transport parameters sent and received,
+	// i.e. the number of connection IDs we and the peer are willing to store. They are 0 until the parameters were
+	// sent or received.
+	ActiveLimit     uint64
+	PeerActiveLimit uint64
+}
+
+// ResourceStats estimates the resources a connection holds, and the peaks during its lifetime.
+// quic-go doesn't report most of them to the tracer, so they are derived from the packets and frames
+// sent and received, and are approximations.
+type ResourceStats struct {
+	// BufferedPackets is the number of packets buffered, since the keys to decrypt them are not available yet.
+	// quic-go doesn't report when it processes them, so they are assumed to be processed as soon as
+	// the keys of their encryption level become available.
+	BufferedPackets    int64
+	MaxBufferedPackets int64
+	// OpenStreams is the number of streams that data was sent or received on, and that were not finished
+	// (by a FIN or a RESET_STREAM) in both directions. Streams that the application still holds after that
+	// are not counted, and bidirectional streams that are only finished in one direction are counted until
+	// the connection is closed.
+	OpenStreams    int64
+	MaxOpenStreams int64
+	// CommittedReceiveWindow is the number of bytes the peer may still send before it's blocked
+	// by connection-level flow control, i.e. the data that might have to be buffered if the application
+	// doesn't read from its streams. It doesn't take stream-level flow control into account.
+	CommittedReceiveWindow    int64
+	MaxCommittedReceiveWindow int64
+}
+
+// TLSDetails are the details of the TLS handshake of a connection.
+type TLSDetails struct {
+	// CipherSuite is the name of the negotiated TLS 1.3 cipher suite, e.g. "TLS_AES_128_GCM_SHA256".
+	CipherSuite string
+	// RemoteKeyType is the type of the peer's libp2p key, e.g. "Ed25519", "RSA", "Secp256k1" or "ECDSA".
+	RemoteKeyType string
+	// CertificateExtension says if the peer's certificate was verified using the libp2p certificate extension,
+	// which carries the peer's libp2p key and a signature of the certificate's key.
+	// This is the only scheme the transport supports, so it is set for all connections that completed the handshake.
+	CertificateExtension bool
+}
+
+// HandshakeTimings are the times of the handshake milestones of a connection,
+// relative to the start of the connection. Milestones that were not reached (yet) are 0.
+type HandshakeTimings struct {
+	// FirstInitialSent and FirstInitialReceived are the times the first Initial packet was sent and received.
+	// Retransmissions don't change them.
+	FirstInitialSent     time.Duration
+	FirstInitialReceived time.Duration
+	// FirstHandshakeSent and FirstHandshakeReceived are the times the first Handshake packet was sent and received.
+	FirstHandshakeSent     time.Duration
+	FirstHandshakeReceived time.Duration
+	// OneRTTKeysInstalled is the time the first 1-RTT key was installed.
+	OneRTTKeysInstalled time.Duration
+	// HandshakeConfirmed is the time the handshake was confirmed, i.e. the HANDSHAKE_DONE frame was sent (server)
+	// or received (client).
+	HandshakeConfirmed time.Duration
+}
+
+// IdleFraction returns the fraction of the lifetime of the connection it was idle.
+func (s ConnectionStats) IdleFraction() float64 {
+	if s.Lifetime <= 0 {
+		return 0
+	}
+	return float64(s.IdleTime) / float64(s.Lifetime)
+}
+
+// TimerSentFraction returns the fraction of packets that were sent in response to a timer expiration.
+func (s ConnectionStats) TimerSentFraction() float64 {
+	if s.PacketsSent == 0 {
+		return 0
+	}
+	return float64(s.PacketsSentOnTimer) / float64(s.PacketsSent)
+}
+
+// A ConnectionStatsReporter reports statistics about a connection.
+// The connections of the transport returned by NewTransport implement this interface.
+type ConnectionStatsReporter interface {
+	Stats() ConnectionStats
+}
+
+// transportStats holds the counters of a transport.
+// All fields are accessed atomically.
+type transportStats struct {
+	gatedAccepts                 uint64
+	retriesSent                  uint64
+	refusedHandshakes            uint64
+	concurrencyLimitedHandshakes uint64
+
+	udpReceiveBufferSize int64
+	udpSendBufferSize    int64
+
+	acceptQueueLength int64
+	acceptQueueDrops  uint64
+
+	refusedConnsPerPeer uint64
+}
+
+// Stats returns the statistics of the transport.
+func (t *transport) Stats() TransportStats {
+	sockets := t.connManager.reuseUDP4.Sockets()
+	for ip, n := range t.connManager.reuseUDP6.Sockets() {
+		sockets[ip] = n
+	}
+	stats := TransportStats{
+		GatedAccepts:                 atomic.LoadUint64(&t.stats.gatedAccepts),
+		RetryMode:                    t.retryMode,
+		ValidatingAddresses:          t.retryMode == RetryAlways || (t.retryMode == RetryAdaptive && t.handshakes.IsUnderLoad()),
+		RetriesSent:                  atomic.LoadUint64(&t.stats.retriesSent),
+		RateLimitedHandshakes:        t.limiter.Limited(),
+		HandshakesInProgress:         t.handshakes.InProgress(),
+		ConcurrencyLimitedHandshakes: atomic.LoadUint64(&t.stats.concurrencyLimitedHandshakes),
+		HandshakeFailureRate:         t.handshakes.FailureRate(),
+		RefusedHandshakes:            atomic.LoadUint64(&t.stats.refusedHandshakes),
+		OpenConnections:              t.conns.numConns(),
+		CertificateChainSize:         t.certChainSize,
+		UDPBufferSize:                t.udpBufferSize,
+		UDPReceiveBufferSize:         int(atomic.LoadInt64(&t.stats.udpReceiveBufferSize)),
+		UDPSendBufferSize:            int(atomic.LoadInt64(&t.stats.udpSendBufferSize)),
+		ReusableSockets:              sockets,
+		AcceptQueueLength:            int(atomic.LoadInt64(&t.stats.acceptQueueLength)),
+		AcceptQueueDrops:             atomic.LoadUint64(&t.stats.acceptQueueDrops),
+		RefusedConnsPerPeer:          atomic.LoadUint64(&t.stats.refusedConnsPerPeer),
+		Listeners:                    t.conns.listenerStats(),
+		SpuriousLosses:               t.statsTracer.SpuriousLosses(),
+		RecorderPanics:               t.statsTracer.RecorderPanics(),
+		RecorderEventsAfterClose:     t.statsTracer.EventsAfterClose(),
+		DeniedPackets:                t.filter.DroppedPackets(),
+		UnroutablePackets:            t.statsTracer.connIDTable().Counts(),
+	}
+	stats.StatelessPackets = t.statsTracer.StatelessPackets()
+	for _, counts := range stats.StatelessPackets {
+		stats.VersionNegotiationsSent += counts.VersionNegotiation
+		stats.RetriesSentTotal += counts.Retry
+	}
+	return stats
+}
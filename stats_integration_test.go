@@ -0,0 +1,226 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+
+	quic "github.com/lucas-clemente/quic-go"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// statsTestPair is a client and a server transport, with a connection between them.
+type statsTestPair struct {
+	ln                 tpt.Listener
+	client, server     tpt.CapableConn
+	clientT, serverT   tpt.Transport
+	clientID, serverID peer.ID
+}
+
+// newStatsTestPair creates a client and a server transport using the given QUIC version, and connects them.
+// The server listens on the given IP address. The options are applied to the server transport.
+func newStatsTestPair(version quic.VersionNumber, ip string, serverOpts ...Option) *statsTestPair {
+	p := &statsTestPair{}
+	serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.serverID, err = peer.IDFromPrivateKey(serverKey)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.serverT, err = NewTransport(serverKey, nil, nil, append([]Option{WithQUICVersions(version)}, serverOpts...)...)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.ln, err = p.serverT.Listen(ma.StringCast(fmt.Sprintf("%s/udp/0/quic", ip)))
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+
+	clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.clientID, err = peer.IDFromPrivateKey(clientKey)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.clientT, err = NewTransport(clientKey, nil, nil, WithQUICVersions(version))
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.client, err = p.clientT.Dial(context.Background(), p.ln.Multiaddr(), p.serverID)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	p.server, err = p.ln.Accept()
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	return p
+}
+
+// transfer sends n bytes from the server to the client.
+func (p *statsTestPair) transfer(n int) {
+	data := make([]byte, n)
+	rand.Read(data)
+	str, err := p.server.OpenStream(context.Background())
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	go func() {
+		defer GinkgoRecover()
+		_, err := str.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(str.CloseWrite()).To(Succeed())
+	}()
+	rstr, err := p.client.AcceptStream()
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	received, err := ioutil.ReadAll(rstr)
+	ExpectWithOffset(1, err).ToNot(HaveOccurred())
+	ExpectWithOffset(1, received).To(Equal(data))
+}
+
+func (p *statsTestPair) clientStats() ConnectionStats {
+	return p.client.(ConnectionStatsReporter).Stats()
+}
+
+func (p *statsTestPair) serverStats() ConnectionStats {
+	return p.server.(ConnectionStatsReporter).Stats()
+}
+
+// close closes the connection from the client side, and waits until the server noticed.
+func (p *statsTestPair) close() {
+	p.client.Close()
+	Eventually(p.server.IsClosed).Should(BeTrue())
+	p.server.Close()
+	p.ln.Close()
+}
+
+var _ = Describe("Connection Statistics", func() {
+	for _, v := range []quic.VersionNumber{quic.VersionDraft29, quic.VersionDraft32} {
+		version := v
+
+		for _, a := range []string{"/ip4/127.0.0.1", "/ip6/::1"} {
+			ip := a
+
+			Context(fmt.Sprintf("using %v on %s", version, ip), func() {
+				It("reports the statistics of both sides", func() {
+					p := newStatsTestPair(version, ip)
+					p.transfer(200 << 10)
+					p.close()
+
+					for _, s := range []ConnectionStats{p.clientStats(), p.serverStats()} {
+						Expect(s.PacketsSent).ToNot(BeZero())
+						Expect(s.Lifetime).To(BeNumerically(">", 0))
+						Expect(s.MaxCongestionWindow).ToNot(BeZero())
+						Expect(s.PacketsPerAckSent).To(BeNumerically(">", 0))
+						Expect(s.PacketsPerAckReceived).To(BeNumerically(">", 0))
+						h := s.Handshake
+						Expect(h.FirstInitialSent).ToNot(BeZero())
+						Expect(h.FirstInitialReceived).ToNot(BeZero())
+						Expect(h.FirstHandshakeSent).ToNot(BeZero())
+						Expect(h.FirstHandshakeReceived).ToNot(BeZero())
+						Expect(h.OneRTTKeysInstalled).ToNot(BeZero())
+						Expect(h.HandshakeConfirmed).ToNot(BeZero())
+					}
+					// the server sent the data, so it sent more packets than the client
+					Expect(p.serverStats().PacketsSent).To(BeNumerically(">", p.clientStats().PacketsSent))
+					// the client delays its ACKs by at most its max_ack_delay (plus scheduling delays)
+					Expect(p.serverStats().MaxAckDelay).To(BeNumerically("<", time.Second))
+					// the client closed the connection
+					Expect(p.clientStats().CloseReason).To(Equal("local_application_error"))
+					Expect(p.clientStats().ClosedByRemote).ToNot(BeNil())
+					Expect(*p.clientStats().ClosedByRemote).To(BeFalse())
+					Expect(p.serverStats().CloseReason).To(Equal("remote_application_error"))
+					Expect(p.serverStats().ClosedByRemote).ToNot(BeNil())
+					Expect(*p.serverStats().ClosedByRemote).To(BeTrue())
+					// the statistics don't change once the connection is closed
+					lifetime := p.clientStats().Lifetime
+					time.Sleep(10 * time.Millisecond)
+					Expect(p.clientStats().Lifetime).To(Equal(lifetime))
+				})
+			})
+		}
+	}
+
+	It("delivers RTT updates until the connection is closed", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1", WithNetworkSimulation(NetworkSimulation{Delay: 5 * time.Millisecond}))
+		ch, unsubscribe := p.client.(RTTSubscriber).SubscribeRTT(100)
+		defer unsubscribe()
+		p.transfer(200 << 10)
+		var m RTTMeasurement
+		Eventually(ch).Should(Receive(&m))
+		Expect(m.LatestRTT).To(BeNumerically(">=", 5*time.Millisecond))
+		p.close()
+		Eventually(ch).Should(BeClosed())
+	})
+
+	It("detects stalled connections", func() {
+		stalled := make(chan tpt.CapableConn, 1)
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1", WithStallDetection(200*time.Millisecond, func(c tpt.CapableConn, s ConnectionStats) {
+			Expect(s.Stalls).To(BeEquivalentTo(1))
+			stalled <- c
+		}))
+		defer p.close()
+		// the client drops all packets, so the server's packets are never acknowledged
+		_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+		Expect(err).ToNot(HaveOccurred())
+		p.clientT.(*transport).filter.SetDeniedPrefixes(loopback)
+		str, err := p.server.OpenStream(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		go str.Write(make([]byte, 1<<20))
+		var c tpt.CapableConn
+		Eventually(stalled, 5*time.Second).Should(Receive(&c))
+		Expect(c).To(Equal(p.server))
+		Expect(p.serverStats().StalledTime).To(BeNumerically(">=", 200*time.Millisecond))
+		Consistently(stalled).ShouldNot(Receive())
+	})
+
+	It("reports if the socket of a listener was used", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1")
+		defer p.close()
+		Expect(p.serverStats().ListeningSocket).To(BeTrue())
+		Expect(p.serverStats().LocalPort).To(Equal(p.ln.Addr().(*net.UDPAddr).Port))
+		// the client isn't listening
+		Expect(p.clientStats().ListeningSocket).To(BeFalse())
+		Expect(p.clientStats().LocalPort).ToNot(BeZero())
+
+		ln, err := p.clientT.Listen(ma.StringCast("/ip4/0.0.0.0/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		port := ln.Addr().(*net.UDPAddr).Port
+		conn, err := p.clientT.Dial(context.Background(), p.ln.Multiaddr(), p.serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.(ConnectionStatsReporter).Stats().ListeningSocket).To(BeTrue())
+		Expect(conn.(ConnectionStatsReporter).Stats().LocalPort).To(Equal(port))
+
+		conn, err = p.clientT.Dial(WithEphemeralSocket(context.Background()), p.ln.Multiaddr(), p.serverID)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(conn.(ConnectionStatsReporter).Stats().ListeningSocket).To(BeFalse())
+		Expect(conn.(ConnectionStatsReporter).Stats().LocalPort).ToNot(Equal(port))
+	})
+
+	It("classifies the remote address of inbound connections", func() {
+		classified := make(chan net.Addr, 1)
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1", WithRemoteAddrClassifier(func(addr net.Addr) string {
+			classified <- addr
+			return "direct"
+		}))
+		defer p.close()
+		var addr net.Addr
+		Eventually(classified).Should(Receive(&addr))
+		Expect(addr.(*net.UDPAddr).Port).To(Equal(p.clientStats().LocalPort))
+		Eventually(func() string { return p.serverStats().RemoteAddrClass }).Should(Equal("direct"))
+		Expect(p.clientStats().RemoteAddrClass).To(BeEmpty())
+		Consistently(classified).ShouldNot(Receive())
+	})
+
+	It("reports duplicated packets", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1", WithNetworkSimulation(NetworkSimulation{Duplication: 0.1}))
+		p.transfer(200 << 10)
+		p.close()
+		Expect(p.clientStats().DuplicatePackets).ToNot(BeZero())
+	})
+
+	It("reports reordered packets", func() {
+		p := newStatsTestPair(quic.VersionDraft29, "/ip4/127.0.0.1", WithNetworkSimulation(NetworkSimulation{Delay: 5 * time.Millisecond, Reordering: 0.1}))
+		p.transfer(200 << 10)
+		p.close()
+		Expect(p.clientStats().MaxReordering).ToNot(BeZero())
+		Expect(p.clientStats().P99Reordering).ToNot(BeZero())
+	})
+})
@@ -0,0 +1,1072 @@
+package libp2pquic
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+
+	"github.com/lucas-clemente/quic-go/logging"
+)
+
+// idleGapThreshold is the minimum gap between two packets for the gap to count as idle time.
+const idleGapThreshold = 5 * time.Second
+
+// maxStatelessPacketPrefixes is the maximum number of address prefixes that stateless packets are counted for.
+// Packets sent to other prefixes are counted under statelessPacketsOtherPrefix.
+const maxStatelessPacketPrefixes = 1024
+
+// statelessPacketsOtherPrefix is the key that stateless packets are counted under once maxStatelessPacketPrefixes is reached.
+const statelessPacketsOtherPrefix = "other"
+
+// spuriousLossWindow is the number of lost packets per packet number space that are remembered
+// in order to detect spurious losses.
+const spuriousLossWindow = 64
+
+// statsTracer collects statistics about the connections of a transport.
+type statsTracer struct {
+	// accessed atomically
+	spuriousLosses uint64
+	recorderPanics uint64
+	// events passed to the event tracer after it was closed
+	eventsAfterClose uint64
+
+	clock clock
+
+	// stallTimeout is the time without forward progress after which a connection is considered stalled.
+	// 0 if stall detection is disabled. onStall is called when a connection stalls, it may be nil.
+	stallTimeout time.Duration
+	onStall      func(tpt.CapableConn, ConnectionStats)
+	// classifyRemoteAddr classifies the remote address of inbound connections. It may be nil.
+	classifyRemoteAddr func(net.Addr) string
+	// connIDs tracks the connection IDs we issued, to classify the packets quic-go can't route. It may be nil.
+	connIDs *connIDTable
+	// handshakes is notified of inbound connections that are closed before the handshake completed.
+	// It may be nil.
+	handshakes *handshakeTracker
+
+	// quic-go doesn't tell us which connection tracer belongs to which session.
+	// The connection tracers are matched to the sessions by their perspective and 4-tuple (see claim).
+	mutex   sync.Mutex
+	pending map[string][]*statsConnectionTracer
+
+	// counts of the Version Negotiation packets and Retries sent, keyed by the prefix of the remote address
+	statelessMutex  sync.Mutex
+	statelessCounts map[string]*StatelessPacketCounts
+}
+
+var _ logging.Tracer = &statsTracer{}
+
+// newStatsTracer creates the stats tracer of a transport.
+// It returns nil if metrics are disabled (see DisableMetrics).
+func newStatsTracer(cfg *config, connIDLen int, handshakes *handshakeTracker) *statsTracer {
+	if cfg.disableMetrics {
+		return nil
+	}
+	return &statsTracer{
+		clock:              realClock{},
+		stallTimeout:       cfg.stallTimeout,
+		onStall:            cfg.onStall,
+		classifyRemoteAddr: cfg.classifyRemoteAddr,
+		connIDs:            newConnIDTable(connIDLen, realClock{}),
+		handshakes:         handshakes,
+	}
+}
+
+// connIDTable returns the table of the connection IDs. It is nil if the stats tracer is nil.
+func (t *statsTracer) connIDTable() *connIDTable {
+	if t == nil {
+		return nil
+	}
+	return t.connIDs
+}
+
+func (t *statsTracer) TracerForConnection(p logging.Perspective, _ logging.ConnectionID) logging.ConnectionTracer {
+	return newStatsConnectionTracer(t, p)
+}
+
+func statsTracerKey(p logging.Perspective, local, remote net.Addr) string {
+	return perspectiveString(p) + "_" + local.String() + "_" + remote.String()
+}
+
+func (t *statsTracer) addPending(c *statsConnectionTracer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[string][]*statsConnectionTracer)
+	}
+	t.pending[c.key] = append(t.pending[c.key], c)
+}
+
+func (t *statsTracer) removePending(c *statsConnectionTracer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pending := t.pending[c.key]
+	for i, pc := range pending {
+		if pc == c {
+			pending = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(pending) == 0 {
+		delete(t.pending, c.key)
+	} else {
+		t.pending[c.key] = pending
+	}
+}
+
+// claim returns the connection tracer of a session.
+// If multiple sessions with the same perspective use the same 4-tuple, the connection tracers
+// are handed out in the order the connections were started.
+// This is only a problem if one of the handshakes fails, or the sessions are accepted out of order.
+// It returns nil if no connection tracer was found.
+func (t *statsTracer) claim(p logging.Perspective, local, remote net.Addr) *statsConnectionTracer {
+	if t == nil {
+		return nil
+	}
+	key := statsTracerKey(p, local, remote)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pending := t.pending[key]
+	if len(pending) == 0 {
+		return nil
+	}
+	if len(pending) == 1 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = pending[1:]
+	}
+	return pending[0]
+}
+
+// SentPacket is called for packets that are not sent on a connection,
+// i.e. Version Negotiation packets, Retries, and Initials closing a connection attempt.
+func (t *statsTracer) SentPacket(remote net.Addr, hdr *logging.Header, _ logging.ByteCount, _ []logging.Frame) {
+	packetType := logging.PacketTypeFromHeader(hdr)
+	if packetType != logging.PacketTypeVersionNegotiation && packetType != logging.PacketTypeRetry {
+		return
+	}
+	prefix := addressPrefix(remote)
+
+	t.statelessMutex.Lock()
+	defer t.statelessMutex.Unlock()
+	if t.statelessCounts == nil {
+		t.statelessCounts = make(map[string]*StatelessPacketCounts)
+	}
+	counts, ok := t.statelessCounts[prefix]
+	if !ok {
+		if len(t.statelessCounts) >= maxStatelessPacketPrefixes {
+			prefix = statelessPacketsOtherPrefix
+		}
+		counts, ok = t.statelessCounts[prefix]
+		if !ok {
+			counts = &StatelessPacketCounts{}
+			t.statelessCounts[prefix] = counts
+		}
+	}
+	if packetType == logging.PacketTypeVersionNegotiation {
+		counts.VersionNegotiation++
+	} else {
+		counts.Retry++
+	}
+}
+
+func (t *statsTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+// SpuriousLosses returns the number of packets that were declared lost, and were acknowledged later.
+func (t *statsTracer) SpuriousLosses() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.spuriousLosses)
+}
+
+// countRecorderPanic counts a panic of an EventRecorder.
+func (t *statsTracer) countRecorderPanic() {
+	if t == nil {
+		return
+	}
+	atomic.AddUint64(&t.recorderPanics, 1)
+}
+
+// RecorderPanics returns the number of panics of EventRecorders.
+func (t *statsTracer) RecorderPanics() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.recorderPanics)
+}
+
+// countEventAfterClose counts an event that was dropped, because the event tracer of the connection was already closed.
+func (t *statsTracer) countEventAfterClose() {
+	if t == nil {
+		return
+	}
+	atomic.AddUint64(&t.eventsAfterClose, 1)
+}
+
+// EventsAfterClose returns the number of events dropped, because they arrived after the event tracer was closed.
+func (t *statsTracer) EventsAfterClose() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.eventsAfterClose)
+}
+
+// StatelessPackets returns the number of Version Negotiation packets and Retries sent,
+// keyed by the prefix of the remote address.
+func (t *statsTracer) StatelessPackets() map[string]StatelessPacketCounts {
+	if t == nil {
+		return nil
+	}
+	t.statelessMutex.Lock()
+	defer t.statelessMutex.Unlock()
+	if len(t.statelessCounts) == 0 {
+		return nil
+	}
+	m := make(map[string]StatelessPacketCounts, len(t.statelessCounts))
+	for prefix, counts := range t.statelessCounts {
+		m[prefix] = *counts
+	}
+	return m
+}
+
+// addressPrefix returns the /24 (for IPv4) or /48 (for IPv6) prefix of a UDP address.
+func addressPrefix(addr net.Addr) string {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return statelessPacketsOtherPrefix
+	}
+	if ip := udpAddr.IP.To4(); ip != nil {
+		mask := net.CIDRMask(24, 32)
+		return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+	}
+	mask := net.CIDRMask(48, 128)
+	return (&net.IPNet{IP: udpAddr.IP.Mask(mask), Mask: mask}).String()
+}
+
+// A lostPackets remembers the most recently lost packets of a packet number space.
+type lostPackets struct {
+	packets [spuriousLossWindow]logging.PacketNumber // -1 for unused entries
+	next    int
+}
+
+func newLostPackets() *lostPackets {
+	l := &lostPackets{}
+	for i := range l.packets {
+		l.packets[i] = -1
+	}
+	return l
+}
+
+func (l *lostPackets) Add(pn logging.PacketNumber) {
+	l.packets[l.next] = pn
+	l.next = (l.next + 1) % spuriousLossWindow
+}
+
+// Acked removes all lost packets acknowledged by the ACK frame, and returns their number.
+func (l *lostPackets) Acked(ack *logging.AckFrame) int {
+	if len(ack.AckRanges) == 0 {
+		return 0
+	}
+	smallest, largest := ack.LowestAcked(), ack.LargestAcked()
+	var n int
+	for i, pn := range l.packets {
+		// AcksPacket does a binary search over the ACK ranges, so check the bounds first
+		if pn < smallest || pn > largest || !ack.AcksPacket(pn) {
+			continue
+		}
+		l.packets[i] = -1
+		n++
+	}
+	return n
+}
+
+// numEncryptionLevels is the number of encryption levels, including the invalid encryption level 0.
+const numEncryptionLevels = int(logging.Encryption1RTT) + 1
+
+type packetNumberSpace uint8
+
+const (
+	spaceInitial packetNumberSpace = iota
+	spaceHandshake
+	spaceAppData
+	numPacketNumberSpaces
+)
+
+func packetNumberSpaceForEncLevel(encLevel logging.EncryptionLevel) packetNumberSpace {
+	switch encLevel {
+	case logging.EncryptionInitial:
+		return spaceInitial
+	case logging.EncryptionHandshake:
+		return spaceHandshake
+	default:
+		return spaceAppData
+	}
+}
+
+func packetNumberSpaceForPacketType(t logging.PacketType) packetNumberSpace {
+	switch t {
+	case logging.PacketTypeInitial:
+		return spaceInitial
+	case logging.PacketTypeHandshake:
+		return spaceHandshake
+	default:
+		return spaceAppData
+	}
+}
+
+// statsConnectionTracer collects the statistics of a single connection.
+// quic-go calls it from the connection's run loop. Only the values reported by Stats
+// are accessed concurrently.
+type statsConnectionTracer struct {
+	// accessed atomically, and need to be 64 bit aligned
+	congestionWindow    int64
+	maxCongestionWindow int64
+	bytesInFlight       int64
+	maxBytesInFlight    int64
+	// packets declared lost that were acknowledged later
+	spuriousLosses uint64
+	// bytes sent and received, counting the size of the QUIC packets
+	bytesSent     uint64
+	bytesReceived uint64
+	// throughput estimates, updated when packets are sent and received
+	sendThroughput    throughputEstimator
+	receiveThroughput throughputEstimator
+	// the RTT estimates of the last metrics update, in nanoseconds
+	smoothedRTT int64
+	minRTT      int64
+	// timer expirations, indexed by the encryption level
+	lossTimerExpirations [numEncryptionLevels]uint64
+	ptoExpirations       [numEncryptionLevels]uint64
+	packetsSent          uint64
+	packetsSentOnTimer   uint64
+	// reordering displacement of late packets
+	maxReordering int64
+	p99Reordering uint64 // float64 bits
+	// packets received more than once
+	duplicatePackets uint64
+	// ACK frames sent and received, and the number of packets they newly acknowledged
+	acksSent             uint64
+	packetsAckedSent     uint64
+	acksReceived         uint64
+	packetsAckedReceived uint64
+	ackDelaySum          int64 // in nanoseconds
+	ackDelaySamples      uint64
+	maxAckDelay          int64 // in nanoseconds
+	// frames sent and received, by frame type
+	framesSent     frameCounts
+	framesReceived frameCounts
+	// the local port, if the socket is used by a listener, and if the connection was dialed
+	// using the DialerHook (0 or 1)
+	localPort       int32
+	listeningSocket int32
+	proxied         int32
+	admissionDelay  int64 // in nanoseconds
+	// active_connection_id_limit transport parameters sent and received
+	activeConnIDLimit     uint64
+	peerActiveConnIDLimit uint64
+	// start is the time the connection was started. It carries a monotonic clock reading,
+	// so the durations measured from it are not affected by wall clock jumps (see elapsed).
+	start time.Time
+	// in nanoseconds since start
+	lastPacket int64
+	closeTime  int64 // 0 until the connection is closed
+	idleTime   int64 // in nanoseconds
+	// handshake milestones, in nanoseconds since start, 0 until reached
+	firstInitialSent       int64
+	firstInitialReceived   int64
+	firstHandshakeSent     int64
+	firstHandshakeReceived int64
+	oneRTTKeysInstalled    int64
+	handshakeConfirmed     int64
+	// packets received with the ECN Congestion Experienced mark, as reported in the ACK frames sent
+	ceMarksReceived uint64
+	// set (to 1) if quic-go reads the ECN bits of the packets received
+	ecn int32
+	// packets buffered because their keys were not available yet, streams open,
+	// and the connection-level receive window that the peer didn't use yet
+	bufferedPackets           int64
+	maxBufferedPackets        int64
+	openStreams               int64
+	maxOpenStreams            int64
+	committedReceiveWindow    int64
+	maxCommittedReceiveWindow int64
+	// bytes of Handshake packets sent before the first 1-RTT packet
+	handshakeFlightSize uint64
+	// set (to 1) when the server was blocked by the anti-amplification limit
+	amplificationStalled int32
+
+	close atomic.Value // *connClose, set when the connection is closed
+	// tls is the *TLSDetails of the handshake, set once the handshake completed
+	tls atomic.Value
+	// remoteAddrClass is the class of the remote address (a string), set once the classifier returned
+	remoteAddrClass atomic.Value
+
+	rttSubscriptions rttSubscriptions
+
+	// stall is nil if stall detection is disabled
+	stall *stallDetector
+	// owner is the tpt.CapableConn of this connection, set once the connection was handed to the application
+	owner atomic.Value
+
+	tracer      *statsTracer
+	perspective logging.Perspective
+	key         string   // set when the connection is started
+	remote      net.Addr // set when the connection is started
+
+	// lost holds the packets recently declared lost, per packet number space.
+	// A lost packet that is acknowledged later was lost spuriously.
+	lost [numPacketNumberSpaces]*lostPackets
+
+	// timerExpired is set when a timer expires, and reset when the next packet is sent.
+	timerExpired bool
+
+	// sent1RTT is set once the first 1-RTT packet was sent.
+	sent1RTT bool
+	// addressValidated is set once the first Handshake packet was received, which validates the peer's address.
+	// Until then, the bytes sent and received are counted to check the anti-amplification limit.
+	addressValidated         bool
+	bytesSentUnvalidated     uint64
+	bytesReceivedUnvalidated uint64
+
+	// highestReceived is the highest packet number received, per packet number space (-1 if none).
+	highestReceived [numPacketNumberSpaces]logging.PacketNumber
+	reordering      *p2Quantile
+
+	// largest packet number acknowledged by the ACK frames sent and received,
+	// per packet number space (-1 if none)
+	largestAckedSent     [numPacketNumberSpaces]logging.PacketNumber
+	largestAckedReceived [numPacketNumberSpaces]logging.PacketNumber
+	// the ECN-CE count of the last ACK frame sent, per packet number space
+	ceCountSent [numPacketNumberSpaces]uint64
+
+	// buffered counts the packets buffered, per encryption level
+	buffered [numEncryptionLevels]int64
+	streams  *streamTracker
+	// maxData is the connection-level flow control limit we granted the peer
+	maxData uint64
+
+	// connIDs are the connection IDs we issued that were not retired yet, keyed by their sequence number
+	connIDs map[uint64]logging.ConnectionID
+}
+
+var _ logging.ConnectionTracer = &statsConnectionTracer{}
+
+func newStatsConnectionTracer(t *statsTracer, p logging.Perspective) *statsConnectionTracer {
+	c := &statsConnectionTracer{
+		tracer:      t,
+		perspective: p,
+		reordering:  newP2Quantile(0.99),
+		streams:     newStreamTracker(),
+		start:       t.clock.Now(),
+	}
+	for i := range c.lost {
+		c.lost[i] = newLostPackets()
+		c.highestReceived[i] = -1
+		c.largestAckedSent[i] = -1
+		c.largestAckedReceived[i] = -1
+	}
+	if t.stallTimeout > 0 {
+		c.stall = newStallDetector(t.stallTimeout, t.clock, c.stalled)
+	}
+	return c
+}
+
+// setListeningSocket records that the connection uses the socket of a listener.
+func (t *statsConnectionTracer) setListeningSocket() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt32(&t.listeningSocket, 1)
+}
+
+// setProxied records that the connection was dialed using the DialerHook.
+func (t *statsConnectionTracer) setProxied() {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt32(&t.proxied, 1)
+}
+
+// setECN records if quic-go reads the ECN bits of the packets received on the connection's socket.
+func (t *statsConnectionTracer) setECN(ecn bool) {
+	if t == nil || !ecn {
+		return
+	}
+	atomic.StoreInt32(&t.ecn, 1)
+}
+
+// setAdmissionDelay records the time the connection was delayed by the concurrent handshake limit.
+func (t *statsConnectionTracer) setAdmissionDelay(d time.Duration) {
+	if t == nil {
+		return
+	}
+	atomic.StoreInt64(&t.admissionDelay, int64(d))
+}
+
+// setTLS records the details of the TLS handshake. It must be called once the handshake completed.
+// The peer's certificate is always verified using the libp2p certificate extension.
+func (t *statsConnectionTracer) setTLS(cipherSuite uint16, remotePubKey ic.PubKey) {
+	if t == nil {
+		return
+	}
+	t.tls.Store(&TLSDetails{
+		CipherSuite:          tls.CipherSuiteName(cipherSuite),
+		RemoteKeyType:        remotePubKey.Type().String(),
+		CertificateExtension: true,
+	})
+}
+
+// setOwner sets the connection that is reported when the connection stalls.
+func (t *statsConnectionTracer) setOwner(c tpt.CapableConn) {
+	if t == nil {
+		return
+	}
+	t.owner.Store(c)
+}
+
+// stalled is called by the stall detector.
+// Stalls that happen before the connection was handed to the application are counted, but not reported.
+func (t *statsConnectionTracer) stalled() {
+	owner, ok := t.owner.Load().(tpt.CapableConn)
+	if !ok || t.tracer.onStall == nil {
+		return
+	}
+	t.tracer.onStall(owner, t.Stats())
+}
+
+func (t *statsConnectionTracer) LostPacket(encLevel logging.EncryptionLevel, pn logging.PacketNumber, _ logging.PacketLossReason) {
+	t.lost[packetNumberSpaceForEncLevel(encLevel)].Add(pn)
+}
+
+func (t *statsConnectionTracer) ReceivedPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	now := t.packetEvent()
+	atomic.AddUint64(&t.bytesReceived, uint64(size))
+	t.receiveThroughput.Add(now, uint64(size))
+	packetType := logging.PacketTypeFromHeader(&hdr.Header)
+	switch packetType {
+	case logging.PacketTypeInitial:
+		setOnce(&t.firstInitialReceived, now)
+	case logging.PacketTypeHandshake:
+		setOnce(&t.firstHandshakeReceived, now)
+	}
+	if !t.addressValidated {
+		t.bytesReceivedUnvalidated += uint64(size)
+		t.addressValidated = packetType == logging.PacketTypeHandshake
+	}
+	space := packetNumberSpaceForPacketType(packetType)
+	t.receivedPacketNumber(space, hdr.PacketNumber)
+	t.framesReceived.Add(frames)
+	t.retiredConnIDs(frames)
+	t.streams.ReceivedFrames(frames)
+	t.updateStreams()
+	for _, f := range frames {
+		ack, ok := f.(*logging.AckFrame)
+		if !ok {
+			continue
+		}
+		if n := t.lost[space].Acked(ack); n > 0 {
+			atomic.AddUint64(&t.spuriousLosses, uint64(n))
+			atomic.AddUint64(&t.tracer.spuriousLosses, uint64(n))
+		}
+		atomic.AddUint64(&t.acksReceived, 1)
+		n := newlyAcked(&t.largestAckedReceived[space], ack)
+		atomic.AddUint64(&t.packetsAckedReceived, n)
+		if n > 0 && t.stall != nil {
+			t.stall.Progress()
+		}
+		// The ACK delay is ignored for Initial and Handshake packets, see section 13.2.1 of RFC 9000.
+		if space == spaceAppData {
+			atomic.AddInt64(&t.ackDelaySum, int64(ack.DelayTime))
+			atomic.AddUint64(&t.ackDelaySamples, 1)
+			if int64(ack.DelayTime) > atomic.LoadInt64(&t.maxAckDelay) {
+				atomic.StoreInt64(&t.maxAckDelay, int64(ack.DelayTime))
+			}
+		}
+	}
+}
+
+// newlyAcked returns the number of packets an ACK frame acknowledges beyond the largest packet number
+// acknowledged before, and updates the largest acknowledged packet number.
+// This is an approximation of the number of packets covered by an ACK: it ignores gaps in the ACK ranges.
+func newlyAcked(largestAcked *logging.PacketNumber, ack *logging.AckFrame) uint64 {
+	if len(ack.AckRanges) == 0 {
+		return 0
+	}
+	largest := ack.LargestAcked()
+	if largest <= *largestAcked {
+		return 0
+	}
+	n := largest - *largestAcked
+	*largestAcked = largest
+	return uint64(n)
+}
+
+// receivedPacketNumber tracks how far behind the highest packet number received a late packet arrives.
+func (t *statsConnectionTracer) receivedPacketNumber(space packetNumberSpace, pn logging.PacketNumber) {
+	if pn > t.highestReceived[space] {
+		t.highestReceived[space] = pn
+		return
+	}
+	displacement := int64(t.highestReceived[space] - pn)
+	if displacement == 0 {
+		t.receivedDuplicate()
+		return
+	}
+	t.reordering.Add(float64(displacement))
+	atomic.StoreUint64(&t.p99Reordering, math.Float64bits(t.reordering.Quantile()))
+	if displacement > atomic.LoadInt64(&t.maxReordering) {
+		atomic.StoreInt64(&t.maxReordering, displacement)
+	}
+}
+
+// receivedDuplicate counts a packet that was received before.
+// quic-go (as of v0.19) drops most duplicates before processing them, and reports them to DroppedPacket.
+// Duplicates that it doesn't detect are passed to ReceivedPacket, and are detected here if they carry the
+// highest packet number received. Both are counted, so the count doesn't depend on where quic-go detects duplicates.
+func (t *statsConnectionTracer) receivedDuplicate() {
+	atomic.AddUint64(&t.duplicatePackets, 1)
+}
+
+func (t *statsConnectionTracer) StartedConnection(local, remote net.Addr, _ logging.VersionNumber, srcConnID, _ logging.ConnectionID) {
+	t.issuedConnID(0, srcConnID)
+	t.key = statsTracerKey(t.perspective, local, remote)
+	t.remote = remote
+	if addr, ok := local.(*net.UDPAddr); ok {
+		atomic.StoreInt32(&t.localPort, int32(addr.Port))
+	}
+	if t.perspective == logging.PerspectiveServer && t.tracer.classifyRemoteAddr != nil {
+		// The classifier may block, e.g. on a peerstore lookup, so it must not be run on quic-go's go routine.
+		go t.classify(remote)
+	}
+	t.tracer.addPending(t)
+}
+
+func (t *statsConnectionTracer) classify(remote net.Addr) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("remote address classifier panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	t.remoteAddrClass.Store(t.tracer.classifyRemoteAddr(remote))
+}
+
+func (t *statsConnectionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+	t.rttSubscriptions.Publish(t.tracer.clock, rttStats)
+	atomic.StoreInt64(&t.smoothedRTT, int64(rttStats.SmoothedRTT()))
+	atomic.StoreInt64(&t.minRTT, int64(rttStats.MinRTT()))
+	storeWithMax(&t.congestionWindow, &t.maxCongestionWindow, int64(cwnd))
+	storeWithMax(&t.bytesInFlight, &t.maxBytesInFlight, int64(bytesInFlight))
+	if t.stall != nil {
+		t.stall.UpdatedBytesInFlight(int64(bytesInFlight))
+	}
+}
+
+// storeWithMax stores a value, and updates the maximum.
+// It must not be called concurrently for the same value.
+func storeWithMax(value, max *int64, v int64) {
+	atomic.StoreInt64(value, v)
+	if v > atomic.LoadInt64(max) {
+		atomic.StoreInt64(max, v)
+	}
+}
+
+func (t *statsConnectionTracer) LossTimerExpired(timerType logging.TimerType, encLevel logging.EncryptionLevel) {
+	if int(encLevel) >= numEncryptionLevels {
+		return
+	}
+	switch timerType {
+	case logging.TimerTypeACK:
+		atomic.AddUint64(&t.lossTimerExpirations[encLevel], 1)
+	case logging.TimerTypePTO:
+		atomic.AddUint64(&t.ptoExpirations[encLevel], 1)
+	}
+	t.timerExpired = true
+}
+
+func (t *statsConnectionTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.ByteCount, ack *logging.AckFrame, frames []logging.Frame) {
+	now := t.packetEvent()
+	atomic.AddUint64(&t.bytesSent, uint64(size))
+	t.sendThroughput.Add(now, uint64(size))
+	packetType := logging.PacketTypeFromHeader(&hdr.Header)
+	switch packetType {
+	case logging.PacketTypeInitial:
+		setOnce(&t.firstInitialSent, now)
+	case logging.PacketTypeHandshake:
+		setOnce(&t.firstHandshakeSent, now)
+	}
+	atomic.AddUint64(&t.packetsSent, 1)
+	t.trackHandshakeFlight(packetType, uint64(size))
+	// the ACK frame is not contained in the frames
+	t.framesSent.Add(frames)
+	t.issuedConnIDs(frames)
+	t.streams.SentFrames(frames)
+	t.grantedMaxData(frames)
+	t.updateStreams()
+	if ack != nil {
+		t.framesSent.AddType(frameTypeAck)
+		space := packetNumberSpaceForPacketType(packetType)
+		atomic.AddUint64(&t.acksSent, 1)
+		atomic.AddUint64(&t.packetsAckedSent, newlyAcked(&t.largestAckedSent[space], ack))
+		// the ECN counts are cumulative
+		if ack.ECNCE > t.ceCountSent[space] {
+			atomic.AddUint64(&t.ceMarksReceived, ack.ECNCE-t.ceCountSent[space])
+			t.ceCountSent[space] = ack.ECNCE
+		}
+	}
+	// This is an approximation: only the first packet sent after a timer expired is attributed to the timer.
+	if t.timerExpired {
+		atomic.AddUint64(&t.packetsSentOnTimer, 1)
+		t.timerExpired = false
+	}
+}
+
+// trackHandshakeFlight sums the Handshake packets sent before the first 1-RTT packet,
+// and checks if the server is blocked by the anti-amplification limit.
+// The server is considered blocked if it can't send another full-sized packet before the client's address
+// is validated. This is an approximation: quic-go counts the sizes of UDP datagrams, which might contain
+// multiple QUIC packets, and doesn't tell us when it actually refrains from sending.
+func (t *statsConnectionTracer) trackHandshakeFlight(packetType logging.PacketType, size uint64) {
+	switch {
+	case packetType == logging.PacketType1RTT:
+		t.sent1RTT = true
+	case packetType == logging.PacketTypeHandshake && !t.sent1RTT:
+		atomic.AddUint64(&t.handshakeFlightSize, size)
+	}
+	if t.perspective != logging.PerspectiveServer || t.addressValidated {
+		return
+	}
+	t.bytesSentUnvalidated += size
+	if t.bytesSentUnvalidated+maxHandshakePacketSize > amplificationFactor*t.bytesReceivedUnvalidated {
+		atomic.StoreInt32(&t.amplificationStalled, 1)
+	}
+}
+
+// grantedMaxData updates the connection-level flow control limit using the MAX_DATA frames sent.
+func (t *statsConnectionTracer) grantedMaxData(frames []logging.Frame) {
+	for _, f := range frames {
+		if f, ok := f.(*logging.MaxDataFrame); ok && uint64(f.MaximumData) > t.maxData {
+			t.maxData = uint64(f.MaximumData)
+		}
+	}
+}
+
+// updateStreams updates the number of open streams, and the receive window committed.
+// The committed receive window is the number of bytes the peer may still send before it's blocked by
+// connection-level flow control. quic-go might have to buffer that much data, if the application doesn't
+// read from its streams. Stream-level flow control might limit the peer further, so this is an upper bound.
+func (t *statsConnectionTracer) updateStreams() {
+	storeWithMax(&t.openStreams, &t.maxOpenStreams, int64(t.streams.Open()))
+	var window int64
+	if received := t.streams.ReceivedBytes(); t.maxData > received {
+		window = int64(t.maxData - received)
+	}
+	storeWithMax(&t.committedReceiveWindow, &t.maxCommittedReceiveWindow, window)
+}
+
+// elapsed returns the time since the connection was started, in nanoseconds.
+// It is measured using the monotonic clock, so wall clock jumps (e.g. NTP adjustments) don't affect it.
+// Clocks without a monotonic reading (i.e. fake clocks) may go backwards, so the result is clamped.
+// It is at least 1, so that 0 can be used for timestamps that were not set.
+func (t *statsConnectionTracer) elapsed() int64 {
+	if d := int64(t.tracer.clock.Now().Sub(t.start)); d > 0 {
+		return d
+	}
+	return 1
+}
+
+// packetEvent accounts for the idle time since the last packet was sent or received.
+// It returns the current time.
+func (t *statsConnectionTracer) packetEvent() int64 {
+	now := t.elapsed()
+	if gap := now - atomic.LoadInt64(&t.lastPacket); gap > int64(idleGapThreshold) {
+		atomic.AddInt64(&t.idleTime, gap)
+	}
+	atomic.StoreInt64(&t.lastPacket, now)
+	return now
+}
+
+// setOnce sets a timestamp, unless it was already set.
+// This makes sure that retransmissions don't overwrite the time of the first packet.
+func setOnce(ts *int64, now int64) {
+	atomic.CompareAndSwapInt64(ts, 0, now)
+}
+
+func (t *statsConnectionTracer) UpdatedKeyFromTLS(encLevel logging.EncryptionLevel, _ logging.Perspective) {
+	t.processedBufferedPackets(encLevel)
+	if encLevel == logging.Encryption1RTT {
+		setOnce(&t.oneRTTKeysInstalled, t.elapsed())
+	}
+}
+
+// DroppedEncryptionLevel is called with the Handshake encryption level when the handshake is confirmed:
+// on the server when it sends the HANDSHAKE_DONE frame, and on the client when it receives it.
+func (t *statsConnectionTracer) DroppedEncryptionLevel(encLevel logging.EncryptionLevel) {
+	t.processedBufferedPackets(encLevel)
+	if encLevel == logging.EncryptionHandshake {
+		setOnce(&t.handshakeConfirmed, t.elapsed())
+	}
+}
+func (t *statsConnectionTracer) DroppedKey(logging.KeyPhase) {}
+
+func (t *statsConnectionTracer) sinceStart(ts *int64) time.Duration {
+	return time.Duration(atomic.LoadInt64(ts))
+}
+
+// Stats returns the current statistics of the connection.
+func (t *statsConnectionTracer) Stats() ConnectionStats {
+	end := atomic.LoadInt64(&t.closeTime)
+	if end == 0 {
+		end = t.elapsed()
+	}
+	idleTime := atomic.LoadInt64(&t.idleTime)
+	// include the current gap
+	if gap := end - atomic.LoadInt64(&t.lastPacket); gap > int64(idleGapThreshold) {
+		idleTime += gap
+	}
+	s := ConnectionStats{
+		CongestionWindow:    atomic.LoadInt64(&t.congestionWindow),
+		MaxCongestionWindow: atomic.LoadInt64(&t.maxCongestionWindow),
+		BytesInFlight:       atomic.LoadInt64(&t.bytesInFlight),
+		MaxBytesInFlight:    atomic.LoadInt64(&t.maxBytesInFlight),
+		SpuriousLosses:      atomic.LoadUint64(&t.spuriousLosses),
+		BytesSent:           atomic.LoadUint64(&t.bytesSent),
+		BytesReceived:       atomic.LoadUint64(&t.bytesReceived),
+		SendThroughput:      t.sendThroughput.Rate(end),
+		ReceiveThroughput:   t.receiveThroughput.Rate(end),
+		SmoothedRTT:         time.Duration(atomic.LoadInt64(&t.smoothedRTT)),
+		MinRTT:              time.Duration(atomic.LoadInt64(&t.minRTT)),
+		PacketsSent:         atomic.LoadUint64(&t.packetsSent),
+		PacketsSentOnTimer:  atomic.LoadUint64(&t.packetsSentOnTimer),
+		MaxReordering:       atomic.LoadInt64(&t.maxReordering),
+		P99Reordering:       math.Float64frombits(atomic.LoadUint64(&t.p99Reordering)),
+		DuplicatePackets:    atomic.LoadUint64(&t.duplicatePackets),
+		MaxAckDelay:         time.Duration(atomic.LoadInt64(&t.maxAckDelay)),
+		LocalPort:           int(atomic.LoadInt32(&t.localPort)),
+		ListeningSocket:     atomic.LoadInt32(&t.listeningSocket) == 1,
+		Proxied:             atomic.LoadInt32(&t.proxied) == 1,
+		AdmissionDelay:      time.Duration(atomic.LoadInt64(&t.admissionDelay)),
+		ECN:                 atomic.LoadInt32(&t.ecn) == 1,
+		CEMarksReceived:     atomic.LoadUint64(&t.ceMarksReceived),
+		HandshakeFlightSize: atomic.LoadUint64(&t.handshakeFlightSize),
+		Resources: ResourceStats{
+			BufferedPackets:           atomic.LoadInt64(&t.bufferedPackets),
+			MaxBufferedPackets:        atomic.LoadInt64(&t.maxBufferedPackets),
+			OpenStreams:               atomic.LoadInt64(&t.openStreams),
+			MaxOpenStreams:            atomic.LoadInt64(&t.maxOpenStreams),
+			CommittedReceiveWindow:    atomic.LoadInt64(&t.committedReceiveWindow),
+			MaxCommittedReceiveWindow: atomic.LoadInt64(&t.maxCommittedReceiveWindow),
+		},
+		AmplificationStalled: atomic.LoadInt32(&t.amplificationStalled) == 1,
+		FramesSent:           t.framesSent.Counts(),
+		FramesReceived:       t.framesReceived.Counts(),
+		Lifetime:             time.Duration(end),
+		IdleTime:             time.Duration(idleTime),
+		Handshake: HandshakeTimings{
+			FirstInitialSent:       t.sinceStart(&t.firstInitialSent),
+			FirstInitialReceived:   t.sinceStart(&t.firstInitialReceived),
+			FirstHandshakeSent:     t.sinceStart(&t.firstHandshakeSent),
+			FirstHandshakeReceived: t.sinceStart(&t.firstHandshakeReceived),
+			OneRTTKeysInstalled:    t.sinceStart(&t.oneRTTKeysInstalled),
+			HandshakeConfirmed:     t.sinceStart(&t.handshakeConfirmed),
+		},
+	}
+	s.RemoteAddrClass, _ = t.remoteAddrClass.Load().(string)
+	s.TLS, _ = t.tls.Load().(*TLSDetails)
+	if c, ok := t.close.Load().(*connClose); ok {
+		s.CloseReason = c.reason
+		s.CloseErrorCode = c.errorCode
+		s.CloseTLSAlert = c.tlsAlert
+		s.CloseTLSAlertCode = c.tlsAlertCode
+		s.ClosedByRemote = c.byRemote
+	}
+	s.ConnectionIDs = ConnectionIDStats{
+		Issued:          atomic.LoadUint64(&t.framesSent[frameTypeNewConnectionID]),
+		Retired:         atomic.LoadUint64(&t.framesReceived[frameTypeRetireConnectionID]),
+		PeerIssued:      atomic.LoadUint64(&t.framesReceived[frameTypeNewConnectionID]),
+		PeerRetired:     atomic.LoadUint64(&t.framesSent[frameTypeRetireConnectionID]),
+		ActiveLimit:     atomic.LoadUint64(&t.activeConnIDLimit),
+		PeerActiveLimit: atomic.LoadUint64(&t.peerActiveConnIDLimit),
+	}
+	if t.stall != nil {
+		s.Stalls, s.StalledTime = t.stall.Stats()
+	}
+	// the peaks are read after the current estimates, which might update them
+	s.PeakSendThroughput = t.sendThroughput.Peak()
+	s.PeakReceiveThroughput = t.receiveThroughput.Peak()
+	if lifetime := s.Lifetime.Seconds(); lifetime > 0 {
+		s.MeanSendThroughput = float64(s.BytesSent) / lifetime
+		s.MeanReceiveThroughput = float64(s.BytesReceived) / lifetime
+	}
+	if n := atomic.LoadUint64(&t.ackDelaySamples); n > 0 {
+		s.MeanAckDelay = time.Duration(atomic.LoadInt64(&t.ackDelaySum) / int64(n))
+	}
+	if n := atomic.LoadUint64(&t.acksSent); n > 0 {
+		s.PacketsPerAckSent = float64(atomic.LoadUint64(&t.packetsAckedSent)) / float64(n)
+	}
+	if n := atomic.LoadUint64(&t.acksReceived); n > 0 {
+		s.PacketsPerAckReceived = float64(atomic.LoadUint64(&t.packetsAckedReceived)) / float64(n)
+	}
+	for i := range t.lossTimerExpirations {
+		if n := atomic.LoadUint64(&t.lossTimerExpirations[i]); n > 0 {
+			if s.LossTimerExpirations == nil {
+				s.LossTimerExpirations = make(map[logging.EncryptionLevel]uint64)
+			}
+			s.LossTimerExpirations[logging.EncryptionLevel(i)] = n
+		}
+		if n := atomic.LoadUint64(&t.ptoExpirations[i]); n > 0 {
+			if s.PTOExpirations == nil {
+				s.PTOExpirations = make(map[logging.EncryptionLevel]uint64)
+			}
+			s.PTOExpirations[logging.EncryptionLevel(i)] = n
+		}
+	}
+	return s
+}
+
+func (t *statsConnectionTracer) DroppedPacket(_ logging.PacketType, _ logging.ByteCount, reason logging.PacketDropReason) {
+	if reason == logging.PacketDropDuplicate {
+		t.receivedDuplicate()
+	}
+}
+
+func (t *statsConnectionTracer) Close() {
+	// quic-go stops routing packets to the connection IDs of a closed connection after the draining period
+	for seq, connID := range t.connIDs {
+		t.tracer.connIDs.Retire(connID)
+		delete(t.connIDs, seq)
+	}
+	t.rttSubscriptions.Close()
+	if t.stall != nil {
+		t.stall.Close()
+	}
+	// remove the connection tracer, if it was never claimed by a session
+	if len(t.key) > 0 {
+		t.tracer.removePending(t)
+	}
+}
+
+// issuedConnID records a connection ID we issued to the peer.
+func (t *statsConnectionTracer) issuedConnID(seq uint64, connID logging.ConnectionID) {
+	if t.tracer.connIDs == nil || len(connID) == 0 {
+		return
+	}
+	if t.connIDs == nil {
+		t.connIDs = make(map[uint64]logging.ConnectionID)
+	}
+	t.connIDs[seq] = connID
+	t.tracer.connIDs.Add(connID)
+}
+
+func (t *statsConnectionTracer) issuedConnIDs(frames []logging.Frame) {
+	for _, f := range frames {
+		if f, ok := f.(*logging.NewConnectionIDFrame); ok {
+			t.issuedConnID(f.SequenceNumber, f.ConnectionID)
+		}
+	}
+}
+
+// retiredConnIDs retires the connection IDs the peer retired.
+func (t *statsConnectionTracer) retiredConnIDs(frames []logging.Frame) {
+	for _, f := range frames {
+		f, ok := f.(*logging.RetireConnectionIDFrame)
+		if !ok {
+			continue
+		}
+		if connID, ok := t.connIDs[f.SequenceNumber]; ok {
+			t.tracer.connIDs.Retire(connID)
+			delete(t.connIDs, f.SequenceNumber)
+		}
+	}
+}
+
+func (t *statsConnectionTracer) ClosedConnection(r logging.CloseReason) {
+	c := classifyCloseReason(r)
+	t.close.Store(&c)
+	atomic.StoreInt64(&t.closeTime, t.elapsed())
+	if t.stall != nil {
+		t.stall.Close()
+	}
+	// Free the handshake slot right away, instead of waiting for the handshake to time out.
+	// On the server, the handshake is confirmed as soon as it completes.
+	if t.perspective == logging.PerspectiveServer && t.tracer.handshakes != nil && t.remote != nil {
+		if atomic.LoadInt64(&t.handshakeConfirmed) == 0 {
+			t.tracer.handshakes.Failed(t.remote)
+		}
+	}
+}
+
+func (t *statsConnectionTracer) SentTransportParameters(tp *logging.TransportParameters) {
+	atomic.StoreUint64(&t.activeConnIDLimit, tp.ActiveConnectionIDLimit)
+	if uint64(tp.InitialMaxData) > t.maxData {
+		t.maxData = uint64(tp.InitialMaxData)
+	}
+	t.updateStreams()
+}
+
+func (t *statsConnectionTracer) ReceivedTransportParameters(tp *logging.TransportParameters) {
+	atomic.StoreUint64(&t.peerActiveConnIDLimit, tp.ActiveConnectionIDLimit)
+}
+
+func (t *statsConnectionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {
+}
+func (t *statsConnectionTracer) ReceivedRetry(*logging.Header) {}
+
+// BufferedPacket is called for packets that can't be decrypted yet, since the keys are not available.
+// quic-go buffers a limited number of them, and processes them once the keys become available.
+func (t *statsConnectionTracer) BufferedPacket(packetType logging.PacketType) {
+	encLevel, ok := encryptionLevelForPacketType(packetType)
+	if !ok {
+		return
+	}
+	t.buffered[encLevel]++
+	t.updateBufferedPackets()
+}
+
+// processedBufferedPackets is called when the keys for an encryption level become available, or when the keys
+// are dropped. quic-go doesn't report what happens to the buffered packets, so they are assumed to be processed
+// (or dropped) right away.
+func (t *statsConnectionTracer) processedBufferedPackets(encLevel logging.EncryptionLevel) {
+	if int(encLevel) >= numEncryptionLevels || t.buffered[encLevel] == 0 {
+		return
+	}
+	t.buffered[encLevel] = 0
+	t.updateBufferedPackets()
+}
+
+func (t *statsConnectionTracer) updateBufferedPackets() {
+	var n int64
+	for _, b := range t.buffered {
+		n += b
+	}
+	storeWithMax(&t.bufferedPackets, &t.maxBufferedPackets, n)
+}
+
+func encryptionLevelForPacketType(packetType logging.PacketType) (logging.EncryptionLevel, bool) {
+	switch packetType {
+	case logging.PacketTypeInitial:
+		return logging.EncryptionInitial, true
+	case logging.PacketTypeHandshake:
+		return logging.EncryptionHandshake, true
+	case logging.PacketType0RTT:
+		return logging.Encryption0RTT, true
+	case logging.PacketType1RTT:
+		return logging.Encryption1RTT, true
+	default:
+		return 0, false
+	}
+}
+
+func (t *statsConnectionTracer) UpdatedCongestionState(logging.CongestionState)                     {}
+func (t *statsConnectionTracer) UpdatedPTOCount(uint32)                                             {}
+func (t *statsConnectionTracer) UpdatedKey(logging.KeyPhase, bool)                                  {}
+func (t *statsConnectionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {}
+func (t *statsConnectionTracer) LossTimerCanceled()                                                 {}
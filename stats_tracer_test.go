@@ -0,0 +1,564 @@
+package libp2pquic
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	tpt "github.com/libp2p/go-libp2p-core/transport"
+	"github.com/lucas-clemente/quic-go/logging"
+	ma "github.com/multiformats/go-multiaddr"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stats Tracer", func() {
+	var (
+		tracer *statsTracer
+		t      logging.ConnectionTracer
+		clk    *fakeClock
+	)
+	shortHeader := &logging.ExtendedHeader{}
+
+	BeforeEach(func() {
+		clk = &fakeClock{now: time.Unix(1612345678, 0)}
+		tracer = &statsTracer{clock: clk}
+		t = tracer.TracerForConnection(logging.PerspectiveClient, logging.ConnectionID{1, 2, 3, 4})
+	})
+
+	ack := func(ranges ...logging.AckRange) *logging.AckFrame {
+		return &logging.AckFrame{AckRanges: ranges}
+	}
+
+	It("counts spurious losses", func() {
+		for _, pn := range []logging.PacketNumber{4, 7, 11, 20} {
+			t.LostPacket(logging.Encryption1RTT, pn, 0)
+		}
+		t.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 10, Largest: 12}, logging.AckRange{Smallest: 3, Largest: 5})})
+		Expect(tracer.SpuriousLosses()).To(BeEquivalentTo(2))
+		// packets are only counted once
+		t.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 0, Largest: 12})})
+		Expect(tracer.SpuriousLosses()).To(BeEquivalentTo(3))
+		Expect(t.(*statsConnectionTracer).Stats().SpuriousLosses).To(BeEquivalentTo(3))
+	})
+
+	It("distinguishes packet number spaces", func() {
+		t.LostPacket(logging.EncryptionInitial, 1, 0)
+		t.LostPacket(logging.EncryptionHandshake, 2, 0)
+		t.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 0, Largest: 10})})
+		Expect(tracer.SpuriousLosses()).To(BeZero())
+		// 0-RTT and 1-RTT packets share a packet number space
+		t.LostPacket(logging.Encryption0RTT, 3, 0)
+		t.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 0, Largest: 10})})
+		Expect(tracer.SpuriousLosses()).To(BeEquivalentTo(1))
+	})
+
+	It("only remembers the most recently lost packets", func() {
+		for pn := logging.PacketNumber(0); pn < spuriousLossWindow+10; pn++ {
+			t.LostPacket(logging.Encryption1RTT, pn, 0)
+		}
+		t.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 0, Largest: 1000})})
+		Expect(tracer.SpuriousLosses()).To(BeEquivalentTo(spuriousLossWindow))
+	})
+
+	It("sums the spurious losses of all connections", func() {
+		t2 := tracer.TracerForConnection(logging.PerspectiveServer, logging.ConnectionID{5, 6, 7, 8})
+		t.LostPacket(logging.Encryption1RTT, 1, 0)
+		t2.LostPacket(logging.Encryption1RTT, 1, 0)
+		t.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 1, Largest: 1})})
+		t2.ReceivedPacket(shortHeader, 100, []logging.Frame{ack(logging.AckRange{Smallest: 1, Largest: 1})})
+		Expect(tracer.SpuriousLosses()).To(BeEquivalentTo(2))
+		Expect(t.(*statsConnectionTracer).Stats().SpuriousLosses).To(BeEquivalentTo(1))
+		Expect(t2.(*statsConnectionTracer).Stats().SpuriousLosses).To(BeEquivalentTo(1))
+	})
+
+	Context("stateless packets", func() {
+		versionNegotiation := &logging.Header{IsLongHeader: true, DestConnectionID: logging.ConnectionID{1, 2, 3, 4}}
+		retry := &logging.Header{
+			IsLongHeader: true,
+			Type:         2, // the Retry packet type
+			Version:      0xff00001d,
+		}
+
+		It("counts Version Negotiation packets and Retries per prefix", func() {
+			tracer.SentPacket(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, versionNegotiation, 100, nil)
+			tracer.SentPacket(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 200), Port: 4321}, versionNegotiation, 100, nil)
+			tracer.SentPacket(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, retry, 100, nil)
+			tracer.SentPacket(&net.UDPAddr{IP: net.ParseIP("2001:db8:1:2::1"), Port: 1234}, retry, 100, nil)
+			Expect(tracer.StatelessPackets()).To(Equal(map[string]StatelessPacketCounts{
+				"192.0.2.0/24":    {VersionNegotiation: 2, Retry: 1},
+				"2001:db8:1::/48": {Retry: 1},
+			}))
+		})
+
+		It("ignores other packets", func() {
+			tracer.SentPacket(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, &logging.Header{}, 100, nil)
+			Expect(tracer.StatelessPackets()).To(BeEmpty())
+		})
+
+		It("limits the number of prefixes", func() {
+			for i := 0; i < maxStatelessPacketPrefixes+10; i++ {
+				addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>8), byte(i), 1), Port: 1234}
+				tracer.SentPacket(addr, retry, 100, nil)
+			}
+			counts := tracer.StatelessPackets()
+			Expect(counts).To(HaveLen(maxStatelessPacketPrefixes + 1))
+			Expect(counts).To(HaveKeyWithValue(statelessPacketsOtherPrefix, StatelessPacketCounts{Retry: 10}))
+			Expect(counts).To(HaveKeyWithValue("10.0.0.0/24", StatelessPacketCounts{Retry: 1}))
+		})
+	})
+
+	Context("connection statistics", func() {
+		localAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+		remoteAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4321}
+
+		It("tracks the congestion window and bytes in flight", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			Expect(c).ToNot(BeNil())
+			t.UpdatedMetrics(&logging.RTTStats{}, 20000, 1000, 1)
+			t.UpdatedMetrics(&logging.RTTStats{}, 30000, 5000, 4)
+			t.UpdatedMetrics(&logging.RTTStats{}, 15000, 3000, 3)
+			stats := c.Stats()
+			Expect(stats.CongestionWindow).To(BeEquivalentTo(15000))
+			Expect(stats.MaxCongestionWindow).To(BeEquivalentTo(30000))
+			Expect(stats.BytesInFlight).To(BeEquivalentTo(3000))
+			Expect(stats.MaxBytesInFlight).To(BeEquivalentTo(5000))
+		})
+
+		It("counts timer expirations", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			hdr := &logging.ExtendedHeader{}
+			t.SentPacket(hdr, 1200, nil, nil)
+			t.LossTimerExpired(logging.TimerTypePTO, logging.EncryptionInitial)
+			t.SentPacket(hdr, 1200, nil, nil)
+			t.SentPacket(hdr, 1200, nil, nil)
+			t.LossTimerExpired(logging.TimerTypeACK, logging.Encryption1RTT)
+			t.LossTimerExpired(logging.TimerTypePTO, logging.Encryption1RTT)
+			t.SentPacket(hdr, 1200, nil, nil)
+			stats := c.Stats()
+			Expect(stats.LossTimerExpirations).To(Equal(map[logging.EncryptionLevel]uint64{logging.Encryption1RTT: 1}))
+			Expect(stats.PTOExpirations).To(Equal(map[logging.EncryptionLevel]uint64{
+				logging.EncryptionInitial: 1,
+				logging.Encryption1RTT:    1,
+			}))
+			Expect(stats.PacketsSent).To(BeEquivalentTo(4))
+			Expect(stats.PacketsSentOnTimer).To(BeEquivalentTo(2))
+			Expect(stats.TimerSentFraction()).To(Equal(0.5))
+			Expect(ConnectionStats{}.TimerSentFraction()).To(BeZero())
+		})
+
+		It("tracks reordering", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			receive := func(pns ...logging.PacketNumber) {
+				for _, pn := range pns {
+					t.ReceivedPacket(&logging.ExtendedHeader{PacketNumber: pn}, 1200, nil)
+				}
+			}
+			receive(0, 1, 2, 3)
+			Expect(c.Stats().MaxReordering).To(BeZero())
+			Expect(c.Stats().P99Reordering).To(BeZero())
+			// packet 4 arrives 2 packets late, packet 8 arrives 1 packet late
+			receive(5, 6, 4, 7, 9, 8)
+			Expect(c.Stats().MaxReordering).To(BeEquivalentTo(2))
+			Expect(c.Stats().P99Reordering).To(Equal(2.0))
+			// duplicates don't count
+			receive(9)
+			Expect(c.Stats().P99Reordering).To(Equal(2.0))
+			for pn := logging.PacketNumber(10); pn < 10000; pn += 2 {
+				receive(pn+1, pn)
+			}
+			receive(10010, 9990)
+			stats := c.Stats()
+			Expect(stats.MaxReordering).To(BeEquivalentTo(20))
+			Expect(stats.P99Reordering).To(BeNumerically("~", 1, 0.5))
+		})
+
+		It("counts duplicate packets", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			t.ReceivedPacket(&logging.ExtendedHeader{PacketNumber: 1}, 1200, nil)
+			t.DroppedPacket(logging.PacketType1RTT, 1200, logging.PacketDropDuplicate)
+			t.DroppedPacket(logging.PacketType1RTT, 1200, logging.PacketDropPayloadDecryptError)
+			Expect(c.Stats().DuplicatePackets).To(BeEquivalentTo(1))
+			// duplicates that quic-go didn't detect
+			t.ReceivedPacket(&logging.ExtendedHeader{PacketNumber: 1}, 1200, nil)
+			Expect(c.Stats().DuplicatePackets).To(BeEquivalentTo(2))
+		})
+
+		It("summarizes the ACKs sent and received", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			Expect(c.Stats().PacketsPerAckSent).To(BeZero())
+			Expect(c.Stats().PacketsPerAckReceived).To(BeZero())
+			// ACKs sent: the first one acknowledges packets 0 to 3, the second one 4 and 5,
+			// the third one doesn't acknowledge any new packets
+			t.SentPacket(shortHeader, 100, ack(logging.AckRange{Smallest: 0, Largest: 3}), nil)
+			t.SentPacket(shortHeader, 100, ack(logging.AckRange{Smallest: 0, Largest: 5}), nil)
+			t.SentPacket(shortHeader, 100, ack(logging.AckRange{Smallest: 0, Largest: 5}), nil)
+			t.SentPacket(shortHeader, 100, nil, nil)
+			Expect(c.Stats().PacketsPerAckSent).To(Equal(2.0))
+
+			received := func(largest logging.PacketNumber, delay time.Duration) {
+				f := ack(logging.AckRange{Smallest: 0, Largest: largest})
+				f.DelayTime = delay
+				t.ReceivedPacket(shortHeader, 100, []logging.Frame{f})
+			}
+			received(9, 10*time.Millisecond)
+			received(19, 30*time.Millisecond)
+			stats := c.Stats()
+			Expect(stats.PacketsPerAckReceived).To(Equal(10.0))
+			Expect(stats.MeanAckDelay).To(Equal(20 * time.Millisecond))
+			Expect(stats.MaxAckDelay).To(Equal(30 * time.Millisecond))
+		})
+
+		It("counts frames by type", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			Expect(c.Stats().FramesSent).To(BeNil())
+			t.SentPacket(shortHeader, 100, ack(logging.AckRange{Smallest: 0, Largest: 3}), []logging.Frame{&logging.StreamFrame{}, &logging.StreamFrame{}})
+			t.SentPacket(shortHeader, 100, nil, []logging.Frame{&logging.PingFrame{}})
+			t.ReceivedPacket(shortHeader, 100, []logging.Frame{
+				ack(logging.AckRange{Smallest: 0, Largest: 1}),
+				&logging.NewConnectionIDFrame{},
+				&logging.NewConnectionIDFrame{},
+				&logging.HandshakeDoneFrame{},
+			})
+			stats := c.Stats()
+			Expect(stats.FramesSent).To(Equal(map[string]uint64{"ack": 1, "stream": 2, "ping": 1}))
+			Expect(stats.FramesReceived).To(Equal(map[string]uint64{"ack": 1, "new_connection_id": 2, "handshake_done": 1}))
+		})
+
+		It("counts the connection IDs issued and retired", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			t.SentTransportParameters(&logging.TransportParameters{ActiveConnectionIDLimit: 4})
+			t.ReceivedTransportParameters(&logging.TransportParameters{ActiveConnectionIDLimit: 8})
+			t.SentPacket(shortHeader, 100, nil, []logging.Frame{&logging.NewConnectionIDFrame{}, &logging.NewConnectionIDFrame{}, &logging.RetireConnectionIDFrame{}})
+			t.ReceivedPacket(shortHeader, 100, []logging.Frame{&logging.NewConnectionIDFrame{}, &logging.RetireConnectionIDFrame{}, &logging.RetireConnectionIDFrame{}})
+			t.ReceivedPacket(shortHeader, 100, []logging.Frame{&logging.NewConnectionIDFrame{}})
+			Expect(c.Stats().ConnectionIDs).To(Equal(ConnectionIDStats{
+				Issued:          2,
+				Retired:         2,
+				PeerIssued:      2,
+				PeerRetired:     1,
+				ActiveLimit:     4,
+				PeerActiveLimit: 8,
+			}))
+		})
+
+		It("tracks the connection IDs that packets are routed by", func() {
+			tracer.connIDs = newConnIDTable(4, clk)
+			t = tracer.TracerForConnection(logging.PerspectiveServer, logging.ConnectionID{1, 2, 3, 4})
+			t.StartedConnection(localAddr, remoteAddr, 0, logging.ConnectionID{0xa, 0xa, 0xa, 0xa}, nil)
+			t.SentPacket(shortHeader, 100, nil, []logging.Frame{
+				&logging.NewConnectionIDFrame{SequenceNumber: 1, ConnectionID: logging.ConnectionID{0xb, 0xb, 0xb, 0xb}},
+				&logging.NewConnectionIDFrame{SequenceNumber: 2, ConnectionID: logging.ConnectionID{0xc, 0xc, 0xc, 0xc}},
+			})
+			Expect(tracer.connIDs.active).To(HaveLen(3))
+			// the peer retires the first connection ID
+			t.ReceivedPacket(shortHeader, 100, []logging.Frame{&logging.RetireConnectionIDFrame{SequenceNumber: 0}})
+			Expect(tracer.connIDs.active).To(HaveLen(2))
+			Expect(tracer.connIDs.retiredAt).To(HaveKey(string([]byte{0xa, 0xa, 0xa, 0xa})))
+			// the other connection IDs are retired when the connection is closed
+			t.Close()
+			Expect(tracer.connIDs.active).To(BeEmpty())
+			Expect(tracer.connIDs.retiredAt).To(HaveLen(3))
+		})
+
+		It("counts frames without allocating", func() {
+			frames := []logging.Frame{&logging.StreamFrame{}, &logging.MaxDataFrame{}, &logging.PingFrame{}}
+			var counts frameCounts
+			Expect(testing.AllocsPerRun(100, func() { counts.Add(frames) })).To(BeZero())
+		})
+
+		It("tracks the idle time", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			hdr := &logging.ExtendedHeader{}
+			t.SentPacket(hdr, 1200, nil, nil)
+			clk.now = clk.now.Add(time.Second)
+			t.ReceivedPacket(hdr, 1200, nil)
+			// short gaps don't count
+			Expect(c.Stats().IdleTime).To(BeZero())
+			clk.now = clk.now.Add(10 * time.Second)
+			t.SentPacket(hdr, 1200, nil, nil)
+			clk.now = clk.now.Add(time.Second)
+			t.ReceivedPacket(hdr, 1200, nil)
+			stats := c.Stats()
+			Expect(stats.IdleTime).To(Equal(10 * time.Second))
+			Expect(stats.Lifetime).To(Equal(12 * time.Second))
+			// the current gap is included, once it's long enough
+			clk.now = clk.now.Add(3 * time.Second)
+			Expect(c.Stats().IdleTime).To(Equal(10 * time.Second))
+			clk.now = clk.now.Add(5 * time.Second)
+			stats = c.Stats()
+			Expect(stats.IdleTime).To(Equal(18 * time.Second))
+			Expect(stats.Lifetime).To(Equal(20 * time.Second))
+			Expect(stats.IdleFraction()).To(Equal(0.9))
+			// the lifetime ends when the connection is closed
+			t.ClosedConnection(logging.CloseReason{})
+			clk.now = clk.now.Add(time.Hour)
+			Expect(c.Stats().Lifetime).To(Equal(20 * time.Second))
+			Expect(ConnectionStats{}.IdleFraction()).To(BeZero())
+		})
+
+		It("estimates the throughput", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			hdr := &logging.ExtendedHeader{}
+			for i := 0; i < 4; i++ {
+				t.SentPacket(hdr, 1000, nil, nil)
+				t.ReceivedPacket(hdr, 500, nil)
+				clk.now = clk.now.Add(time.Second)
+			}
+			stats := c.Stats()
+			Expect(stats.SendThroughput).To(BeNumerically(">", 0))
+			Expect(stats.SendThroughput).To(BeNumerically("<", 1000))
+			Expect(stats.ReceiveThroughput).To(Equal(stats.SendThroughput / 2))
+			Expect(stats.PeakSendThroughput).To(Equal(stats.SendThroughput))
+			Expect(stats.MeanSendThroughput).To(Equal(1000.0))
+			Expect(stats.MeanReceiveThroughput).To(Equal(500.0))
+			// the estimate decays while the connection is idle, the peak doesn't
+			clk.now = clk.now.Add(10 * time.Second)
+			stats = c.Stats()
+			Expect(stats.SendThroughput).To(BeNumerically("<", 100))
+			Expect(stats.PeakSendThroughput).To(BeNumerically(">", 500))
+		})
+
+		It("counts the packets received with the ECN Congestion Experienced mark", func() {
+			initial := &logging.ExtendedHeader{Header: logging.Header{IsLongHeader: true, Type: 1, Version: 0xff00001d}}
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			t.SentPacket(initial, 1200, &logging.AckFrame{AckRanges: []logging.AckRange{{Smallest: 0, Largest: 0}}, ECNCE: 1}, nil)
+			t.SentPacket(shortHeader, 1200, &logging.AckFrame{AckRanges: []logging.AckRange{{Smallest: 0, Largest: 3}}, ECNCE: 2}, nil)
+			// the counts are cumulative
+			t.SentPacket(shortHeader, 1200, &logging.AckFrame{AckRanges: []logging.AckRange{{Smallest: 0, Largest: 5}}, ECNCE: 3}, nil)
+			t.SentPacket(shortHeader, 1200, &logging.AckFrame{AckRanges: []logging.AckRange{{Smallest: 0, Largest: 6}}, ECNCE: 3}, nil)
+			Expect(c.Stats().CEMarksReceived).To(BeEquivalentTo(4))
+		})
+
+		It("estimates the resources held by the connection", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			t.BufferedPacket(logging.PacketTypeHandshake)
+			t.BufferedPacket(logging.PacketType1RTT)
+			t.BufferedPacket(logging.PacketType1RTT)
+			Expect(c.Stats().Resources.BufferedPackets).To(BeEquivalentTo(3))
+			t.UpdatedKeyFromTLS(logging.EncryptionHandshake, logging.PerspectiveServer)
+			Expect(c.Stats().Resources.BufferedPackets).To(BeEquivalentTo(2))
+			t.UpdatedKeyFromTLS(logging.Encryption1RTT, logging.PerspectiveServer)
+			Expect(c.Stats().Resources.BufferedPackets).To(BeZero())
+			Expect(c.Stats().Resources.MaxBufferedPackets).To(BeEquivalentTo(3))
+
+			t.SentTransportParameters(&logging.TransportParameters{InitialMaxData: 1000})
+			Expect(c.Stats().Resources.CommittedReceiveWindow).To(BeEquivalentTo(1000))
+			t.SentPacket(shortHeader, 1200, nil, []logging.Frame{&logging.StreamFrame{StreamID: 0, Length: 100}})
+			t.ReceivedPacket(shortHeader, 1200, []logging.Frame{
+				&logging.StreamFrame{StreamID: 0, Length: 600},
+				&logging.StreamFrame{StreamID: 4, Length: 100},
+			})
+			stats := c.Stats().Resources
+			Expect(stats.OpenStreams).To(BeEquivalentTo(2))
+			Expect(stats.CommittedReceiveWindow).To(BeEquivalentTo(300))
+			t.SentPacket(shortHeader, 1200, nil, []logging.Frame{&logging.MaxDataFrame{MaximumData: 2000}})
+			t.ReceivedPacket(shortHeader, 1200, []logging.Frame{&logging.StreamFrame{StreamID: 4, Offset: 100, Fin: true}})
+			t.SentPacket(shortHeader, 1200, nil, []logging.Frame{&logging.StreamFrame{StreamID: 4, Fin: true}})
+			stats = c.Stats().Resources
+			Expect(stats.OpenStreams).To(BeEquivalentTo(1))
+			Expect(stats.MaxOpenStreams).To(BeEquivalentTo(2))
+			Expect(stats.CommittedReceiveWindow).To(BeEquivalentTo(1300))
+			Expect(stats.MaxCommittedReceiveWindow).To(BeEquivalentTo(1300))
+		})
+
+		It("measures the handshake flight and detects amplification stalls", func() {
+			initial := &logging.ExtendedHeader{Header: logging.Header{IsLongHeader: true, Type: 1, Version: 0xff00001d}}
+			handshake := &logging.ExtendedHeader{Header: logging.Header{IsLongHeader: true, Type: 3, Version: 0xff00001d}}
+			t := tracer.TracerForConnection(logging.PerspectiveServer, logging.ConnectionID{1, 2, 3, 4})
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := t.(*statsConnectionTracer)
+			t.ReceivedPacket(initial, 1200, nil)
+			t.SentPacket(initial, 200, nil, nil)
+			t.SentPacket(handshake, 1200, nil, nil)
+			Expect(c.Stats().AmplificationStalled).To(BeFalse())
+			t.SentPacket(handshake, 1000, nil, nil)
+			Expect(c.Stats().AmplificationStalled).To(BeTrue())
+			// the client's address is validated, packets sent afterwards don't count
+			t.ReceivedPacket(handshake, 100, nil)
+			t.SentPacket(handshake, 50, nil, nil)
+			t.SentPacket(shortHeader, 1000, nil, nil)
+			// Handshake packets sent after the first 1-RTT packet are not part of the flight
+			t.SentPacket(handshake, 50, nil, nil)
+			Expect(c.Stats().HandshakeFlightSize).To(BeEquivalentTo(2250))
+		})
+
+		It("doesn't detect amplification stalls for outbound connections", func() {
+			handshake := &logging.ExtendedHeader{Header: logging.Header{IsLongHeader: true, Type: 3, Version: 0xff00001d}}
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			t.SentPacket(handshake, 1200, nil, nil)
+			t.SentPacket(handshake, 1200, nil, nil)
+			Expect(c.Stats().AmplificationStalled).To(BeFalse())
+			Expect(c.Stats().HandshakeFlightSize).To(BeEquivalentTo(2400))
+		})
+
+		It("records the times of the handshake milestones", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			Expect(c.Stats().Handshake).To(BeZero())
+			clk.now = clk.now.Add(10 * time.Millisecond)
+			t.UpdatedKeyFromTLS(logging.EncryptionHandshake, logging.PerspectiveServer)
+			clk.now = clk.now.Add(10 * time.Millisecond)
+			t.UpdatedKeyFromTLS(logging.Encryption1RTT, logging.PerspectiveServer)
+			clk.now = clk.now.Add(10 * time.Millisecond)
+			t.UpdatedKeyFromTLS(logging.Encryption1RTT, logging.PerspectiveClient)
+			t.DroppedEncryptionLevel(logging.EncryptionInitial)
+			clk.now = clk.now.Add(10 * time.Millisecond)
+			t.DroppedEncryptionLevel(logging.EncryptionHandshake)
+			Expect(c.Stats().Handshake).To(Equal(HandshakeTimings{
+				OneRTTKeysInstalled: 20 * time.Millisecond,
+				HandshakeConfirmed:  40 * time.Millisecond,
+			}))
+		})
+
+		It("keeps durations sane when the wall clock jumps", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			c := tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)
+			clk.now = clk.now.Add(10 * time.Millisecond)
+			t.UpdatedKeyFromTLS(logging.Encryption1RTT, logging.PerspectiveClient)
+			// The fake clock doesn't have a monotonic reading, so this looks like the wall clock being stepped back.
+			// The real clock is not affected by such jumps.
+			clk.now = clk.now.Add(-time.Hour)
+			t.DroppedEncryptionLevel(logging.EncryptionHandshake)
+			stats := c.Stats()
+			Expect(stats.Handshake.OneRTTKeysInstalled).To(Equal(10 * time.Millisecond))
+			// the handshake was confirmed, even though the time can't be determined
+			Expect(stats.Handshake.HandshakeConfirmed).To(BeNumerically(">", 0))
+			Expect(stats.Lifetime).To(BeNumerically(">", 0))
+			Expect(stats.IdleTime).To(BeZero())
+		})
+
+		It("records the handshake milestones of a connection", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+
+			for _, c := range []interface{}{conn, serverConn} {
+				var h HandshakeTimings
+				Eventually(func() time.Duration {
+					h = c.(ConnectionStatsReporter).Stats().Handshake
+					return h.HandshakeConfirmed
+				}).ShouldNot(BeZero())
+				Expect(h.FirstInitialSent).ToNot(BeZero())
+				Expect(h.FirstInitialReceived).ToNot(BeZero())
+				Expect(h.FirstHandshakeSent).ToNot(BeZero())
+				Expect(h.FirstHandshakeReceived).ToNot(BeZero())
+				Expect(h.OneRTTKeysInstalled).ToNot(BeZero())
+			}
+			client := conn.(ConnectionStatsReporter).Stats().Handshake
+			Expect(client.FirstInitialSent).To(BeNumerically("<", client.FirstInitialReceived))
+			Expect(client.FirstInitialReceived).To(BeNumerically("<=", client.HandshakeConfirmed))
+		})
+
+		It("matches connection tracers to sessions", func() {
+			Expect(tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)).To(BeNil())
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			t2 := tracer.TracerForConnection(logging.PerspectiveClient, logging.ConnectionID{5, 6, 7, 8})
+			t2.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			// different perspective
+			Expect(tracer.claim(logging.PerspectiveServer, localAddr, remoteAddr)).To(BeNil())
+			Expect(tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)).To(Equal(t))
+			Expect(tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)).To(Equal(t2))
+			Expect(tracer.claim(logging.PerspectiveClient, localAddr, remoteAddr)).To(BeNil())
+			Expect(tracer.pending).To(BeEmpty())
+		})
+
+		It("forgets connections that were never claimed", func() {
+			t.StartedConnection(localAddr, remoteAddr, 0, nil, nil)
+			Expect(tracer.pending).To(HaveLen(1))
+			t.Close()
+			Expect(tracer.pending).To(BeEmpty())
+		})
+
+		It("reports the statistics of a connection", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+
+			Expect(conn.(ConnectionStatsReporter).Stats().MaxCongestionWindow).ToNot(BeZero())
+			for _, c := range []tpt.CapableConn{conn, serverConn} {
+				tlsDetails := c.(ConnectionStatsReporter).Stats().TLS
+				Expect(tlsDetails).ToNot(BeNil())
+				Expect(tlsDetails.CipherSuite).To(HavePrefix("TLS_"))
+				Expect(tlsDetails.RemoteKeyType).To(Equal("Ed25519"))
+				Expect(tlsDetails.CertificateExtension).To(BeTrue())
+				Expect(c.(ConnectionStatsReporter).Stats().ECN).To(Equal(runtime.GOOS == "linux" || runtime.GOOS == "darwin"))
+			}
+			serverStats := serverConn.(ConnectionStatsReporter).Stats()
+			Expect(serverStats.HandshakeFlightSize).ToNot(BeZero())
+			Expect(serverStats.AmplificationStalled).To(BeFalse())
+			Eventually(func() int64 {
+				return serverConn.(ConnectionStatsReporter).Stats().MaxCongestionWindow
+			}).ShouldNot(BeZero())
+			Expect(serverTransport.(*transport).statsTracer.pending).To(BeEmpty())
+			Expect(clientTransport.(*transport).statsTracer.pending).To(BeEmpty())
+		})
+	})
+})
+
+// BenchmarkFrameCounts counts the frames of a typical 1-RTT packet.
+func BenchmarkFrameCounts(b *testing.B) {
+	frames := []logging.Frame{
+		&logging.AckFrame{},
+		&logging.StreamFrame{},
+		&logging.StreamFrame{},
+		&logging.MaxStreamDataFrame{},
+	}
+	var counts frameCounts
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		counts.Add(frames)
+	}
+}
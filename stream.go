@@ -1,6 +1,9 @@
 package libp2pquic
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/libp2p/go-libp2p-core/mux"
 
 	quic "github.com/lucas-clemente/quic-go"
@@ -10,31 +13,92 @@ const (
 	reset quic.ErrorCode = 0
 )
 
+// A StreamResetError is returned by Read and Write when a stream was reset with a non-zero error code.
+// Streams reset with error code 0 return mux.ErrReset.
+type StreamResetError struct {
+	ErrorCode uint64
+	// Remote is true if the stream was reset by the peer.
+	Remote bool
+}
+
+var _ error = &StreamResetError{}
+
+func (e *StreamResetError) Error() string {
+	side := "locally"
+	if e.Remote {
+		side = "remotely"
+	}
+	return fmt.Sprintf("stream reset %s (error code %d)", side, e.ErrorCode)
+}
+
+// Is makes errors.Is(err, mux.ErrReset) return true for every reset.
+func (e *StreamResetError) Is(target error) bool {
+	return target == mux.ErrReset
+}
+
+// A ResettableStream is a stream that can be reset with an application error code.
+type ResettableStream interface {
+	mux.MuxedStream
+	// ResetWithCode resets both directions of the stream using the given error code.
+	ResetWithCode(code uint64) error
+}
+
 type stream struct {
 	quic.Stream
+
+	mutex sync.Mutex
+	// set if the stream was reset by calling Reset or ResetWithCode
+	resetLocally   bool
+	localResetCode uint64
 }
 
 func (s *stream) Read(b []byte) (n int, err error) {
 	n, err = s.Stream.Read(b)
-	if serr, ok := err.(quic.StreamError); ok && serr.Canceled() {
-		err = mux.ErrReset
-	}
-
-	return n, err
+	return n, s.convertError(err)
 }
 
 func (s *stream) Write(b []byte) (n int, err error) {
 	n, err = s.Stream.Write(b)
+	return n, s.convertError(err)
+}
+
+func (s *stream) convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	// quic-go returns a StreamError with Canceled() set when the peer reset the stream.
 	if serr, ok := err.(quic.StreamError); ok && serr.Canceled() {
-		err = mux.ErrReset
+		return resetError(uint64(serr.ErrorCode()), true)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.resetLocally {
+		return resetError(s.localResetCode, false)
 	}
+	return err
+}
 
-	return n, err
+func resetError(code uint64, remote bool) error {
+	if code == uint64(reset) {
+		return mux.ErrReset
+	}
+	return &StreamResetError{ErrorCode: code, Remote: remote}
 }
 
 func (s *stream) Reset() error {
-	s.Stream.CancelRead(reset)
-	s.Stream.CancelWrite(reset)
+	return s.ResetWithCode(uint64(reset))
+}
+
+// ResetWithCode resets the stream using the given application error code.
+func (s *stream) ResetWithCode(code uint64) error {
+	s.mutex.Lock()
+	if !s.resetLocally {
+		s.resetLocally = true
+		s.localResetCode = code
+	}
+	s.mutex.Unlock()
+	s.Stream.CancelRead(quic.ErrorCode(code))
+	s.Stream.CancelWrite(quic.ErrorCode(code))
 	return nil
 }
 
@@ -53,3 +117,4 @@ func (s *stream) CloseWrite() error {
 }
 
 var _ mux.MuxedStream = &stream{}
+var _ ResettableStream = &stream{}
@@ -0,0 +1,105 @@
+package libp2pquic
+
+import "github.com/lucas-clemente/quic-go/logging"
+
+// streamTracker tracks the open streams of a connection, and the stream data received,
+// using the STREAM and RESET_STREAM frames sent and received.
+// quic-go doesn't report when streams are opened and closed, so this is an approximation.
+// A stream is considered open from the first frame sent or received on it. Streams opened implicitly, by opening
+// a stream with a higher stream ID of the same type, are missed if their first frame arrives after that.
+// A stream is considered closed once a FIN or a RESET_STREAM was both sent and received, or, for unidirectional
+// streams, either sent or received. The application might still hold on to a closed stream,
+// and a bidirectional stream that is only used in one direction is never closed.
+// It is only used on quic-go's run loop.
+type streamTracker struct {
+	streams map[logging.StreamID]trackedStream
+	// highest is the highest stream ID seen, per stream type (the two least significant bits of the stream ID).
+	highest [4]logging.StreamID
+	// received is the sum of the highest offsets received on all streams.
+	received uint64
+}
+
+type trackedStream struct {
+	finSent, finReceived bool
+	highestReceived      logging.ByteCount
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{highest: [4]logging.StreamID{-1, -1, -1, -1}}
+}
+
+// Open returns the number of open streams.
+func (t *streamTracker) Open() int { return len(t.streams) }
+
+// ReceivedBytes returns the number of bytes received on all streams, not counting retransmissions.
+func (t *streamTracker) ReceivedBytes() uint64 { return t.received }
+
+// SentFrames processes the frames of a packet sent.
+func (t *streamTracker) SentFrames(frames []logging.Frame) {
+	for _, f := range frames {
+		switch f := f.(type) {
+		case *logging.StreamFrame:
+			if s, ok := t.get(f.StreamID); ok {
+				s.finSent = s.finSent || f.Fin
+				t.put(f.StreamID, s)
+			}
+		case *logging.ResetStreamFrame:
+			if s, ok := t.get(f.StreamID); ok {
+				s.finSent = true
+				t.put(f.StreamID, s)
+			}
+		}
+	}
+}
+
+// ReceivedFrames processes the frames of a packet received.
+func (t *streamTracker) ReceivedFrames(frames []logging.Frame) {
+	for _, f := range frames {
+		switch f := f.(type) {
+		case *logging.StreamFrame:
+			if s, ok := t.get(f.StreamID); ok {
+				t.receivedUpTo(&s, f.Offset+f.Length)
+				s.finReceived = s.finReceived || f.Fin
+				t.put(f.StreamID, s)
+			}
+		case *logging.ResetStreamFrame:
+			if s, ok := t.get(f.StreamID); ok {
+				t.receivedUpTo(&s, f.FinalSize)
+				s.finReceived = true
+				t.put(f.StreamID, s)
+			}
+		}
+	}
+}
+
+func (t *streamTracker) receivedUpTo(s *trackedStream, offset logging.ByteCount) {
+	if offset > s.highestReceived {
+		t.received += uint64(offset - s.highestReceived)
+		s.highestReceived = offset
+	}
+}
+
+// get returns the state of a stream. Streams that were already closed are not returned.
+func (t *streamTracker) get(id logging.StreamID) (trackedStream, bool) {
+	if s, ok := t.streams[id]; ok {
+		return s, true
+	}
+	if id <= t.highest[id&0x3] {
+		return trackedStream{}, false
+	}
+	t.highest[id&0x3] = id
+	return trackedStream{}, true
+}
+
+// put stores the state of a stream, or removes the stream once it is closed.
+func (t *streamTracker) put(id logging.StreamID, s trackedStream) {
+	unidirectional := id&0x2 != 0
+	if (unidirectional && (s.finSent || s.finReceived)) || (s.finSent && s.finReceived) {
+		delete(t.streams, id)
+		return
+	}
+	if t.streams == nil {
+		t.streams = make(map[logging.StreamID]trackedStream)
+	}
+	t.streams[id] = s
+}
@@ -0,0 +1,62 @@
+package libp2pquic
+
+import (
+	"github.com/lucas-clemente/quic-go/logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stream Tracker", func() {
+	var t *streamTracker
+
+	BeforeEach(func() {
+		t = newStreamTracker()
+	})
+
+	stream := func(id logging.StreamID, offset, length logging.ByteCount, fin bool) []logging.Frame {
+		return []logging.Frame{&logging.StreamFrame{StreamID: id, Offset: offset, Length: length, Fin: fin}}
+	}
+
+	It("closes bidirectional streams once they are finished in both directions", func() {
+		t.SentFrames(stream(0, 0, 100, false))
+		t.SentFrames(stream(4, 0, 100, false))
+		Expect(t.Open()).To(Equal(2))
+		t.SentFrames(stream(0, 100, 0, true))
+		Expect(t.Open()).To(Equal(2))
+		t.ReceivedFrames(stream(0, 0, 50, true))
+		Expect(t.Open()).To(Equal(1))
+		t.ReceivedFrames([]logging.Frame{&logging.ResetStreamFrame{StreamID: 4, FinalSize: 10}})
+		t.SentFrames([]logging.Frame{&logging.ResetStreamFrame{StreamID: 4}})
+		Expect(t.Open()).To(BeZero())
+	})
+
+	It("closes unidirectional streams once they are finished", func() {
+		t.ReceivedFrames(stream(3, 0, 100, false))
+		Expect(t.Open()).To(Equal(1))
+		t.ReceivedFrames(stream(3, 100, 100, true))
+		Expect(t.Open()).To(BeZero())
+	})
+
+	It("ignores frames for closed streams", func() {
+		t.SentFrames(stream(0, 0, 100, true))
+		t.ReceivedFrames(stream(0, 0, 100, true))
+		Expect(t.Open()).To(BeZero())
+		// a retransmission
+		t.SentFrames(stream(0, 0, 100, true))
+		Expect(t.Open()).To(BeZero())
+		// streams of a different type are tracked separately
+		t.ReceivedFrames(stream(1, 0, 100, false))
+		Expect(t.Open()).To(Equal(1))
+	})
+
+	It("counts the bytes received, without retransmissions", func() {
+		t.ReceivedFrames(stream(1, 0, 100, false))
+		t.ReceivedFrames(stream(1, 0, 100, false))
+		t.ReceivedFrames(stream(1, 200, 100, false))
+		t.ReceivedFrames(stream(5, 0, 50, false))
+		Expect(t.ReceivedBytes()).To(BeEquivalentTo(350))
+		t.ReceivedFrames([]logging.Frame{&logging.ResetStreamFrame{StreamID: 5, FinalSize: 80}})
+		Expect(t.ReceivedBytes()).To(BeEquivalentTo(380))
+	})
+})
@@ -0,0 +1,75 @@
+package libp2pquic
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// throughputBucket is the interval over which bytes are summed before they are fed into the throughput estimate.
+const throughputBucket = time.Second
+
+// throughputAlpha is the weight of the most recent bucket in the throughput estimate.
+const throughputAlpha = 0.25
+
+// throughputEstimator estimates the throughput of one direction of a connection, in bytes per second.
+// It sums the bytes of every 1 second bucket, and calculates an exponentially weighted moving average
+// over the buckets. Buckets are rotated lazily when bytes are added, so no timer is needed.
+// Add must not be called concurrently. Rate and Peak may be called concurrently with Add.
+type throughputEstimator struct {
+	// accessed atomically
+	bucket      int64  // index of the current bucket, counted from the start of the connection
+	bucketBytes uint64 // bytes added to the current bucket
+	rate        uint64 // float64 bits, the estimate over all buckets before the current one
+	peak        uint64 // float64 bits, the highest estimate
+}
+
+// Add adds bytes sent or received at the given time, in nanoseconds since the start of the connection.
+func (e *throughputEstimator) Add(now int64, bytes uint64) {
+	if bucket := now / int64(throughputBucket); bucket > atomic.LoadInt64(&e.bucket) {
+		rate := e.rateAt(bucket)
+		atomic.StoreUint64(&e.rate, math.Float64bits(rate))
+		atomic.StoreUint64(&e.bucketBytes, 0)
+		atomic.StoreInt64(&e.bucket, bucket)
+	}
+	atomic.AddUint64(&e.bucketBytes, bytes)
+}
+
+// rateAt returns the estimate over all buckets before the given bucket.
+// Buckets that no bytes were added to count as 0 bytes.
+func (e *throughputEstimator) rateAt(bucket int64) float64 {
+	rate := math.Float64frombits(atomic.LoadUint64(&e.rate))
+	current := atomic.LoadInt64(&e.bucket)
+	if bucket <= current {
+		return rate
+	}
+	bytesPerSecond := float64(atomic.LoadUint64(&e.bucketBytes)) / throughputBucket.Seconds()
+	rate = throughputAlpha*bytesPerSecond + (1-throughputAlpha)*rate
+	e.updatePeak(rate)
+	if empty := bucket - current - 1; empty > 0 {
+		rate *= math.Pow(1-throughputAlpha, float64(empty))
+	}
+	return rate
+}
+
+// updatePeak updates the highest estimate.
+// Rate might be called concurrently with Add, so it uses a compare-and-swap loop.
+func (e *throughputEstimator) updatePeak(rate float64) {
+	for {
+		peak := atomic.LoadUint64(&e.peak)
+		if rate <= math.Float64frombits(peak) || atomic.CompareAndSwapUint64(&e.peak, peak, math.Float64bits(rate)) {
+			return
+		}
+	}
+}
+
+// Rate returns the current estimate, in bytes per second.
+// The bucket that the given time falls into is not complete yet, and is not taken into account.
+func (e *throughputEstimator) Rate(now int64) float64 {
+	return e.rateAt(now / int64(throughputBucket))
+}
+
+// Peak returns the highest estimate, in bytes per second.
+func (e *throughputEstimator) Peak() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&e.peak))
+}
@@ -0,0 +1,51 @@
+package libp2pquic
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Throughput Estimation", func() {
+	const second = int64(time.Second)
+
+	It("returns 0 without any bytes", func() {
+		var e throughputEstimator
+		Expect(e.Rate(10 * second)).To(BeZero())
+		Expect(e.Peak()).To(BeZero())
+	})
+
+	It("doesn't take the current bucket into account", func() {
+		var e throughputEstimator
+		e.Add(0, 1000)
+		e.Add(second/2, 1000)
+		Expect(e.Rate(second - 1)).To(BeZero())
+		Expect(e.Rate(second)).To(Equal(throughputAlpha * 2000))
+	})
+
+	It("converges to a constant rate", func() {
+		var e throughputEstimator
+		for i := int64(0); i < 100; i++ {
+			e.Add(i*second, 1e6)
+		}
+		Expect(e.Rate(100 * second)).To(BeNumerically("~", 1e6, 1))
+		Expect(e.Peak()).To(BeNumerically("~", 1e6, 1))
+	})
+
+	It("decays the estimate when no bytes are added", func() {
+		var e throughputEstimator
+		e.Add(0, 1000)
+		rate := e.Rate(second)
+		Expect(rate).To(Equal(throughputAlpha * 1000))
+		// buckets without any bytes count as 0
+		Expect(e.Rate(3 * second)).To(Equal(rate * (1 - throughputAlpha) * (1 - throughputAlpha)))
+		e.Add(3*second, 1000)
+		Expect(e.Rate(4 * second)).To(Equal(rate*(1-throughputAlpha)*(1-throughputAlpha)*(1-throughputAlpha) + throughputAlpha*1000))
+		// the decay doesn't lower the peak
+		Expect(e.Peak()).To(Equal(e.Rate(4 * second)))
+		e.Add(20*second, 0)
+		Expect(e.Rate(20 * second)).To(BeNumerically("<", 10))
+		Expect(e.Peak()).To(BeNumerically(">", 300))
+	})
+})
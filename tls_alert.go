@@ -0,0 +1,60 @@
+package libp2pquic
+
+// QUIC transport errors in the CRYPTO_ERROR range carry a TLS alert: the error code is 0x100 + alert.
+const (
+	cryptoErrorStart = 0x100
+	cryptoErrorEnd   = 0x1ff
+)
+
+// tlsAlertNames are the descriptions of the TLS alerts, as defined in the TLS alert registry.
+var tlsAlertNames = map[uint8]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	21:  "decryption_failed",
+	22:  "record_overflow",
+	30:  "decompression_failure",
+	40:  "handshake_failure",
+	41:  "no_certificate",
+	42:  "bad_certificate",
+	43:  "unsupported_certificate",
+	44:  "certificate_revoked",
+	45:  "certificate_expired",
+	46:  "certificate_unknown",
+	47:  "illegal_parameter",
+	48:  "unknown_ca",
+	49:  "access_denied",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	60:  "export_restriction",
+	70:  "protocol_version",
+	71:  "insufficient_security",
+	80:  "internal_error",
+	86:  "inappropriate_fallback",
+	90:  "user_canceled",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	111: "certificate_unobtainable",
+	112: "unrecognized_name",
+	113: "bad_certificate_status_response",
+	114: "bad_certificate_hash_value",
+	115: "unknown_psk_identity",
+	116: "certificate_required",
+	120: "no_application_protocol",
+}
+
+// tlsAlertFromErrorCode decodes the TLS alert from a transport error code.
+// It returns false if the error code is not in the CRYPTO_ERROR range.
+// Alerts that are not in the registry are described as "unknown".
+func tlsAlertFromErrorCode(code uint64) (alert uint8, description string, ok bool) {
+	if code < cryptoErrorStart || code > cryptoErrorEnd {
+		return 0, "", false
+	}
+	alert = uint8(code - cryptoErrorStart)
+	description, ok = tlsAlertNames[alert]
+	if !ok {
+		description = "unknown"
+	}
+	return alert, description, true
+}
@@ -2,9 +2,15 @@ package libp2pquic
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
@@ -14,86 +20,499 @@ import (
 	"github.com/lucas-clemente/quic-go/qlog"
 )
 
-var tracer logging.Tracer
+// defaultQlogMaxFileSize is the default size limit of a qlog file, after compression.
+// It can be changed using the QLOGMAXSIZE environment variable (in bytes).
+const defaultQlogMaxFileSize = 100 << 20
 
-func init() {
-	tracers := []logging.Tracer{metrics.NewTracer()}
-	if qlogDir := os.Getenv("QLOGDIR"); len(qlogDir) > 0 {
-		if qlogger := initQlogger(qlogDir); qlogger != nil {
-			tracers = append(tracers, qlogger)
+var metricsTracer = metrics.NewTracer()
+
+// qlogConfig configures where the qlogs of a transport's connections are written to.
+type qlogConfig struct {
+	// dir is the directory that qlogs are written to. Empty if qlogs are not written to disk.
+	dir string
+	// subdir is the template for the subdirectory of dir that qlogs are written to, e.g. {date}/{role}.
+	// By default, qlogs are written to dir itself.
+	subdir string
+	// maxSize is the size limit of a qlog file, after compression. 0 means defaultQlogMaxFileSize.
+	maxSize int64
+	// socket is the path of the unix domain socket that qlogs are streamed on. Empty if qlogs are not streamed.
+	socket string
+	// tags are added to every entry of the qlog index.
+	tags map[string]string
+	// retain is the set of close reasons that qlogs are kept for. nil if all qlogs are kept.
+	retain map[string]struct{}
+}
+
+// qlogConfigFromEnv reads the qlog configuration from the QLOGDIR, QLOGDIRTEMPLATE, QLOGMAXSIZE and QLOGSOCKET
+// environment variables. Invalid values are logged and ignored.
+func qlogConfigFromEnv() qlogConfig {
+	cfg := qlogConfig{
+		dir:    os.Getenv("QLOGDIR"),
+		socket: os.Getenv("QLOGSOCKET"),
+	}
+	if s := os.Getenv("QLOGMAXSIZE"); len(s) > 0 {
+		size, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || size <= 0 {
+			log.Errorf("invalid QLOGMAXSIZE: %s", s)
+		} else {
+			cfg.maxSize = size
 		}
 	}
-	tracer = logging.NewMultiplexedTracer(tracers...)
+	if s := os.Getenv("QLOGDIRTEMPLATE"); len(s) > 0 {
+		subdir, err := parseQlogDirTemplate(s)
+		if err != nil {
+			log.Errorf("invalid QLOGDIRTEMPLATE: %s", err)
+		} else {
+			cfg.subdir = subdir
+		}
+	}
+	return cfg
+}
+
+// qlogConfig returns the qlog configuration of the transport.
+// The environment variables are read every time a transport is created, and can be overridden using options.
+func (c *config) qlogConfig() qlogConfig {
+	cfg := qlogConfigFromEnv()
+	if c.qlogDir != nil {
+		cfg.dir = *c.qlogDir
+	}
+	if c.qlogSocket != nil {
+		cfg.socket = *c.qlogSocket
+	}
+	cfg.tags = c.statsTags
+	cfg.retain = c.qlogRetention
+	return cfg
+}
+
+// newTracer returns the tracer for the connections of a transport.
+// The stats tracer collects the statistics reported by the transport, the qlog tracer writes qlogs.
+// Both may be nil.
+// newTracer returns nil if neither stats, metrics, qlog nor event recording are enabled.
+func newTracer(cfg *config, stats *statsTracer, qlog *qlogTracer) logging.Tracer {
+	var tracers []logging.Tracer
+	if stats != nil {
+		tracers = append(tracers, stats)
+	}
+	if !cfg.disableMetrics {
+		tracers = append(tracers, metricsTracer)
+	}
+	if qlog != nil {
+		tracers = append(tracers, qlog)
+	}
+	if cfg.newEventRecorder != nil {
+		tracers = append(tracers, &eventTracer{newRecorder: cfg.newEventRecorder, clock: realClock{}, stats: stats})
+	}
+	switch len(tracers) {
+	case 0:
+		return nil
+	case 1:
+		return tracers[0]
+	default:
+		return logging.NewMultiplexedTracer(tracers...)
+	}
+}
+
+// A clock returns the current time.
+// It is used instead of calling time.Now directly, so that tests can control the time.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// parseQlogDirTemplate parses a directory template, and returns the template for the subdirectory.
+// The template must start with {dir}, the QLOGDIR. It may contain {date} and {role}.
+func parseQlogDirTemplate(template string) (string, error) {
+	if !strings.HasPrefix(template, "{dir}") {
+		return "", fmt.Errorf("%s doesn't start with {dir}", template)
+	}
+	subdir := filepath.Clean("/" + strings.TrimPrefix(template, "{dir}"))[1:]
+	if strings.Contains(strings.NewReplacer("{date}", "", "{role}", "").Replace(subdir), "{") {
+		return "", fmt.Errorf("%s contains an unknown placeholder", template)
+	}
+	return subdir, nil
 }
 
-func initQlogger(qlogDir string) logging.Tracer {
-	return qlog.NewTracer(func(role logging.Perspective, connID []byte) io.WriteCloser {
+// qlogDirFor returns the directory for a qlog.
+func qlogDirFor(qlogDir, subdir string, now time.Time, role logging.Perspective) string {
+	if len(subdir) == 0 {
+		return qlogDir
+	}
+	r := strings.NewReplacer("{date}", now.UTC().Format("2006-01-02"), "{role}", perspectiveString(role))
+	return filepath.Join(qlogDir, r.Replace(subdir))
+}
+
+// qlogTracer writes the qlogs of a transport's connections to disk, and streams them.
+// It is owned by the transport, and closed when the transport is shut down.
+type qlogTracer struct {
+	logging.Tracer
+
+	dir      string
+	index    *qlogIndex    // nil if qlogs are not written to disk
+	streamer *qlogStreamer // nil if qlogs are not streamed
+	stats    qlogStats
+	// resources counts the go routines and files of the qlog subsystem.
+	// Once the tracer is closed and all connections are closed, both counts are 0.
+	resources resourceCounts
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newQlogTracer returns a tracer that writes qlogs to the configured directory, and streams them on the configured socket.
+// Either of them may be unset. It returns nil if both are unset, or if the socket can't be opened
+// and qlogs are not written to disk.
+// The qlogs written to disk are listed in an index file (see qlogIndex).
+func newQlogTracer(cfg qlogConfig) *qlogTracer {
+	t := &qlogTracer{}
+	if len(cfg.socket) > 0 {
+		streamer, err := newQlogStreamer(cfg.socket, &t.resources)
+		if err != nil {
+			log.Errorf("serving qlogs on %s failed: %s", cfg.socket, err)
+		} else {
+			t.streamer = streamer
+		}
+	}
+	if len(cfg.dir) > 0 {
+		t.dir = cfg.dir
+		t.index = newQlogIndex(cfg.dir, realClock{})
+		t.index.tags = cfg.tags
+		t.index.resources = &t.resources
+	}
+	if t.index == nil && t.streamer == nil {
+		return nil
+	}
+	index, streamer := t.index, t.streamer
+	tracer := qlog.NewTracer(func(role logging.Perspective, connID []byte) io.WriteCloser {
+		if index == nil {
+			return streamer.NewWriter(connID)
+		}
+		info := index.connInfo(role, connID)
 		// create the QLOGDIR, if it doesn't exist
-		if err := os.MkdirAll(qlogDir, 0777); err != nil {
+		if err := os.MkdirAll(cfg.dir, 0777); err != nil {
 			log.Errorf("creating the QLOGDIR failed: %s", err)
+			atomic.AddUint64(&t.stats.failed, 1)
 			return nil
 		}
-		return newQlogger(qlogDir, role, connID)
+		l := newQlogger(&cfg, role, connID, connLabel(role, connID), realClock{})
+		if l == nil {
+			atomic.AddUint64(&t.stats.failed, 1)
+			return nil
+		}
+		l.stats = &t.stats
+		l.resources = &t.resources
+		l.resources.OpenedFile()
+		l.index = index
+		l.info = info
+		if streamer == nil {
+			return l
+		}
+		return &teeWriteCloser{WriteCloser: l, tee: streamer.NewWriter(connID)}
 	})
+	if index == nil {
+		t.Tracer = tracer
+	} else {
+		// The index needs to see the connection first, see qlogIndex.
+		t.Tracer = logging.NewMultiplexedTracer(index, tracer)
+	}
+	return t
+}
+
+// qlogStats counts the qlogs written by a qlogTracer.
+// All fields are accessed atomically.
+type qlogStats struct {
+	written        uint64
+	failed         uint64
+	truncated      uint64
+	lastTruncation int64 // in nanoseconds since the Unix epoch
+	discarded      uint64
 }
 
+// Close stops streaming qlogs, and closes the index.
+// qlogs of connections that are still open are written to disk, but not added to the index.
+func (t *qlogTracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closeOnce.Do(func() {
+		if t.streamer != nil {
+			t.closeErr = t.streamer.Close()
+		}
+		if t.index != nil {
+			if err := t.index.Close(); t.closeErr == nil {
+				t.closeErr = err
+			}
+		}
+	})
+	return t.closeErr
+}
+
+// qlogTruncatedEvent is written to a qlog when it reaches the size limit.
+const qlogTruncatedEvent = `{"name":"libp2p:qlog_truncated","data":{"size_limit":%d}}` + "\n"
+
 type qlogger struct {
-	f        *os.File // QLOGDIR/.log_xxx.qlog.gz.swp
-	filename string   // QLOGDIR/log_xxx.qlog.gz
+	f        *os.File // QLOGDIR[/subdir]/.log_xxx.qlog.gz.swp
+	filename string   // QLOGDIR[/subdir]/log_xxx.qlog.gz
 	io.WriteCloser
+
+	// written counts the bytes written to f.
+	// Once it exceeds maxSize, the qlog is truncated.
+	written *countingWriter
+	maxSize int64
+	closed  bool
+
+	role   logging.Perspective
+	connID []byte
+	label  string
+	clock  clock
+	index  *qlogIndex // nil if the qlog isn't added to the index
+	info   *qlogConnInfo
+	stats  *qlogStats // nil if the qlog isn't counted
+	// resources counts the qlog file while it is open. nil if it isn't counted.
+	resources *resourceCounts
+	// retain is the set of close reasons that the qlog is kept for. nil if it is always kept.
+	retain map[string]struct{}
 }
 
-func newQlogger(qlogDir string, role logging.Perspective, connID []byte) io.WriteCloser {
-	t := time.Now().UTC().Format("2006-01-02T15-04-05.999999999UTC")
-	r := "server"
-	if role == logging.PerspectiveClient {
-		r = "client"
+func newQlogger(cfg *qlogConfig, role logging.Perspective, connID []byte, label string, clock clock) *qlogger {
+	now := clock.Now()
+	qlogDir := cfg.dir
+	if subdir := qlogDirFor(qlogDir, cfg.subdir, now, role); subdir != qlogDir {
+		if err := os.MkdirAll(subdir, 0777); err != nil {
+			log.Errorf("creating the qlog directory %s failed: %s", subdir, err)
+			return nil
+		}
+		qlogDir = subdir
 	}
-	finalFilename := fmt.Sprintf("%s%clog_%s_%s_%x.qlog.zst", qlogDir, os.PathSeparator, t, r, connID)
-	filename := fmt.Sprintf("%s%c.log_%s_%s_%x.qlog.zst.swp", qlogDir, os.PathSeparator, t, r, connID)
+	t := now.UTC().Format("2006-01-02T15-04-05.999999999UTC")
+	r := perspectiveString(role)
+	var suffix string
+	if len(label) > 0 {
+		suffix = "_" + sanitizeLabel(label)
+	}
+	finalFilename := fmt.Sprintf("%s%clog_%s_%s_%x%s.qlog.zst", qlogDir, os.PathSeparator, t, r, connID, suffix)
+	filename := fmt.Sprintf("%s%c.log_%s_%s_%x%s.qlog.zst.swp", qlogDir, os.PathSeparator, t, r, connID, suffix)
 	f, err := os.Create(filename)
 	if err != nil {
 		log.Errorf("unable to create qlog file %s: %s", filename, err)
 		return nil
 	}
-	gz, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	written := &countingWriter{Writer: f}
+	w, err := newQlogWriter(written)
 	if err != nil {
 		log.Errorf("failed to initialize zstd: %s", err)
+		f.Close()
+		os.Remove(filename)
 		return nil
 	}
+	maxSize := cfg.maxSize
+	if maxSize == 0 {
+		maxSize = defaultQlogMaxFileSize
+	}
 	return &qlogger{
 		f:           f,
 		filename:    finalFilename,
-		WriteCloser: newBufferedWriteCloser(bufio.NewWriter(gz), gz),
+		WriteCloser: w,
+		written:     written,
+		maxSize:     maxSize,
+		role:        role,
+		connID:      connID,
+		label:       label,
+		clock:       clock,
+		retain:      cfg.retain,
+	}
+}
+
+// Write writes to the qlog file.
+// Once the file exceeds the size limit, a marker event is written, and the file is finalized.
+// All further writes are discarded, as are the writes to a qlog that is not kept.
+func (l *qlogger) Write(b []byte) (int, error) {
+	if l.closed || l.discarded() {
+		return len(b), nil
 	}
+	if _, err := l.WriteCloser.Write(b); err != nil {
+		return 0, err
+	}
+	if l.written.Written() > l.maxSize {
+		log.Debugf("qlog %s exceeded the size limit of %d bytes", l.filename, l.maxSize)
+		fmt.Fprintf(l.WriteCloser, qlogTruncatedEvent, l.maxSize)
+		if l.stats != nil {
+			atomic.AddUint64(&l.stats.truncated, 1)
+			atomic.StoreInt64(&l.stats.lastTruncation, l.clock.Now().UnixNano())
+		}
+		if err := l.Close(); err != nil {
+			log.Errorf("finalizing truncated qlog %s failed: %s", l.filename, err)
+		}
+	}
+	return len(b), nil
 }
 
 func (l *qlogger) Close() error {
-	if err := l.WriteCloser.Close(); err != nil {
-		return err
+	if l.closed {
+		return nil
 	}
+	l.closed = true
+	err := l.WriteCloser.Close()
+	// the qlogWriter was returned to the pool
+	l.WriteCloser = nil
 	path := l.f.Name()
-	if err := l.f.Close(); err != nil {
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.resources.ClosedFile()
+	if l.discarded() || !l.retained() {
+		if l.stats != nil {
+			atomic.AddUint64(&l.stats.discarded, 1)
+		}
+		return os.Remove(path)
+	}
+	if err != nil {
+		l.countFailure()
 		return err
 	}
-	return os.Rename(path, l.filename)
+	if err := os.Rename(path, l.filename); err != nil {
+		// retry once, in case the error was transient
+		if err := os.Rename(path, l.filename); err != nil {
+			log.Errorf("renaming the qlog failed: %s. The qlog was left at %s", err, path)
+			l.countFailure()
+			return err
+		}
+	}
+	if l.stats != nil {
+		atomic.AddUint64(&l.stats.written, 1)
+	}
+	if l.index != nil {
+		if err := l.addToIndex(); err != nil {
+			log.Errorf("adding %s to the qlog index failed: %s", l.filename, err)
+		}
+	}
+	return nil
 }
 
-type bufferedWriteCloser struct {
-	*bufio.Writer
-	io.Closer
+// discarded says if the qlog is not kept, because it was not sampled (see WithListenerQlogSampling).
+func (l *qlogger) discarded() bool {
+	return l.info != nil && l.info.isDiscarded()
+}
+
+// retained says if the qlog is kept, based on the reason the connection was closed (see WithQlogRetention).
+// The connection tracer of the index records the close reason before the qlog is closed.
+// qlogs of connections that were not closed yet, e.g. because they were truncated, are kept.
+func (l *qlogger) retained() bool {
+	if l.retain == nil || l.info == nil || len(l.info.close.reason) == 0 {
+		return true
+	}
+	_, ok := l.retain[l.info.close.reason]
+	return ok
 }
 
-func newBufferedWriteCloser(writer *bufio.Writer, closer io.Closer) io.WriteCloser {
-	return &bufferedWriteCloser{
-		Writer: writer,
-		Closer: closer,
+func (l *qlogger) countFailure() {
+	if l.stats != nil {
+		atomic.AddUint64(&l.stats.failed, 1)
 	}
 }
 
-func (h bufferedWriteCloser) Close() error {
-	if err := h.Writer.Flush(); err != nil {
+func (l *qlogger) addToIndex() error {
+	fi, err := os.Stat(l.filename)
+	if err != nil {
 		return err
 	}
-	return h.Closer.Close()
+	// the index lives in the QLOGDIR, even if the qlogs are written to subdirectories
+	filename, err := filepath.Rel(l.index.dir, l.filename)
+	if err != nil {
+		return err
+	}
+	end := l.clock.Now()
+	e := &qlogIndexEntry{
+		Filename:       filepath.ToSlash(filename),
+		ODCID:          hex.EncodeToString(l.connID),
+		Perspective:    perspectiveString(l.role),
+		Label:          l.label,
+		StartTime:      l.info.startTime,
+		EndTime:        end,
+		Close:          l.info.close.reason,
+		ErrorCode:      l.info.close.errorCode,
+		TLSAlert:       l.info.close.tlsAlert,
+		ClosedByRemote: l.info.close.byRemote,
+		Tags:           l.index.tags,
+		Size:           fi.Size(),
+	}
+	// Both times carry a monotonic clock reading, unless the clock is faked.
+	if d := end.Sub(l.info.startTime); d > 0 {
+		e.DurationMs = d.Milliseconds()
+	}
+	if l.info.localAddr != nil {
+		e.LocalAddr = l.info.localAddr.String()
+	}
+	if l.info.remoteAddr != nil {
+		e.RemoteAddr = l.info.remoteAddr.String()
+	}
+	return l.index.Add(e)
+}
+
+// countingWriter counts the bytes written.
+// The zstd encoder writes compressed blocks from its own go routine, so the count is accessed atomically.
+type countingWriter struct {
+	n int64
+	io.Writer
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+// Written returns the number of bytes written.
+func (w *countingWriter) Written() int64 { return atomic.LoadInt64(&w.n) }
+
+// The zstd encoders and buffers are pooled, since every encoder allocates several hundred kB.
+var (
+	qlogBufferPool  = sync.Pool{New: func() interface{} { return bufio.NewWriter(nil) }}
+	zstdEncoderPool sync.Pool
+)
+
+// qlogWriter buffers and compresses a qlog.
+type qlogWriter struct {
+	*bufio.Writer
+	enc *zstd.Encoder
+}
+
+func newQlogWriter(w io.Writer) (*qlogWriter, error) {
+	enc, ok := zstdEncoderPool.Get().(*zstd.Encoder)
+	if ok {
+		enc.Reset(w)
+	} else {
+		var err error
+		enc, err = zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf := qlogBufferPool.Get().(*bufio.Writer)
+	buf.Reset(enc)
+	return &qlogWriter{Writer: buf, enc: enc}, nil
+}
+
+// Close flushes the buffer and the encoder, and returns them to their pools.
+// The qlogWriter must not be used after calling Close.
+func (w *qlogWriter) Close() error {
+	if w.enc == nil {
+		return nil
+	}
+	err := w.Writer.Flush()
+	if err == nil {
+		err = w.enc.Close()
+	}
+	// Encoders and buffers that failed to flush are not reused.
+	if err == nil {
+		w.Writer.Reset(nil)
+		qlogBufferPool.Put(w.Writer)
+		w.enc.Reset(nil)
+		zstdEncoderPool.Put(w.enc)
+	}
+	w.Writer = nil
+	w.enc = nil
+	return err
 }
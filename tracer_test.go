@@ -2,12 +2,24 @@ package libp2pquic
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 
+	ic "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+
+	quic "github.com/lucas-clemente/quic-go"
 	"github.com/lucas-clemente/quic-go/logging"
 
 	. "github.com/onsi/ginkgo"
@@ -18,6 +30,10 @@ type nopCloser struct{}
 
 func (nopCloser) Close() error { return nil }
 
+type fakeClock struct{ now time.Time }
+
+func (c fakeClock) Now() time.Time { return c.now }
+
 var _ = Describe("qlogger", func() {
 	var qlogDir string
 
@@ -26,7 +42,6 @@ var _ = Describe("qlogger", func() {
 		qlogDir, err = ioutil.TempDir("", "libp2p-quic-transport-test")
 		Expect(err).ToNot(HaveOccurred())
 		fmt.Fprintf(GinkgoWriter, "Creating temporary directory: %s\n", qlogDir)
-		initQlogger(qlogDir)
 	})
 
 	AfterEach(func() {
@@ -41,7 +56,7 @@ var _ = Describe("qlogger", func() {
 	}
 
 	It("saves a qlog", func() {
-		logger := newQlogger(qlogDir, logging.PerspectiveServer, []byte{0xde, 0xad, 0xbe, 0xef})
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte{0xde, 0xad, 0xbe, 0xef}, "", realClock{})
 		file := getFile()
 		Expect(string(file.Name()[0])).To(Equal("."))
 		Expect(file.Name()).To(HaveSuffix(".qlog.zst.swp"))
@@ -56,8 +71,22 @@ var _ = Describe("qlogger", func() {
 		))
 	})
 
+	It("uses the clock for the file name", func() {
+		now := time.Date(2021, 2, 3, 4, 5, 6, 789000000, time.FixedZone("CET", 3600))
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveClient, []byte{0xde, 0xad, 0xbe, 0xef}, "", fakeClock{now: now})
+		Expect(logger.Close()).To(Succeed())
+		Expect(getFile().Name()).To(Equal("log_2021-02-03T03-05-06.789UTC_client_deadbeef.qlog.zst"))
+	})
+
+	It("appends the label to the file name", func() {
+		now := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveClient, []byte{0xde, 0xad, 0xbe, 0xef}, "dht/v1", fakeClock{now: now})
+		Expect(logger.Close()).To(Succeed())
+		Expect(getFile().Name()).To(Equal("log_2021-02-03T04-05-06UTC_client_deadbeef_dht_v1.qlog.zst"))
+	})
+
 	It("buffers", func() {
-		logger := newQlogger(qlogDir, logging.PerspectiveServer, []byte("connid"))
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte("connid"), "", realClock{})
 		initialSize := getFile().Size()
 		// Do a small write.
 		// Since the writter is buffered, this should not be written to disk yet.
@@ -71,7 +100,7 @@ var _ = Describe("qlogger", func() {
 	})
 
 	It("compresses", func() {
-		logger := newQlogger(qlogDir, logging.PerspectiveServer, []byte("connid"))
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte("connid"), "", realClock{})
 		logger.Write([]byte("foobar"))
 		Expect(logger.Close()).To(Succeed())
 		compressed, err := ioutil.ReadFile(qlogDir + "/" + getFile().Name())
@@ -83,4 +112,371 @@ var _ = Describe("qlogger", func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(data).To(Equal([]byte("foobar")))
 	})
+
+	It("truncates qlogs that exceed the size limit", func() {
+		logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte("connid"), "", realClock{})
+		logger.maxSize = 10 << 10
+		// Random data doesn't compress. The encoder buffers internally, so the limit is exceeded by up to a block.
+		event := make([]byte, 100)
+		var i int
+		for !logger.closed {
+			Expect(i).To(BeNumerically("<", 10000))
+			rand.Read(event)
+			_, err := fmt.Fprintf(logger, "{\"data\":\"%x\"}\n", event)
+			Expect(err).ToNot(HaveOccurred())
+			i++
+		}
+		// the file was finalized
+		file := getFile()
+		Expect(file.Name()).To(HaveSuffix(".qlog.zst"))
+		Expect(file.Size()).To(BeNumerically(">", 10<<10))
+		// further writes are discarded
+		n, err := logger.Write([]byte("foobar"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(6))
+		Expect(logger.Close()).To(Succeed())
+		Expect(getFile().Size()).To(Equal(file.Size()))
+
+		compressed, err := ioutil.ReadFile(qlogDir + "/" + file.Name())
+		Expect(err).ToNot(HaveOccurred())
+		gz, err := zstd.NewReader(bytes.NewReader(compressed))
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(gz)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(HaveSuffix(fmt.Sprintf(qlogTruncatedEvent, 10<<10)))
+		Expect(bytes.Count(data, []byte("\n"))).To(Equal(i + 1))
+	})
+
+	It("reuses pooled writers", func() {
+		for i := 0; i < 3; i++ {
+			logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte{byte(i)}, "", realClock{})
+			fmt.Fprintf(logger, "qlog %d", i)
+			Expect(logger.Close()).To(Succeed())
+		}
+		files, err := ioutil.ReadDir(qlogDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(3))
+		for _, file := range files {
+			compressed, err := ioutil.ReadFile(qlogDir + "/" + file.Name())
+			Expect(err).ToNot(HaveOccurred())
+			gz, err := zstd.NewReader(bytes.NewReader(compressed))
+			Expect(err).ToNot(HaveOccurred())
+			data, err := ioutil.ReadAll(gz)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(MatchRegexp("^qlog [0-2]$"))
+			Expect(file.Name()).To(ContainSubstring(fmt.Sprintf("_server_0%s.qlog.zst", data[5:])))
+		}
+	})
+
+	Context("handling errors", func() {
+		BeforeEach(func() {
+			if os.Geteuid() == 0 {
+				Skip("file permissions don't apply to root")
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.Chmod(qlogDir, 0755)).To(Succeed())
+		})
+
+		It("doesn't create qlogs in unwritable directories", func() {
+			Expect(os.Chmod(qlogDir, 0555)).To(Succeed())
+			Expect(newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte("connid"), "", realClock{})).To(BeNil())
+			files, err := ioutil.ReadDir(qlogDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+
+		It("keeps the swap file if renaming fails", func() {
+			logger := newQlogger(&qlogConfig{dir: qlogDir}, logging.PerspectiveServer, []byte("connid"), "", realClock{})
+			logger.Write([]byte("foobar"))
+			Expect(os.Chmod(qlogDir, 0555)).To(Succeed())
+			Expect(logger.Close()).ToNot(Succeed())
+			file := getFile()
+			Expect(file.Name()).To(HaveSuffix(".qlog.zst.swp"))
+			Expect(file.Size()).ToNot(BeZero())
+		})
+	})
+
+	Context("qlog tracer", func() {
+		It("is disabled by default", func() {
+			Expect(newQlogTracer(qlogConfig{})).To(BeNil())
+		})
+
+		It("closes the index and the streamer", func() {
+			socket := filepath.Join(qlogDir, "qlog.sock")
+			t := newQlogTracer(qlogConfig{dir: qlogDir, socket: socket})
+			Expect(t).ToNot(BeNil())
+			Expect(t.index.Add(&qlogIndexEntry{Filename: "foo"})).To(Succeed())
+			Expect(t.Close()).To(Succeed())
+			Expect(t.index.Add(&qlogIndexEntry{Filename: "bar"})).To(MatchError("qlog index closed"))
+			_, err := net.Dial("unix", socket)
+			Expect(err).To(HaveOccurred())
+			// closing is idempotent
+			Expect(t.Close()).To(Succeed())
+		})
+
+		It("reports its status", func() {
+			Expect((*qlogTracer)(nil).Status()).To(Equal(QlogStatus{FreeBytes: -1}))
+
+			t := newQlogTracer(qlogConfig{dir: qlogDir})
+			defer t.Close()
+			now := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+			for i := 0; i < 2; i++ {
+				logger := newQlogger(&qlogConfig{dir: qlogDir, maxSize: 100}, logging.PerspectiveServer, []byte{byte(i)}, "", fakeClock{now: now})
+				logger.stats = &t.stats
+				if i == 0 {
+					// write incompressible data until the size limit is hit
+					data := make([]byte, 10<<10)
+					for !logger.closed {
+						rand.Read(data)
+						logger.Write(data)
+					}
+				}
+				Expect(logger.Close()).To(Succeed())
+			}
+			status := t.Status()
+			Expect(status.Enabled).To(BeTrue())
+			Expect(status.Dir).To(Equal(qlogDir))
+			Expect(status.Written).To(BeEquivalentTo(2))
+			Expect(status.Failed).To(BeZero())
+			Expect(status.Truncated).To(BeEquivalentTo(1))
+			Expect(status.LastTruncation.Equal(now)).To(BeTrue())
+			if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+				Expect(status.FreeBytes).To(BeNumerically(">", 0))
+			}
+		})
+
+		It("adds the connections closed on shutdown to the index", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithQlogDir(qlogDir), WithQlogSocket(""))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil, WithQlogDir(""), WithQlogSocket(""))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(clientTransport.(*transport).qlog).To(BeNil())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(serverTransport.(Shutdowner).Shutdown(ctx)).To(Succeed())
+			data, err := ioutil.ReadFile(filepath.Join(qlogDir, qlogIndexFilename))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bytes.Count(data, []byte("\n"))).To(Equal(1))
+			Expect(string(data)).To(ContainSubstring(`"perspective":"server"`))
+		})
+
+		It("doesn't leak go routines or files", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			socket := filepath.Join(qlogDir, "qlog.sock")
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithQlogDir(qlogDir), WithQlogSocket(socket))
+			Expect(err).ToNot(HaveOccurred())
+			status := serverTransport.(QlogStatusReporter).QlogStatus
+			ln, err := serverTransport.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+
+			// one client subscribes, the other one never sends its subscription
+			subscriber, err := net.Dial("unix", socket)
+			Expect(err).ToNot(HaveOccurred())
+			defer subscriber.Close()
+			_, err = subscriber.Write([]byte("all\n"))
+			Expect(err).ToNot(HaveOccurred())
+			idle, err := net.Dial("unix", socket)
+			Expect(err).ToNot(HaveOccurred())
+			defer idle.Close()
+			Eventually(func() int { return status().StreamClients }).Should(Equal(1))
+			// the accept loop, the idle client, and two go routines for the subscriber
+			Eventually(func() int { return status().Goroutines }).Should(Equal(4))
+
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil, WithQlogDir(""), WithQlogSocket(""))
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer serverConn.Close()
+			Expect(status().OpenFiles).To(Equal(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(serverTransport.(Shutdowner).Shutdown(ctx)).To(Succeed())
+			Eventually(func() int { return status().Goroutines }).Should(BeZero())
+			Eventually(func() int { return status().OpenFiles }).Should(BeZero())
+			Expect(status().Written).To(BeEquivalentTo(1))
+		})
+
+		It("samples the qlogs of a listener", func() {
+			serverKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			serverID, err := peer.IDFromPrivateKey(serverKey)
+			Expect(err).ToNot(HaveOccurred())
+			addr := ma.StringCast("/ip4/127.0.0.1/udp/0/quic")
+			serverTransport, err := NewTransport(serverKey, nil, nil, WithQlogDir(qlogDir), WithQlogSocket(""), WithListenerQlogSampling(addr, 0))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := serverTransport.Listen(addr)
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+
+			clientKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			clientTransport, err := NewTransport(clientKey, nil, nil, WithQlogDir(""), WithQlogSocket(""))
+			Expect(err).ToNot(HaveOccurred())
+			conn, err := clientTransport.Dial(context.Background(), ln.Multiaddr(), serverID)
+			Expect(err).ToNot(HaveOccurred())
+			serverConn, err := ln.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conn.Close()).To(Succeed())
+			Eventually(serverConn.IsClosed).Should(BeTrue())
+
+			status := serverTransport.(QlogStatusReporter).QlogStatus
+			Eventually(func() uint64 { return status().Discarded }).Should(BeEquivalentTo(1))
+			Expect(status().Written).To(BeZero())
+			files, err := ioutil.ReadDir(qlogDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+
+	Context("directory templates", func() {
+		It("parses templates", func() {
+			for template, subdir := range map[string]string{
+				"{dir}":                 "",
+				"{dir}/":                "",
+				"{dir}/{date}/{role}/":  "{date}/{role}",
+				"{dir}/qlogs/{role}":    "qlogs/{role}",
+				"{dir}/../{date}/../..": "",
+			} {
+				s, err := parseQlogDirTemplate(template)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s).To(Equal(subdir))
+			}
+			_, err := parseQlogDirTemplate("/tmp/{date}")
+			Expect(err).To(MatchError("/tmp/{date} doesn't start with {dir}"))
+			_, err = parseQlogDirTemplate("{dir}/{hour}")
+			Expect(err).To(MatchError("{dir}/{hour} contains an unknown placeholder"))
+		})
+
+		It("writes qlogs to subdirectories", func() {
+			now := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+			index := newQlogIndex(qlogDir, fakeClock{now: now})
+			logger := newQlogger(&qlogConfig{dir: qlogDir, subdir: "{date}/{role}"}, logging.PerspectiveClient, []byte{0xde, 0xad, 0xbe, 0xef}, "", fakeClock{now: now})
+			logger.index = index
+			logger.info = index.connInfo(logging.PerspectiveClient, []byte{0xde, 0xad, 0xbe, 0xef})
+			dir := filepath.Join(qlogDir, "2021-02-03", "client")
+			files, err := ioutil.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			Expect(files[0].Name()).To(HaveSuffix(".qlog.zst.swp"))
+			Expect(logger.Close()).To(Succeed())
+			files, err = ioutil.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			Expect(files[0].Name()).To(Equal("log_2021-02-03T04-05-06UTC_client_deadbeef.qlog.zst"))
+
+			data, err := ioutil.ReadFile(filepath.Join(qlogDir, qlogIndexFilename))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"filename":"2021-02-03/client/log_2021-02-03T04-05-06UTC_client_deadbeef.qlog.zst"`))
+		})
+	})
 })
+
+// newBenchmarkConnectionTracer creates a connection tracer for a started connection.
+func newBenchmarkConnectionTracer(cfg *config) logging.ConnectionTracer {
+	t := newTracer(cfg, &statsTracer{clock: realClock{}}, nil).TracerForConnection(logging.PerspectiveClient, logging.ConnectionID{0xde, 0xad, 0xbe, 0xef})
+	t.StartedConnection(
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234},
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4321},
+		quic.VersionDraft29,
+		logging.ConnectionID{1, 2, 3, 4},
+		logging.ConnectionID{5, 6, 7, 8},
+	)
+	return t
+}
+
+// tracePackets invokes the callbacks that quic-go invokes for every packet sent and received,
+// and for every ACK processed.
+func tracePackets(t logging.ConnectionTracer, hdr *logging.ExtendedHeader, rttStats *logging.RTTStats, i int) {
+	hdr.PacketNumber = logging.PacketNumber(i)
+	t.SentPacket(hdr, 1200, nil, nil)
+	t.ReceivedPacket(hdr, 1200, nil)
+	// an ACK is received for roughly every other packet
+	if i%2 == 0 {
+		t.UpdatedMetrics(rttStats, 32*1200, 10*1200, 10)
+	}
+}
+
+var _ = Describe("connection tracer", func() {
+	It("doesn't allocate when tracing packets", func() {
+		t := newBenchmarkConnectionTracer(&config{disableMetrics: true})
+		defer t.Close()
+		hdr := &logging.ExtendedHeader{PacketNumberLen: 2}
+		rttStats := &logging.RTTStats{}
+		var i int
+		Expect(testing.AllocsPerRun(100, func() {
+			tracePackets(t, hdr, rttStats, i)
+			i++
+		})).To(BeZero())
+	})
+})
+
+// BenchmarkConnectionTracer drives the connection tracer with the callbacks that quic-go
+// invokes for every packet sent and received, and for every ACK processed.
+// The metrics sub-benchmark includes quic-go's metrics tracer, which allocates when recording.
+func BenchmarkConnectionTracer(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		cfg  *config
+	}{
+		{name: "stats", cfg: &config{disableMetrics: true}},
+		{name: "metrics", cfg: &config{}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			t := newBenchmarkConnectionTracer(bm.cfg)
+			hdr := &logging.ExtendedHeader{PacketNumberLen: 2}
+			rttStats := &logging.RTTStats{}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tracePackets(t, hdr, rttStats, i)
+			}
+			b.StopTimer()
+			t.Close()
+		})
+	}
+}
+
+// BenchmarkQlogWriter creates and closes qlog writers.
+// Run it with -benchtime=10000x to simulate 10k traced connections.
+func BenchmarkQlogWriter(b *testing.B) {
+	event := []byte(`{"time":1.337,"name":"transport:packet_sent","data":{"header":{"packet_number":42}}}` + "\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w, err := newQlogWriter(ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.Write(event)
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
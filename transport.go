@@ -2,10 +2,13 @@ package libp2pquic
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/connmgr"
 	n "github.com/libp2p/go-libp2p-core/network"
@@ -20,6 +23,7 @@ import (
 	tpt "github.com/libp2p/go-libp2p-core/transport"
 	p2ptls "github.com/libp2p/go-libp2p-tls"
 	quic "github.com/lucas-clemente/quic-go"
+	quiclogging "github.com/lucas-clemente/quic-go/logging"
 	ma "github.com/multiformats/go-multiaddr"
 	mafmt "github.com/multiformats/go-multiaddr-fmt"
 	manet "github.com/multiformats/go-multiaddr/net"
@@ -34,25 +38,63 @@ var quicConfig = &quic.Config{
 	MaxIncomingUniStreams:                 -1,             // disable unidirectional streams
 	MaxReceiveStreamFlowControlWindow:     10 * (1 << 20), // 10 MB
 	MaxReceiveConnectionFlowControlWindow: 15 * (1 << 20), // 15 MB
-	AcceptToken: func(clientAddr net.Addr, _ *quic.Token) bool {
-		// TODO(#6): require source address validation when under load
-		return true
-	},
-	KeepAlive: true,
-	Versions:  []quic.VersionNumber{quic.VersionDraft29, quic.VersionDraft32},
+	KeepAlive:                             true,
+	Versions:                              []quic.VersionNumber{quic.VersionDraft29, quic.VersionDraft32},
 }
 
+// quic-go's default handshake timeout, used if the quic.Config doesn't set one
+const defaultHandshakeTimeout = 10 * time.Second
+
 const statelessResetKeyInfo = "libp2p quic stateless reset key"
-const errorCodeConnectionGating = 0x47415445 // GATE in ASCII
+
+// Application error codes used by this package when closing connections.
+const (
+	// ErrorCodeConnectionGating is used when the connection gater rejects a secured connection.
+	ErrorCodeConnectionGating = 0x47415445 // GATE in ASCII
+	// ErrorCodeAcceptQueueFull is used when the listener's accept queue is full.
+	ErrorCodeAcceptQueueFull = 0x46554c4c // FULL in ASCII
+	// ErrorCodeShutdown is the default error code used when the transport is shut down.
+	ErrorCodeShutdown = 0x53485554 // SHUT in ASCII
+	// ErrorCodeSuperseded is used when a connection established by DialAddrs is not needed,
+	// because a connection to another address was established first.
+	ErrorCodeSuperseded = 0x53555045 // SUPE in ASCII
+	// ErrorCodeTooManyConns is used when an inbound connection is refused,
+	// because the limit of connections per peer is reached (see WithMaxConnsPerPeer).
+	ErrorCodeTooManyConns = 0x4d414e59 // MANY in ASCII
+)
+
+const defaultAcceptQueueLength = 16
+
+// A transportConn is a UDP socket that connections are accepted and dialed on.
+// DecreaseCount must be called once the listener or the connection stops using it.
+type transportConn interface {
+	LocalAddr() net.Addr
+	DecreaseCount()
+	// quicConn returns the net.PacketConn passed to quic-go.
+	quicConn() net.PacketConn
+	// listeningSocket says if a listener uses the socket, i.e. if connections dialed from it use the listening port.
+	listeningSocket() bool
+	// closeSocket closes the socket, regardless of the connections still using it.
+	// quic-go then destroys these connections without sending a CONNECTION_CLOSE.
+	closeSocket()
+}
 
 type connManager struct {
 	reuseUDP4 *reuse
 	reuseUDP6 *reuse
+	// external is the socket passed to WithPacketConn. If set, it is used for all listeners and dials.
+	external *externalConn
 }
 
-func newConnManager(gater connmgr.ConnectionGater) (*connManager, error) {
+// newConnManager creates a new connManager.
+// If set, configureReuse is called for the reuse of both address families.
+func newConnManager(gater connmgr.ConnectionGater, configureReuse func(*reuse)) (*connManager, error) {
 	reuseUDP4 := newReuse(gater)
 	reuseUDP6 := newReuse(gater)
+	if configureReuse != nil {
+		configureReuse(reuseUDP4)
+		configureReuse(reuseUDP6)
+	}
 
 	return &connManager{
 		reuseUDP4: reuseUDP4,
@@ -71,7 +113,10 @@ func (c *connManager) getReuse(network string) (*reuse, error) {
 	}
 }
 
-func (c *connManager) Listen(network string, laddr *net.UDPAddr) (*reuseConn, error) {
+func (c *connManager) Listen(network string, laddr *net.UDPAddr) (transportConn, error) {
+	if c.external != nil {
+		return c.external.Listen(laddr)
+	}
 	reuse, err := c.getReuse(network)
 	if err != nil {
 		return nil, err
@@ -79,16 +124,27 @@ func (c *connManager) Listen(network string, laddr *net.UDPAddr) (*reuseConn, er
 	return reuse.Listen(network, laddr)
 }
 
-func (c *connManager) Dial(network string, raddr *net.UDPAddr) (*reuseConn, error) {
+// Dial returns the socket to dial raddr from.
+// If ephemeral is set, a new socket is created for the connection (see WithEphemeralSocket).
+func (c *connManager) Dial(network string, raddr *net.UDPAddr, ephemeral bool) (transportConn, error) {
+	if c.external != nil && !ephemeral {
+		return c.external, nil
+	}
 	reuse, err := c.getReuse(network)
 	if err != nil {
 		return nil, err
 	}
+	if ephemeral {
+		return reuse.DialEphemeral(network)
+	}
 	return reuse.Dial(network, raddr)
 }
 
 // The Transport implements the tpt.Transport interface for QUIC connections.
 type transport struct {
+	// stats needs to be the first field, to guarantee 64 bit alignment of its counters
+	stats transportStats
+
 	privKey      ic.PrivKey
 	localPeer    peer.ID
 	identity     *p2ptls.Identity
@@ -96,12 +152,55 @@ type transport struct {
 	serverConfig *quic.Config
 	clientConfig *quic.Config
 	gater        connmgr.ConnectionGater
+
+	// certChainSize is the size of the certificate chain sent during the handshake.
+	certChainSize int
+	// statsTracer collects the statistics of the connections.
+	statsTracer *statsTracer
+	// qlog writes the qlogs of the connections. It is nil if qlog is disabled.
+	qlog *qlogTracer
+	// listenerQlogSampling is the fraction of qlogs kept, keyed by listen address.
+	listenerQlogSampling map[string]float64
+
+	retryMode              RetryMode
+	adaptiveRetryThreshold int
+	// maxConcurrentHandshakes is 0 if the number of handshakes in progress is not limited
+	maxConcurrentHandshakes int
+	handshakes              *handshakeTracker
+	limiter                 *handshakeRateLimiter
+	// watchdog is nil if no handshake failure alert is configured.
+	watchdog *handshakeWatchdog
+
+	shedLoad   func(TransportStats) AcceptDecision
+	statsCache *statsCache
+
+	udpBufferSize        int
+	udpBufferWarningOnce sync.Once
+
+	acceptQueueLength int
+
+	conns             connRegistry
+	shutdownErrorCode uint64
+	maxConnsPerPeer   int
+
+	happyEyeballsDelay time.Duration
+	// dialerHook is nil if connections are dialed from our own sockets
+	dialerHook DialerHook
+
+	filter *packetFilter
+
+	packetConnWrapperNoticeOnce sync.Once
 }
 
 var _ tpt.Transport = &transport{}
+var _ StatsReporter = &transport{}
 
 // NewTransport creates a new QUIC transport
-func NewTransport(key ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater) (tpt.Transport, error) {
+func NewTransport(key ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater, opts ...Option) (tpt.Transport, error) {
+	var cfg config
+	if err := cfg.apply(opts...); err != nil {
+		return nil, err
+	}
 	if len(psk) > 0 {
 		log.Error("QUIC doesn't support private networks yet.")
 		return nil, errors.New("QUIC doesn't support private networks yet")
@@ -114,35 +213,186 @@ func NewTransport(key ic.PrivKey, psk pnet.PSK, gater connmgr.ConnectionGater) (
 	if err != nil {
 		return nil, err
 	}
-	connManager, err := newConnManager(gater)
+	certChainSize := certChainSize(identity)
+	checkCertChainSize(certChainSize)
+	config := quicConfig.Clone()
+	cfg.populateQUICConfig(config)
+	if cfg.randomStatelessResetKey {
+		config.StatelessResetKey = make([]byte, 32)
+		if _, err := rand.Read(config.StatelessResetKey); err != nil {
+			return nil, err
+		}
+	} else {
+		config.StatelessResetKey, err = DeriveStatelessResetKey(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.modifyQUICConfig != nil {
+		versions := config.Versions
+		config = cfg.modifyQUICConfig(config)
+		if config == nil {
+			return nil, errors.New("WithQUICConfig returned a nil quic.Config")
+		}
+		if len(versions) > 0 && len(config.Versions) == 0 {
+			return nil, errors.New("no QUIC versions configured")
+		}
+		if len(config.StatelessResetKey) != 0 && len(config.StatelessResetKey) != 32 {
+			return nil, fmt.Errorf("invalid stateless reset key length: %d", len(config.StatelessResetKey))
+		}
+	}
+	if cfg.handshakeRate > 0 && cfg.rateLimitMode == RateLimitDrop && config.ConnectionIDLength >= minClientConnIDLen {
+		return nil, fmt.Errorf("dropping rate limited Initials requires connection IDs shorter than %d bytes", minClientConnIDLen)
+	}
+	handshakeTimeout := config.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+	handshakes := newHandshakeTracker(handshakeTimeout)
+
+	// The transport owns the Tracer and the AcceptToken callback.
+	statsTracer := newStatsTracer(&cfg, config.ConnectionIDLength, handshakes)
+	qlog := newQlogTracer(cfg.qlogConfig())
+	config.Tracer = newTracer(&cfg, statsTracer, qlog)
+
+	adaptiveRetryThreshold := cfg.adaptiveRetryThreshold
+	if adaptiveRetryThreshold == 0 {
+		adaptiveRetryThreshold = defaultAdaptiveRetryThreshold
+	}
+	udpBufferSize := cfg.udpBufferSize
+	if udpBufferSize == 0 {
+		udpBufferSize = defaultUDPBufferSize
+	}
+	acceptQueueLength := cfg.acceptQueueLength
+	if acceptQueueLength == 0 {
+		acceptQueueLength = defaultAcceptQueueLength
+	}
+	t := &transport{
+		privKey:                 key,
+		localPeer:               localPeer,
+		identity:                identity,
+		certChainSize:           certChainSize,
+		statsTracer:             statsTracer,
+		qlog:                    qlog,
+		gater:                   gater,
+		retryMode:               cfg.retryMode,
+		adaptiveRetryThreshold:  adaptiveRetryThreshold,
+		maxConcurrentHandshakes: cfg.maxConcurrentHandshakes,
+		handshakes:              handshakes,
+		udpBufferSize:           udpBufferSize,
+		acceptQueueLength:       acceptQueueLength,
+		shutdownErrorCode:       ErrorCodeShutdown,
+		maxConnsPerPeer:         cfg.maxConnsPerPeer,
+		happyEyeballsDelay:      defaultHappyEyeballsDelay,
+		filter:                  &packetFilter{},
+		listenerQlogSampling:    cfg.listenerQlogSampling,
+		dialerHook:              cfg.dialerHook,
+	}
+	if qlog != nil && qlog.index != nil && len(cfg.listenerQlogSampling) > 0 {
+		// The index decides which qlogs to keep once it knows the local address of a connection.
+		qlog.index.sample = t.sampleQlog
+	}
+	if cfg.shedLoad != nil {
+		t.shedLoad = cfg.shedLoad
+		t.statsCache = &statsCache{maxAge: defaultLoadSheddingStatsMaxAge}
+		if cfg.loadSheddingStatsMaxAge > 0 {
+			t.statsCache.maxAge = cfg.loadSheddingStatsMaxAge
+		}
+	}
+	if cfg.handshakeRate > 0 {
+		t.limiter = newHandshakeRateLimiter(cfg.handshakeRate, cfg.handshakeBurst, cfg.rateLimitMode, config.Tracer)
+	}
+	if len(cfg.deniedPrefixes) > 0 {
+		t.filter.SetDeniedPrefixes(cfg.deniedPrefixes...)
+	}
+	if cfg.happyEyeballsDelay > 0 {
+		t.happyEyeballsDelay = cfg.happyEyeballsDelay
+	}
+	if cfg.shutdownErrorCode != nil {
+		t.shutdownErrorCode = *cfg.shutdownErrorCode
+	}
+	connManager, err := newConnManager(gater, func(r *reuse) {
+		r.configureConn = t.configureUDPConn
+		r.filter = t.filter
+		r.limiter = t.limiter
+		r.connIDs = statsTracer.connIDTable()
+		wrapper := cfg.packetConnWrapper
+		if sim := cfg.networkSimulation; sim != nil {
+			// The simulated network is below any custom framing added by the packet conn wrapper.
+			userWrapper := wrapper
+			wrapper = func(c net.PacketConn) net.PacketConn {
+				simulated := newSimulatedPacketConn(c, *sim)
+				if userWrapper == nil {
+					return simulated
+				}
+				return userWrapper(simulated)
+			}
+		}
+		if wrapper != nil {
+			r.wrapConn = t.wrapPacketConn(wrapper)
+		}
+		if cfg.reuseGarbageCollectInterval > 0 {
+			r.garbageCollectInterval = cfg.reuseGarbageCollectInterval
+		}
+		if cfg.reuseMaxUnusedDuration > 0 {
+			r.maxUnusedDuration = cfg.reuseMaxUnusedDuration
+		}
+	})
 	if err != nil {
+		qlog.Close()
 		return nil, err
 	}
-	config := quicConfig.Clone()
+	if cfg.packetConn != nil {
+		// WithPacketConn checks the address, but the packet conn might report a different one now.
+		laddr, ok := cfg.packetConn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			qlog.Close()
+			return nil, fmt.Errorf("packet conn must have a UDP address, got %T", cfg.packetConn.LocalAddr())
+		}
+		reuse := connManager.reuseUDP4
+		if laddr.IP.To4() == nil {
+			reuse = connManager.reuseUDP6
+		}
+		connManager.external = newExternalConn(cfg.packetConn, laddr, reuse)
+	}
+	t.connManager = connManager
+	config.AcceptToken = t.acceptToken
+	t.serverConfig = config
+	t.clientConfig = config.Clone()
+	if !cfg.disableTokenStore && t.clientConfig.TokenStore == nil {
+		tokenStoreSize := cfg.tokenStoreSize
+		if tokenStoreSize == 0 {
+			tokenStoreSize = defaultTokenStoreSize
+		}
+		t.clientConfig.TokenStore = quic.NewLRUTokenStore(tokenStoreSize, tokensPerOrigin)
+	}
+	if cfg.handshakeFailureAlert != nil {
+		t.watchdog = newHandshakeWatchdog(t.handshakes, cfg.handshakeFailureThreshold, cfg.handshakeFailureWindow, cfg.handshakeFailureAlert)
+	}
+	return t, nil
+}
+
+// DeriveStatelessResetKey derives the key used to generate stateless reset tokens from the private key.
+// Since the key is stable across restarts, a node can reset connections that were established
+// before it restarted.
+func DeriveStatelessResetKey(key ic.PrivKey) ([]byte, error) {
 	keyBytes, err := key.Raw()
 	if err != nil {
 		return nil, err
 	}
 	keyReader := hkdf.New(sha256.New, keyBytes, nil, []byte(statelessResetKeyInfo))
-	config.StatelessResetKey = make([]byte, 32)
-	if _, err := io.ReadFull(keyReader, config.StatelessResetKey); err != nil {
+	statelessResetKey := make([]byte, 32)
+	if _, err := io.ReadFull(keyReader, statelessResetKey); err != nil {
 		return nil, err
 	}
-	config.Tracer = tracer
-
-	return &transport{
-		privKey:      key,
-		localPeer:    localPeer,
-		identity:     identity,
-		connManager:  connManager,
-		serverConfig: config,
-		clientConfig: config.Clone(),
-		gater:        gater,
-	}, nil
+	return statelessResetKey, nil
 }
 
 // Dial dials a new QUIC connection
 func (t *transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tpt.CapableConn, error) {
+	if t.conns.isClosed() {
+		return nil, errTransportClosed
+	}
 	network, host, err := manet.DialArgs(raddr)
 	if err != nil {
 		return nil, err
@@ -155,12 +405,22 @@ func (t *transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tp
 	if err != nil {
 		return nil, err
 	}
+	quicConf, err := t.clientConfigForContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	tlsConf, keyCh := t.identity.ConfigForPeer(p)
-	pconn, err := t.connManager.Dial(network, addr)
+	var pconn transportConn
+	dialAddr := addr
+	if t.dialerHook != nil {
+		pconn, dialAddr, err = t.dialProxied(ctx, addr)
+	} else {
+		pconn, err = t.connManager.Dial(network, addr, isEphemeralSocket(ctx))
+	}
 	if err != nil {
 		return nil, err
 	}
-	sess, err := quicDialContext(ctx, pconn, addr, host, tlsConf, t.clientConfig)
+	sess, err := quicDialContext(ctx, pconn.quicConn(), dialAddr, host, tlsConf, quicConf)
 	if err != nil {
 		pconn.DecreaseCount()
 		return nil, err
@@ -194,14 +454,60 @@ func (t *transport) Dial(ctx context.Context, raddr ma.Multiaddr, p peer.ID) (tp
 		remotePubKey:    remotePubKey,
 		remotePeerID:    p,
 		remoteMultiaddr: remoteMultiaddr,
+		direction:       n.DirOutbound,
+		socket:          pconn,
+		stats:           t.statsTracer.claim(quiclogging.PerspectiveClient, sess.LocalAddr(), sess.RemoteAddr()),
+	}
+	conn.stats.setTLS(sess.ConnectionState().CipherSuite, remotePubKey)
+	conn.stats.setECN(ecnCapable(pconn.quicConn()))
+	if pconn.listeningSocket() {
+		conn.stats.setListeningSocket()
+	}
+	if t.dialerHook != nil {
+		conn.stats.setProxied()
 	}
 	if t.gater != nil && !t.gater.InterceptSecured(n.DirOutbound, p, conn) {
-		sess.CloseWithError(errorCodeConnectionGating, "connection gated")
+		sess.CloseWithError(ErrorCodeConnectionGating, "connection gated")
 		return nil, fmt.Errorf("secured connection gated")
 	}
+	// Outbound connections are not subject to the per-peer limit.
+	if _, err := t.conns.addConn(conn, 0); err != nil {
+		sess.CloseWithError(quic.ErrorCode(t.shutdownErrorCode), "shutting down")
+		return nil, err
+	}
+	conn.stats.setOwner(conn)
 	return conn, nil
 }
 
+// clientConfigForContext returns the quic.Config used for dialing.
+// If the context has a deadline that expires before the handshake timeout,
+// the handshake timeout is reduced, such that the handshake is aborted when the deadline expires.
+// If the context carries a dial label (see WithDialLabel), the tracer attaches it to the connection.
+func (t *transport) clientConfigForContext(ctx context.Context) (*quic.Config, error) {
+	conf := t.clientConfig
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		maxTimeout := t.clientConfig.HandshakeTimeout
+		if maxTimeout == 0 {
+			maxTimeout = defaultHandshakeTimeout
+		}
+		if timeout < maxTimeout {
+			conf = conf.Clone()
+			conf.HandshakeTimeout = timeout
+		}
+	}
+	if label := DialLabel(ctx); len(label) > 0 && conf.Tracer != nil {
+		if conf == t.clientConfig {
+			conf = conf.Clone()
+		}
+		conf.Tracer = &labelTracer{Tracer: conf.Tracer, label: label}
+	}
+	return conf, nil
+}
+
 // Don't use mafmt.QUIC as we don't want to dial DNS addresses. Just /ip{4,6}/udp/quic
 var dialMatcher = mafmt.And(mafmt.IP, mafmt.Base(ma.P_UDP), mafmt.Base(ma.P_QUIC))
 
@@ -212,6 +518,9 @@ func (t *transport) CanDial(addr ma.Multiaddr) bool {
 
 // Listen listens for new QUIC connections on the passed multiaddr.
 func (t *transport) Listen(addr ma.Multiaddr) (tpt.Listener, error) {
+	if t.conns.isClosed() {
+		return nil, errTransportClosed
+	}
 	lnet, host, err := manet.DialArgs(addr)
 	if err != nil {
 		return nil, err
@@ -224,7 +533,11 @@ func (t *transport) Listen(addr ma.Multiaddr) (tpt.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	ln, err := newListener(conn, t, t.localPeer, t.privKey, t.identity)
+	qlogSampling, ok := t.listenerQlogSampling[addr.String()]
+	if !ok {
+		qlogSampling = 1
+	}
+	ln, err := newListener(conn, t, t.localPeer, t.privKey, t.identity, qlogSampling)
 	if err != nil {
 		conn.DecreaseCount()
 		return nil, err
@@ -7,7 +7,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"net"
+	"runtime"
+	"strings"
+	"time"
 
 	ic "github.com/libp2p/go-libp2p-core/crypto"
 	tpt "github.com/libp2p/go-libp2p-core/transport"
@@ -19,12 +23,15 @@ import (
 )
 
 var _ = Describe("Transport", func() {
-	var t tpt.Transport
+	var (
+		t   tpt.Transport
+		key ic.PrivKey
+	)
 
 	BeforeEach(func() {
 		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
 		Expect(err).ToNot(HaveOccurred())
-		key, err := ic.UnmarshalRsaPrivateKey(x509.MarshalPKCS1PrivateKey(rsaKey))
+		key, err = ic.UnmarshalRsaPrivateKey(x509.MarshalPKCS1PrivateKey(rsaKey))
 		Expect(err).ToNot(HaveOccurred())
 		t, err = NewTransport(key, nil, nil)
 		Expect(err).ToNot(HaveOccurred())
@@ -69,4 +76,318 @@ var _ = Describe("Transport", func() {
 		_, ok := conn.(udpConn)
 		Expect(ok).To(BeTrue())
 	})
+
+	It("traces connections", func() {
+		Expect(t.(*transport).serverConfig.Tracer).ToNot(BeNil())
+		Expect(t.(*transport).clientConfig.Tracer).ToNot(BeNil())
+	})
+
+	It("doesn't collect metrics if disabled", func() {
+		tr, err := NewTransport(key, nil, nil, DisableMetrics(), WithQlogDir(""), WithQlogSocket(""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tr.(*transport).serverConfig.Tracer).To(BeNil())
+		Expect(tr.(*transport).clientConfig.Tracer).To(BeNil())
+		Expect(tr.(StatsReporter).Stats().SpuriousLosses).To(BeZero())
+	})
+
+	It("sets the idle timeout", func() {
+		tr, err := NewTransport(key, nil, nil, WithMaxIdleTimeout(time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tr.(*transport).serverConfig.MaxIdleTimeout).To(Equal(time.Minute))
+		Expect(tr.(*transport).clientConfig.MaxIdleTimeout).To(Equal(time.Minute))
+	})
+
+	It("validates stats tags", func() {
+		tags := map[string]string{"experiment": "cubic", "arm_2": "b"}
+		var cfg config
+		Expect(cfg.apply(WithStatsTags(tags))).To(Succeed())
+		// the tags are copied
+		tags["experiment"] = "reno"
+		Expect(cfg.statsTags).To(Equal(map[string]string{"experiment": "cubic", "arm_2": "b"}))
+		for _, k := range []string{"", "Experiment", "2nd", "arm-2", "arm 2"} {
+			_, err := NewTransport(key, nil, nil, WithStatsTags(map[string]string{k: "foo"}))
+			Expect(err).To(MatchError(fmt.Sprintf("invalid stats tag key: %q", k)))
+		}
+		_, err := NewTransport(key, nil, nil, WithStatsTags(map[string]string{"experiment": strings.Repeat("a", 1024)}))
+		Expect(err).To(MatchError("stats tags too large: 1034 bytes (maximum 1024 bytes)"))
+	})
+
+	It("rejects invalid qlog sampling fractions", func() {
+		addr := ma.StringCast("/ip4/127.0.0.1/udp/4001/quic")
+		for _, f := range []float64{-0.1, 1.1} {
+			_, err := NewTransport(key, nil, nil, WithListenerQlogSampling(addr, f))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("invalid qlog sampling fraction"))
+		}
+	})
+
+	It("rejects unknown close reasons for the qlog retention", func() {
+		_, err := NewTransport(key, nil, nil, WithQlogRetention("handshake_timeout", "clean_close"))
+		Expect(err).To(MatchError(`unknown close reason: "clean_close"`))
+	})
+
+	It("rejects invalid idle timeouts", func() {
+		_, err := NewTransport(key, nil, nil, WithMaxIdleTimeout(0))
+		Expect(err).To(MatchError("idle timeout must be positive"))
+	})
+
+	It("rejects invalid stall timeouts", func() {
+		_, err := NewTransport(key, nil, nil, WithStallDetection(0, nil))
+		Expect(err).To(MatchError("stall timeout must be positive"))
+	})
+
+	It("rejects invalid handshake failure alerts", func() {
+		alert := func(HandshakeFailureWindow) {}
+		_, err := NewTransport(key, nil, nil, WithHandshakeFailureAlert(1.5, time.Minute, alert))
+		Expect(err).To(MatchError(ContainSubstring("invalid handshake failure threshold")))
+		_, err = NewTransport(key, nil, nil, WithHandshakeFailureAlert(0.5, time.Millisecond, alert))
+		Expect(err).To(MatchError("handshake failure window too short"))
+		_, err = NewTransport(key, nil, nil, WithHandshakeFailureAlert(0.5, time.Minute, nil))
+		Expect(err).To(MatchError("handshake failure alert callback must not be nil"))
+	})
+
+	It("rejects a nil dialer hook", func() {
+		_, err := NewTransport(key, nil, nil, WithDialerHook(nil))
+		Expect(err).To(MatchError("dialer hook must not be nil"))
+	})
+
+	It("rejects stream limits that can't be encoded", func() {
+		_, err := NewTransport(key, nil, nil, WithMaxIncomingStreams(1<<60+1))
+		Expect(err).To(MatchError(fmt.Sprintf("maximum number of incoming streams too large: %d (maximum %d)", 1<<60+1, 1<<60)))
+		_, err = NewTransport(key, nil, nil, WithMaxIncomingUniStreams(1<<60+1))
+		Expect(err).To(MatchError(fmt.Sprintf("maximum number of incoming unidirectional streams too large: %d (maximum %d)", 1<<60+1, 1<<60)))
+		_, err = NewTransport(key, nil, nil, WithMaxIncomingStreams(1<<60), WithMaxIncomingUniStreams(1<<60))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("sets the stream limits and flow control windows", func() {
+		tr, err := NewTransport(key, nil, nil,
+			WithMaxIncomingStreams(42),
+			WithMaxIncomingUniStreams(10),
+			WithMaxStreamReceiveWindow(1<<20),
+			WithMaxConnectionReceiveWindow(2<<20),
+		)
+		Expect(err).ToNot(HaveOccurred())
+		for _, conf := range []*quic.Config{tr.(*transport).serverConfig, tr.(*transport).clientConfig} {
+			Expect(conf.MaxIncomingStreams).To(BeEquivalentTo(42))
+			Expect(conf.MaxIncomingUniStreams).To(BeEquivalentTo(10))
+			Expect(conf.MaxReceiveStreamFlowControlWindow).To(BeEquivalentTo(1 << 20))
+			Expect(conf.MaxReceiveConnectionFlowControlWindow).To(BeEquivalentTo(2 << 20))
+		}
+	})
+
+	It("uses the default stream limits and flow control windows", func() {
+		conf := t.(*transport).serverConfig
+		Expect(conf.MaxIncomingStreams).To(Equal(quicConfig.MaxIncomingStreams))
+		Expect(conf.MaxIncomingUniStreams).To(Equal(quicConfig.MaxIncomingUniStreams))
+		Expect(conf.MaxReceiveStreamFlowControlWindow).To(Equal(quicConfig.MaxReceiveStreamFlowControlWindow))
+		Expect(conf.MaxReceiveConnectionFlowControlWindow).To(Equal(quicConfig.MaxReceiveConnectionFlowControlWindow))
+	})
+
+	Context("handshake timeouts", func() {
+		It("uses the configured handshake timeout if the context doesn't have a deadline", func() {
+			conf, err := t.(*transport).clientConfigForContext(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf).To(BeIdenticalTo(t.(*transport).clientConfig))
+		})
+
+		It("reduces the handshake timeout to the context deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			conf, err := t.(*transport).clientConfigForContext(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.HandshakeTimeout).To(And(
+				BeNumerically("<=", time.Second),
+				BeNumerically(">", 900*time.Millisecond),
+			))
+			Expect(conf.Tracer).To(BeIdenticalTo(t.(*transport).clientConfig.Tracer))
+		})
+
+		It("doesn't increase the handshake timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+			defer cancel()
+			conf, err := t.(*transport).clientConfigForContext(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf).To(BeIdenticalTo(t.(*transport).clientConfig))
+		})
+
+		It("aborts the handshake when the context deadline expires", func() {
+			// a UDP socket that never responds
+			blackhole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			Expect(err).ToNot(HaveOccurred())
+			defer blackhole.Close()
+			raddr, err := toQuicMultiaddr(blackhole.LocalAddr())
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			_, err = t.Dial(ctx, raddr, "remote peer id")
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		})
+	})
+
+	It("sets the QUIC versions", func() {
+		tr, err := NewTransport(key, nil, nil, WithQUICVersions(quic.VersionDraft32, quic.VersionDraft29))
+		Expect(err).ToNot(HaveOccurred())
+		for _, conf := range []*quic.Config{tr.(*transport).serverConfig, tr.(*transport).clientConfig} {
+			Expect(conf.Versions).To(Equal([]quic.VersionNumber{quic.VersionDraft32, quic.VersionDraft29}))
+		}
+		_, err = NewTransport(key, nil, nil, WithQUICVersions())
+		Expect(err).To(MatchError("no QUIC versions configured"))
+	})
+
+	Context("stateless reset keys", func() {
+		It("derives the stateless reset key from the private key", func() {
+			resetKey, err := DeriveStatelessResetKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resetKey).To(HaveLen(32))
+			resetKey2, err := DeriveStatelessResetKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resetKey2).To(Equal(resetKey))
+			Expect(t.(*transport).serverConfig.StatelessResetKey).To(Equal(resetKey))
+			Expect(t.(*transport).clientConfig.StatelessResetKey).To(Equal(resetKey))
+		})
+
+		It("derives different stateless reset keys for different private keys", func() {
+			otherKey, _, err := ic.GenerateEd25519Key(rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			resetKey, err := DeriveStatelessResetKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			otherResetKey, err := DeriveStatelessResetKey(otherKey)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(otherResetKey).ToNot(Equal(resetKey))
+		})
+
+		It("uses a random stateless reset key", func() {
+			resetKey, err := DeriveStatelessResetKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			tr, err := NewTransport(key, nil, nil, WithRandomStatelessResetKey())
+			Expect(err).ToNot(HaveOccurred())
+			conf := tr.(*transport).serverConfig
+			Expect(conf.StatelessResetKey).To(HaveLen(32))
+			Expect(conf.StatelessResetKey).ToNot(Equal(resetKey))
+		})
+	})
+
+	It("configures the garbage collection of reused sockets", func() {
+		tr, err := NewTransport(key, nil, nil, WithReuseGarbageCollectInterval(time.Minute), WithReuseMaxUnusedDuration(time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		cm := tr.(*transport).connManager
+		for _, r := range []*reuse{cm.reuseUDP4, cm.reuseUDP6} {
+			Expect(r.garbageCollectInterval).To(Equal(time.Minute))
+			Expect(r.maxUnusedDuration).To(Equal(time.Hour))
+		}
+		_, err = NewTransport(key, nil, nil, WithReuseGarbageCollectInterval(0))
+		Expect(err).To(MatchError("garbage collection interval must be positive"))
+		_, err = NewTransport(key, nil, nil, WithReuseMaxUnusedDuration(-time.Second))
+		Expect(err).To(MatchError("maximum unused duration must be positive"))
+	})
+
+	It("reports the reusable sockets", func() {
+		Expect(t.(*transport).Stats().ReusableSockets).To(BeEmpty())
+		ln, err := t.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+		Expect(err).ToNot(HaveOccurred())
+		defer ln.Close()
+		Expect(t.(*transport).Stats().ReusableSockets).To(Equal(map[string]int{"127.0.0.1": 1}))
+	})
+
+	It("reports the certificate chain size", func() {
+		// the transport uses an RSA-2048 key
+		size := t.(StatsReporter).Stats().CertificateChainSize
+		Expect(size).ToNot(BeZero())
+		Expect(size).To(BeNumerically("<", maxCertChainSize))
+	})
+
+	Context("modifying the quic.Config", func() {
+		It("applies the modifications", func() {
+			tr, err := NewTransport(key, nil, nil, WithMaxIdleTimeout(time.Minute), WithQUICConfig(func(conf *quic.Config) *quic.Config {
+				Expect(conf.MaxIdleTimeout).To(Equal(time.Minute))
+				conf.HandshakeTimeout = 3 * time.Second
+				conf.KeepAlive = false
+				conf.Tracer = nil
+				conf.AcceptToken = nil
+				return conf
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			for _, conf := range []*quic.Config{tr.(*transport).serverConfig, tr.(*transport).clientConfig} {
+				Expect(conf.HandshakeTimeout).To(Equal(3 * time.Second))
+				Expect(conf.KeepAlive).To(BeFalse())
+				Expect(conf.Tracer).ToNot(BeNil())
+			}
+			Expect(tr.(*transport).serverConfig.AcceptToken).ToNot(BeNil())
+			Expect(tr.(*transport).clientConfig.TokenStore).ToNot(BeNil())
+		})
+
+		It("uses the token store from the quic.Config", func() {
+			tokenStore := quic.NewLRUTokenStore(1, 1)
+			tr, err := NewTransport(key, nil, nil, WithQUICConfig(func(conf *quic.Config) *quic.Config {
+				conf.TokenStore = tokenStore
+				return conf
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tr.(*transport).clientConfig.TokenStore).To(BeIdenticalTo(tokenStore))
+		})
+
+		It("rejects invalid configurations", func() {
+			_, err := NewTransport(key, nil, nil, WithQUICConfig(func(*quic.Config) *quic.Config { return nil }))
+			Expect(err).To(MatchError("WithQUICConfig returned a nil quic.Config"))
+			_, err = NewTransport(key, nil, nil, WithQUICConfig(func(conf *quic.Config) *quic.Config {
+				conf.Versions = nil
+				return conf
+			}))
+			Expect(err).To(MatchError("no QUIC versions configured"))
+			_, err = NewTransport(key, nil, nil, WithQUICConfig(func(conf *quic.Config) *quic.Config {
+				conf.StatelessResetKey = []byte("foobar")
+				return conf
+			}))
+			Expect(err).To(MatchError("invalid stateless reset key length: 6"))
+		})
+	})
+
+	Context("UDP buffer sizes", func() {
+		It("uses the default UDP buffer size", func() {
+			Expect(t.(*transport).Stats().UDPBufferSize).To(Equal(defaultUDPBufferSize))
+		})
+
+		It("rejects invalid UDP buffer sizes", func() {
+			_, err := NewTransport(key, nil, nil, WithUDPBufferSize(0))
+			Expect(err).To(MatchError("UDP buffer size must be positive"))
+		})
+
+		It("reports the UDP buffer sizes after listening", func() {
+			if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+				Skip("reading the UDP buffer sizes is not supported on this platform")
+			}
+			tr, err := NewTransport(key, nil, nil, WithUDPBufferSize(64<<10))
+			Expect(err).ToNot(HaveOccurred())
+			ln, err := tr.Listen(ma.StringCast("/ip4/127.0.0.1/udp/0/quic"))
+			Expect(err).ToNot(HaveOccurred())
+			defer ln.Close()
+			stats := tr.(*transport).Stats()
+			Expect(stats.UDPBufferSize).To(Equal(64 << 10))
+			// Linux doubles the requested value, other platforms might clamp it.
+			Expect(stats.UDPReceiveBufferSize).To(BeNumerically(">", 0))
+			Expect(stats.UDPSendBufferSize).To(BeNumerically(">", 0))
+		})
+
+		It("reports the smallest UDP buffer size", func() {
+			var size int64
+			storeWithMin(&size, 200)
+			Expect(size).To(BeEquivalentTo(200))
+			storeWithMin(&size, 300)
+			Expect(size).To(BeEquivalentTo(200))
+			storeWithMin(&size, 100)
+			Expect(size).To(BeEquivalentTo(100))
+		})
+
+		It("accounts for Linux doubling the buffer size", func() {
+			if runtime.GOOS == "linux" {
+				Expect(reportedUDPBufferSize(1000)).To(Equal(2000))
+			} else {
+				Expect(reportedUDPBufferSize(1000)).To(Equal(1000))
+			}
+		})
+	})
 })
@@ -0,0 +1,69 @@
+package libp2pquic
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+)
+
+const defaultUDPBufferSize = 2 << 20 // 2 MB
+
+// setUDPBufferSizes tries to set the receive and send buffer sizes of the socket.
+// It returns the buffer sizes reported by the kernel afterwards.
+// Note that the kernel might limit the buffer size (on Linux, using net.core.rmem_max and net.core.wmem_max),
+// and that Linux reports twice the configured value, to account for bookkeeping overhead.
+func setUDPBufferSizes(conn *net.UDPConn, size int) (recv, send int, err error) {
+	if err := conn.SetReadBuffer(size); err != nil {
+		log.Debugf("failed to set UDP receive buffer size: %s", err)
+	}
+	if err := conn.SetWriteBuffer(size); err != nil {
+		log.Debugf("failed to set UDP send buffer size: %s", err)
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	return getUDPBufferSizes(rawConn)
+}
+
+// reportedUDPBufferSize is the buffer size the kernel reports if a buffer of the given size is applied without clamping.
+// Linux doubles the value passed to setsockopt.
+func reportedUDPBufferSize(size int) int {
+	if runtime.GOOS == "linux" {
+		return 2 * size
+	}
+	return size
+}
+
+// configureUDPConn is called for every UDP socket the transport creates.
+func (t *transport) configureUDPConn(conn *net.UDPConn) {
+	recv, send, err := setUDPBufferSizes(conn, t.udpBufferSize)
+	if err != nil {
+		log.Debugf("failed to read UDP buffer sizes: %s", err)
+		return
+	}
+	storeWithMin(&t.stats.udpReceiveBufferSize, int64(recv))
+	storeWithMin(&t.stats.udpSendBufferSize, int64(send))
+	if expected := reportedUDPBufferSize(t.udpBufferSize); recv < expected || send < expected {
+		t.udpBufferWarningOnce.Do(func() {
+			log.Warnw("failed to sufficiently increase UDP buffer sizes",
+				"requested", t.udpBufferSize,
+				"receive", recv,
+				"send", send,
+			)
+		})
+	}
+}
+
+// storeWithMin stores v if it is smaller than the current value, or if no value was stored yet.
+func storeWithMin(min *int64, v int64) {
+	for {
+		cur := atomic.LoadInt64(min)
+		if cur != 0 && cur <= v {
+			return
+		}
+		if atomic.CompareAndSwapInt64(min, cur, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package libp2pquic
+
+import (
+	"errors"
+	"syscall"
+)
+
+func getUDPBufferSizes(syscall.RawConn) (recv, send int, err error) {
+	return 0, 0, errors.New("reading the UDP buffer sizes is not supported on this platform")
+}
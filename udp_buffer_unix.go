@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package libp2pquic
+
+import "syscall"
+
+func getUDPBufferSizes(rawConn syscall.RawConn) (recv, send int, err error) {
+	if cerr := rawConn.Control(func(fd uintptr) {
+		recv, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if err != nil {
+			return
+		}
+		send, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); cerr != nil {
+		return 0, 0, cerr
+	}
+	return recv, send, err
+}